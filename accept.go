@@ -0,0 +1,59 @@
+package gitkit
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Bounds of the backoff Serve waits through before accepting again after
+// a temporary error, such as running out of file descriptors
+const (
+	DefaultAcceptBackoffMin = 5 * time.Millisecond
+	DefaultAcceptBackoffMax = time.Second
+)
+
+func (c *Config) acceptBackoffMax() time.Duration {
+	if c.AcceptBackoffMax > 0 {
+		return c.AcceptBackoffMax
+	}
+
+	return DefaultAcceptBackoffMax
+}
+
+// temporaryAcceptError reports whether err, returned by Accept, is expected
+// to pass, so that Serve should retry rather than return
+func temporaryAcceptError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+
+	var temp interface{ Temporary() bool }
+
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+// acceptBackoff doubles the wait between failed Accepts, from
+// DefaultAcceptBackoffMin up to max
+type acceptBackoff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
+func (b *acceptBackoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = DefaultAcceptBackoffMin
+	} else {
+		b.delay *= 2
+	}
+
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+
+	return b.delay
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
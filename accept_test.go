@@ -0,0 +1,117 @@
+package gitkit
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyListener fails Accept with each of errs in turn before accepting
+// from the listener it wraps
+type flakyListener struct {
+	net.Listener
+
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+
+		return nil, err
+	}
+	l.mu.Unlock()
+
+	return l.Listener.Accept()
+}
+
+func startFlakySSH(t *testing.T, errs []error, onError func(error)) (*SSH, chan error) {
+	t.Helper()
+
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), AcceptBackoffMax: 20 * time.Millisecond})
+	s.OnAcceptError = onError
+
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetListener(&flakyListener{Listener: s.currentListener(), errs: errs})
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	t.Cleanup(func() { s.Stop() })
+
+	return s, served
+}
+
+func TestSSH_Serve_TemporaryAcceptError(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+
+	var (
+		mu   sync.Mutex
+		seen []error
+	)
+
+	s, served := startFlakySSH(t, []error{emfile, emfile, emfile}, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		seen = append(seen, err)
+	})
+
+	// The server rides out the errors and goes on serving
+	client := testSSHClient(t, s)
+	_, _, err := client.SendRequest("ping", true, nil)
+	assert.NoError(t, err)
+
+	mu.Lock()
+	assert.Equal(t, []error{emfile, emfile, emfile}, seen)
+	mu.Unlock()
+
+	assert.True(t, errors.Is(s.Report().LastError, syscall.EMFILE))
+
+	// Stopping is not an error worth reporting
+	assert.NoError(t, s.Stop())
+	assert.True(t, errors.Is(<-served, net.ErrClosed))
+
+	mu.Lock()
+	assert.Len(t, seen, 3)
+	mu.Unlock()
+}
+
+func TestSSH_Serve_AcceptError(t *testing.T) {
+	broken := errors.New("listener is broken")
+
+	var seen error
+	_, served := startFlakySSH(t, []error{broken}, func(err error) { seen = err })
+
+	select {
+	case err := <-served:
+		assert.Equal(t, broken, err)
+		assert.Equal(t, broken, seen)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+func Test_acceptBackoff(t *testing.T) {
+	b := acceptBackoff{max: 18 * time.Millisecond}
+
+	assert.Equal(t, 5*time.Millisecond, b.next())
+	assert.Equal(t, 10*time.Millisecond, b.next())
+	assert.Equal(t, 18*time.Millisecond, b.next())
+	assert.Equal(t, 18*time.Millisecond, b.next())
+
+	b.reset()
+	assert.Equal(t, 5*time.Millisecond, b.next())
+}
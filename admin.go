@@ -0,0 +1,251 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AdminCommand is the command under which the built-in admin commands are
+// served, as in ssh git@host gitkit sessions
+const AdminCommand = "gitkit"
+
+// ErrQuarantined is returned for operations on quarantined repositories
+var ErrQuarantined = errors.New("repository is quarantined")
+
+const adminUsage = `usage: gitkit <command> [<repo> | <session>]
+
+commands:
+  gc <repo>            run git gc against a repository
+  fsck <repo>          check the integrity of a repository
+  quarantine <repo>    refuse all git operations on a repository
+  unquarantine <repo>  serve a quarantined repository again
+  archive <repo>       serve fetches but refuse pushes to a repository
+  delete <repo>        refuse a repository until it is purged, or restored
+  restore <repo>       serve an archived or deleted repository again
+  sessions             list connected clients
+  kill <session>       disconnect a client listed by sessions
+  reload               reload configuration
+`
+
+// adminCommand serves the built-in admin commands, once AuthoriseAdminFunc
+// has allowed them
+func (s SSH) adminCommand(ctx context.Context, ch ssh.Channel, args []string) error {
+	if err := s.AuthoriseAdminFunc(ctx, args[1:]); err != nil {
+		return fmt.Errorf("access denied: %w", err)
+	}
+
+	if len(args) < 2 {
+		fmt.Fprint(ch, adminUsage)
+
+		return nil
+	}
+
+	switch args[1] {
+	case "gc":
+		repo, err := adminRepoArg(args)
+		if err == nil {
+			err = s.GC(ctx, repo)
+		}
+
+		return err
+
+	case "fsck":
+		repo, err := adminRepoArg(args)
+		if err != nil {
+			return err
+		}
+
+		result, err := s.Repos().Check(ctx, repo)
+		if err != nil {
+			return err
+		}
+
+		for _, problem := range result.Problems {
+			fmt.Fprintln(ch, problem)
+		}
+
+		if result.Corrupt {
+			return fmt.Errorf("%w: %s", ErrRepoCorrupt, repo)
+		}
+
+		return nil
+
+	case "quarantine":
+		repo, err := adminRepoArg(args)
+		if err == nil {
+			err = s.Quarantine(ctx, repo)
+		}
+
+		return err
+
+	case "unquarantine":
+		repo, err := adminRepoArg(args)
+		if err == nil {
+			err = s.Unquarantine(ctx, repo)
+		}
+
+		return err
+
+	case "archive", "delete", "restore":
+		repo, err := adminRepoArg(args)
+		if err == nil {
+			err = s.Repos().SetState(ctx, repo, adminRepoStates[args[1]], "")
+		}
+
+		return err
+
+	case "sessions":
+		w := tabwriter.NewWriter(ch, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREMOTE\tUSER\tKEY\tSTARTED\tCOMMAND")
+
+		for _, info := range s.Sessions() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, info.RemoteAddr, info.User, info.PublicKey.Id, info.Started.Format(time.RFC3339), info.Command)
+		}
+
+		return w.Flush()
+
+	case "kill":
+		if len(args) != 3 {
+			return fmt.Errorf("kill takes a single session")
+		}
+
+		return s.KillSession(args[2])
+
+	case "reload":
+		return s.Reload(ctx)
+
+	default:
+		fmt.Fprint(ch.Stderr(), adminUsage)
+
+		return fmt.Errorf("unknown command %q", args[1])
+	}
+}
+
+// adminRepoStates are the states the archive, delete and restore commands
+// move repositories into
+var adminRepoStates = map[string]RepoState{
+	"archive": RepoArchived,
+	"delete":  RepoDeletePending,
+	"restore": RepoActive,
+}
+
+// adminRepoArg returns the repository named by an admin command
+func adminRepoArg(args []string) (string, error) {
+	if len(args) != 3 {
+		return "", fmt.Errorf("%s takes a single repository", args[1])
+	}
+
+	repo := parseRepoName(args[2])
+
+	return repo, validateRepoPath(repo)
+}
+
+// GC runs git gc against a repository. Events of type gc.started,
+// gc.completed and gc.failed report progress. Unreachable objects are not
+// pruned from repositories which have forks.
+func (s *SSH) GC(ctx context.Context, repo string) error {
+	args, err := s.gcArgs(repo)
+	if err != nil {
+		return err
+	}
+
+	return s.maintain(ctx, "gc", repo, args)
+}
+
+// Reload calls ReloadFunc, so that the embedding application may re-read
+// its own configuration, then reinstalls hooks in every repository when
+// Config.AutoHooks is set
+func (s *SSH) Reload(ctx context.Context) error {
+	if s.ReloadFunc != nil {
+		if err := s.ReloadFunc(ctx); err != nil {
+			return err
+		}
+	}
+
+	config := s.current().config
+	if config.AutoHooks && !config.ReadOnly {
+		return config.setupHooks()
+	}
+
+	return nil
+}
+
+// quarantineKey is the Store key quarantining the repository at path,
+// which must be absolute
+func quarantineKey(path string) string {
+	return "quarantine/" + strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
+
+// Quarantine refuses all git operations on repo, such as while an incident
+// is investigated, until Unquarantine is called. Quarantines are kept in
+// Store, so last as long as it does, and are held against where repo
+// lives rather than its name, so cover every name routed to it.
+func (s *SSH) Quarantine(ctx context.Context, repo string) error {
+	path, err := s.quarantinePath(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	return s.Store.Put(quarantineKey(path), []byte(time.Now().Format(time.RFC3339)))
+}
+
+// Unquarantine serves a quarantined repository again
+func (s *SSH) Unquarantine(ctx context.Context, repo string) error {
+	path, err := s.quarantinePath(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	return s.Store.Delete(quarantineKey(path))
+}
+
+// Quarantined reports whether repo has been quarantined
+func (s *SSH) Quarantined(ctx context.Context, repo string) (bool, error) {
+	path, err := s.quarantinePath(ctx, repo)
+	if err != nil {
+		return false, err
+	}
+
+	return quarantined(s.Store, path)
+}
+
+// quarantinePath resolves repo to the path its quarantine is held against
+func (s *SSH) quarantinePath(ctx context.Context, repo string) (string, error) {
+	if err := validateRepoPath(repo); err != nil {
+		return "", err
+	}
+
+	loc, err := s.current().resolveRepo(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(loc.Path)
+}
+
+// quarantined reports whether the repository at path has been quarantined
+// in store, which may be nil
+func quarantined(store Store, path string) (bool, error) {
+	if store == nil {
+		return false, nil
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = store.Get(quarantineKey(path))
+	if errors.Is(err, ErrStoreKeyNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,174 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSSHRun runs cmd on s, returning its combined output
+func testSSHRun(t *testing.T, s *SSH, cmd string) (string, error) {
+	t.Helper()
+
+	sess, err := testSSHClient(t, s).NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	out, err := sess.CombinedOutput(cmd)
+
+	return string(out), err
+}
+
+func TestSSH_AdminCommands_Disabled(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+
+	_, err := testSSHRun(t, s, "gitkit sessions")
+	assert.Error(t, err)
+}
+
+func TestSSH_AdminCommands_Denied(t *testing.T) {
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.AuthoriseAdminFunc = func(context.Context, []string) error {
+			return fmt.Errorf("not an operator")
+		}
+	})
+
+	out, err := testSSHRun(t, s, "gitkit sessions")
+	assert.Error(t, err)
+	assert.Contains(t, out, "access denied: not an operator")
+}
+
+func TestSSH_AdminCommands(t *testing.T) {
+	var (
+		authorised [][]string
+		reloaded   bool
+	)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthoriseAdminFunc = func(_ context.Context, args []string) error {
+			authorised = append(authorised, args)
+			return nil
+		}
+
+		s.ReloadFunc = func(context.Context) error {
+			reloaded = true
+			return nil
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	t.Run("gc", func(t *testing.T) {
+		out, err := testSSHRun(t, s, "gitkit gc test.git")
+		assert.NoError(t, err, out)
+
+		out, err = testSSHRun(t, s, "gitkit gc missing")
+		assert.Error(t, err)
+		assert.Contains(t, out, "does not exist")
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		out, err := testSSHRun(t, s, "gitkit quarantine test")
+		assert.NoError(t, err, out)
+
+		out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), ".")
+		assert.Error(t, err)
+		assert.Contains(t, out, "quarantined")
+
+		out, err = testSSHRun(t, s, "gitkit unquarantine test")
+		assert.NoError(t, err, out)
+
+		out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), ".")
+		assert.NoError(t, err, out)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		out, err := testSSHRun(t, s, "gitkit sessions")
+		assert.NoError(t, err, out)
+
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		assert.True(t, strings.HasPrefix(lines[0], "ID"), out)
+		assert.Contains(t, out, "gitkit sessions")
+	})
+
+	t.Run("kill", func(t *testing.T) {
+		idle := testSSHClient(t, s)
+
+		var id string
+		for _, info := range s.Sessions() {
+			if info.RemoteAddr == idle.LocalAddr().String() {
+				id = info.ID
+			}
+		}
+
+		out, err := testSSHRun(t, s, "gitkit kill "+id)
+		assert.NoError(t, err, out)
+		assert.Error(t, idle.Wait())
+
+		out, err = testSSHRun(t, s, "gitkit kill "+id)
+		assert.Error(t, err, out)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		out, err := testSSHRun(t, s, "gitkit reload")
+		assert.NoError(t, err, out)
+		assert.True(t, reloaded)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		out, err := testSSHRun(t, s, "gitkit frobnicate")
+		assert.Error(t, err)
+		assert.Contains(t, out, "usage: gitkit")
+	})
+
+	assert.Contains(t, authorised, []string{"quarantine", "test"})
+}
+
+func TestSSH_Quarantine_Routed(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, Routes: []Route{{Pattern: "alias/*", TrimPrefix: "alias/"}}}, nil)
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	assert.NoError(t, s.Quarantine(context.Background(), "test"))
+
+	quarantined, err := s.Quarantined(context.Background(), "alias/test")
+	assert.NoError(t, err)
+	assert.True(t, quarantined)
+
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "alias/test.git"), ".")
+	assert.Error(t, err)
+	assert.Contains(t, out, "quarantined")
+
+	assert.NoError(t, s.Unquarantine(context.Background(), "alias/test"))
+
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), ".")
+	assert.NoError(t, err, out)
+}
+
+func TestServer_Quarantined(t *testing.T) {
+	var path string
+
+	store := NewMemoryStore()
+	srv := startTestHTTP(t, Config{}, func(s *Server) {
+		s.Store = store
+		path, _ = filepath.Abs(filepath.Join(s.config.Dir, "team", "test.git"))
+	})
+
+	assert.Equal(t, http.StatusOK, testHTTPRefs(t, srv, "git-upload-pack", nil).StatusCode)
+
+	assert.NoError(t, store.Put(quarantineKey(path), []byte("now")))
+	assert.Equal(t, http.StatusForbidden, testHTTPRefs(t, srv, "git-upload-pack", nil).StatusCode)
+}
@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// archivePath matches /<repo>/archive/<ref>.tar.gz. The repository is
+// everything before the first /archive/, so refs may contain slashes.
+var archivePath = regexp.MustCompile(`^(.+?)/archive/(.+)\.tar\.gz$`)
+
+// findArchive matches archive download requests, returning the repository
+// path and ref
+func findArchive(req *http.Request) (repo, ref string, ok bool) {
+	if req.Method != http.MethodGet {
+		return "", "", false
+	}
+
+	m := archivePath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return "", "", false
+	}
+
+	return m[1], m[2], true
+}
+
+// getArchive streams a gzipped tarball of a ref, such as a branch, tag or
+// commit, with its files under a <repo>-<ref>/ directory
+func (s *Server) getArchive(_ string, w http.ResponseWriter, r *Request) {
+	context := "get-archive"
+
+	_, ref, _ := findArchive(r.Request)
+
+	// Refs starting with - would be taken as options by git
+	if strings.HasPrefix(ref, "-") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if err := exec.Command(s.config.GitPath, "-C", r.RepoPath, "rev-parse", "--verify", "--quiet", ref+"^{tree}").Run(); err != nil {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	name := strings.TrimSuffix(path.Base(r.RepoName), ".git") + "-" + strings.ReplaceAll(ref, "/", "-")
+
+	cmd, pipe := gitCommand(&s.config, "-C", r.RepoPath, "archive", "--format=tar.gz", "--prefix="+name+"/", ref)
+	cmd.Stderr = nil // Keep errors out of the tarball
+
+	if err := cmd.Start(); err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer cleanUpProcessGroup(cmd)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, pipe); err != nil {
+		logError(context, err)
+		return
+	}
+
+	if err := cmd.Wait(); err != nil {
+		logError(context, err)
+	}
+}
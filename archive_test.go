@@ -0,0 +1,205 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testArchiveWorkTree creates a local repository with README committed on
+// main, using git's own environment
+func testArchiveWorkTree(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "README"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	return dir
+}
+
+func TestServer_getArchive(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), GitPath: "git"}
+	repo := filepath.Join(cfg.Dir, "team", "test.git")
+
+	if err := initRepo(repo, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "push", "-q", repo, "main", "main:refs/heads/release/1.0")
+	cmd.Dir = testArchiveWorkTree(t)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	srv := httptest.NewServer(New(cfg))
+	defer srv.Close()
+
+	for path, expect := range map[string]int{
+		"/team/test.git/archive/main.tar.gz":        http.StatusOK,
+		"/team/test.git/archive/release/1.0.tar.gz": http.StatusOK,
+		"/team/test.git/archive/missing.tar.gz":     http.StatusNotFound,
+		"/team/test.git/archive/--output.tar.gz":    http.StatusBadRequest,
+	} {
+		t.Run(path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != expect {
+				t.Fatalf("expected %d, received %d", expect, resp.StatusCode)
+			}
+
+			if expect != http.StatusOK {
+				return
+			}
+
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+			tr := tar.NewReader(gz)
+			for {
+				h, err := tr.Next()
+				if err != nil {
+					break
+				}
+
+				names = append(names, h.Name)
+			}
+
+			found := false
+			for _, name := range names {
+				if filepath.Base(name) == "README" && filepath.Dir(name) != "." {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("README missing from archive, received %v", names)
+			}
+		})
+	}
+}
+
+func TestSSH_UploadArchive(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testArchiveWorkTree(t)
+
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	out, err := testGit(t, s, work, "archive", "--remote", testRemote(s, "test.git"), "--output", "out.tar", "main")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	f, err := os.Open(filepath.Join(work, "out.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := []string{}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		names = append(names, h.Name)
+	}
+
+	if names[len(names)-1] != "README" {
+		t.Errorf("expected README in archive, received %v", names)
+	}
+}
+
+func TestConfig_DisableArchive(t *testing.T) {
+	t.Run("HTTP", func(t *testing.T) {
+		cfg := Config{Dir: t.TempDir(), GitPath: "git", DisableArchive: true}
+		if err := initRepo(filepath.Join(cfg.Dir, "team", "test.git"), &cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		srv := httptest.NewServer(New(cfg))
+		defer srv.Close()
+
+		for path, expect := range map[string]int{
+			"/team/test.git/archive/main.tar.gz":                http.StatusForbidden,
+			"/team/test.git/info/refs?service=git-upload-pack":  http.StatusOK,
+			"/team/test.git/info/refs?service=git-receive-pack": http.StatusOK,
+		} {
+			resp, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != expect {
+				t.Errorf("%s: expected %d, received %d", path, expect, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("SSH", func(t *testing.T) {
+		s := startTestSSH(t, Config{AutoCreate: true, DisableArchive: true}, nil)
+
+		work := testArchiveWorkTree(t)
+		if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+			t.Fatalf("unexpected error: %v\n%s", err, out)
+		}
+
+		if out, err := testGit(t, s, work, "archive", "--remote", testRemote(s, "test.git"), "main"); err == nil {
+			t.Fatalf("expected archive to be refused\n%s", out)
+		}
+
+		if last := s.Report().LastError; !errors.Is(last, ErrOperationDisabled) {
+			t.Errorf("expected ErrOperationDisabled, received %v", last)
+		}
+	})
+}
+
+func TestSSH_AllowedOperations(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, AllowedOperations: []string{OperationReceivePack}}, nil)
+
+	work := testArchiveWorkTree(t)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	if out, err := testGit(t, s, work, "fetch", testRemote(s, "test.git"), "main"); err == nil {
+		t.Errorf("expected fetch to be refused\n%s", out)
+	}
+
+	if last := s.Report().LastError; !errors.Is(last, ErrOperationDisabled) {
+		t.Errorf("expected ErrOperationDisabled, received %v", last)
+	}
+}
@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// makeAtomic has receive-pack apply push all or nothing, as though the
+// client had run git push --atomic, when Config.AtomicPushes is set and the
+// push updates more than one ref. raw is the push request as read by
+// readPushRequest, and is returned with the atomic capability added.
+func (c Config) makeAtomic(push *PushRequest, raw []byte) ([]byte, error) {
+	if !c.AtomicPushes || len(push.Updates) < 2 || push.HasCapability("atomic") {
+		return raw, nil
+	}
+
+	raw, err := addPushCapability(raw, "atomic")
+	if err != nil {
+		return nil, err
+	}
+
+	push.Capabilities = append(push.Capabilities, "atomic")
+	push.GitConfig = append(push.GitConfig, "receive.advertiseAtomic=true")
+
+	return raw, nil
+}
+
+// addPushCapability adds capability to those requested in the first
+// command of raw, a push request
+func addPushCapability(raw []byte, capability string) ([]byte, error) {
+	for off := 0; ; {
+		rest := bytes.NewReader(raw[off:])
+
+		line, flush, err := readPktLine(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		if flush {
+			return nil, errors.New("push request has no commands")
+		}
+
+		end := len(raw) - rest.Len()
+
+		if bytes.HasPrefix(line, []byte("shallow ")) {
+			off = end
+			continue
+		}
+
+		line, newline := bytes.CutSuffix(line, []byte("\n"))
+
+		cmd, caps, _ := bytes.Cut(line, []byte{0})
+
+		fields := append(bytes.Fields(caps), []byte(capability))
+
+		payload := append(append([]byte{}, cmd...), 0)
+		payload = append(payload, bytes.Join(fields, []byte(" "))...)
+		if newline {
+			payload = append(payload, '\n')
+		}
+
+		if len(payload)+4 > maxPktLen {
+			return nil, fmt.Errorf("invalid pkt-line length %d", len(payload)+4)
+		}
+
+		out := append([]byte{}, raw[:off]...)
+		out = fmt.Appendf(out, "%04x%s", len(payload)+4, payload)
+
+		return append(out, raw[end:]...), nil
+	}
+}
@@ -0,0 +1,79 @@
+package gitkit
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_addPushCapability(t *testing.T) {
+	update := ZeroSHA + " " + strings.Repeat("a", 40) + " refs/heads/main"
+
+	for _, test := range []struct {
+		name   string
+		input  []string
+		expect []string
+	}{
+		{"with capabilities", []string{update + "\x00report-status side-band-64k\n"}, []string{update + "\x00report-status side-band-64k atomic\n"}},
+		{"without capabilities", []string{update + "\x00\n"}, []string{update + "\x00atomic\n"}},
+		{"after shallow lines", []string{"shallow " + strings.Repeat("b", 40), update + "\x00report-status"}, []string{"shallow " + strings.Repeat("b", 40), update + "\x00report-status atomic"}},
+		{"signed push", []string{"push-cert\x00report-status\n", "certificate version 0.1\n"}, []string{"push-cert\x00report-status atomic\n", "certificate version 0.1\n"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			raw := testPktLines(t, test.input...)
+			raw = append(raw, "0000PACK"...)
+
+			out, err := addPushCapability(raw, "atomic")
+			require.NoError(t, err)
+
+			expect := append(testPktLines(t, test.expect...), "0000PACK"...)
+			assert.Equal(t, string(expect), string(out))
+		})
+	}
+
+	_, err := addPushCapability([]byte("0000"), "atomic")
+	assert.Error(t, err)
+}
+
+func testPktLines(t *testing.T, lines ...string) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	for _, line := range lines {
+		require.NoError(t, packLine(buf, line))
+	}
+
+	return buf.Bytes()
+}
+
+func TestSSH_AtomicPushes(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		s := startTestSSH(t, Config{AutoCreate: true, AtomicPushes: atomic}, nil)
+
+		work := testWorkTree(t, s)
+		remote := testRemote(s, "test.git")
+
+		out, err := testGit(t, s, work, "push", remote, "main")
+		require.NoError(t, err, out)
+
+		// Refuse one of the two refs the next push updates
+		hook := filepath.Join(s.config.Dir, "test", "hooks", "update")
+		require.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\n[ \"$1\" != refs/heads/denied ]\n"), 0755))
+
+		out, err = testGit(t, s, work, "push", remote, "main:allowed", "main:denied")
+		assert.Error(t, err, out)
+
+		err = exec.Command("git", "--git-dir", filepath.Join(s.config.Dir, "test"), "rev-parse", "--verify", "-q", "refs/heads/allowed").Run()
+		if atomic {
+			assert.Error(t, err, "allowed should not have been created by an atomic push")
+		} else {
+			assert.NoError(t, err, "allowed should have been created")
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// What happens to addresses and keys which fail authentication
+// AuthFailureOptions.MaxFailures times
+const (
+	AuthFailureBan    = "ban"    // Connections from the address, and attempts with the key, are refused
+	AuthFailureTarpit = "tarpit" // Handshakes from the address, and attempts with the key, are delayed by TarpitDelay
+)
+
+// Defaults for AuthFailureOptions, used when its fields are zero
+const (
+	DefaultAuthFailureWindow   = 10 * time.Minute
+	DefaultAuthFailureDuration = 15 * time.Minute
+	DefaultAuthTarpitDelay     = 5 * time.Second
+)
+
+// EventAuthBlocked is emitted as an address or key is banned or tarpitted
+const EventAuthBlocked = "security.auth_blocked"
+
+// ErrAuthBlocked is returned for connections and keys banned after too many
+// authentication failures
+var ErrAuthBlocked = errors.New("too many authentication failures")
+
+// AuthFailureOptions bans or tarpits addresses whose handshakes fail, and
+// keys which are refused, too often, blunting brute force scans. Every
+// handshake which fails to authenticate counts against its address, and
+// every refusal of a key, such as an unknown or revoked one, counts against
+// that key as offered from the address. PreLoginFunc refusals, such as for
+// the wrong user, only count against the address.
+type AuthFailureOptions struct {
+	MaxFailures int           // Failures within Window after which Action is taken. Zero disables tracking.
+	Window      time.Duration // Defaults to DefaultAuthFailureWindow
+	Action      string        // One of the AuthFailure constants. Defaults to AuthFailureBan.
+	Duration    time.Duration // How long Action lasts. Defaults to DefaultAuthFailureDuration.
+	TarpitDelay time.Duration // Defaults to DefaultAuthTarpitDelay
+}
+
+func (o AuthFailureOptions) window() time.Duration {
+	if o.Window > 0 {
+		return o.Window
+	}
+
+	return DefaultAuthFailureWindow
+}
+
+func (o AuthFailureOptions) duration() time.Duration {
+	if o.Duration > 0 {
+		return o.Duration
+	}
+
+	return DefaultAuthFailureDuration
+}
+
+func (o AuthFailureOptions) tarpitDelay() time.Duration {
+	if o.TarpitDelay > 0 {
+		return o.TarpitDelay
+	}
+
+	return DefaultAuthTarpitDelay
+}
+
+// check returns an error for unknown actions
+func (o AuthFailureOptions) check() error {
+	switch o.Action {
+	case "", AuthFailureBan, AuthFailureTarpit:
+		return nil
+	}
+
+	return fmt.Errorf("auth failures: unknown action %q", o.Action)
+}
+
+// authFailures counts recent failures by address and key, kept across
+// config reloads
+type authFailures struct {
+	mu      sync.Mutex
+	entries map[string]*authFailureEntry
+}
+
+type authFailureEntry struct {
+	failed  []time.Time
+	blocked time.Time // When Action ends
+}
+
+// record counts a failure by id, reporting whether it is the one which
+// blocks id
+func (f *authFailures) record(id string, opts AuthFailureOptions, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.entries == nil {
+		f.entries = map[string]*authFailureEntry{}
+	}
+
+	f.prune(opts, now)
+
+	entry, ok := f.entries[id]
+	if !ok {
+		entry = &authFailureEntry{}
+		f.entries[id] = entry
+	}
+
+	if now.Before(entry.blocked) {
+		return false
+	}
+
+	entry.failed = append(entry.failed, now)
+	if len(entry.failed) < opts.MaxFailures {
+		return false
+	}
+
+	// Failures start over once Action ends
+	entry.failed, entry.blocked = nil, now.Add(opts.duration())
+
+	return true
+}
+
+// prune forgets entries with neither recent failures nor a block in force
+func (f *authFailures) prune(opts AuthFailureOptions, now time.Time) {
+	since := now.Add(-opts.window())
+
+	for id, entry := range f.entries {
+		recent := entry.failed[:0]
+		for _, t := range entry.failed {
+			if t.After(since) {
+				recent = append(recent, t)
+			}
+		}
+
+		entry.failed = recent
+
+		if len(recent) == 0 && !now.Before(entry.blocked) {
+			delete(f.entries, id)
+		}
+	}
+}
+
+// blocked reports whether Action is in force against id
+func (f *authFailures) blocked(id string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.entries[id]
+
+	return ok && now.Before(entry.blocked)
+}
+
+// addrFailureID identifies the address of addr to authFailures, or is
+// empty for connections without one, such as over unix sockets
+func addrFailureID(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return "addr " + tcp.IP.String()
+	}
+
+	return ""
+}
+
+// keyFailureID identifies a key to authFailures as used from addr, so
+// that refusals of a key offered by someone without it, who needs only the
+// public half, cannot lock its owner out from elsewhere
+func keyFailureID(fingerprint string, addr net.Addr) string {
+	return "key " + fingerprint + " " + addrFailureID(addr)
+}
+
+// authFailed counts a failure against id, emitting EventAuthBlocked as
+// that blocks it
+func (s SSH) authFailed(ctx context.Context, id string, data map[string]string) {
+	opts := s.config.AuthFailures
+	if opts.MaxFailures <= 0 || id == "" || !s.failures.record(id, opts, time.Now()) {
+		return
+	}
+
+	data["action"] = opts.Action
+	if data["action"] == "" {
+		data["action"] = AuthFailureBan
+	}
+
+	s.emit(ctx, Event{Type: EventAuthBlocked, Data: data})
+}
+
+// throttleAuth refuses id while it is banned, or delays it while it is
+// tarpitted
+func (s SSH) throttleAuth(ctx context.Context, id string) error {
+	opts := s.config.AuthFailures
+	if opts.MaxFailures <= 0 || id == "" || !s.failures.blocked(id, time.Now()) {
+		return nil
+	}
+
+	if opts.Action != AuthFailureTarpit {
+		return ErrAuthBlocked
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-time.After(opts.tarpitDelay()):
+		return nil
+	}
+}
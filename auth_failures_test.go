@@ -0,0 +1,170 @@
+package gitkit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testAddrBlocked waits for the client's address to be blocked, returning
+// the event saying so
+func testAddrBlocked(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	for {
+		blocked := testEvents(t, events, EventAuthBlocked)
+		if e := blocked[len(blocked)-1]; e.Data["fingerprint"] == "" {
+			return e
+		}
+	}
+}
+
+func Test_authFailures(t *testing.T) {
+	f := new(authFailures)
+	opts := AuthFailureOptions{MaxFailures: 3, Window: time.Minute, Duration: time.Hour}
+	now := time.Now()
+
+	assert.False(t, f.record("a", opts, now))
+	assert.False(t, f.record("a", opts, now.Add(time.Second)))
+	assert.False(t, f.blocked("a", now.Add(time.Second)))
+
+	// Failures outside the window are forgotten
+	assert.False(t, f.record("a", opts, now.Add(2*time.Minute)))
+	assert.False(t, f.record("a", opts, now.Add(2*time.Minute)))
+	assert.True(t, f.record("a", opts, now.Add(2*time.Minute)))
+	assert.True(t, f.blocked("a", now.Add(3*time.Minute)))
+	assert.False(t, f.blocked("b", now.Add(3*time.Minute)))
+
+	// Failures while blocked neither count nor extend the block
+	assert.False(t, f.record("a", opts, now.Add(4*time.Minute)))
+	assert.False(t, f.blocked("a", now.Add(2*time.Hour)))
+
+	assert.NoError(t, AuthFailureOptions{Action: AuthFailureTarpit}.check())
+	assert.Error(t, AuthFailureOptions{Action: "drop"}.check())
+}
+
+func TestSSH_AuthFailures_BanAddress(t *testing.T) {
+	known, unknown := testClientSigner(t), testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(known.PublicKey()): {Id: "known", Name: "known"},
+	}, func(s *SSH) {
+		s.config.AuthFailures = AuthFailureOptions{MaxFailures: 2}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	for i := 0; i < 2; i++ {
+		_, err := testKeyDial(s, unknown)
+		assert.Error(t, err)
+	}
+
+	blocked := testAddrBlocked(t, events)
+	assert.Contains(t, blocked.Data["remote_addr"], "127.0.0.1:")
+	assert.Equal(t, AuthFailureBan, blocked.Data["action"])
+
+	// Even valid keys are refused from a banned address
+	_, err := testKeyDial(s, known)
+	assert.Error(t, err)
+}
+
+func TestSSH_AuthFailures_BanKey(t *testing.T) {
+	known, unknown := testClientSigner(t), testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(known.PublicKey()): {Id: "known", Name: "known"},
+	}, func(s *SSH) {
+		s.config.AuthFailures = AuthFailureOptions{MaxFailures: 2}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	// The unknown key is refused each time, though the handshakes succeed
+	for i := 0; i < 2; i++ {
+		client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(unknown, known)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		client.Close()
+	}
+
+	blocked := testEvents(t, events, EventAuthBlocked)
+	assert.Equal(t, ssh.FingerprintSHA256(unknown.PublicKey()), blocked[len(blocked)-1].Data["fingerprint"])
+
+	client, err := testKeyDial(s, known)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+}
+
+func TestSSH_AuthFailures_WrongUser(t *testing.T) {
+	known := testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(known.PublicKey()): {Id: "known", Name: "known"},
+	}, func(s *SSH) {
+		s.config.GitUser = "git"
+		s.config.AuthFailures = AuthFailureOptions{MaxFailures: 2}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	// Offering someone's key as another user counts against the address
+	// alone, never against the key
+	for i := 0; i < 2; i++ {
+		_, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            "mallory",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(known)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		assert.Error(t, err)
+	}
+
+	for _, e := range testEvents(t, events, EventAuthBlocked) {
+		if e.Type == EventAuthBlocked {
+			assert.Empty(t, e.Data["fingerprint"])
+		}
+	}
+
+	assert.NotEqual(t, keyFailureID("SHA256:x", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}), keyFailureID("SHA256:x", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2)}))
+}
+
+func TestSSH_AuthFailures_Tarpit(t *testing.T) {
+	known, unknown := testClientSigner(t), testClientSigner(t)
+	delay := 300 * time.Millisecond
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(known.PublicKey()): {Id: "known", Name: "known"},
+	}, func(s *SSH) {
+		s.config.AuthFailures = AuthFailureOptions{MaxFailures: 1, Action: AuthFailureTarpit, TarpitDelay: delay}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	_, err := testKeyDial(s, unknown)
+	assert.Error(t, err)
+
+	assert.Equal(t, AuthFailureTarpit, testAddrBlocked(t, events).Data["action"])
+
+	// Tarpitted addresses are slowed down, not refused
+	start := time.Now()
+
+	client, err := testKeyDial(s, known)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), delay)
+}
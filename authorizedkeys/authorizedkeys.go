@@ -0,0 +1,311 @@
+// Package authorizedkeys authenticates gitkit SSH clients against an
+// OpenSSH authorized_keys file, so that a server can be stood up without a
+// key database:
+//
+//	keys, err := authorizedkeys.Load("/home/git/.ssh/authorized_keys")
+//	if err != nil {
+//		return err
+//	}
+//
+//	keys.Wire(server)
+//
+// Each key's comment names it, becoming the gitkit.PublicKey's Id and Name;
+// keys without a comment are named by their fingerprint. The file is
+// re-read whenever it changes on disk.
+//
+// Key options are parsed into Options and attached to the key as its
+// Metadata, and expiry-time= becomes the key's ExpiresAt, so that the server
+// refuses it once it has passed. from= is enforced against the client's address, matching IP
+// addresses, wildcards and CIDR ranges, though not host names, which are
+// never resolved. Ptys, forwarding and X11 are never offered by gitkit, so
+// no-pty, no-port-forwarding and the like are always honoured; command=,
+// environment= and the rest are left for callbacks to act on.
+package authorizedkeys
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jspc/gitkit"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrUnknownKey = errors.New("authorizedkeys: unknown key")
+	ErrFromDenied = errors.New("authorizedkeys: key may not be used from this address")
+	ErrBadOption  = errors.New("authorizedkeys: malformed key option")
+)
+
+// expiryFormats are the forms expiry-time= may take
+var expiryFormats = []string{"20060102150405", "200601021504", "20060102"}
+
+// Options holds the options given before a key
+type Options struct {
+	Command     string    // command=, the command the key is restricted to
+	Environment []string  // environment=, as NAME=value
+	From        []string  // from=, patterns the client's address must match
+	ExpiryTime  time.Time // expiry-time=, after which the key is refused
+	NoPTY       bool      // no-pty
+	Restrict    bool      // restrict, which disables ptys and forwarding
+	Raw         []string  // Every option, as written
+}
+
+// Key is a single entry from an authorized_keys file
+type Key struct {
+	Key     ssh.PublicKey
+	Comment string
+	Options Options
+}
+
+// File is a parsed authorized_keys file, kept up to date with the file on
+// disk
+type File struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[string]Key // fingerprint to key
+	modTime time.Time
+	size    int64
+}
+
+// Load reads the authorized_keys file at p
+func Load(p string) (*File, error) {
+	f := &File{path: p}
+
+	return f, f.Reload()
+}
+
+// Parse reads keys in authorized_keys format from data. Blank lines and
+// comments are skipped.
+func Parse(data []byte) (map[string]Key, error) {
+	keys := make(map[string]Key)
+
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		pub, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("authorizedkeys: line %d: %w", n+1, err)
+		}
+
+		opts, err := parseOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+
+		keys[ssh.FingerprintSHA256(pub)] = Key{Key: pub, Comment: comment, Options: opts}
+	}
+
+	return keys, nil
+}
+
+func parseOptions(options []string) (opts Options, err error) {
+	opts.Raw = options
+
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		name = strings.ToLower(name)
+
+		if hasValue {
+			if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+				return opts, fmt.Errorf("%w: %s", ErrBadOption, option)
+			}
+
+			value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+		}
+
+		switch name {
+		case "command":
+			opts.Command = value
+
+		case "environment":
+			opts.Environment = append(opts.Environment, value)
+
+		case "from":
+			opts.From = strings.Split(value, ",")
+
+		case "expiry-time":
+			if opts.ExpiryTime, err = parseExpiry(value); err != nil {
+				return opts, fmt.Errorf("%w: %s", ErrBadOption, option)
+			}
+
+		case "no-pty":
+			opts.NoPTY = true
+
+		case "restrict":
+			opts.Restrict, opts.NoPTY = true, true
+		}
+	}
+
+	return opts, nil
+}
+
+// parseExpiry reads an expiry-time, which is in local time unless it ends
+// with Z
+func parseExpiry(value string) (time.Time, error) {
+	loc := time.Local
+	if v, ok := strings.CutSuffix(value, "Z"); ok {
+		value, loc = v, time.UTC
+	}
+
+	for _, layout := range expiryFormats {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid expiry time %q", value)
+}
+
+// Reload re-reads the file, keeping the keys already loaded should it fail
+// to parse
+func (f *File) Reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.keys, f.modTime, f.size = keys, info.ModTime(), info.Size()
+
+	return nil
+}
+
+// refresh reloads the file if it has changed since it was last read
+func (f *File) refresh() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.RLock()
+	changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+	f.mu.RUnlock()
+
+	if !changed {
+		return nil
+	}
+
+	return f.Reload()
+}
+
+// Keys returns every key in the file
+func (f *File) Keys() []Key {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	keys := make([]Key, 0, len(f.keys))
+	for _, k := range f.keys {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// Wire installs the file's key lookup on s
+func (f *File) Wire(s *gitkit.SSH) {
+	s.PublicKeyLookupFunc = f.PublicKeyLookup
+}
+
+// PublicKeyLookup finds key in the file, refusing keys used from addresses
+// their from= option does not allow
+func (f *File) PublicKeyLookup(ctx context.Context, key gitkit.PublicKeyLookup) (*gitkit.PublicKey, error) {
+	// A file which has gone missing or no longer parses leaves the keys
+	// last read in place, rather than locking everyone out
+	f.refresh()
+
+	f.mu.RLock()
+	k, ok := f.keys[key.Fingerprint]
+	f.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if len(k.Options.From) > 0 {
+		addr, _ := ctx.Value(gitkit.RemoteAddrContextKey{}).(string)
+		if !matchFrom(k.Options.From, addr) {
+			return nil, ErrFromDenied
+		}
+	}
+
+	name := k.Comment
+	if name == "" {
+		name = key.Fingerprint
+	}
+
+	return &gitkit.PublicKey{
+		Id:          name,
+		Name:        name,
+		Fingerprint: key.Fingerprint,
+		Content:     key.Payload,
+		ExpiresAt:   k.Options.ExpiryTime,
+		Metadata:    k.Options,
+	}, nil
+}
+
+// matchFrom reports whether addr satisfies a from= pattern list: it must
+// match at least one pattern, and none negated with !
+func matchFrom(patterns []string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if !matchAddress(pattern, ip) {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+
+		matched = true
+	}
+
+	return matched
+}
+
+func matchAddress(pattern string, ip net.IP) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return network.Contains(ip)
+	}
+
+	ok, _ := path.Match(pattern, ip.String())
+
+	return ok
+}
@@ -0,0 +1,232 @@
+package authorizedkeys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jspc/gitkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func testKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func authorizedLine(key ssh.PublicKey, options, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if options != "" {
+		line = options + " " + line
+	}
+
+	if comment != "" {
+		line += " " + comment
+	}
+
+	return line + "\n"
+}
+
+func lookupFor(key ssh.PublicKey) gitkit.PublicKeyLookup {
+	return gitkit.PublicKeyLookup{
+		Payload:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Type:        key.Type(),
+	}
+}
+
+func addrContext(addr string) context.Context {
+	return context.WithValue(context.Background(), gitkit.RemoteAddrContextKey{}, addr)
+}
+
+func TestParse(t *testing.T) {
+	key := testKey(t)
+
+	data := "# Deploy keys\n\n" + authorizedLine(key,
+		`command="git-shell -c \"$SSH_ORIGINAL_COMMAND\"",no-pty,from="10.0.0.0/8,!10.0.0.1",environment="TEAM=ops",expiry-time="20300101Z"`,
+		"alice@example.com")
+
+	keys, err := Parse([]byte(data))
+	if !assert.NoError(t, err) || !assert.Len(t, keys, 1) {
+		return
+	}
+
+	k := keys[ssh.FingerprintSHA256(key)]
+	assert.Equal(t, "alice@example.com", k.Comment)
+	assert.Equal(t, `git-shell -c "$SSH_ORIGINAL_COMMAND"`, k.Options.Command)
+	assert.True(t, k.Options.NoPTY)
+	assert.False(t, k.Options.Restrict)
+	assert.Equal(t, []string{"10.0.0.0/8", "!10.0.0.1"}, k.Options.From)
+	assert.Equal(t, []string{"TEAM=ops"}, k.Options.Environment)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), k.Options.ExpiryTime)
+	assert.Len(t, k.Options.Raw, 5)
+}
+
+func TestParse_Errors(t *testing.T) {
+	key := testKey(t)
+
+	for _, test := range []struct {
+		name string
+		data string
+	}{
+		{"bad key", "ssh-ed25519 not-base64\n"},
+		{"bad expiry", authorizedLine(key, `expiry-time="tomorrow"`, "")},
+		{"unquoted value", authorizedLine(key, `command=true`, "")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.data))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "line 1")
+			}
+		})
+	}
+}
+
+func Test_matchFrom(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		addr     string
+		expect   bool
+	}{
+		{[]string{"192.0.2.10"}, "192.0.2.10:2222", true},
+		{[]string{"192.0.2.10"}, "192.0.2.11:2222", false},
+		{[]string{"192.0.2.*"}, "192.0.2.11:2222", true},
+		{[]string{"192.0.2.?"}, "192.0.2.11:2222", false},
+		{[]string{"192.0.2.0/24"}, "192.0.2.200:2222", true},
+		{[]string{"192.0.2.0/24", "!192.0.2.1"}, "192.0.2.1:2222", false},
+		{[]string{"!192.0.2.1"}, "192.0.2.2:2222", false},
+		{[]string{"::1"}, "[::1]:2222", true},
+		{[]string{"example.com"}, "192.0.2.10:2222", false},
+		{[]string{"*"}, "", false},
+	} {
+		t.Run(strings.Join(test.patterns, ",")+" "+test.addr, func(t *testing.T) {
+			assert.Equal(t, test.expect, matchFrom(test.patterns, test.addr))
+		})
+	}
+}
+
+func TestFile_PublicKeyLookup(t *testing.T) {
+	alice, bob, carol, dave := testKey(t), testKey(t), testKey(t), testKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	data := authorizedLine(alice, "", "alice") +
+		authorizedLine(bob, "", "") +
+		authorizedLine(carol, `expiry-time="20000101"`, "carol") +
+		authorizedLine(dave, `restrict,from="192.0.2.0/24"`, "dave")
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := addrContext("198.51.100.7:50000")
+
+	pk, err := f.PublicKeyLookup(ctx, lookupFor(alice))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", pk.Id)
+		assert.Equal(t, "alice", pk.Name)
+		assert.Equal(t, ssh.FingerprintSHA256(alice), pk.Fingerprint)
+	}
+
+	pk, err = f.PublicKeyLookup(ctx, lookupFor(bob))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ssh.FingerprintSHA256(bob), pk.Name)
+	}
+
+	pk, err = f.PublicKeyLookup(ctx, lookupFor(carol))
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local), pk.ExpiresAt)
+	}
+
+	_, err = f.PublicKeyLookup(ctx, lookupFor(dave))
+	assert.ErrorIs(t, err, ErrFromDenied)
+
+	pk, err = f.PublicKeyLookup(addrContext("192.0.2.7:50000"), lookupFor(dave))
+	if assert.NoError(t, err) {
+		opts, ok := pk.Metadata.(Options)
+		assert.True(t, ok)
+		assert.True(t, opts.Restrict)
+		assert.True(t, opts.NoPTY)
+	}
+
+	_, err = f.PublicKeyLookup(ctx, lookupFor(testKey(t)))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	assert.Len(t, f.Keys(), 4)
+}
+
+func TestFile_Refresh(t *testing.T) {
+	alice, bob := testKey(t), testKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte(authorizedLine(alice, "", "alice")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := addrContext("192.0.2.7:50000")
+
+	_, err = f.PublicKeyLookup(ctx, lookupFor(bob))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	if err := os.WriteFile(path, []byte(authorizedLine(bob, "", "bob")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.PublicKeyLookup(ctx, lookupFor(bob))
+	assert.NoError(t, err)
+
+	_, err = f.PublicKeyLookup(ctx, lookupFor(alice))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	t.Run("unparseable file keeps the last keys", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("not a key at all\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.PublicKeyLookup(ctx, lookupFor(bob))
+		assert.NoError(t, err)
+	})
+}
+
+func TestFile_Wire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := gitkit.NewSSH(gitkit.Config{})
+	f.Wire(s)
+
+	assert.NotNil(t, s.PublicKeyLookupFunc)
+}
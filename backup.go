@@ -0,0 +1,456 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats backups are written in
+const (
+	BackupBundle = "bundle" // A git bundle of every ref, as written by RepoManager.ExportBundle
+	BackupTar    = "tar"    // A tar of the bare repository, hooks and config included
+)
+
+// Event types emitted as repositories are backed up
+const (
+	EventBackupCompleted = "backup.completed"
+	EventBackupFailed    = "backup.failed"
+)
+
+// DefaultBackupInterval is how often RunBackups runs when
+// BackupPolicy.Interval is not set
+const DefaultBackupInterval = 24 * time.Hour
+
+// backupTimeFormat names backups by when they were taken, sorting in order
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// BackupUploader stores backups under slash separated names, such as
+// team/project/20240102T030405.000000000Z.bundle, which begin with the
+// repository's name
+type BackupUploader interface {
+	Upload(ctx context.Context, name string, r io.Reader) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// BackupDirectory is a BackupUploader writing backups beneath a local
+// directory, such as a mounted volume
+type BackupDirectory struct {
+	Path string
+}
+
+// Upload writes r to name, in place of any backup already there. Partial
+// uploads are not left behind.
+func (d BackupDirectory) Upload(ctx context.Context, name string, r io.Reader) error {
+	dst := filepath.Join(d.Path, filepath.FromSlash(name))
+	if !withinDir(d.Path, dst) {
+		return fmt.Errorf("backup: %w: %s", ErrPathTraversal, name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), dst)
+}
+
+// List returns the names of backups beginning with prefix
+func (d BackupDirectory) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+
+	err := filepath.WalkDir(d.Path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return err
+		}
+
+		rel, err := filepath.Rel(d.Path, p)
+		if name := filepath.ToSlash(rel); err == nil && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+
+		return err
+	})
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return names, nil
+	}
+
+	return names, err
+}
+
+// Delete removes the backup name
+func (d BackupDirectory) Delete(ctx context.Context, name string) error {
+	p := filepath.Join(d.Path, filepath.FromSlash(name))
+	if !withinDir(d.Path, p) {
+		return fmt.Errorf("backup: %w: %s", ErrPathTraversal, name)
+	}
+
+	return os.Remove(p)
+}
+
+// BackupPolicy configures Backup and RunBackups
+type BackupPolicy struct {
+	Uploader BackupUploader // Where backups are written
+	Format   string         // One of the Backup format constants. Defaults to BackupBundle.
+	Interval time.Duration  // How often RunBackups runs. Defaults to DefaultBackupInterval.
+	Prefix   string         // Only back up repositories whose names begin with Prefix
+
+	// Repositories whose refs have not changed since their last backup are
+	// skipped, unless Full is set
+	Full bool
+
+	// Keep is the most backups kept of each repository, the oldest being
+	// deleted first, and MaxAge how long they are kept for. The newest
+	// backup is always kept. Zero keeps every backup.
+	Keep   int
+	MaxAge time.Duration
+}
+
+func (p BackupPolicy) format() string {
+	if p.Format == "" {
+		return BackupBundle
+	}
+
+	return p.Format
+}
+
+// BackupResult reports the backup of one repository
+type BackupResult struct {
+	Repo      string
+	Name      string // The backup's name in the BackupUploader; empty when none was written
+	Unchanged bool   // Skipped, since its refs are as they were at the last backup
+	Err       error
+}
+
+// Backup backs up each repository once, as policy says, and applies its
+// retention rules. Failures are reported in the results, rather than
+// stopping the other repositories being backed up.
+func (s *SSH) Backup(ctx context.Context, policy BackupPolicy) ([]BackupResult, error) {
+	srv := s.current()
+
+	if policy.Uploader == nil {
+		return nil, errors.New("backup: no uploader")
+	}
+
+	if f := policy.format(); f != BackupBundle && f != BackupTar {
+		return nil, fmt.Errorf("backup: unknown format %q", f)
+	}
+
+	if srv.config.InMemory {
+		return nil, fmt.Errorf("backup: %w in memory", ErrOperationDisabled)
+	}
+
+	repos, err := srv.listAllRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []BackupResult{}
+	for _, repo := range repos {
+		if !strings.HasPrefix(repo, policy.Prefix) {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		result := srv.backupRepo(ctx, policy, repo)
+		if result.Err == nil && result.Name != "" {
+			result.Err = srv.pruneBackups(ctx, policy, repo)
+		}
+
+		if result.Err != nil {
+			srv.emit(ctx, Event{Type: EventBackupFailed, Repo: repo, Data: map[string]string{"error": result.Err.Error()}})
+		} else if result.Name != "" {
+			srv.emit(ctx, Event{Type: EventBackupCompleted, Repo: repo, Data: map[string]string{"name": result.Name}})
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// RunBackups calls Backup every BackupPolicy.Interval, starting straight
+// away, until ctx is cancelled. Failures are logged, and retried at the
+// next run.
+func (s *SSH) RunBackups(ctx context.Context, policy BackupPolicy) error {
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = DefaultBackupInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := s.Backup(ctx, policy)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		for _, result := range results {
+			if result.Err != nil {
+				log.Printf("backup: %s: %v", result.Repo, result.Err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// backupRepo writes a backup of repo, unless its refs are unchanged since
+// the last one
+func (s *SSH) backupRepo(ctx context.Context, policy BackupPolicy, repo string) BackupResult {
+	result := BackupResult{Repo: repo}
+
+	loc, err := s.resolveRepo(ctx, repo)
+	if err != nil {
+		result.Err = err
+
+		return result
+	}
+
+	// Held so that GC cannot remove objects from under the backup
+	if !s.maintenance.acquire(loc.Path) {
+		result.Err = ErrMaintenanceRunning
+
+		return result
+	}
+	defer s.maintenance.release(loc.Path)
+
+	refs, err := s.refsDigest(ctx, loc.Path)
+	if err != nil {
+		result.Err = err
+
+		return result
+	}
+
+	// Bundles cannot be made of repositories without refs
+	if refs == "" && policy.format() == BackupBundle {
+		result.Unchanged = true
+
+		return result
+	}
+
+	if s.Store != nil && !policy.Full {
+		if last, err := s.Store.Get(backupKey(repo)); err == nil && string(last) == refs {
+			result.Unchanged = true
+
+			return result
+		}
+	}
+
+	name := path.Join(repo, time.Now().UTC().Format(backupTimeFormat)+"."+policy.format())
+
+	pr, pw := io.Pipe()
+	go func() {
+		if policy.format() == BackupTar {
+			pw.CloseWithError(writeRepoTar(loc.Path, pw))
+		} else {
+			pw.CloseWithError(s.Repos().ExportBundle(ctx, repo, pw))
+		}
+	}()
+
+	err = policy.Uploader.Upload(ctx, name, pr)
+	pr.CloseWithError(err)
+
+	if err != nil {
+		result.Err = fmt.Errorf("backup: %s: %w", repo, err)
+
+		return result
+	}
+
+	result.Name = name
+
+	if s.Store != nil {
+		result.Err = s.Store.Put(backupKey(repo), []byte(refs))
+	}
+
+	return result
+}
+
+// refsDigest summarises a repository's refs and HEAD, changing whenever
+// either does. Repositories without refs give an empty digest.
+func (s *SSH) refsDigest(ctx context.Context, path string) (string, error) {
+	refs, err := exec.CommandContext(ctx, s.config.GitPath, "-C", path, "for-each-ref", "--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return "", fmt.Errorf("backup: unable to list refs: %w", err)
+	}
+
+	if len(refs) == 0 {
+		return "", nil
+	}
+
+	head, _ := exec.CommandContext(ctx, s.config.GitPath, "-C", path, "symbolic-ref", "--quiet", "HEAD").Output()
+
+	sum := sha256.Sum256(append(refs, head...))
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// pruneBackups deletes the backups of repo policy no longer keeps
+func (s *SSH) pruneBackups(ctx context.Context, policy BackupPolicy, repo string) error {
+	if policy.Keep <= 0 && policy.MaxAge <= 0 {
+		return nil
+	}
+
+	listed, err := policy.Uploader.List(ctx, repo+"/")
+	if err != nil {
+		return fmt.Errorf("backup: listing %s: %w", repo, err)
+	}
+
+	type backup struct {
+		name  string
+		taken time.Time
+	}
+
+	backups := []backup{}
+	for _, name := range listed {
+		base := strings.TrimPrefix(name, repo+"/")
+
+		// Backups of repositories nested beneath repo are theirs to prune
+		if strings.Contains(base, "/") {
+			continue
+		}
+
+		taken, err := time.Parse(backupTimeFormat, strings.TrimSuffix(base, path.Ext(base)))
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backup{name: name, taken: taken})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].taken.After(backups[j].taken) })
+
+	for i, b := range backups {
+		if i == 0 {
+			continue
+		}
+
+		if (policy.Keep > 0 && i >= policy.Keep) || (policy.MaxAge > 0 && time.Since(b.taken) > policy.MaxAge) {
+			if err := policy.Uploader.Delete(ctx, b.name); err != nil {
+				return fmt.Errorf("backup: deleting %s: %w", b.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func backupKey(repo string) string {
+	return "backup/" + repo
+}
+
+// writeRepoTar writes the repository at root to w as a tar, with paths
+// relative to root. Objects are written after everything else: git writes
+// the objects of a push before pointing refs at them, so refs updated while
+// the tar is written never name objects it lacks.
+func writeRepoTar(root string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	objects := filepath.Join(root, "objects")
+
+	add := func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// Only regular files and directories make up a repository, less
+		// the temporary files and locks of pushes in progress
+		if !info.Mode().IsRegular() && !info.IsDir() || strings.HasPrefix(entry.Name(), "tmp_") || strings.HasSuffix(entry.Name(), ".lock") {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.CopyN(tw, f, hdr.Size)
+
+		return err
+	}
+
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if p == objects {
+			return fs.SkipDir
+		}
+
+		return add(p, entry, err)
+	})
+
+	if err == nil {
+		err = filepath.WalkDir(objects, add)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
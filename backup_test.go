@@ -0,0 +1,196 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testBackupRepos starts a server holding pushed repositories named repos
+func testBackupRepos(t *testing.T, repos ...string) (*SSH, string) {
+	t.Helper()
+
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testWorkTree(t, s)
+	for _, repo := range repos {
+		if out, err := testGit(t, s, work, "push", testRemote(s, repo+".git"), "main"); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+	}
+
+	return s, work
+}
+
+func testBackupNames(results []BackupResult) map[string]string {
+	names := map[string]string{}
+	for _, result := range results {
+		names[result.Repo] = result.Name
+	}
+
+	return names
+}
+
+func TestSSH_Backup(t *testing.T) {
+	s, work := testBackupRepos(t, "app", "team/lib")
+	dir := BackupDirectory{Path: t.TempDir()}
+	policy := BackupPolicy{Uploader: dir}
+
+	results, err := s.Backup(context.Background(), policy)
+	if !assert.NoError(t, err) || !assert.Len(t, results, 2) {
+		return
+	}
+
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+		assert.FileExists(t, filepath.Join(dir.Path, result.Name))
+	}
+
+	first := testBackupNames(results)
+
+	// Repositories whose refs are unchanged are skipped
+	results, err = s.Backup(context.Background(), policy)
+	if assert.NoError(t, err) {
+		for _, result := range results {
+			assert.True(t, result.Unchanged, result.Repo)
+			assert.Empty(t, result.Name)
+		}
+	}
+
+	testCommitRandom(t, s, work, "change", 16)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "app.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	results, err = s.Backup(context.Background(), policy)
+	if assert.NoError(t, err) {
+		names := testBackupNames(results)
+		assert.NotEmpty(t, names["app"])
+		assert.NotEqual(t, first["app"], names["app"])
+		assert.Empty(t, names["team/lib"])
+	}
+
+	// Backups restore with ImportBundle
+	f, err := os.Open(filepath.Join(dir.Path, first["team/lib"]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	restored := startTestSSH(t, Config{}, nil)
+	assert.NoError(t, restored.Repos().ImportBundle(context.Background(), "team/lib", f))
+}
+
+func TestSSH_Backup_Retention(t *testing.T) {
+	s, _ := testBackupRepos(t, "app")
+	dir := BackupDirectory{Path: t.TempDir()}
+
+	// One left by a backup long ago
+	old := "app/" + time.Now().Add(-90*24*time.Hour).UTC().Format(backupTimeFormat) + ".bundle"
+	assert.NoError(t, dir.Upload(context.Background(), old, strings.NewReader("")))
+
+	policy := BackupPolicy{Uploader: dir, Full: true, Keep: 2, MaxAge: 30 * 24 * time.Hour}
+
+	for i := 0; i < 3; i++ {
+		results, err := s.Backup(context.Background(), policy)
+		if assert.NoError(t, err) && assert.Len(t, results, 1) {
+			assert.NoError(t, results[0].Err)
+		}
+	}
+
+	names, err := dir.List(context.Background(), "app/")
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+	assert.NotContains(t, names, old)
+}
+
+func TestSSH_Backup_Tar(t *testing.T) {
+	s, _ := testBackupRepos(t, "app")
+	dir := BackupDirectory{Path: t.TempDir()}
+
+	results, err := s.Backup(context.Background(), BackupPolicy{Uploader: dir, Format: BackupTar})
+	if !assert.NoError(t, err) || !assert.Len(t, results, 1) || !assert.NoError(t, results[0].Err) {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(dir.Path, results[0].Name))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	files := map[string]bool{}
+	inObjects := false
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		files[hdr.Name] = true
+
+		// Objects come last, after the refs which name them
+		isObject := strings.HasPrefix(hdr.Name, "objects/")
+		assert.False(t, inObjects && !isObject, "%s archived after objects", hdr.Name)
+		inObjects = inObjects || isObject
+	}
+
+	for _, name := range []string{"HEAD", "config", "refs/", "refs/heads/main", "objects/"} {
+		assert.True(t, files[name], name)
+	}
+}
+
+func TestSSH_Backup_Errors(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+
+	_, err := s.Backup(context.Background(), BackupPolicy{})
+	assert.Error(t, err)
+
+	_, err = s.Backup(context.Background(), BackupPolicy{Uploader: BackupDirectory{Path: t.TempDir()}, Format: "zip"})
+	assert.Error(t, err)
+
+	err = BackupDirectory{Path: t.TempDir()}.Upload(context.Background(), "../escape", strings.NewReader(""))
+	assert.True(t, errors.Is(err, ErrPathTraversal))
+}
+
+func TestSSH_RunBackups(t *testing.T) {
+	s, _ := testBackupRepos(t, "app")
+	dir := BackupDirectory{Path: t.TempDir()}
+	events := s.Subscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- s.RunBackups(ctx, BackupPolicy{Uploader: dir, Interval: 10 * time.Millisecond, Full: true})
+	}()
+
+	for completed := 0; completed < 2; {
+		select {
+		case e := <-events:
+			if e.Type == EventBackupCompleted {
+				completed++
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("backups did not run")
+		}
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,152 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthLimits caps the rate, in bytes per second, at which data moves
+// between a connection and git. Download limits what clients receive, as
+// when cloning or fetching, and Upload what they send, as when pushing.
+// Zero means unlimited.
+type BandwidthLimits struct {
+	Upload   int64
+	Download int64
+}
+
+type bandwidthContextKey struct{}
+
+// connBandwidth holds the limiters shared by every channel on a connection
+type connBandwidth struct {
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+// withBandwidth attaches the connection's limiters to ctx, using
+// BandwidthFunc for the key when set and Config.Bandwidth otherwise
+func (s SSH) withBandwidth(ctx context.Context, pk PublicKey) context.Context {
+	limits := s.config.Bandwidth
+	if s.BandwidthFunc != nil {
+		limits = s.BandwidthFunc(ctx, pk)
+	}
+
+	return context.WithValue(ctx, bandwidthContextKey{}, &connBandwidth{
+		upload:   newRateLimiter(limits.Upload),
+		download: newRateLimiter(limits.Download),
+	})
+}
+
+// throttleReader limits reads from a client to the connection's upload rate
+func throttleReader(ctx context.Context, r io.Reader) io.Reader {
+	bw, ok := ctx.Value(bandwidthContextKey{}).(*connBandwidth)
+	if !ok || bw.upload == nil {
+		return r
+	}
+
+	return &throttledReader{r: r, l: bw.upload}
+}
+
+// throttleWriter limits writes to a client to the connection's download rate
+func throttleWriter(ctx context.Context, w io.Writer) io.Writer {
+	bw, ok := ctx.Value(bandwidthContextKey{}).(*connBandwidth)
+	if !ok || bw.download == nil {
+		return w
+	}
+
+	return &throttledWriter{w: w, l: bw.download}
+}
+
+// rateLimiter is a token bucket holding up to a second of tokens
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate bytes per second, or nil
+// when rate is not positive
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// chunk returns the most that may be passed to wait at once
+func (l *rateLimiter) chunk(n int) int {
+	if int64(n) > l.rate {
+		return int(l.rate)
+	}
+
+	return n
+}
+
+// wait blocks until n bytes may be sent
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// The bucket fills within a second, so longer gaps need not be counted
+	elapsed := now.Sub(l.last)
+	if elapsed > time.Second {
+		elapsed = time.Second
+	}
+
+	l.tokens += int64(elapsed) * l.rate / int64(time.Second)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= int64(n)
+	if l.tokens < 0 {
+		// Holding the lock while sleeping queues other channels on the
+		// connection behind this one
+		time.Sleep(time.Duration(-l.tokens * int64(time.Second) / l.rate))
+
+		l.tokens = 0
+		l.last = time.Now()
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p[:t.l.chunk(len(p))])
+	if n > 0 {
+		t.l.wait(n)
+	}
+
+	return n, err
+}
+
+type throttledWriter struct {
+	w io.Writer
+	l *rateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		n := t.l.chunk(len(p))
+		t.l.wait(n)
+
+		n, err = t.w.Write(p[:n])
+		written += n
+		p = p[n:]
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
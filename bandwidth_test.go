@@ -0,0 +1,66 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottleWriter(t *testing.T) {
+	ctx := NewSSH(Config{Bandwidth: BandwidthLimits{Download: 1000}}).withBandwidth(context.Background(), PublicKey{})
+
+	buf := new(bytes.Buffer)
+	w := throttleWriter(ctx, buf)
+
+	start := time.Now()
+
+	// The first second's worth goes at once, the rest at the limit
+	n, err := w.Write(make([]byte, 1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1500 || buf.Len() != 1500 {
+		t.Errorf("expected 1500 bytes written, received %d (%d buffered)", n, buf.Len())
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected writes to be throttled, took %s", elapsed)
+	}
+}
+
+func TestThrottleReader(t *testing.T) {
+	s := NewSSH(Config{})
+	s.BandwidthFunc = func(_ context.Context, pk PublicKey) BandwidthLimits {
+		if pk.Id == "slow" {
+			return BandwidthLimits{Upload: 1000}
+		}
+
+		return BandwidthLimits{}
+	}
+
+	ctx := s.withBandwidth(context.Background(), PublicKey{Id: "slow"})
+
+	start := time.Now()
+
+	data, err := io.ReadAll(throttleReader(ctx, bytes.NewReader(make([]byte, 1500))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 1500 {
+		t.Errorf("expected 1500 bytes, received %d", len(data))
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected reads to be throttled, took %s", elapsed)
+	}
+
+	// Other keys are not limited
+	r := bytes.NewReader(nil)
+	if throttleReader(s.withBandwidth(context.Background(), PublicKey{Id: "fast"}), r) != io.Reader(r) {
+		t.Error("expected unthrottled reader")
+	}
+}
@@ -0,0 +1,176 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ExportBundle writes every ref of the repository name, along with HEAD and
+// the objects they need, to w as a git bundle, such as for a backup or to
+// move the repository to another server with ImportBundle
+func (m *RepoManager) ExportBundle(ctx context.Context, name string, w io.Writer) error {
+	s := m.s.current()
+
+	loc, err := s.bundleLocation(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if !repoExists(loc.Path) {
+		return fmt.Errorf("bundle: %w: %s", ErrRepoNotFound, name)
+	}
+
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.CommandContext(ctx, s.config.GitPath, "-C", loc.Path, "bundle", "create", "--quiet", "-", "--all")
+	cmd.Stdout, cmd.Stderr = w, stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("bundle: exporting %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// ImportBundle creates the repository name from a bundle read from r, as
+// written by ExportBundle or git bundle create. Every ref in the bundle is
+// kept. Bundles record HEAD's commit rather than its branch, so HEAD points
+// at a branch at that commit, the default branch if it is one.
+func (m *RepoManager) ImportBundle(ctx context.Context, name string, r io.Reader) (err error) {
+	s := m.s.current()
+
+	loc, err := s.bundleLocation(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(loc.Path); err == nil {
+		return fmt.Errorf("bundle: %w: %s", ErrRepoExists, name)
+	}
+
+	// git reads bundles from files, which it may seek within
+	f, err := os.CreateTemp(s.config.TmpDir, "gitkit-*.bundle")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("bundle: reading %s: %w", name, err)
+	}
+
+	git := func(args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, s.config.GitPath, append([]string{"-C", loc.Path}, args...)...).Output()
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(ee.Stderr)))
+		}
+
+		return string(out), err
+	}
+
+	if err := initRepoFromTemplate(loc.Path, s.config, nil); err != nil {
+		return fmt.Errorf("bundle: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(loc.Path)
+		}
+	}()
+
+	// Held until imported, so that pushes to the new repository are refused
+	// until it is whole
+	release, err := lockForMaintenance(loc.Path)
+	if err != nil {
+		return fmt.Errorf("bundle: %w", err)
+	}
+	defer release()
+
+	if _, err = git("fetch", "--quiet", f.Name(), "+refs/*:refs/*"); err != nil {
+		return fmt.Errorf("bundle: importing %s: %w", name, err)
+	}
+
+	heads, err := git("bundle", "list-heads", f.Name())
+	if err != nil {
+		return fmt.Errorf("bundle: importing %s: %w", name, err)
+	}
+
+	current, _ := git("symbolic-ref", "HEAD")
+
+	if head := bundleHead(heads, strings.TrimSpace(current)); head != "" {
+		if _, err = git("symbolic-ref", "HEAD", head); err != nil {
+			return fmt.Errorf("bundle: importing %s: %w", name, err)
+		}
+	}
+
+	s.emit(ctx, Event{Type: EventRepoCreated, Repo: name, Data: map[string]string{"source": "bundle"}})
+
+	return nil
+}
+
+// bundleLocation resolves name for a bundle, which are only read and
+// written for repositories on disk
+func (s *SSH) bundleLocation(ctx context.Context, name string) (repoLocation, error) {
+	if s.config.InMemory {
+		return repoLocation{}, fmt.Errorf("bundle: %w in memory", ErrOperationDisabled)
+	}
+
+	if err := validateRepoPath(name); err != nil {
+		return repoLocation{}, err
+	}
+
+	return s.resolveRepo(ctx, name)
+}
+
+// bundleHead returns the branch HEAD pointed at, going by the heads git
+// bundle list-heads gives: the branch at the same commit as HEAD, preferring
+// current. Bundles without a HEAD, or whose HEAD was detached, give none.
+func bundleHead(heads, current string) string {
+	var (
+		head     string
+		branches []string
+		commits  = map[string]string{}
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(heads))
+	for scanner.Scan() {
+		commit, ref, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		if ref == "HEAD" {
+			head = commit
+		} else if strings.HasPrefix(ref, "refs/heads/") {
+			branches = append(branches, ref)
+			commits[ref] = commit
+		}
+	}
+
+	if head == "" {
+		return ""
+	}
+
+	if commits[current] == head {
+		return current
+	}
+
+	for _, branch := range branches {
+		if commits[branch] == head {
+			return branch
+		}
+	}
+
+	return ""
+}
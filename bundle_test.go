@@ -0,0 +1,85 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoManager_Bundle(t *testing.T) {
+	src := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testWorkTree(t, src)
+	for _, args := range [][]string{
+		{"push", testRemote(src, "team/app.git"), "main:refs/heads/develop"},
+		{"commit", "-q", "--allow-empty", "-m", "second"},
+		{"tag", "v1"},
+		{"push", testRemote(src, "team/app.git"), "main", "v1"},
+	} {
+		if out, err := testGit(t, src, work, args...); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	// The bare repository's HEAD is master until pointed at main
+	if out, err := testGit(t, src, filepath.Join(src.config.Dir, "team", "app"), "symbolic-ref", "HEAD", "refs/heads/main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	bundle := new(bytes.Buffer)
+	if !assert.NoError(t, src.Repos().ExportBundle(context.Background(), "team/app", bundle)) {
+		return
+	}
+
+	dst := startTestSSH(t, Config{}, nil)
+	events := dst.Subscribe()
+
+	if !assert.NoError(t, dst.Repos().ImportBundle(context.Background(), "moved/app", bundle)) {
+		return
+	}
+
+	stat, err := dst.Repos().Stat(context.Background(), "moved/app")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "main", stat.DefaultBranch)
+		assert.Equal(t, 3, stat.Refs)
+	}
+
+	out, err := testGit(t, dst, t.TempDir(), "clone", "-q", testRemote(dst, "moved/app.git"), "clone")
+	assert.NoError(t, err, out)
+
+	e := <-events
+	assert.Equal(t, EventRepoCreated, e.Type)
+	assert.Equal(t, "moved/app", e.Repo)
+
+	err = dst.Repos().ImportBundle(context.Background(), "moved/app", new(bytes.Buffer))
+	assert.True(t, errors.Is(err, ErrRepoExists))
+}
+
+func TestRepoManager_Bundle_Errors(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+	repos := s.Repos()
+
+	err := repos.ExportBundle(context.Background(), "missing", new(bytes.Buffer))
+	assert.True(t, errors.Is(err, ErrRepoNotFound))
+
+	err = repos.ExportBundle(context.Background(), "../escape", new(bytes.Buffer))
+	assert.True(t, errors.Is(err, ErrInvalidRepoName))
+
+	// Repositories are not left behind by bundles which fail to import
+	assert.Error(t, repos.ImportBundle(context.Background(), "broken", strings.NewReader("not a bundle")))
+	assert.False(t, fileExists(filepath.Join(s.config.Dir, "broken")))
+}
+
+func Test_bundleHead(t *testing.T) {
+	heads := "aaa refs/heads/develop\naaa refs/heads/main\nbbb refs/heads/topic\naaa refs/tags/v1\naaa HEAD\n"
+
+	assert.Equal(t, "refs/heads/main", bundleHead(heads, "refs/heads/main"))
+	assert.Equal(t, "refs/heads/develop", bundleHead(heads, "refs/heads/master"))
+	assert.Equal(t, "", bundleHead("aaa refs/heads/main\n", "refs/heads/main"))
+	assert.Equal(t, "", bundleHead("aaa refs/heads/main\nccc HEAD\n", "refs/heads/main"))
+}
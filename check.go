@@ -0,0 +1,235 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types emitted as repositories are checked
+const (
+	EventCheckCompleted = "check.completed"
+	EventCheckCorrupt   = "check.corrupt"
+	EventCheckFailed    = "check.failed"
+)
+
+// ErrRepoCorrupt is returned by the fsck admin command for repositories
+// Check finds corrupt
+var ErrRepoCorrupt = errors.New("repository is corrupt")
+
+// Kinds of FsckProblem
+const (
+	FsckMissing    = "missing"     // An object is referenced, but not in the repository
+	FsckBrokenLink = "broken-link" // An object links to one which is missing
+	FsckError      = "error"       // An object, or the repository, is malformed
+	FsckWarning    = "warning"     // Something is amiss, though the repository is usable
+)
+
+// FsckProblem is an issue git fsck reported
+type FsckProblem struct {
+	Kind       string // One of the Fsck constants
+	ObjectType string // Such as blob, tree or commit; empty when git named no object
+	Object     string
+	Message    string
+}
+
+func (p FsckProblem) String() string {
+	s := p.Kind
+	if p.Object != "" {
+		s += " " + p.ObjectType + " " + p.Object
+	}
+
+	if p.Message != "" {
+		s += ": " + p.Message
+	}
+
+	return s
+}
+
+// CheckResult is what Check found in a repository
+type CheckResult struct {
+	Repo     string
+	Problems []FsckProblem
+	Corrupt  bool // git fsck failed, for the reasons in Problems
+	Duration time.Duration
+	Err      error // Set in CheckAll's results for repositories which could not be checked
+}
+
+// Check verifies the integrity of every object in the repository name with
+// git fsck --full. Corruption is reported in the result, and by an event
+// of type check.corrupt; the error is for when fsck could not be run.
+func (m *RepoManager) Check(ctx context.Context, name string) (CheckResult, error) {
+	s := m.s.current()
+
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return CheckResult{Repo: name}, err
+	}
+
+	// Held so that GC cannot change objects as they are read
+	if !s.maintenance.acquire(path) {
+		return CheckResult{Repo: name}, ErrMaintenanceRunning
+	}
+	defer s.maintenance.release(path)
+
+	// As is the lock file, against maintenance by other servers, unless
+	// this one has taken it already with Lock
+	if !s.locks.holds(path) {
+		release, err := lockForWrite(path)
+		if err != nil {
+			return CheckResult{Repo: name}, fmt.Errorf("check: %w", err)
+		}
+		defer release()
+	}
+
+	start := time.Now()
+
+	cmd := exec.CommandContext(ctx, s.config.GitPath, "-C", path, "fsck", "--full", "--no-dangling", "--no-progress")
+	cmd.Env = append(os.Environ(), s.config.tmpEnv()...)
+
+	out, err := cmd.CombinedOutput()
+
+	result := CheckResult{
+		Repo:     name,
+		Problems: parseFsck(out),
+		Duration: time.Since(start),
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		result.Corrupt = true
+
+		if len(result.Problems) == 0 {
+			result.Problems = []FsckProblem{{Kind: FsckError, Message: exitErr.Error()}}
+		}
+
+	case err != nil:
+		s.emit(ctx, Event{Type: EventCheckFailed, Repo: name, Data: map[string]string{"error": err.Error()}})
+
+		return result, fmt.Errorf("check: git fsck: %w", err)
+	}
+
+	data := map[string]string{
+		"duration": result.Duration.String(),
+		"problems": strconv.Itoa(len(result.Problems)),
+	}
+
+	if result.Corrupt {
+		data["first"] = result.Problems[0].String()
+		s.emit(ctx, Event{Type: EventCheckCorrupt, Repo: name, Data: data})
+	} else {
+		s.emit(ctx, Event{Type: EventCheckCompleted, Repo: name, Data: data})
+	}
+
+	return result, nil
+}
+
+// CheckAll runs Check against every repository. Repositories which could
+// not be checked have the reason in their result's Err, rather than
+// stopping the others being checked.
+func (m *RepoManager) CheckAll(ctx context.Context) ([]CheckResult, error) {
+	s := m.s.current()
+
+	if s.config.InMemory {
+		return nil, fmt.Errorf("check: %w in memory", ErrOperationDisabled)
+	}
+
+	repos, err := s.listAllRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []CheckResult{}
+	for _, repo := range repos {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		result, err := m.Check(ctx, repo)
+		result.Err = err
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// RunChecks calls CheckAll every interval until ctx is cancelled, logging
+// corrupt repositories and those which could not be checked
+func (m *RepoManager) RunChecks(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := m.CheckAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		for _, result := range results {
+			switch {
+			case result.Err != nil:
+				log.Printf("check: %s: %v", result.Repo, result.Err)
+
+			case result.Corrupt:
+				log.Printf("check: %s: %s", result.Repo, result.Problems[0])
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseFsck reads the problems from git fsck's output, ignoring progress
+// and notices
+func parseFsck(out []byte) []FsckProblem {
+	problems := []FsckProblem{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+
+		switch {
+		// missing blob 7898192...
+		case len(fields) == 3 && fields[0] == "missing":
+			problems = append(problems, FsckProblem{Kind: FsckMissing, ObjectType: fields[1], Object: fields[2]})
+
+		// broken link from    tree 3683f87...
+		//               to    blob 7898192...
+		case len(fields) == 5 && fields[0] == "broken" && fields[1] == "link" && fields[2] == "from":
+			problems = append(problems, FsckProblem{Kind: FsckBrokenLink, ObjectType: fields[3], Object: fields[4]})
+
+		case len(fields) == 3 && fields[0] == "to" && len(problems) > 0 && problems[len(problems)-1].Kind == FsckBrokenLink:
+			problems[len(problems)-1].Message = "links to missing " + fields[1] + " " + fields[2]
+
+		// error in tree 3683f87...: badFilemode: contains bad file modes
+		case len(fields) >= 4 && fields[1] == "in" && (fields[0] == FsckError || fields[0] == FsckWarning):
+			object, msg, _ := strings.Cut(strings.Join(fields[3:], " "), ": ")
+			problems = append(problems, FsckProblem{Kind: fields[0], ObjectType: fields[2], Object: strings.TrimSuffix(object, ":"), Message: msg})
+
+		default:
+			for prefix, kind := range map[string]string{"error: ": FsckError, "fatal: ": FsckError, "warning: ": FsckWarning} {
+				if msg, ok := strings.CutPrefix(line, prefix); ok {
+					problems = append(problems, FsckProblem{Kind: kind, Message: msg})
+				}
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,98 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseFsck(t *testing.T) {
+	out := `Checking object directories
+missing blob 78981922613b2afb6025042ff6bd878ac1994e85
+broken link from    tree 3683f870be446c7cc05ffaef9fa06415276e1828
+              to    blob 78981922613b2afb6025042ff6bd878ac1994e85
+error in tree 3683f870be446c7cc05ffaef9fa06415276e1828: badFilemode: contains bad file modes
+warning in commit 1f0b4d6c1a7b8f3f6b1e2f6e3b7c8d9e0a1b2c3d: missingTaggerEntry: invalid format
+error: inflate: data stream error (incorrect header check)
+notice: HEAD points to an unborn branch (main)
+fatal: loose object 3683f870be446c7cc05ffaef9fa06415276e1828 is corrupt
+`
+
+	assert.Equal(t, []FsckProblem{
+		{Kind: FsckMissing, ObjectType: "blob", Object: "78981922613b2afb6025042ff6bd878ac1994e85"},
+		{Kind: FsckBrokenLink, ObjectType: "tree", Object: "3683f870be446c7cc05ffaef9fa06415276e1828", Message: "links to missing blob 78981922613b2afb6025042ff6bd878ac1994e85"},
+		{Kind: FsckError, ObjectType: "tree", Object: "3683f870be446c7cc05ffaef9fa06415276e1828", Message: "badFilemode: contains bad file modes"},
+		{Kind: FsckWarning, ObjectType: "commit", Object: "1f0b4d6c1a7b8f3f6b1e2f6e3b7c8d9e0a1b2c3d", Message: "missingTaggerEntry: invalid format"},
+		{Kind: FsckError, Message: "inflate: data stream error (incorrect header check)"},
+		{Kind: FsckError, Message: "loose object 3683f870be446c7cc05ffaef9fa06415276e1828 is corrupt"},
+	}, parseFsck([]byte(out)))
+
+	assert.Empty(t, parseFsck(nil))
+}
+
+func TestRepoManager_Check(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthoriseAdminFunc = func(context.Context, []string) error { return nil }
+	})
+
+	work := testWorkTree(t, s)
+	require.NoError(t, os.WriteFile(filepath.Join(work, "file"), []byte("content\n"), 0644))
+
+	for _, args := range [][]string{
+		{"add", "file"},
+		{"commit", "-q", "-m", "file"},
+		{"push", testRemote(s, "test.git"), "main"},
+	} {
+		out, err := testGit(t, s, work, args...)
+		require.NoError(t, err, out)
+	}
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	ctx := context.Background()
+	repos := s.Repos()
+
+	result, err := repos.Check(ctx, "test")
+	require.NoError(t, err)
+	assert.False(t, result.Corrupt)
+	assert.Empty(t, result.Problems)
+
+	completed := testEvents(t, events, EventCheckCompleted)
+	assert.Equal(t, "test", completed[len(completed)-1].Repo)
+
+	_, err = repos.Check(ctx, "missing")
+	assert.ErrorIs(t, err, ErrRepoNotFound)
+
+	// Pushes this small are unpacked, so the blob is a loose object
+	repo := filepath.Join(s.config.Dir, "test")
+
+	blob, err := exec.Command("git", "--git-dir", repo, "rev-parse", "main:file").Output()
+	require.NoError(t, err)
+
+	id := strings.TrimSpace(string(blob))
+	require.NoError(t, os.Remove(filepath.Join(repo, "objects", id[:2], id[2:])))
+
+	result, err = repos.Check(ctx, "test")
+	require.NoError(t, err)
+	assert.True(t, result.Corrupt)
+	assert.Contains(t, result.Problems, FsckProblem{Kind: FsckMissing, ObjectType: "blob", Object: id})
+
+	corrupt := testEvents(t, events, EventCheckCorrupt)
+	assert.Equal(t, "test", corrupt[len(corrupt)-1].Repo)
+
+	results, err := repos.CheckAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.True(t, results[0].Corrupt)
+
+	out, err := testSSHRun(t, s, "gitkit fsck test.git")
+	assert.Error(t, err)
+	assert.Contains(t, out, "missing blob "+id)
+}
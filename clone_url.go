@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ExternalURLs describes how clients reach the server, which may differ
+// from the addresses it listens on when behind a proxy or load balancer.
+// Zero ports mean the protocol's default.
+type ExternalURLs struct {
+	SSHHost   string
+	SSHPort   int
+	HTTPSHost string
+	HTTPSPort int
+	HTTPSPath string // Prefix under which the smart HTTP server is mounted, such as /git
+}
+
+// CloneURLs holds the addresses clients may clone a repository from. Each
+// is empty when the configuration does not allow it to be formed; SCP is
+// empty whenever SSH uses a non-standard port, which scp style addresses
+// cannot express.
+type CloneURLs struct {
+	SSH   string `json:"ssh,omitempty"`   // ssh://git@example.com:2222/repo.git
+	SCP   string `json:"scp,omitempty"`   // git@example.com:repo.git
+	HTTPS string `json:"https,omitempty"` // https://example.com/git/repo.git
+}
+
+// CloneURLs returns the addresses repo may be cloned from, according to
+// Config.ExternalURLs
+func (c *Config) CloneURLs(repo string) CloneURLs {
+	ext := c.ExternalURLs
+	urls := CloneURLs{}
+
+	repo = strings.TrimPrefix(repo, "/")
+	if !strings.HasSuffix(repo, ".git") {
+		repo += ".git"
+	}
+
+	user := defaultValue("git", c.GitUser)
+
+	if ext.SSHHost != "" {
+		host := hostPort(ext.SSHHost, ext.SSHPort, 22)
+		urls.SSH = "ssh://" + user + "@" + host + "/" + repo
+
+		if ext.SSHPort == 0 || ext.SSHPort == 22 {
+			urls.SCP = user + "@" + host + ":" + repo
+		}
+	}
+
+	if ext.HTTPSHost != "" {
+		prefix := strings.Trim(ext.HTTPSPath, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+
+		urls.HTTPS = "https://" + hostPort(ext.HTTPSHost, ext.HTTPSPort, 443) + "/" + prefix + repo
+	}
+
+	return urls
+}
+
+// hostPort formats host for use in a URL, bracketing IPv6 addresses and
+// leaving out default ports
+func hostPort(host string, port, defaultPort int) string {
+	if port == 0 || port == defaultPort {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+
+		return host
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// CloneURLs returns the addresses repo may be cloned from
+func (s *SSH) CloneURLs(repo string) CloneURLs {
+	return s.config.CloneURLs(repo)
+}
+
+// CloneURLs returns the addresses repo may be cloned from
+func (s *Server) CloneURLs(repo string) CloneURLs {
+	return s.config.CloneURLs(repo)
+}
@@ -0,0 +1,36 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_CloneURLs(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config Config
+		repo   string
+		expect CloneURLs
+	}{
+		{"Nothing configured", Config{}, "repo", CloneURLs{}},
+		{"Default ports", Config{ExternalURLs: ExternalURLs{SSHHost: "example.com", HTTPSHost: "example.com"}}, "team/repo", CloneURLs{
+			SSH:   "ssh://git@example.com/team/repo.git",
+			SCP:   "git@example.com:team/repo.git",
+			HTTPS: "https://example.com/team/repo.git",
+		}},
+		{"Custom ports and path", Config{GitUser: "code", ExternalURLs: ExternalURLs{SSHHost: "example.com", SSHPort: 2222, HTTPSHost: "example.com", HTTPSPort: 8443, HTTPSPath: "/git/"}}, "/repo.git", CloneURLs{
+			SSH:   "ssh://code@example.com:2222/repo.git",
+			HTTPS: "https://example.com:8443/git/repo.git",
+		}},
+		{"IPv6", Config{ExternalURLs: ExternalURLs{SSHHost: "::1", HTTPSHost: "::1", HTTPSPort: 8443}}, "repo", CloneURLs{
+			SSH:   "ssh://git@[::1]/repo.git",
+			SCP:   "git@[::1]:repo.git",
+			HTTPS: "https://[::1]:8443/repo.git",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, test.config.CloneURLs(test.repo))
+		})
+	}
+}
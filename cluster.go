@@ -0,0 +1,230 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNodeUnavailable is returned when the cluster node owning a
+// repository cannot be reached
+var ErrNodeUnavailable = errors.New("cluster node unavailable")
+
+// clusterClientRequest is sent by a node proxying a command, ahead of the
+// command, to say which client it acts for
+const clusterClientRequest = "gitkit-cluster-client@gitkit"
+
+// clusterNode is set in the ssh.Permissions of connections from other
+// nodes in the cluster
+const clusterNode = "cluster-node"
+
+// ClusterRouter maps repositories to the nodes of a cluster which hold
+// them, such as from a table every node shares
+type ClusterRouter interface {
+	// RepoNode returns the ID of the node holding repo. Repositories no
+	// node holds are reported with ErrRepoNotFound, and served, or
+	// created, by the node the client reached.
+	RepoNode(ctx context.Context, repo string) (string, error)
+
+	// NodeAddr returns the ssh address, as host:port, of the node id
+	NodeAddr(ctx context.Context, id string) (string, error)
+}
+
+// Cluster joins an SSH server to a cluster of gitkit nodes, each holding
+// its own repositories. Git commands for repositories another node holds
+// are proxied to it, so that clients may reach any node.
+type Cluster struct {
+	NodeID string // This node's ID, as ClusterRouter knows it
+	Router ClusterRouter
+
+	// Signer authenticates this node to the others
+	Signer ssh.Signer
+
+	// NodeKeys are the public keys of the other nodes. Connections with
+	// them skip PublicKeyLookupFunc, and are trusted to say which client
+	// each command they proxy is for.
+	NodeKeys []ssh.PublicKey
+
+	// HostKeyCallback checks the host keys of other nodes
+	HostKeyCallback ssh.HostKeyCallback
+
+	// DialTimeout bounds connecting to another node. Defaults to 10s.
+	DialTimeout time.Duration
+}
+
+// clusterClient is the client a proxied command is run for
+type clusterClient struct {
+	PublicKey  PublicKey
+	User       string
+	RemoteAddr string
+}
+
+func (c *Cluster) validate(config *Config, keyAuth bool) error {
+	switch {
+	case c.NodeID == "":
+		return fmt.Errorf("cluster: node ID is not set")
+
+	case c.Router == nil:
+		return fmt.Errorf("cluster: router is not set")
+
+	case c.Signer == nil:
+		return fmt.Errorf("cluster: signer is not set")
+
+	case c.HostKeyCallback == nil:
+		return fmt.Errorf("cluster: host key callback is not set")
+
+	case !config.Auth || !keyAuth:
+		return fmt.Errorf("cluster: nodes can only be told apart from clients with Config.Auth and PublicKeyLookupFunc")
+	}
+
+	return nil
+}
+
+// isNode reports whether key is one of the cluster's NodeKeys
+func (c *Cluster) isNode(key ssh.PublicKey) bool {
+	if c == nil {
+		return false
+	}
+
+	for _, k := range c.NodeKeys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodePermissions admits a connection from another node
+func nodePermissions(conn ssh.ConnMetadata, key ssh.PublicKey) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{
+		keyName:        clusterNode,
+		keyFingerprint: ssh.FingerprintSHA256(key),
+		sshUser:        conn.User(),
+		clusterNode:    "true",
+	}}
+}
+
+type clusterNodeContextKey struct{}
+
+// fromClusterNode reports whether ctx is for a connection from another
+// node in the cluster
+func fromClusterNode(ctx context.Context) bool {
+	node, _ := ctx.Value(clusterNodeContextKey{}).(bool)
+
+	return node
+}
+
+// handleClusterClient records the client a node is proxying the session's
+// command for. Only other nodes may send this.
+func (s SSH) handleClusterClient(ctx context.Context, sess *session, req *ssh.Request) error {
+	if !fromClusterNode(ctx) {
+		req.Reply(false, nil)
+
+		return fmt.Errorf("cluster: client request from a connection which is not a node")
+	}
+
+	client := new(clusterClient)
+	if err := json.Unmarshal(req.Payload, client); err != nil {
+		req.Reply(false, nil)
+
+		return fmt.Errorf("cluster: invalid client request: %w", err)
+	}
+
+	sess.client = client
+
+	return req.Reply(true, nil)
+}
+
+// clientContext returns ctx as it would be for the client a node is
+// proxying for
+func (s SSH) clientContext(ctx context.Context, client *clusterClient) context.Context {
+	ctx = context.WithValue(ctx, PublicKeyContextKey{}, client.PublicKey)
+	ctx = context.WithValue(ctx, UserContextKey{}, client.User)
+	ctx = context.WithValue(ctx, RemoteAddrContextKey{}, client.RemoteAddr)
+
+	return s.withBandwidth(ctx, client.PublicKey)
+}
+
+// proxyToOwner runs command on the node whose repository gitcmd is for,
+// when that is another node, reporting whether it did. Commands proxied
+// from other nodes are always served here.
+func (s SSH) proxyToOwner(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, command string) (bool, error) {
+	if s.Cluster == nil || fromClusterNode(ctx) {
+		return false, nil
+	}
+
+	node, err := s.Cluster.Router.RepoNode(ctx, gitcmd.Repo)
+	switch {
+	case errors.Is(err, ErrRepoNotFound) || err == nil && node == s.Cluster.NodeID:
+		return false, nil
+
+	case err != nil:
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgNodeUnavailable, gitcmd)))
+
+		return true, fmt.Errorf("cluster: %w: %w", ErrNodeUnavailable, err)
+	}
+
+	ctx, span := s.startSpan(ctx, "gitkit.cluster.proxy", commandAttributes(gitcmd)...)
+
+	err = s.Cluster.proxy(ctx, sess, ch, req, node, command)
+	endSpan(span, err)
+
+	if errors.Is(err, ErrNodeUnavailable) {
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgNodeUnavailable, gitcmd)))
+	}
+
+	return true, err
+}
+
+// proxy runs command on node for the client of ctx, passing the channel's
+// input, output and exit status between them
+func (c *Cluster) proxy(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, node, command string) error {
+	addr, err := c.Router.NodeAddr(ctx, node)
+	if err != nil {
+		return fmt.Errorf("cluster: %w: %s: %w", ErrNodeUnavailable, node, err)
+	}
+
+	client, err := dialSSH(ctx, addr, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(c.Signer)},
+		HostKeyCallback: c.HostKeyCallback,
+	}, c.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("cluster: %w: %s: %w", ErrNodeUnavailable, node, err)
+	}
+	defer client.Close()
+
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+	user, _ := ctx.Value(UserContextKey{}).(string)
+	remoteAddr, _ := ctx.Value(RemoteAddrContextKey{}).(string)
+
+	claim, err := json.Marshal(clusterClient{PublicKey: pk, User: user, RemoteAddr: remoteAddr})
+	if err != nil {
+		return fmt.Errorf("cluster: %w", err)
+	}
+
+	err = runRemote(ctx, client, sess, ch, req, command, func(remote *ssh.Session) error {
+		if ok, err := remote.SendRequest(clusterClientRequest, true, claim); err != nil || !ok {
+			return fmt.Errorf("%s did not accept this node", node)
+		}
+
+		return nil
+	})
+
+	var unavailable remoteUnavailable
+	if errors.As(err, &unavailable) {
+		return fmt.Errorf("cluster: %w: %s: %w", ErrNodeUnavailable, node, unavailable.err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("cluster: %s: %w", node, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type testRouter struct {
+	mu    sync.Mutex
+	repos map[string]string
+	addrs map[string]string
+}
+
+func (r *testRouter) RepoNode(_ context.Context, repo string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node, ok := r.repos[repo]
+	if !ok {
+		return "", ErrRepoNotFound
+	}
+
+	return node, nil
+}
+
+func (r *testRouter) NodeAddr(_ context.Context, id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	addr, ok := r.addrs[id]
+	if !ok {
+		return "", errors.New("unknown node " + id)
+	}
+
+	return addr, nil
+}
+
+// testKeyFile writes the private key of a new client key to a file, for
+// the system ssh client, returning both
+func testKeyFile(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	return path, signer.PublicKey()
+}
+
+// testKeyGit runs git as testGit does, authenticating with the key in
+// keyFile
+func testKeyGit(t *testing.T, s *SSH, keyFile, dir string, args ...string) (string, error) {
+	t.Helper()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR -o IdentitiesOnly=yes -o IdentityAgent=none -i "+keyFile+" -p "+port,
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	return string(out), err
+}
+
+func TestSSH_Cluster(t *testing.T) {
+	keyFile, clientKey := testKeyFile(t)
+	signerA, signerB := testClientSigner(t), testClientSigner(t)
+
+	router := &testRouter{
+		repos: map[string]string{"test": "b", "gone": "c"},
+		addrs: map[string]string{},
+	}
+
+	var (
+		mu      sync.Mutex
+		clients []string
+	)
+
+	node := func(id string, signer ssh.Signer) *SSH {
+		return startTestSSH(t, Config{Auth: true, AutoCreate: true}, func(s *SSH) {
+			s.PublicKeyLookupFunc = func(_ context.Context, key PublicKeyLookup) (*PublicKey, error) {
+				if key.Fingerprint != ssh.FingerprintSHA256(clientKey) {
+					return nil, errors.New("unknown key")
+				}
+
+				return &PublicKey{Id: "1", Name: "alice"}, nil
+			}
+
+			s.AuthoriseOperationFunc = func(ctx context.Context, cmd *GitCommand) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				clients = append(clients, id+":"+ctx.Value(PublicKeyContextKey{}).(PublicKey).Name)
+
+				return nil
+			}
+
+			s.Cluster = &Cluster{
+				NodeID:          id,
+				Router:          router,
+				Signer:          signer,
+				NodeKeys:        []ssh.PublicKey{signerA.PublicKey(), signerB.PublicKey()},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}
+		})
+	}
+
+	a, b := node("a", signerA), node("b", signerB)
+
+	router.mu.Lock()
+	router.addrs["a"], router.addrs["b"] = a.Address(), b.Address()
+	router.mu.Unlock()
+
+	takeClients := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		taken := clients
+		clients = nil
+
+		return taken
+	}
+
+	work := testWorkTree(t, a)
+
+	// Pushed through a, but kept on b, which authorises it for alice
+	out, err := testKeyGit(t, a, keyFile, work, "push", testRemote(a, "test.git"), "main")
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{"b:alice"}, takeClients())
+
+	assert.DirExists(t, filepath.Join(b.config.Dir, "test"))
+	assert.NoDirExists(t, filepath.Join(a.config.Dir, "test"))
+
+	out, err = testKeyGit(t, a, keyFile, t.TempDir(), "clone", testRemote(a, "test.git"), "clone")
+	assert.NoError(t, err, out)
+	assert.Equal(t, []string{"b:alice"}, takeClients())
+
+	// Repositories no node holds are served where clients land
+	out, err = testKeyGit(t, a, keyFile, work, "push", testRemote(a, "local.git"), "main")
+	require.NoError(t, err, out)
+	assert.DirExists(t, filepath.Join(a.config.Dir, "local"))
+	assert.Equal(t, []string{"a:alice"}, takeClients())
+
+	out, err = testKeyGit(t, a, keyFile, t.TempDir(), "clone", testRemote(a, "gone.git"), "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "gone is unavailable at the moment")
+}
+
+func TestSSH_Cluster_Impersonation(t *testing.T) {
+	signer := testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "1", Name: "mallory"},
+	}, func(s *SSH) {
+		s.Cluster = &Cluster{
+			NodeID:          "a",
+			Router:          &testRouter{},
+			Signer:          testClientSigner(t),
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+	})
+
+	client, err := testKeyDial(s, signer)
+	require.NoError(t, err)
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	require.NoError(t, err)
+	defer sess.Close()
+
+	ok, err := sess.SendRequest(clusterClientRequest, true, []byte(`{"PublicKey":{"Id":"2","Name":"admin"}}`))
+	require.NoError(t, err)
+	assert.False(t, ok, "only nodes may say who they act for")
+
+	out, err := sess.CombinedOutput("whoami")
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(out))
+}
+
+func TestCluster_validate(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+	s.Cluster = &Cluster{NodeID: "a", Router: &testRouter{}, Signer: testClientSigner(t), HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	assert.ErrorContains(t, s.Listen("127.0.0.1:0"), "cluster: nodes can only be told apart from clients")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jspc/gitkit"
+	"github.com/jspc/gitkit/sqlkeys"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is gitkitd's configuration file
+type Config struct {
+	Dir        string `yaml:"dir"`         // Directory holding repositories
+	GitPath    string `yaml:"git_path"`    // Path to git. Defaults to git on PATH.
+	AutoCreate bool   `yaml:"auto_create"` // Create repositories as they are first pushed to
+	TmpDir     string `yaml:"tmp_dir"`     // Directory for git's temporary files. Defaults to the system's.
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // How long connections have to finish on SIGTERM
+
+	SSH   SSHConfig   `yaml:"ssh"`
+	HTTP  HTTPConfig  `yaml:"http"`
+	Users UsersConfig `yaml:"users"`
+}
+
+// SSHConfig configures the SSH server
+type SSHConfig struct {
+	Listen   []string `yaml:"listen"`    // Addresses, or unix:<path> sockets, to listen on. Defaults to :2222.
+	KeyDir   string   `yaml:"key_dir"`   // Directory host keys are generated in, when HostKeys is empty
+	HostKeys []string `yaml:"host_keys"` // Paths to PEM encoded host private keys
+}
+
+// HTTPConfig configures the smart HTTP server, which is only started when
+// Listen is set
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+
+	// AnonymousRead serves fetches to clients without credentials. Without
+	// a users database, the HTTP server can authenticate no one, so it must
+	// be set and pushes are refused.
+	AnonymousRead bool `yaml:"anonymous_read"`
+}
+
+// UsersConfig says where clients' keys and permissions come from. At most
+// one may be set; with none, every client is let in.
+type UsersConfig struct {
+	AuthorizedKeys string          `yaml:"authorized_keys"` // An OpenSSH authorized_keys file
+	Gitolite       *GitoliteConfig `yaml:"gitolite"`
+	Database       *DatabaseConfig `yaml:"database"`
+}
+
+// GitoliteConfig names a gitolite configuration and key directory
+type GitoliteConfig struct {
+	Conf   string `yaml:"conf"`
+	KeyDir string `yaml:"key_dir"`
+}
+
+// DatabaseConfig names a database/sql database holding users, keys and
+// permissions in the sqlkeys schema
+type DatabaseConfig struct {
+	Driver string `yaml:"driver"` // Defaults to sqlite
+	DSN    string `yaml:"dsn"`
+}
+
+// dialect returns the SQL dialect Driver speaks
+func (c DatabaseConfig) dialect() sqlkeys.Dialect {
+	switch c.Driver {
+	case "postgres", "pgx":
+		return sqlkeys.Postgres
+	}
+
+	return sqlkeys.SQLite
+}
+
+// loadConfig reads the configuration file at path. JSON is accepted too,
+// being YAML. Unknown keys are refused, so that misspelt options are not
+// silently ignored.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := cfg.check(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// check validates cfg, filling in defaults
+func (c *Config) check() error {
+	if c.Dir == "" {
+		return errors.New("dir is required")
+	}
+
+	if len(c.SSH.Listen) == 0 {
+		c.SSH.Listen = []string{":2222"}
+	}
+
+	if c.SSH.KeyDir == "" && len(c.SSH.HostKeys) == 0 {
+		return errors.New("ssh.key_dir or ssh.host_keys is required")
+	}
+
+	backends := []string{}
+	if c.Users.AuthorizedKeys != "" {
+		backends = append(backends, "authorized_keys")
+	}
+
+	if c.Users.Gitolite != nil {
+		backends = append(backends, "gitolite")
+	}
+
+	if c.Users.Database != nil {
+		backends = append(backends, "database")
+
+		if c.Users.Database.Driver == "" {
+			c.Users.Database.Driver = "sqlite"
+		}
+
+		// No driver is linked by default, which would otherwise only show
+		// once the database is opened
+		if !slices.Contains(sql.Drivers(), c.Users.Database.Driver) {
+			return fmt.Errorf("users.database: no database/sql driver named %q is linked into gitkitd; add a blank import of one, such as modernc.org/sqlite, and rebuild", c.Users.Database.Driver)
+		}
+	}
+
+	if len(backends) > 1 {
+		return fmt.Errorf("users: only one of %s may be set", strings.Join(backends, ", "))
+	}
+
+	if c.HTTP.Listen != "" && c.Users.Database == nil && len(backends) > 0 && !c.HTTP.AnonymousRead {
+		return fmt.Errorf("http: %s cannot authenticate HTTP clients, so http.anonymous_read must be set", backends[0])
+	}
+
+	return nil
+}
+
+// auth reports whether clients must authenticate
+func (c Config) auth() bool {
+	return c.Users.AuthorizedKeys != "" || c.Users.Gitolite != nil || c.Users.Database != nil
+}
+
+// sshConfig returns the gitkit configuration the SSH server is run with
+func (c Config) sshConfig() (gitkit.Config, error) {
+	cfg := gitkit.Config{
+		Dir:             c.Dir,
+		GitPath:         c.GitPath,
+		KeyDir:          c.SSH.KeyDir,
+		AutoCreate:      c.AutoCreate,
+		TmpDir:          c.TmpDir,
+		Auth:            c.auth(),
+		ShutdownTimeout: c.ShutdownTimeout,
+	}
+
+	for _, path := range c.SSH.HostKeys {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("ssh.host_keys: %w", err)
+		}
+
+		cfg.HostKeys = append(cfg.HostKeys, key)
+	}
+
+	return cfg, nil
+}
+
+// httpConfig returns the gitkit configuration the HTTP server is run
+// with. Only a users database can authenticate HTTP clients, so otherwise
+// the server is read-only once any users backend is set.
+func (c Config) httpConfig() gitkit.Config {
+	cfg := gitkit.Config{
+		Dir:           c.Dir,
+		GitPath:       c.GitPath,
+		AutoCreate:    c.AutoCreate,
+		TmpDir:        c.TmpDir,
+		AnonymousRead: c.HTTP.AnonymousRead,
+	}
+
+	switch {
+	case c.Users.Database != nil:
+		cfg.Auth = true
+
+	case c.auth():
+		cfg.ReadOnly, cfg.AutoCreate = true, false
+	}
+
+	return cfg
+}
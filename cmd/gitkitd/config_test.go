@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gitkitd links no driver itself, so one stands in for the default
+func init() {
+	sql.Register("sqlite", testDB{})
+}
+
+func testConfigFile(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "gitkitd.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func Test_loadConfig(t *testing.T) {
+	cfg, err := loadConfig(testConfigFile(t, `
+dir: /srv/git
+shutdown_timeout: 30s
+ssh:
+  key_dir: /srv/keys
+users:
+  database:
+    dsn: users.db
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "/srv/git", cfg.Dir)
+	assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+	assert.Equal(t, []string{":2222"}, cfg.SSH.Listen)
+	assert.Equal(t, "sqlite", cfg.Users.Database.Driver)
+	assert.True(t, cfg.auth())
+}
+
+func Test_loadConfig_Invalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"no dir":          "ssh: {key_dir: /srv/keys}",
+		"no host keys":    "dir: /srv/git",
+		"two backends":    "dir: /srv/git\nssh: {key_dir: k}\nusers: {authorized_keys: a, gitolite: {conf: c}}",
+		"http auth":       "dir: /srv/git\nssh: {key_dir: k}\nhttp: {listen: ':80'}\nusers: {authorized_keys: a}",
+		"not yaml":        "dir: [",
+		"unknown key":     "dir: /srv/git\nssh: {key_dir: k}\nauto_craete: true",
+		"unlinked driver": "dir: /srv/git\nssh: {key_dir: k}\nusers: {database: {driver: mysql, dsn: x}}",
+	} {
+		_, err := loadConfig(testConfigFile(t, data))
+		assert.Error(t, err, name)
+	}
+
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestConfig_httpConfig(t *testing.T) {
+	open := Config{Dir: "/srv/git", AutoCreate: true}
+	assert.False(t, open.httpConfig().Auth)
+	assert.False(t, open.httpConfig().ReadOnly)
+	assert.True(t, open.httpConfig().AutoCreate)
+
+	keys := Config{Dir: "/srv/git", AutoCreate: true, Users: UsersConfig{AuthorizedKeys: "keys"}, HTTP: HTTPConfig{AnonymousRead: true}}
+	assert.True(t, keys.httpConfig().ReadOnly)
+	assert.False(t, keys.httpConfig().AutoCreate)
+	assert.True(t, keys.httpConfig().AnonymousRead)
+
+	sshConfig, err := keys.sshConfig()
+	assert.NoError(t, err)
+	assert.True(t, sshConfig.Auth)
+
+	db := Config{Dir: "/srv/git", Users: UsersConfig{Database: &DatabaseConfig{}}}
+	assert.True(t, db.httpConfig().Auth)
+	assert.False(t, db.httpConfig().ReadOnly)
+}
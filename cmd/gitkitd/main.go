@@ -0,0 +1,158 @@
+// Command gitkitd runs gitkit's SSH server, and optionally its smart HTTP
+// server, from a YAML configuration file, so that gitkit can be deployed
+// without writing any Go:
+//
+//	dir: /var/lib/gitkitd/repos
+//	auto_create: true
+//	shutdown_timeout: 30s
+//
+//	ssh:
+//	  listen: [":2222"]
+//	  key_dir: /var/lib/gitkitd/keys
+//
+//	http:
+//	  listen: ":8080"
+//
+//	users:
+//	  database:
+//	    driver: sqlite
+//	    dsn: /var/lib/gitkitd/users.db
+//
+// Clients are let in according to at most one users backend:
+// authorized_keys, naming an OpenSSH authorized_keys file; gitolite, naming
+// a gitolite.conf and key directory; or database, a database/sql driver and
+// DSN for a database in the sqlkeys schema, which is migrated on start.
+// Drivers named postgres or pgx are spoken to in Postgres's dialect, and
+// any other in SQLite's. No driver is linked by default, keeping gitkit free
+// of cgo and database dependencies; link one, such as modernc.org/sqlite
+// which registers itself as sqlite, by adding a blank import to a file in
+// this directory before building. Until then, database configurations are
+// refused on start.
+//
+// Only a database can authenticate HTTP clients, so with either of the
+// other backends the HTTP server is read-only and http.anonymous_read must
+// be set. Repositories are shared between both servers: SSH clients clone
+// host:project.git and HTTP clients http://host/project.
+//
+// gitkitd shuts down gracefully on SIGINT or SIGTERM. gitkitd -version
+// prints the gitkit version, commit and dependency versions it was built
+// with.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jspc/gitkit"
+)
+
+func main() {
+	configPath := flag.String("config", "/etc/gitkitd.yaml", "Path to the configuration file")
+	version := flag.Bool("version", false, "Print the gitkit build and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(gitkit.BuildInfo())
+
+		return
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves cfg until ctx is cancelled
+func run(ctx context.Context, cfg Config) error {
+	sshConfig, err := cfg.sshConfig()
+	if err != nil {
+		return err
+	}
+
+	s := gitkit.NewSSH(sshConfig)
+
+	var srv *gitkit.Server
+	if cfg.HTTP.Listen != "" {
+		srv = gitkit.New(cfg.httpConfig())
+	}
+
+	closeUsers, err := wireUsers(ctx, cfg.Users, s, srv)
+	if err != nil {
+		return err
+	}
+	defer closeUsers()
+
+	// Either server failing stops the other
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	httpErr := make(chan error, 1)
+	if srv != nil {
+		if err := srv.Setup(); err != nil {
+			return err
+		}
+
+		go func() {
+			err := serveHTTP(ctx, cfg, srv)
+			cancel()
+			httpErr <- err
+		}()
+	} else {
+		httpErr <- nil
+	}
+
+	log.Printf("gitkitd: %s serving ssh on %v", gitkit.BuildInfo(), cfg.SSH.Listen)
+
+	_, err = s.Run(ctx, cfg.SSH.Listen...)
+	cancel()
+
+	return errors.Join(err, <-httpErr)
+}
+
+// serveHTTP serves srv on cfg.HTTP.Listen until ctx is cancelled, then
+// shuts down gracefully
+func serveHTTP(ctx context.Context, cfg Config, srv *gitkit.Server) error {
+	hs := &http.Server{Addr: cfg.HTTP.Listen, Handler: srv}
+
+	served := make(chan error, 1)
+	go func() {
+		log.Printf("gitkitd: serving http on %s", cfg.HTTP.Listen)
+		served <- hs.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+
+	case <-ctx.Done():
+		timeout := cfg.ShutdownTimeout
+		if timeout == 0 {
+			timeout = gitkit.DefaultShutdownTimeout
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err := hs.Shutdown(shutdownCtx)
+		if serveErr := <-served; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+			err = serveErr
+		}
+
+		return err
+	}
+}
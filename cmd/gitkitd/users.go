@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jspc/gitkit"
+	"github.com/jspc/gitkit/authorizedkeys"
+	"github.com/jspc/gitkit/gitolite"
+	"github.com/jspc/gitkit/sqlkeys"
+)
+
+// wireUsers installs the callbacks of the users backend cfg names on the
+// servers, migrating a users database first. srv may be nil when HTTP is
+// not served. The returned func releases the backend.
+func wireUsers(ctx context.Context, cfg UsersConfig, s *gitkit.SSH, srv *gitkit.Server) (func() error, error) {
+	noop := func() error { return nil }
+
+	switch {
+	case cfg.AuthorizedKeys != "":
+		keys, err := authorizedkeys.Load(cfg.AuthorizedKeys)
+		if err != nil {
+			return noop, fmt.Errorf("users.authorized_keys: %w", err)
+		}
+
+		keys.Wire(s)
+
+	case cfg.Gitolite != nil:
+		acl, err := gitolite.Load(cfg.Gitolite.Conf, cfg.Gitolite.KeyDir)
+		if err != nil {
+			return noop, fmt.Errorf("users.gitolite: %w", err)
+		}
+
+		acl.Wire(s)
+
+		// Anonymous HTTP clients get what gitolite gives @all
+		if srv != nil {
+			srv.AuthoriseOperationFunc = acl.AuthoriseOperation
+		}
+
+	case cfg.Database != nil:
+		db, err := sql.Open(cfg.Database.Driver, cfg.Database.DSN)
+		if err != nil {
+			return noop, fmt.Errorf("users.database: %w", err)
+		}
+
+		store := sqlkeys.New(db, cfg.Database.dialect())
+		if err := store.Migrate(ctx); err != nil {
+			db.Close()
+			return noop, fmt.Errorf("users.database: %w", err)
+		}
+
+		store.Wire(s)
+
+		if srv != nil {
+			srv.BasicAuthFunc = store.BasicAuth
+			srv.AuthoriseOperationFunc = store.AuthoriseOperation
+		}
+
+		return db.Close, nil
+	}
+
+	return noop, nil
+}
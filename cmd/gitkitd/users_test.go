@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jspc/gitkit"
+	"github.com/jspc/gitkit/sqlkeys"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testDB is a database/sql driver answering the sqlkeys queries gitkitd
+// relies on from maps, keyed by the query's first argument
+type testDB struct {
+	keys      map[string]string
+	passwords map[string]string
+}
+
+func (d testDB) Open(string) (driver.Conn, error) { return testConn{d}, nil }
+
+type testConn struct{ db testDB }
+
+func (c testConn) Prepare(query string) (driver.Stmt, error) { return testStmt{c.db, query}, nil }
+func (c testConn) Close() error                              { return nil }
+func (c testConn) Begin() (driver.Tx, error)                 { return testTx{}, nil }
+
+type testTx struct{}
+
+func (testTx) Commit() error   { return nil }
+func (testTx) Rollback() error { return nil }
+
+type testStmt struct {
+	db    testDB
+	query string
+}
+
+func (s testStmt) Close() error  { return nil }
+func (s testStmt) NumInput() int { return -1 }
+
+func (s testStmt) Exec([]driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+
+func (s testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "MAX(version)"):
+		return &testRows{row: []driver.Value{int64(0)}}, nil
+
+	case strings.Contains(s.query, "FROM keys"):
+		if name, ok := s.db.keys[args[0].(string)]; ok {
+			return &testRows{row: []driver.Value{name, "", nil}}, nil
+		}
+
+	case strings.Contains(s.query, "FROM users"):
+		if hash, ok := s.db.passwords[args[0].(string)]; ok {
+			return &testRows{row: []driver.Value{hash}}, nil
+		}
+	}
+
+	return &testRows{}, nil
+}
+
+type testRows struct {
+	row []driver.Value
+}
+
+func (r *testRows) Columns() []string { return make([]string, max(len(r.row), 1)) }
+func (r *testRows) Close() error      { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+
+	copy(dest, r.row)
+	r.row = nil
+
+	return nil
+}
+
+func TestWireUsers_Database(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql.Register("gitkitd-test", testDB{
+		keys:      map[string]string{"SHA256:alice": "alice"},
+		passwords: map[string]string{"alice": string(hash)},
+	})
+
+	s, srv := gitkit.NewSSH(gitkit.Config{}), gitkit.New(gitkit.Config{})
+	ctx := context.Background()
+
+	closeUsers, err := wireUsers(ctx, UsersConfig{Database: &DatabaseConfig{Driver: "gitkitd-test"}}, s, srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeUsers()
+
+	assert.NotNil(t, s.AuthoriseOperationFunc)
+	assert.NotNil(t, srv.AuthoriseOperationFunc)
+
+	pk, err := s.PublicKeyLookupFunc(ctx, gitkit.PublicKeyLookup{Fingerprint: "SHA256:alice"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", pk.Name)
+		assert.Equal(t, "SHA256:alice", pk.Fingerprint)
+	}
+
+	_, err = s.PublicKeyLookupFunc(ctx, gitkit.PublicKeyLookup{Fingerprint: "SHA256:mallory"})
+	assert.ErrorIs(t, err, sqlkeys.ErrUnknownKey)
+
+	pk, err = srv.BasicAuthFunc(ctx, "alice", "secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", pk.Name)
+	}
+
+	_, err = srv.BasicAuthFunc(ctx, "alice", "wrong")
+	assert.ErrorIs(t, err, sqlkeys.ErrBadPassword)
+}
+
+func TestDatabaseConfig_dialect(t *testing.T) {
+	assert.Equal(t, sqlkeys.SQLite, DatabaseConfig{Driver: "sqlite"}.dialect())
+	assert.Equal(t, sqlkeys.Postgres, DatabaseConfig{Driver: "pgx"}.dialect())
+}
+
+func TestWireUsers_Gitolite(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "gitolite.conf")
+
+	if err := os.WriteFile(conf, []byte("repo public\n    R = @all\n\nrepo private\n    RW+ = alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, srv := gitkit.NewSSH(gitkit.Config{}), gitkit.New(gitkit.Config{})
+
+	_, err := wireUsers(context.Background(), UsersConfig{Gitolite: &GitoliteConfig{Conf: conf, KeyDir: dir}}, s, srv)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NotNil(t, s.PublicKeyLookupFunc)
+	assert.NotNil(t, s.AuthorisePushFunc)
+
+	// Anonymous HTTP clients get @all's permissions
+	ctx := context.Background()
+	assert.NoError(t, srv.AuthoriseOperationFunc(ctx, &gitkit.GitCommand{Command: "git-upload-pack", Repo: "public"}))
+	assert.Error(t, srv.AuthoriseOperationFunc(ctx, &gitkit.GitCommand{Command: "git-upload-pack", Repo: "private"}))
+}
+
+func TestWireUsers_Errors(t *testing.T) {
+	s := gitkit.NewSSH(gitkit.Config{})
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	_, err := wireUsers(context.Background(), UsersConfig{AuthorizedKeys: missing}, s, nil)
+	assert.Error(t, err)
+
+	_, err = wireUsers(context.Background(), UsersConfig{Gitolite: &GitoliteConfig{Conf: missing}}, s, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,62 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CommandFunc serves an exec request for a command other than git. args
+// holds the words of the command line, args[0] being the command's name.
+// Output written to ch is shown to the client, and returning an error
+// writes it to stderr and exits with status 1.
+type CommandFunc func(ctx context.Context, ch ssh.Channel, args []string) error
+
+// lookupCommand finds the handler for a non-git exec request. The git
+// commands themselves cannot be replaced.
+func (s SSH) lookupCommand(req *ssh.Request) (CommandFunc, []string, bool) {
+	var payload struct{ Command string }
+
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		return nil, nil, false
+	}
+
+	if _, err := ParseGitCommand(payload.Command); err == nil {
+		return nil, nil, false
+	}
+
+	args, err := shellSplit(payload.Command)
+	if err != nil || len(args) == 0 {
+		return nil, nil, false
+	}
+
+	if handler, ok := s.Commands[args[0]]; ok {
+		return handler, args, true
+	}
+
+	if args[0] == AdminCommand && s.AuthoriseAdminFunc != nil {
+		return s.adminCommand, args, true
+	}
+
+	if args[0] == WhoamiCommand && s.WhoamiFunc != nil {
+		return s.whoamiCommand, args, true
+	}
+
+	return nil, nil, false
+}
+
+// runCommand serves an exec request with handler, reporting its outcome
+// with the exit status
+func (s SSH) runCommand(ctx context.Context, ch ssh.Channel, req *ssh.Request, handler CommandFunc, args []string) error {
+	req.Reply(true, nil)
+
+	if err := handler(ctx, ch, args); err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s: %v\r\n", args[0], err)
+		sendExitStatus(ch, 1)
+
+		return fmt.Errorf("ssh: command %s: %w", args[0], err)
+	}
+
+	return sendExitStatus(ch, 0)
+}
@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var gitSubCommandRegex = regexp.MustCompile(`^git[-\s](upload-pack|upload-archive|receive-pack)$`)
+
+// rewriteCommand passes gitcmd through RewriteCommandFunc, checking what
+// comes back is still a command gitkit serves. A nil command leaves gitcmd
+// as it is.
+func (s SSH) rewriteCommand(ctx context.Context, gitcmd *GitCommand) (*GitCommand, error) {
+	if s.RewriteCommandFunc == nil {
+		return gitcmd, nil
+	}
+
+	in := *gitcmd
+
+	rewritten, err := s.RewriteCommandFunc(ctx, &in)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: rewriting %q: %w", gitcmd.Original, err)
+	}
+
+	if rewritten == nil {
+		return gitcmd, nil
+	}
+
+	if !gitSubCommandRegex.MatchString(rewritten.Command) {
+		return nil, fmt.Errorf("%w: rewritten to %q", ErrInvalidCommand, rewritten.Command)
+	}
+
+	if err := validateRepoPath(rewritten.Repo); err != nil {
+		return nil, err
+	}
+
+	// Anything but a flag would be taken for the repository path
+	for _, arg := range rewritten.Args {
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("%w: rewritten argument %q is not a flag", ErrInvalidCommand, arg)
+		}
+	}
+
+	rewritten.Original = gitcmd.Original
+
+	return rewritten, nil
+}
+
+// gitProgram returns the program to run for args, built for git, along
+// with its arguments and environment. Commands with a Binary run it in
+// place of git and the subcommand, taking git's -c options from
+// GIT_CONFIG_PARAMETERS.
+func (s SSH) gitProgram(gitcmd *GitCommand, args, env []string) (string, []string, []string) {
+	if gitcmd.Binary == "" {
+		return s.config.GitPath, args, env
+	}
+
+	params := []string{}
+	for len(args) >= 2 && args[0] == "-c" {
+		params = append(params, "'"+strings.ReplaceAll(args[1], "'", `'\''`)+"'")
+		args = args[2:]
+	}
+
+	if len(params) > 0 {
+		env = append(env, "GIT_CONFIG_PARAMETERS="+strings.Join(params, " "))
+	}
+
+	// What is left starts with the subcommand the binary stands in for
+	return gitcmd.Binary, args[1:], env
+}
@@ -0,0 +1,114 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_RewriteCommandFunc(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	binary := filepath.Join(t.TempDir(), "receive-pack")
+
+	script := "#!/bin/sh\necho \"$GIT_CONFIG_PARAMETERS $*\" >> " + calls + "\nexec git receive-pack \"$@\"\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.RewriteCommandFunc = func(_ context.Context, cmd *GitCommand) (*GitCommand, error) {
+			if cmd.Repo == "alias" {
+				cmd.Repo = "real"
+			}
+
+			if cmd.IsWrite() {
+				cmd.Binary = binary
+				cmd.Args = []string{"--quiet"}
+			}
+
+			return cmd, nil
+		}
+	})
+
+	if out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "alias.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	assert.True(t, repoExists(filepath.Join(s.config.Dir, "real")))
+	assert.False(t, repoExists(filepath.Join(s.config.Dir, "alias")))
+
+	recorded, err := os.ReadFile(calls)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(recorded)), "\n") {
+		assert.Equal(t, "'receive.advertisePushOptions=true' --quiet "+filepath.Join(s.config.Dir, "real"), line)
+	}
+
+	clone := t.TempDir()
+	if out, err := testGit(t, s, clone, "clone", "-q", testRemote(s, "alias.git"), "."); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+func TestSSH_RewriteCommandFunc_Invalid(t *testing.T) {
+	refused := errors.New("maintenance")
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.RewriteCommandFunc = func(_ context.Context, cmd *GitCommand) (*GitCommand, error) {
+			switch cmd.Repo {
+			case "command":
+				cmd.Command = "rm"
+			case "argument":
+				cmd.Args = []string{"/etc"}
+			case "traversal":
+				cmd.Repo = "../outside"
+			case "refused":
+				return nil, refused
+			}
+
+			return cmd, nil
+		}
+	})
+
+	client := testSSHClient(t, s)
+
+	for repo, expect := range map[string]error{
+		"command":   ErrInvalidCommand,
+		"argument":  ErrInvalidCommand,
+		"traversal": ErrInvalidRepoName,
+		"refused":   refused,
+	} {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Error(t, sess.Run("git-upload-pack '"+repo+".git'"), repo)
+		sess.Close()
+
+		last := s.Report().LastError
+		assert.True(t, errors.Is(last, expect), "%s: expected %v, received %v", repo, expect, last)
+	}
+}
+
+func TestSSH_gitProgram(t *testing.T) {
+	s := SSH{config: &Config{GitPath: "git"}}
+	args := []string{"-c", "receive.advertisePushOptions=true", "-c", "a.b=it's", "receive-pack", "--stateless-rpc", "/repos/app"}
+
+	program, rest, env := s.gitProgram(&GitCommand{Command: "git-receive-pack"}, args, nil)
+	assert.Equal(t, "git", program)
+	assert.Equal(t, args, rest)
+	assert.Empty(t, env)
+
+	program, rest, env = s.gitProgram(&GitCommand{Command: "git-receive-pack", Binary: "/usr/local/bin/receive-pack"}, args, []string{"GITKIT_KEY=alice"})
+	assert.Equal(t, "/usr/local/bin/receive-pack", program)
+	assert.Equal(t, []string{"--stateless-rpc", "/repos/app"}, rest)
+	assert.Equal(t, []string{"GITKIT_KEY=alice", `GIT_CONFIG_PARAMETERS='receive.advertisePushOptions=true' 'a.b=it'\''s'`}, env)
+}
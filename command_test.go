@@ -0,0 +1,65 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_Commands(t *testing.T) {
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.Commands = map[string]CommandFunc{
+			"echo": func(_ context.Context, ch ssh.Channel, args []string) error {
+				fmt.Fprint(ch, strings.Join(args[1:], ","))
+				return nil
+			},
+			"fail": func(context.Context, ssh.Channel, []string) error {
+				return fmt.Errorf("broken")
+			},
+		}
+	})
+
+	client := testSSHClient(t, s)
+
+	t.Run("Output", func(t *testing.T) {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		out, err := sess.Output(`echo hello 'big world'`)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello,big world", string(out))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		out, err := sess.CombinedOutput("fail")
+		if assert.Error(t, err) {
+			assert.Equal(t, 1, err.(*ssh.ExitError).ExitStatus())
+		}
+
+		assert.Contains(t, string(out), "fail: broken")
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		_, err = sess.CombinedOutput("unknown")
+		assert.Error(t, err)
+	})
+}
@@ -2,27 +2,108 @@ package gitkit
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 )
 
 var (
 	DefaultSSHBanner = `Welcome to gitkit {{ .Name }}
 Your public key id is {{ .Id }}
 `
+
+	// DefaultAllowedEnv lists the variables clients may set for git when
+	// Config.AllowedEnv is nil: GIT_PROTOCOL, which selects protocol v2, and
+	// the locale
+	DefaultAllowedEnv = []string{"GIT_PROTOCOL", "LANG", "LC_ALL"}
 )
 
 type Config struct {
-	KeyDir         string       // Directory for server ssh keys. Only used in SSH strategy.
-	Dir            string       // Directory that contains repositories
-	GitPath        string       // Path to git binary
-	GitUser        string       // User for ssh connections
-	AutoCreate     bool         // Automatically create repostories
-	AutoHooks      bool         // Automatically setup git hooks
-	Hooks          *HookScripts // Scripts for hooks/* directory
-	Auth           bool         // Require authentication
-	BannerTemplate string       // text/template string to compile when a user tries to login via ssh, such as when verifying keys
+	KeyDir              string          // Directory for server ssh keys. Only used in SSH strategy.
+	HostKeys            [][]byte        // PEM encoded ssh host private keys. When set, KeyDir is not used.
+	Dir                 string          // Directory that contains repositories
+	GitPath             string          // Path to git binary
+	GitUser             string          // User for ssh connections
+	ServerVersion       string          // Identification string the SSH server sends, which must begin "SSH-2.0-". Defaults to one naming gitkit and its Version. Only used in SSH strategy.
+	ServerVersionBuild  bool            // Adds the commit gitkit was built from and its Go version to the default ServerVersion. Only used in SSH strategy.
+	AutoCreate          bool            // Automatically create repostories
+	AutoHooks           bool            // Automatically setup git hooks
+	RepoTemplate        *RepoTemplate   // Default branch, first commit and git config of repositories made by AutoCreate
+	DefaultBranch       string          // Branch HEAD points at in created repositories, such as main, rather than the host git's default. RepoTemplate.DefaultBranch takes precedence.
+	Hooks               *HookScripts    // Scripts for hooks/* directory
+	Auth                bool            // Require authentication
+	BannerTemplate      string          // text/template string to compile when a user tries to login via ssh, such as when verifying keys
+	MinDiskFree         uint64          // Minimum free bytes under Dir before health checks report unready. Zero disables the check.
+	ReadOnly            bool            // Serve fetches only from a read-only Dir; disables AutoCreate, AutoHooks and pushes
+	Messages            MessageCatalog  // Localised client facing messages, overriding DefaultMessages
+	Routes              []Route         // Initial routing table mapping repository names to storage roots and policy. Only used in SSH strategy.
+	RepoNames           RepoNamePolicy  // Characters and nesting depth allowed in repository names
+	ShutdownTimeout     time.Duration   // How long Run waits for connections to drain when stopping. Defaults to DefaultShutdownTimeout.
+	AcceptBackoffMax    time.Duration   // Longest Serve waits to accept again after a temporary error. Defaults to DefaultAcceptBackoffMax. Only used in SSH strategy.
+	Webhooks            []Webhook       // Endpoints notified after successful pushes. Only used in SSH strategy.
+	Bandwidth           BandwidthLimits // Transfer rate limits applied to each connection. Only used in SSH strategy.
+	MaxHandshakeBytes   int64           // Bytes a client may send before ending its first pkt-line section. Defaults to DefaultMaxHandshakeBytes. Only used in SSH strategy.
+	MaxRequestPayload   int             // Largest ssh request payload, such as an exec command, accepted. Defaults to DefaultMaxRequestPayload. Only used in SSH strategy.
+	RecordMaxBytes      int64           // Most bytes of a session kept in its transcript. Defaults to DefaultRecordMaxBytes. Only used in SSH strategy.
+	AllowedEnv          []string        // Environment variables clients may set for git. Defaults to DefaultAllowedEnv. Only used in SSH strategy.
+	Roots               []RepoRoot      // Further repository directories searched, in order, for repositories not in Dir. Only used in SSH strategy.
+	PushCertSeed        string          // Secret used to issue nonces for signed pushes; must be shared by servers behind a load balancer. Random when empty. Only used in SSH strategy.
+	PushCertNonceSlop   time.Duration   // How old a signed push's nonce may be. Defaults to DefaultPushCertNonceSlop. Only used in SSH strategy.
+	ExternalURLs        ExternalURLs    // Hostnames and ports clients use to reach the server, for CloneURLs
+	MaxPackSize         int64           // Most bytes a client may send in a single push. Zero is unlimited. Only used in SSH strategy.
+	MaxRepoSize         int64           // Disk space, in bytes, a repository may use before pushes to it are rejected. Zero is unlimited. Only used in SSH strategy.
+	QuotaWarning        float64         // Fraction of MaxRepoSize, such as 0.8, past which pushes warn that a repository is nearly full. Zero disables warnings. Only used in SSH strategy.
+	UploadPackTimeout   time.Duration   // Longest a fetch or clone may run before git is killed. Zero is unlimited. Only used in SSH strategy.
+	ReceivePackTimeout  time.Duration   // Longest a push may run before git is killed. Zero is unlimited. Only used in SSH strategy.
+	PushHistory         bool            // Keep a PushSummary of every push in SSH.Store, as returned by SSH.Pushes. Only used in SSH strategy.
+	PushHistoryMaxAge   time.Duration   // How long push summaries are kept. Defaults to DefaultPushHistoryMaxAge. Only used in SSH strategy.
+	PushHistoryMaxCount int             // Most push summaries kept for each repository. Defaults to DefaultPushHistoryMaxCount. Only used in SSH strategy.
+	PackCache           bool            // Share one pack-objects run between identical protocol v2 clones made at the same time. Only used in SSH strategy.
+	PackCacheMaxBytes   int64           // Total size of finished packs PackCache keeps for later identical fetches, evicting the least recently used. Zero keeps none. Only used in SSH strategy.
+	PackCacheMaxPack    int64           // Largest single pack PackCache keeps. Defaults to PackCacheMaxBytes. Only used in SSH strategy.
+	SystemUsers         string          // How git is run as the account SSH.SystemUserFunc maps keys to: SystemUsersSudo or SystemUsersSetuid. Only used in SSH strategy.
+	MaxSessionsPerKey   int             // Most connections a single key may have open at once. Zero is unlimited. Only used in SSH strategy.
+	AnonymousRead       bool            // Serve fetches to clients which send no credentials, though Auth is set. Only used in HTTP strategy.
+	ProxyProtocol       bool            // Connections begin with a PROXY protocol v1 or v2 header giving the client's address, as sent by HAProxy or a network load balancer. Those which do not are closed. Only used in SSH strategy.
+	TrustedProxies      []string        // CIDRs, such as "10.0.0.0/8", of the load balancers sending PROXY protocol headers. Connections from elsewhere are served as they are. Required with ProxyProtocol. Only used in SSH strategy.
+	ProxyHeaderTimeout  time.Duration   // How long connections have to send their PROXY protocol header. Defaults to DefaultProxyHeaderTimeout. Only used in SSH strategy.
+	KeepaliveInterval   time.Duration   // How often keepalive requests are sent to clients, so that idle connections survive NAT and firewalls. Zero disables keepalives. Only used in SSH strategy.
+	KeepaliveCountMax   int             // Keepalives in a row a client may leave unanswered before it is disconnected. Defaults to DefaultKeepaliveCountMax. Only used in SSH strategy.
+	AllowedOperations   []string        // Operation constants clients may run, such as OperationUploadPack and OperationReceivePack. Nil allows all.
+	DisableArchive      bool            // Refuse OperationUploadArchive, whatever AllowedOperations holds
+	InMemory            bool            // Serve repositories from SSH.Repositories with go-git, rather than running git against Dir. Only used in SSH strategy.
+	EventBuffer         int             // Events each SSH.Subscribe channel holds before dropping. Defaults to DefaultEventBuffer. Only used in SSH strategy.
+	AllowCIDRs          []string        // CIDRs, such as "192.0.2.0/24", connections may come from. Others are closed before the handshake. Empty allows all. Only used in SSH strategy.
+	DenyCIDRs           []string        // CIDRs connections are closed before the handshake for, whatever AllowCIDRs holds. Only used in SSH strategy.
+	DeleteRetention     time.Duration   // How long repositories pending deletion are kept before RepoManager.PurgeDeleted removes them. Defaults to DefaultDeleteRetention. Only used in SSH strategy.
+	ProgressInterval    time.Duration   // How often SSH.ProgressFunc is told how a transfer is going. Defaults to DefaultProgressInterval. Only used in SSH strategy.
+	TmpDir              string          // Directory for temporary files, such as the bundles ImportBundle reads and the files git writes while serving, in place of the system's. Passed to git as TMPDIR.
+	AtomicPushes        bool            // Apply pushes updating several refs all or nothing, as git push --atomic does, so that a rejected ref leaves the others untouched. Only used in SSH strategy.
+
+	// UploadPack holds the partial and shallow clone settings passed to
+	// upload-pack, which Route.UploadPack may replace. Only used in SSH
+	// strategy.
+	UploadPack UploadPackOptions
+
+	// RepoPaths enables addressing repositories as ~user/repo, or by
+	// absolute paths jailed to a root. Only used in SSH strategy.
+	RepoPaths RepoPathOptions
+
+	// RefPolicy protects branches and tags from deletion and rewinding,
+	// and Route.RefPolicy may replace it. Only used in SSH strategy, and
+	// not with InMemory.
+	RefPolicy RefPolicy
+
+	// AuthFailures bans or tarpits addresses and keys which fail to
+	// authenticate too often. Only used in SSH strategy.
+	AuthFailures AuthFailureOptions
+
+	// SSHCrypto restricts the key exchange, cipher and MAC algorithms
+	// clients may negotiate. Only used in SSH strategy.
+	SSHCrypto SSHCrypto
 }
 
 // HookScripts represents all repository server-size git hooks
@@ -69,17 +150,100 @@ func (c *HookScripts) setupInDir(path string) error {
 	return nil
 }
 
+// autoCreate reports whether missing repositories should be initialised
+func (c *Config) autoCreate() bool {
+	return c.AutoCreate && !c.ReadOnly
+}
+
+// tmpEnv returns the environment pointing git at TmpDir
+func (c *Config) tmpEnv() []string {
+	if c.TmpDir == "" {
+		return nil
+	}
+
+	return []string{"TMPDIR=" + c.TmpDir}
+}
+
+// envAllowed reports whether clients may set the environment variable name
+func (c *Config) envAllowed(name string) bool {
+	allowed := c.AllowedEnv
+	if allowed == nil {
+		allowed = DefaultAllowedEnv
+	}
+
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// operationAllowed reports whether clients may run op, one of the
+// Operation constants
+func (c *Config) operationAllowed(op string) bool {
+	if op == OperationUploadArchive && c.DisableArchive {
+		return false
+	}
+
+	if c.AllowedOperations == nil {
+		return true
+	}
+
+	for _, allowed := range c.AllowedOperations {
+		if allowed == op {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *Config) KeyPath() string {
 	return filepath.Join(c.KeyDir, "gitkit.rsa")
 }
 
 func (c *Config) Setup() error {
+	// Repositories kept in memory need nothing on disk
+	if c.InMemory {
+		return nil
+	}
+
+	for _, root := range c.Roots {
+		if _, err := os.Stat(root.Path); err != nil {
+			return fmt.Errorf("repository root is not accessible: %w", err)
+		}
+	}
+
+	if c.TmpDir != "" {
+		if err := os.MkdirAll(c.TmpDir, 0700); err != nil {
+			return fmt.Errorf("temporary directory is not accessible: %w", err)
+		}
+	}
+
+	if c.ReadOnly {
+		if _, err := os.Stat(c.Dir); err != nil {
+			return fmt.Errorf("read-only repository directory is not accessible: %w", err)
+		}
+
+		if c.AutoCreate || c.AutoHooks {
+			logInfo("setup", "read-only mode: ignoring AutoCreate and AutoHooks")
+		}
+
+		return nil
+	}
+
 	if _, err := os.Stat(c.Dir); err != nil {
 		if err = os.Mkdir(c.Dir, 0755); err != nil {
 			return err
 		}
 	}
 
+	if _, err := c.Migrate(false); err != nil {
+		return err
+	}
+
 	if c.AutoHooks {
 		return c.setupHooks()
 	}
@@ -108,21 +272,61 @@ func (c *Config) setupHooks() error {
 	return nil
 }
 
-func (c Config) CompileBanner(pk PublicKey) (banner []byte, err error) {
+// BannerData is passed to BannerTemplate when compiling a banner. PublicKey
+// is embedded so that templates may refer to {{ .Name }} and {{ .Id }}
+// directly
+type BannerData struct {
+	PublicKey
+
+	User          string
+	RemoteAddr    string
+	ServerVersion string
+	Locale        string
+	Repos         []string // Only listed for the banner, not other messages
+}
+
+// BannerFuncs are the helper functions available to banner templates
+var BannerFuncs = template.FuncMap{
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"title":     titleCase,
+	"trim":      strings.TrimSpace,
+	"join":      func(sep string, s []string) string { return strings.Join(s, sep) },
+	"split":     func(sep, s string) []string { return strings.Split(s, sep) },
+	"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"replace":   func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"repeat":    func(n int, s string) string { return strings.Repeat(s, n) },
+	"default":   defaultValue,
+	"now":       time.Now,
+	"date":      func(layout string, t time.Time) string { return t.Format(layout) },
+	"bytes":     formatBytes,
+}
+
+func (c Config) CompileBanner(data BannerData) (banner []byte, err error) {
 	tmpl := c.BannerTemplate
 
+	if localised, ok := c.Messages.lookup(data.Locale, MsgBanner); ok {
+		tmpl = localised
+	}
+
 	if tmpl == "" {
 		tmpl = DefaultSSHBanner
 	}
 
-	t, err := template.New("").Parse(tmpl)
+	// cloneURLs formats addresses using this configuration, as in
+	// {{ range .Repos }}{{ (cloneURLs .).SSH }}{{ end }}
+	funcs := template.FuncMap{"cloneURLs": c.CloneURLs}
+
+	t, err := template.New("").Funcs(BannerFuncs).Funcs(funcs).Parse(tmpl)
 	if err != nil {
 		return
 	}
 
 	out := new(bytes.Buffer)
 
-	err = t.Execute(out, pk)
+	err = t.Execute(out, data)
 	banner = out.Bytes()
 
 	return
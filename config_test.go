@@ -1,6 +1,8 @@
 package gitkit
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -19,13 +21,23 @@ Your public key id is 0xdeadbeef
 `, false},
 		{"Custom banner returns accordingly", "Hello {{ .Name }}", "Hello test-user", false},
 		{"Dodgy banner returns empty string", "{{ .Foo ", "", true},
+		{"Banner data is available", "{{ .User }}@{{ .RemoteAddr }} ({{ .ServerVersion }}): {{ join \", \" .Repos }}", "git@127.0.0.1:1234 (SSH-2.0-gitkit): a, b/c", false},
+		{"Helper functions are available", "{{ .Name | upper }} {{ .Fingerprint | default \"none\" }}", "TEST-USER none", false},
+		{"Clone URLs are available", "{{ range .Repos }}{{ (cloneURLs .).SCP }} {{ end }}", "git@git.example.com:a.git git@git.example.com:b/c.git ", false},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			c := Config{
 				BannerTemplate: test.banner,
+				ExternalURLs:   ExternalURLs{SSHHost: "git.example.com"},
 			}
 
-			rcvd, err := c.CompileBanner(PublicKey{Id: "0xdeadbeef", Name: "test-user"})
+			rcvd, err := c.CompileBanner(BannerData{
+				PublicKey:     PublicKey{Id: "0xdeadbeef", Name: "test-user"},
+				User:          "git",
+				RemoteAddr:    "127.0.0.1:1234",
+				ServerVersion: "SSH-2.0-gitkit",
+				Repos:         []string{"a", "b/c"},
+			})
 			if err != nil && !test.expectError {
 				t.Errorf("unexpected error: %v", err)
 			} else if err == nil && test.expectError {
@@ -39,3 +51,81 @@ Your public key id is 0xdeadbeef
 		})
 	}
 }
+
+func TestConfig_Setup_ReadOnly(t *testing.T) {
+	t.Run("Missing dir is not created", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "repos")
+
+		c := Config{Dir: dir, ReadOnly: true}
+		if err := c.Setup(); err == nil {
+			t.Error("expected error")
+		}
+
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist", dir)
+		}
+	})
+
+	t.Run("Existing dir is left alone", func(t *testing.T) {
+		c := Config{Dir: t.TempDir(), ReadOnly: true, AutoHooks: true}
+		if err := c.Setup(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Repos are never initialised", func(t *testing.T) {
+		c := Config{Dir: t.TempDir(), ReadOnly: true, AutoCreate: true}
+		if err := initRepo(filepath.Join(c.Dir, "test"), &c); err != ErrReadOnly {
+			t.Errorf("expected ErrReadOnly, received %v", err)
+		}
+	})
+}
+
+func TestConfig_operationAllowed(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		c      Config
+		allow  []string
+		refuse []string
+	}{
+		{"All by default", Config{}, []string{OperationUploadPack, OperationReceivePack, OperationUploadArchive}, nil},
+		{"Listed operations only", Config{AllowedOperations: []string{OperationUploadPack}}, []string{OperationUploadPack}, []string{OperationReceivePack, OperationUploadArchive}},
+		{"Empty list allows nothing", Config{AllowedOperations: []string{}}, nil, []string{OperationUploadPack, OperationReceivePack}},
+		{"Archive disabled", Config{DisableArchive: true, AllowedOperations: []string{OperationUploadArchive, OperationUploadPack}}, []string{OperationUploadPack}, []string{OperationUploadArchive}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, op := range test.allow {
+				if !test.c.operationAllowed(op) {
+					t.Errorf("expected %s to be allowed", op)
+				}
+			}
+
+			for _, op := range test.refuse {
+				if test.c.operationAllowed(op) {
+					t.Errorf("expected %s to be refused", op)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_TmpDir(t *testing.T) {
+	tmp := filepath.Join(t.TempDir(), "tmp")
+
+	c := Config{Dir: t.TempDir(), TmpDir: tmp}
+	if err := c.Setup(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("expected %s to be created: %v", tmp, err)
+	}
+
+	if env := c.tmpEnv(); len(env) != 1 || env[0] != "TMPDIR="+tmp {
+		t.Errorf("unexpected environment %q", env)
+	}
+
+	if env := (&Config{}).tmpEnv(); env != nil {
+		t.Errorf("expected no environment, received %q", env)
+	}
+}
@@ -0,0 +1,92 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+)
+
+// ErrPushConflict is returned when a push lost a race with another push
+// to the same ref, and git was unable to take the ref lock
+var ErrPushConflict = errors.New("push conflicted with a concurrent update")
+
+var reRefLockFailure = regexp.MustCompile(`cannot lock ref '([^']+)'|ng (\S+) failed to update ref`)
+
+// PushConflict is passed to the MsgPushConflict template
+type PushConflict struct {
+	Repo string
+	Ref  string
+}
+
+// conflictWatcher watches git output for ref lock failures. When rewrite is
+// set, lines containing a failure are swallowed so that the raw git error is
+// never shown to the client; otherwise (as for the pack protocol on stdout,
+// which must not be altered) output passes through untouched.
+type conflictWatcher struct {
+	w       io.Writer
+	rewrite bool
+	ref     string
+	buf     []byte
+}
+
+func (c *conflictWatcher) Write(p []byte) (int, error) {
+	if !c.rewrite {
+		// Keep a little of the previous write, so matches which straddle
+		// writes are not missed
+		window := append(c.buf, p...)
+		c.detect(window)
+
+		if len(window) > 256 {
+			window = window[len(window)-256:]
+		}
+		c.buf = append([]byte{}, window...)
+
+		return c.w.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+
+	for {
+		i := bytes.IndexAny(c.buf, "\r\n")
+		if i == -1 {
+			break
+		}
+
+		line := c.buf[:i+1]
+		if !c.detect(line) {
+			if _, err := c.w.Write(line); err != nil {
+				return 0, err
+			}
+		}
+
+		c.buf = c.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out any trailing partial line
+func (c *conflictWatcher) Flush() error {
+	if !c.rewrite || len(c.buf) == 0 || c.detect(c.buf) {
+		return nil
+	}
+
+	_, err := c.w.Write(c.buf)
+	c.buf = nil
+
+	return err
+}
+
+func (c *conflictWatcher) detect(b []byte) bool {
+	m := reRefLockFailure.FindSubmatch(b)
+	if m == nil {
+		return false
+	}
+
+	if c.ref == "" {
+		c.ref = string(m[1]) + string(m[2])
+	}
+
+	return true
+}
@@ -0,0 +1,44 @@
+package gitkit
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_conflictWatcher_rewrite(t *testing.T) {
+	out := new(bytes.Buffer)
+	w := &conflictWatcher{w: out, rewrite: true}
+
+	w.Write([]byte("hook output\nerror: cannot lock ref 'refs/heads/ma"))
+	w.Write([]byte("in': is at abc but expected def\nmore output"))
+	assert.NoError(t, w.Flush())
+
+	assert.Equal(t, "hook output\nmore output", out.String())
+	assert.Equal(t, "refs/heads/main", w.ref)
+}
+
+func Test_conflictWatcher_passthrough(t *testing.T) {
+	out := new(bytes.Buffer)
+	w := &conflictWatcher{w: out}
+
+	input := []string{"0030\x01000eunpack ok\n0027ng refs/heads/", "feature failed to update ref\n0000"}
+	for _, chunk := range input {
+		w.Write([]byte(chunk))
+	}
+
+	assert.Equal(t, input[0]+input[1], out.String())
+	assert.Equal(t, "refs/heads/feature", w.ref)
+}
+
+func Test_conflictWatcher_noConflict(t *testing.T) {
+	out := new(bytes.Buffer)
+	w := &conflictWatcher{w: out, rewrite: true}
+
+	w.Write([]byte("To ssh://localhost/repo.git\n * [new branch] main -> main"))
+	assert.NoError(t, w.Flush())
+
+	assert.Equal(t, "To ssh://localhost/repo.git\n * [new branch] main -> main", out.String())
+	assert.Empty(t, w.ref)
+}
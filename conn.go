@@ -0,0 +1,40 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// watchedConn reads ahead from a connection so that a client disconnecting
+// is noticed straight away, even while the ssh library is blocked waiting on
+// a callback such as PublicKeyLookupFunc
+type watchedConn struct {
+	net.Conn
+	r *io.PipeReader
+}
+
+// watchConn returns a connection reading from conn, and a context which is
+// cancelled once conn is closed from either end
+func watchConn(parent context.Context, conn net.Conn) (net.Conn, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	pr, pw := io.Pipe()
+
+	go func() {
+		_, err := io.Copy(pw, conn)
+		cancel()
+		pw.CloseWithError(err)
+	}()
+
+	return &watchedConn{Conn: conn, r: pr}, ctx
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *watchedConn) Close() error {
+	c.r.Close()
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,59 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrAddressDenied is returned for connections from addresses which
+// Config.AllowCIDRs, Config.DenyCIDRs or SSH.AllowConnFunc refuse
+var ErrAddressDenied = errors.New("address denied")
+
+// checkCIDRs returns an error should any of Config.AllowCIDRs or
+// Config.DenyCIDRs not be a CIDR
+func (c *Config) checkCIDRs() error {
+	for _, cidrs := range [][]string{c.AllowCIDRs, c.DenyCIDRs} {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("address filter: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// allowConn checks the address conn comes from against DenyCIDRs, then
+// AllowCIDRs, then AllowConnFunc. Connections over unix sockets have no
+// address, and are only checked by AllowConnFunc.
+func (s SSH) allowConn(ctx context.Context, conn net.Conn) error {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if cidrsContain(s.config.DenyCIDRs, addr.IP) {
+			return fmt.Errorf("%w: %s is in DenyCIDRs", ErrAddressDenied, addr.IP)
+		}
+
+		if len(s.config.AllowCIDRs) > 0 && !cidrsContain(s.config.AllowCIDRs, addr.IP) {
+			return fmt.Errorf("%w: %s is not in AllowCIDRs", ErrAddressDenied, addr.IP)
+		}
+	}
+
+	if s.AllowConnFunc != nil {
+		if err := s.AllowConnFunc(ctx, conn.RemoteAddr()); err != nil {
+			return fmt.Errorf("%w: %w", ErrAddressDenied, err)
+		}
+	}
+
+	return nil
+}
+
+func cidrsContain(cidrs []string, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func testDial(s *SSH) error {
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+	}
+
+	return err
+}
+
+func TestSSH_AllowCIDRs(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config Config
+		allow  bool
+	}{
+		{"allowed", Config{AllowCIDRs: []string{"127.0.0.0/8"}}, true},
+		{"not allowed", Config{AllowCIDRs: []string{"192.0.2.0/24"}}, false},
+		{"denied", Config{DenyCIDRs: []string{"127.0.0.1/32"}}, false},
+		{"denied though allowed", Config{AllowCIDRs: []string{"127.0.0.0/8"}, DenyCIDRs: []string{"127.0.0.1/32"}}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := startTestSSH(t, test.config, nil)
+
+			err := testDial(s)
+			if test.allow {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	bad := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), DenyCIDRs: []string{"10.0.0.1"}})
+	assert.Error(t, bad.Listen("127.0.0.1:0"))
+}
+
+func TestSSH_AllowConnFunc(t *testing.T) {
+	var deny atomic.Bool
+
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.AllowConnFunc = func(context.Context, net.Addr) error {
+			if deny.Load() {
+				return errors.New("blocked")
+			}
+
+			return nil
+		}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	assert.NoError(t, testDial(s))
+
+	deny.Store(true)
+	assert.Error(t, testDial(s))
+
+	denied := testEvents(t, events, EventConnectionDenied)
+	last := denied[len(denied)-1]
+	assert.Contains(t, last.Data["error"], "blocked")
+	assert.NotEmpty(t, last.Data["remote_addr"])
+}
@@ -0,0 +1,100 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// EventForwardOpened is emitted when a direct-tcpip channel is forwarded
+const EventForwardOpened = "forward.opened"
+
+// forwardDialTimeout bounds connecting to the address a forward is for
+const forwardDialTimeout = 10 * time.Second
+
+// DirectTCPIP is a client's request, as made by ssh -L, to have the server
+// connect to an address on its behalf
+type DirectTCPIP struct {
+	Host       string // Address to connect to
+	Port       uint32
+	OriginHost string // Where the client says the connection came from
+	OriginPort uint32
+}
+
+// Address returns the address to connect to, as host:port
+func (d DirectTCPIP) Address() string {
+	return net.JoinHostPort(d.Host, strconv.FormatUint(uint64(d.Port), 10))
+}
+
+// handleDirectTCPIP forwards a direct-tcpip channel, when DirectTCPIPFunc
+// allows it, to the address asked for. It connects before accepting the
+// channel, so is run apart from the connection's other channels, which
+// would otherwise wait on a slow address.
+func (s *SSH) handleDirectTCPIP(ctx context.Context, newChan ssh.NewChannel) {
+	if s.DirectTCPIPFunc == nil {
+		newChan.Reject(ssh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	var fwd DirectTCPIP
+	if err := ssh.Unmarshal(newChan.ExtraData(), &fwd); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+
+	if err := s.DirectTCPIPFunc(ctx, fwd); err != nil {
+		log.Printf("ssh: refusing forward to %s: %v", fwd.Address(), err)
+		newChan.Reject(ssh.Prohibited, clientMessage(err, "forwarding to this address is not allowed"))
+
+		return
+	}
+
+	dialer := net.Dialer{Timeout: forwardDialTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", fwd.Address())
+	if err != nil {
+		log.Printf("ssh: forwarding to %s: %v", fwd.Address(), err)
+		newChan.Reject(ssh.ConnectionFailed, fmt.Sprintf("could not connect to %s", fwd.Address()))
+
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		log.Printf("error accepting channel: %v", err)
+
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	s.emit(ctx, Event{Type: EventForwardOpened, Data: map[string]string{"address": fwd.Address()}})
+
+	go func() {
+		defer ch.Close()
+		defer conn.Close()
+
+		done := make(chan struct{})
+
+		// Each direction is half-closed as it finishes, so that replies
+		// still arrive after the client has finished sending
+		go func() {
+			io.Copy(conn, ch)
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+			close(done)
+		}()
+
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+		<-done
+	}()
+}
@@ -0,0 +1,142 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testEchoServer listens on a local port, echoing back whatever each
+// connection sends
+func testEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestSSH_DirectTCPIP(t *testing.T) {
+	signer := testClientSigner(t)
+	echo := testEchoServer(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "1", Name: "alice"},
+	}, func(s *SSH) {
+		s.DirectTCPIPFunc = func(_ context.Context, fwd DirectTCPIP) error {
+			if fwd.Address() != echo.Addr().String() {
+				return NewClientError(errors.New("not the echo server"), "only the echo server may be reached")
+			}
+
+			return nil
+		}
+	})
+
+	client, err := testKeyDial(s, signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	conn, err := client.Dial("tcp", echo.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	// The reply arrives even once the client has finished sending
+	assert.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(reply))
+
+	_, err = client.Dial("tcp", "127.0.0.1:1")
+	assert.ErrorContains(t, err, "only the echo server may be reached")
+}
+
+func TestSSH_DirectTCPIP_Slow(t *testing.T) {
+	signer := testClientSigner(t)
+	echo := testEchoServer(t)
+
+	asked, release := make(chan struct{}), make(chan struct{})
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "1", Name: "alice"},
+	}, func(s *SSH) {
+		s.DirectTCPIPFunc = func(context.Context, DirectTCPIP) error {
+			close(asked)
+			<-release
+			return nil
+		}
+	})
+
+	client, err := testKeyDial(s, signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := client.Dial("tcp", echo.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+
+		dialed <- err
+	}()
+
+	// Sessions are opened while a forward is still connecting
+	<-asked
+
+	sess, err := client.NewSession()
+	if assert.NoError(t, err) {
+		sess.Close()
+	}
+
+	close(release)
+	assert.NoError(t, <-dialed)
+}
+
+func TestSSH_DirectTCPIP_Disabled(t *testing.T) {
+	signer := testClientSigner(t)
+	echo := testEchoServer(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "1", Name: "alice"},
+	}, nil)
+
+	client, err := testKeyDial(s, signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	_, err = client.Dial("tcp", echo.Addr().String())
+	assert.ErrorContains(t, err, "port forwarding is disabled")
+}
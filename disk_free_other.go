@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd)
+
+package gitkit
+
+func diskFree(string) (uint64, error) {
+	return 0, errDiskFreeUnsupported
+}
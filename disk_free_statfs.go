@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package gitkit
+
+import "syscall"
+
+func diskFree(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	// Field types differ between platforms, such as signed on FreeBSD
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,74 @@
+package gitkit
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidCommand is returned for exec requests which are not a git
+	// command gitkit serves
+	ErrInvalidCommand = errors.New("invalid git command")
+
+	// ErrAccessDenied is returned when a client may not run a command,
+	// whether refused by a route's Readers and Writers or by a callback
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrOperationDisabled is returned for operations Config.AllowedOperations
+	// or Config.DisableArchive turn off
+	ErrOperationDisabled = errors.New("operation is disabled")
+)
+
+// ClientError is implemented by errors which carry their own text for
+// clients. Callbacks such as AuthoriseOperationFunc and AuthorisePushFunc
+// may return one to tell clients why they were refused; clients are shown
+// ClientMessage in place of gitkit's own message, while Error is kept for
+// logs and events.
+type ClientError interface {
+	error
+	ClientMessage() string
+}
+
+// NewClientError returns an error wrapping err which shows clients msg
+func NewClientError(err error, msg string) error {
+	return &clientError{err: err, msg: msg}
+}
+
+type clientError struct {
+	err error
+	msg string
+}
+
+func (e *clientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *clientError) Unwrap() error {
+	return e.err
+}
+
+func (e *clientError) ClientMessage() string {
+	return e.msg
+}
+
+// clientMessage returns the ClientMessage of the first ClientError in
+// err's chain, or fallback when there is none
+func clientMessage(err error, fallback string) string {
+	var ce ClientError
+	if !errors.As(err, &ce) {
+		return fallback
+	}
+
+	return ce.ClientMessage()
+}
+
+// clientLine is clientMessage ending in the CRLF ssh clients expect of
+// stderr lines, as rendered messages do
+func clientLine(err error, fallback string) string {
+	msg := clientMessage(err, fallback)
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\r\n"
+	}
+
+	return msg
+}
@@ -0,0 +1,96 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClientError(t *testing.T) {
+	cause := errors.New("ticket lookup failed: connection refused")
+	err := fmt.Errorf("push: %w", NewClientError(cause, "A ticket is required"))
+
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, "push: ticket lookup failed: connection refused", err.Error())
+	assert.Equal(t, "A ticket is required", clientMessage(err, "fallback"))
+	assert.Equal(t, "A ticket is required\r\n", clientLine(err, "fallback"))
+
+	assert.Equal(t, "fallback", clientMessage(cause, "fallback"))
+	assert.Equal(t, "Access denied.\r\n", clientLine(cause, "Access denied.\r\n"))
+}
+
+func TestSSH_Errors(t *testing.T) {
+	denied := errors.New("secret repositories are off limits")
+
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.AuthoriseOperationFunc = func(_ context.Context, cmd *GitCommand) error {
+			if strings.HasPrefix(cmd.Repo, "secret") {
+				return denied
+			}
+
+			return nil
+		}
+	})
+
+	client := testSSHClient(t, s)
+
+	for cmd, expect := range map[string]error{
+		"rm -rf /":                    ErrInvalidCommand,
+		"git-upload-pack 'a b.git'":   ErrInvalidRepoName,
+		"git-upload-pack 'missing'":   ErrRepoNotFound,
+		"git-upload-pack 'secret'":    ErrAccessDenied,
+		"git-receive-pack 'secret/x'": denied,
+	} {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Error(t, sess.Run(cmd), cmd)
+		sess.Close()
+
+		last := s.Report().LastError
+		assert.True(t, errors.Is(last, expect), "%s: expected %v, received %v", cmd, expect, last)
+	}
+}
+
+func TestSSH_ClientError(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthorisePushFunc = func(context.Context, *GitCommand, *PushRequest) error {
+			return NewClientError(errors.New("ticket service: dial tcp 10.0.0.5:443: i/o timeout"), "a ticket is required")
+		}
+	})
+
+	out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "test.git"), "main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Push rejected: a ticket is required")
+	assert.NotContains(t, out, "10.0.0.5")
+}
+
+func TestServer_ClientError(t *testing.T) {
+	srv := startTestHTTP(t, Config{}, func(s *Server) {
+		s.AuthoriseOperationFunc = func(context.Context, *GitCommand) error {
+			return NewClientError(errors.New("policy engine unavailable"), "Pushes are paused for maintenance")
+		}
+	})
+
+	resp, err := http.Get(srv.URL + "/team/test.git/info/refs?service=git-receive-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "Pushes are paused for maintenance\n", string(body))
+}
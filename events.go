@@ -0,0 +1,145 @@
+package gitkit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event types emitted by the server
+const (
+	EventConnectionOpened = "connection.opened"
+	EventConnectionClosed = "connection.closed"
+	EventConnectionDenied = "connection.denied"
+	EventAuthFailed       = "auth.failed"
+	EventRepoCreated      = "repo.created"
+	EventPushConflict     = "push.conflict"
+	EventPushCompleted    = "push.completed"
+	EventPrewarmStarted   = "prewarm.started"
+	EventPrewarmCompleted = "prewarm.completed"
+	EventPrewarmFailed    = "prewarm.failed"
+)
+
+// subscriberOnlyEvents are sent to Subscribe channels but not EventFunc,
+// which was there before them, so that it is not given an event for every
+// connection
+var subscriberOnlyEvents = map[string]bool{
+	EventConnectionOpened: true,
+	EventConnectionClosed: true,
+	EventConnectionDenied: true,
+	EventAuthFailed:       true,
+	EventRepoCreated:      true,
+}
+
+// DefaultEventBuffer is how many events a subscription holds before
+// further events are dropped for it
+const DefaultEventBuffer = 64
+
+// Event describes something which happened while serving a client
+type Event struct {
+	Type      string
+	Time      time.Time
+	Repo      string
+	PublicKey PublicKey
+	Data      map[string]string
+}
+
+// eventBus fans events out to subscribers. Sends never block: a subscriber
+// which falls more than its buffer behind misses events rather than
+// stalling the server
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[<-chan Event]chan Event
+}
+
+func (b *eventBus) subscribe(size int) <-chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[<-chan Event]chan Event)
+	}
+
+	ch := make(chan Event, size)
+	b.subs[ch] = ch
+
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(sub)
+	}
+}
+
+// subscribed reports whether anything is subscribed to b, which may be nil
+func (b *eventBus) subscribed() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.subs) > 0
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event the server emits,
+// including the connection, auth and repository events EventFunc is not
+// given, until passed to Unsubscribe. The channel holds
+// Config.EventBuffer events, or DefaultEventBuffer when unset; events
+// arriving while it is full are dropped for that subscriber.
+func (s *SSH) Subscribe() <-chan Event {
+	size := s.config.EventBuffer
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+
+	return s.events.subscribe(size)
+}
+
+// Unsubscribe stops events being sent to ch, a channel returned by
+// Subscribe, and closes it
+func (s *SSH) Unsubscribe(ch <-chan Event) {
+	s.events.unsubscribe(ch)
+}
+
+// emit fills in the common event fields from ctx and passes the event to
+// subscribers and, unless it is for subscribers only, EventFunc, if set
+func (s SSH) emit(ctx context.Context, e Event) {
+	if s.EventFunc == nil && s.events == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if pk, ok := ctx.Value(PublicKeyContextKey{}).(PublicKey); ok {
+		e.PublicKey = pk
+	}
+
+	if s.events != nil {
+		s.events.publish(e)
+	}
+
+	if s.EventFunc != nil && !subscriberOnlyEvents[e.Type] {
+		s.EventFunc(ctx, e)
+	}
+}
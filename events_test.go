@@ -0,0 +1,212 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// testEvents collects events from ch until one of type last arrives
+func testEvents(t *testing.T, ch <-chan Event, last string) []Event {
+	t.Helper()
+
+	var events []Event
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+			if e.Type == last {
+				return events
+			}
+
+		case <-timeout:
+			t.Fatalf("event %s never arrived, received %v", last, events)
+
+			return nil
+		}
+	}
+}
+
+func testEventTypes(events []Event) []string {
+	types := make([]string, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+
+	return types
+}
+
+func Test_eventBus(t *testing.T) {
+	b := new(eventBus)
+
+	full, other := b.subscribe(1), b.subscribe(2)
+
+	b.publish(Event{Type: "one"})
+	b.publish(Event{Type: "two"})
+
+	// Subscribers which fall behind miss events, without holding up others
+	assert.Equal(t, "one", (<-full).Type)
+	assert.Len(t, full, 0)
+	assert.Len(t, other, 2)
+
+	b.unsubscribe(full)
+	b.unsubscribe(full)
+
+	_, open := <-full
+	assert.False(t, open)
+
+	b.publish(Event{Type: "three"})
+	assert.Len(t, other, 2)
+}
+
+func TestSSH_Subscribe(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		called []string
+	)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			called = append(called, e.Type)
+		}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	if out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	received := testEvents(t, events, EventConnectionClosed)
+	types := testEventTypes(received)
+
+	assert.Equal(t, EventConnectionOpened, types[0])
+	assert.Contains(t, types, EventRepoCreated)
+	assert.Contains(t, types, EventPushCompleted)
+
+	for _, e := range received {
+		assert.False(t, e.Time.IsZero(), e.Type)
+
+		if e.Type == EventRepoCreated {
+			assert.Equal(t, "test", e.Repo)
+		}
+	}
+
+	assert.NotEmpty(t, received[0].Data["remote_addr"])
+	assert.Contains(t, received[0].Data["client_version"], "SSH-2.0")
+
+	// Events do not share data
+	received[0].Data["remote_addr"] = ""
+	assert.NotEmpty(t, received[len(received)-1].Data["remote_addr"])
+
+	// EventFunc is only given the events it always was
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Contains(t, called, EventPushCompleted)
+	for _, typ := range []string{EventConnectionOpened, EventConnectionClosed, EventRepoCreated} {
+		assert.NotContains(t, called, typ)
+	}
+}
+
+func TestSSH_RepoCreatedFunc(t *testing.T) {
+	keyFile, key := testKeyFile(t)
+
+	var created []string
+
+	s := startTestSSH(t, Config{Auth: true, AutoCreate: true}, func(s *SSH) {
+		s.PublicKeyLookupFunc = func(_ context.Context, lookup PublicKeyLookup) (*PublicKey, error) {
+			if lookup.Fingerprint != ssh.FingerprintSHA256(key) {
+				return nil, errors.New("unknown key")
+			}
+
+			return &PublicKey{Id: "1", Name: "deploy"}, nil
+		}
+
+		s.RepoCreatedFunc = func(_ context.Context, repo string, pk PublicKey) {
+			created = append(created, repo+" by "+pk.Name)
+		}
+	})
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	work := testWorkTree(t, s)
+	for i := 0; i < 2; i++ {
+		out, err := testKeyGit(t, s, keyFile, work, "push", testRemote(s, "team/new.git"), "main")
+		require.NoError(t, err, out)
+	}
+
+	assert.Equal(t, []string{"team/new by deploy"}, created)
+
+	received := testEvents(t, events, EventRepoCreated)
+	assert.Equal(t, "team/new", received[len(received)-1].Repo)
+	assert.Equal(t, "autocreate", received[len(received)-1].Data["source"])
+	assert.Equal(t, "deploy", received[len(received)-1].PublicKey.Name)
+}
+
+func TestServer_RepoCreatedFunc(t *testing.T) {
+	var created []string
+
+	srv := startTestHTTP(t, Config{AutoCreate: true}, func(s *Server) {
+		s.RepoCreatedFunc = func(_ context.Context, repo string, _ PublicKey) {
+			created = append(created, repo)
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/team/new.git/info/refs?service=git-receive-pack")
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"team/new.git"}, created)
+}
+
+func TestSSH_Subscribe_AuthFailed(t *testing.T) {
+	s := startTestKeySSH(t, map[string]PublicKey{}, nil)
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	_, err := testKeyDial(s, testClientSigner(t))
+	assert.Error(t, err)
+
+	received := testEvents(t, events, EventAuthFailed)
+	failed := received[len(received)-1]
+
+	assert.NotContains(t, testEventTypes(received), EventConnectionOpened)
+	assert.NotEmpty(t, failed.Data["remote_addr"])
+	assert.Equal(t, PublicKey{}, failed.PublicKey)
+}
+
+func TestSSH_Unsubscribe(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+
+	events := s.Subscribe()
+	s.Unsubscribe(events)
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+	}
+
+	_, open := <-events
+	assert.False(t, open)
+}
@@ -0,0 +1,235 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// EventRepoForked is emitted once Fork has created a repository
+const EventRepoForked = "repo.forked"
+
+// ErrRepoExists is returned when creating a repository which already exists
+var ErrRepoExists = errors.New("repository already exists")
+
+// forkKey escapes repository names, so that the forks of team and of
+// team/project are kept apart
+func forkKey(src, dst string) string {
+	return "forks/" + url.PathEscape(src) + "/" + url.PathEscape(dst)
+}
+
+// keepForkObjectsArgs configures a repository with forks never to prune
+// objects, which forks may still borrow, including in the gc receive-pack
+// runs after pushes
+var keepForkObjectsArgs = []string{"config", "gc.pruneExpire", "never"}
+
+// Fork creates dst as a copy of the refs and HEAD of src. Rather than
+// copying objects, dst borrows them from src through
+// objects/info/alternates, so forks only take space for what is pushed to
+// them. Forks are recorded in Store, and neither GC, Prewarm nor the gc git
+// runs after pushes prune the objects of repositories with forks, since
+// forks may still need them.
+func (s *SSH) Fork(ctx context.Context, src, dst string) error {
+	for _, repo := range []string{src, dst} {
+		if err := validateRepoPath(repo); err != nil {
+			return err
+		}
+	}
+
+	// Resolved as the latest configuration routes them
+	srv := s.current()
+
+	srcLoc, err := srv.resolveRepo(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	dstLoc, err := srv.resolveRepo(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	if !repoExists(srcLoc.Path) {
+		return fmt.Errorf("fork: repository %s does not exist", src)
+	}
+
+	if _, err := os.Stat(dstLoc.Path); err == nil {
+		return fmt.Errorf("fork: %w: %s", ErrRepoExists, dst)
+	}
+
+	// Holding the maintenance lock stops GC from pruning objects the fork
+	// is about to depend on, before it is recorded
+	if !s.maintenance.acquire(srcLoc.Path) {
+		return ErrMaintenanceRunning
+	}
+	defer s.maintenance.release(srcLoc.Path)
+
+	objects, err := filepath.Abs(filepath.Join(srcLoc.Path, "objects"))
+	if err != nil {
+		return err
+	}
+
+	if err := initRepoFromTemplate(dstLoc.Path, s.config, nil); err != nil {
+		return fmt.Errorf("fork: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dstLoc.Path, "objects", "info", "alternates"), []byte(objects+"\n"), 0644)
+	if err == nil {
+		err = s.keepForkObjects(ctx, srcLoc.Path)
+	}
+
+	if err == nil {
+		err = s.copyRefs(ctx, srcLoc.Path, dstLoc.Path)
+	}
+
+	if err == nil {
+		err = s.Store.Put(forkKey(src, dst), []byte(dstLoc.Path))
+	}
+
+	if err != nil {
+		os.RemoveAll(dstLoc.Path)
+
+		return fmt.Errorf("fork: %w", err)
+	}
+
+	s.emit(ctx, Event{Type: EventRepoForked, Repo: dst, Data: map[string]string{"source": src}})
+
+	return nil
+}
+
+// keepForkObjects applies keepForkObjectsArgs to the repository at path
+func (s *SSH) keepForkObjects(ctx context.Context, path string) error {
+	out, err := exec.CommandContext(ctx, s.config.GitPath, append([]string{"-C", path}, keepForkObjectsArgs...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git config: %w: %s", err, out)
+	}
+
+	return nil
+}
+
+// copyRefs copies every ref, and the target of HEAD, from the repository at
+// src to dst. The objects they point to must already be available in dst.
+func (s *SSH) copyRefs(ctx context.Context, src, dst string) error {
+	git := func(dir string, args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, s.config.GitPath, append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, out)
+		}
+
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if _, err := git(dst, "fetch", "--quiet", "--no-tags", "--no-write-fetch-head", src, "+refs/*:refs/*"); err != nil {
+		return err
+	}
+
+	head, err := git(src, "symbolic-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	_, err = git(dst, "symbolic-ref", "HEAD", head)
+
+	return err
+}
+
+// Forks returns the names of the repositories forked from repo
+func (s *SSH) Forks(repo string) ([]string, error) {
+	if s.Store == nil {
+		return nil, nil
+	}
+
+	prefix := forkKey(repo, "")
+
+	keys, err := s.Store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	forks := make([]string, len(keys))
+	for i, key := range keys {
+		if forks[i], err = url.PathUnescape(strings.TrimPrefix(key, prefix)); err != nil {
+			return nil, err
+		}
+	}
+
+	return forks, nil
+}
+
+// dissociateForks gives each fork of repo its own copy of the objects it
+// borrows from repo, as git clone --dissociate does, so that repo can be
+// removed, and forgets they were forked from it
+func (s *SSH) dissociateForks(ctx context.Context, repo string) error {
+	forks, err := s.Forks(repo)
+	if err != nil {
+		return fmt.Errorf("unable to list forks: %w", err)
+	}
+
+	for _, fork := range forks {
+		loc, err := s.resolveRepo(ctx, fork)
+		if err != nil {
+			return err
+		}
+
+		if repoExists(loc.Path) {
+			if err := s.dissociate(ctx, loc.Path); err != nil {
+				return fmt.Errorf("fork %s: %w", fork, err)
+			}
+		}
+
+		if err := s.Store.Delete(forkKey(repo, fork)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dissociate repacks the repository at path to hold every object it
+// refers to, including those from its alternates, which are then no longer
+// used. Pushes are held off meanwhile, so that none comes to depend on the
+// alternates afresh.
+func (s *SSH) dissociate(ctx context.Context, path string) error {
+	if !s.maintenance.acquire(path) {
+		return ErrMaintenanceRunning
+	}
+	defer s.maintenance.release(path)
+
+	unlock, err := lockForMaintenance(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	out, err := exec.CommandContext(ctx, s.config.GitPath, "-C", path, "repack", "-a", "-d", "-q").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git repack: %w: %s", err, out)
+	}
+
+	if err = os.Remove(filepath.Join(path, "objects", "info", "alternates")); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// gcArgs returns the git gc arguments for repo. Objects no longer reachable
+// from a repository with forks may still be reachable from a fork, so
+// those are kept rather than pruned.
+func (s *SSH) gcArgs(repo string) ([]string, error) {
+	forks, err := s.Forks(repo)
+	if err != nil {
+		return nil, fmt.Errorf("gc: unable to list forks: %w", err)
+	}
+
+	if len(forks) > 0 {
+		return []string{"gc", "--quiet", "--no-prune"}, nil
+	}
+
+	return []string{"gc", "--quiet"}, nil
+}
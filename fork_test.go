@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_Fork(t *testing.T) {
+	var mu sync.Mutex
+	var forked []Event
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if e.Type == EventRepoForked {
+				forked = append(forked, e)
+			}
+		}
+	})
+
+	work := testWorkTree(t, s)
+	testGit(t, s, work, "checkout", "-q", "-b", "feature")
+	os.WriteFile(filepath.Join(work, "feature"), []byte("feature"), 0644)
+	testGit(t, s, work, "add", "feature")
+	testGit(t, s, work, "commit", "-q", "-m", "feature")
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main", "feature")
+	assert.NoError(t, err, out)
+
+	assert.NoError(t, s.Fork(context.Background(), "test", "team/fork"))
+
+	mu.Lock()
+	assert.Len(t, forked, 1)
+	assert.Equal(t, "test", forked[0].Data["source"])
+	mu.Unlock()
+
+	forks, err := s.Forks("test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team/fork"}, forks)
+
+	alternates, err := os.ReadFile(filepath.Join(s.config.Dir, "team", "fork", "objects", "info", "alternates"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(alternates), filepath.Join(s.config.Dir, "test", "objects"))
+
+	packs, _ := filepath.Glob(filepath.Join(s.config.Dir, "team", "fork", "objects", "pack", "*.pack"))
+	assert.Empty(t, packs)
+
+	// Objects only the fork still refers to survive GC of the source
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), ":feature")
+	assert.NoError(t, err, out)
+
+	src := filepath.Join(s.config.Dir, "test")
+	assert.NoError(t, exec.Command("git", "-C", src, "config", "gc.pruneExpire", "now").Run())
+	assert.NoError(t, exec.Command("git", "-C", src, "config", "gc.reflogExpireUnreachable", "now").Run())
+	assert.NoError(t, s.GC(context.Background(), "test"))
+
+	clone := t.TempDir()
+	out, err = testGit(t, s, clone, "clone", "-q", "-b", "feature", testRemote(s, "team/fork.git"), ".")
+	assert.NoError(t, err, out)
+
+	_, err = os.Stat(filepath.Join(clone, "feature"))
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, s.Fork(context.Background(), "test", "team/fork"), ErrRepoExists)
+	assert.Error(t, s.Fork(context.Background(), "missing", "other"))
+	assert.Error(t, s.Fork(context.Background(), "test", "../escape"))
+}
+
+func TestSSH_Forks_Nested(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir()})
+
+	assert.NoError(t, s.Store.Put(forkKey("team", "one"), nil))
+	assert.NoError(t, s.Store.Put(forkKey("team/project", "two"), nil))
+
+	forks, err := s.Forks("team")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one"}, forks)
+}
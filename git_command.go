@@ -3,35 +3,222 @@ package gitkit
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack) '(.*)'$`)
+// Operations clients may run, as returned by GitCommand.SubCommand and
+// listed in Config.AllowedOperations
+const (
+	OperationUploadPack    = "upload-pack"    // Fetches and clones
+	OperationReceivePack   = "receive-pack"   // Pushes
+	OperationUploadArchive = "upload-archive" // git archive --remote, and HTTP archive downloads
+)
+
+var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack)\s+(.*)$`)
 
 type GitCommand struct {
 	Command  string
 	Repo     string
 	Original string
+
+	// Path is the repository path as the client gave it, such as
+	// /srv/git/project.git or ~alice/project.git, from which Repo is taken
+	Path string
+
+	// Args are extra flags, such as --strict or --timeout=60, given to the
+	// subcommand before the repository path. Clients may only give the
+	// flags commandFlags allows for the subcommand; a RewriteCommandFunc
+	// may set any.
+	Args []string
+
+	// Binary, when set by a RewriteCommandFunc, is run in place of git and
+	// its subcommand, such as a custom upload-pack. It is given Args and
+	// the repository path, with any git configuration in
+	// GIT_CONFIG_PARAMETERS as git passes it to its own subcommands.
+	Binary string
+
+	// Namespace is the GIT_NAMESPACE git runs in, as chosen by
+	// SSH.NamespaceFunc or a RewriteCommandFunc, so that many logical
+	// repositories can share one object store. Empty serves the whole
+	// repository.
+	Namespace string
+}
+
+// SubCommand returns the git subcommand being run, such as receive-pack,
+// regardless of whether the client used the dashed or spaced form
+func (g GitCommand) SubCommand() string {
+	return strings.TrimPrefix(strings.TrimPrefix(g.Command, "git-"), "git ")
+}
+
+// IsWrite returns true for commands which modify the repository
+func (g GitCommand) IsWrite() bool {
+	return g.SubCommand() == OperationReceivePack
+}
+
+// commandFlags are the flags clients may give each subcommand ahead of
+// the repository, mapped to a check of any value given after "=". Flags
+// with no check take no value.
+var commandFlags = map[string]map[string]func(value string) error{
+	OperationUploadPack: {
+		"--strict":  nil,
+		"--timeout": checkTimeoutFlag,
+	},
+}
+
+// checkTimeoutFlag accepts upload-pack's --timeout, a number of seconds
+func checkTimeoutFlag(value string) error {
+	if _, err := strconv.ParseUint(value, 10, 31); err != nil {
+		return fmt.Errorf("timeout %q is not a number of seconds", value)
+	}
+
+	return nil
 }
 
 func ParseGitCommand(cmd string) (*GitCommand, error) {
 	matches := gitCommandRegex.FindAllStringSubmatch(cmd, 1)
 	if len(matches) == 0 {
-		return nil, fmt.Errorf("invalid git command")
+		return nil, ErrInvalidCommand
+	}
+
+	words, err := shellSplit(matches[0][2])
+	if err != nil {
+		return nil, err
 	}
 
 	result := &GitCommand{
 		Original: cmd,
 		Command:  matches[0][1],
-		Repo:     parseRepoName(matches[0][2]),
+	}
+
+	arg, err := result.parseArgs(words)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Repo, result.Path = parseRepoName(arg), arg
+
+	if err := validateRepoPath(result.Repo); err != nil {
+		return nil, err
 	}
 
 	return result, nil
 }
 
+// parseArgs sets Args from the flags in words, returning the repository
+// path which follows them. upload-archive may be given the path with
+// --remote=, as git archive takes it.
+func (g *GitCommand) parseArgs(words []string) (string, error) {
+	var path []string
+
+	for _, word := range words {
+		if !strings.HasPrefix(word, "-") {
+			path = append(path, word)
+
+			continue
+		}
+
+		if remote, ok := strings.CutPrefix(word, "--remote="); ok && g.SubCommand() == OperationUploadArchive {
+			path = append(path, remote)
+
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(word, "=")
+
+		check, ok := commandFlags[g.SubCommand()][name]
+		switch {
+		case !ok:
+			return "", fmt.Errorf("%w: unsupported flag %q", ErrInvalidCommand, name)
+
+		case check == nil && hasValue:
+			return "", fmt.Errorf("%w: flag %q takes no value", ErrInvalidCommand, name)
+
+		case check != nil && !hasValue:
+			return "", fmt.Errorf("%w: flag %q needs a value", ErrInvalidCommand, name)
+
+		case check != nil:
+			if err := check(value); err != nil {
+				return "", fmt.Errorf("%w: %w", ErrInvalidCommand, err)
+			}
+		}
+
+		g.Args = append(g.Args, word)
+	}
+
+	if len(path) != 1 {
+		return "", fmt.Errorf("%w: unexpected whitespace", ErrInvalidCommand)
+	}
+
+	return path[0], nil
+}
+
+// Flag returns the value of the flag name in Args, such as "60" for
+// --timeout=60, and whether it was given at all. Later flags take
+// precedence, as they do with git.
+func (g GitCommand) Flag(name string) (value string, ok bool) {
+	for _, arg := range g.Args {
+		if n, v, _ := strings.Cut(arg, "="); n == name {
+			value, ok = v, true
+		}
+	}
+
+	return value, ok
+}
+
 func parseRepoName(s string) (repoName string) {
 	repoPath, _ := strings.CutPrefix(s, "/")
 	repoName, _ = strings.CutSuffix(repoPath, ".git")
 
 	return
 }
+
+// shellSplit breaks a command line into words on unquoted whitespace,
+// undoing the quoting git applies to the repository argument, as with git
+// archive --remote=host:"my repo". git quotes the whole path in single
+// quotes, escaping any single quote or ! within it by closing the quotes,
+// adding the character with a backslash, and opening them again. Unquoted
+// words, as typed by hand over ssh, end at whitespace.
+func shellSplit(s string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidCommand)
+			}
+
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
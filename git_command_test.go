@@ -1,21 +1,28 @@
 package gitkit
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 )
 
 func TestParseGitCommand(t *testing.T) {
 	tests := map[string]GitCommand{
-		"git-upload-pack 'hello.git'":        {"git-upload-pack", "hello", "git-upload-pack 'hello.git'"},
-		"git upload-pack 'hello.git'":        {"git upload-pack", "hello", "git upload-pack 'hello.git'"},
-		"git-upload-pack '/hello.git'":       {"git-upload-pack", "hello", "git-upload-pack 'hello.git'"},
-		"git-upload-pack '/hello/world.git'": {"git-upload-pack", "hello/world", "git-upload-pack 'hello/world.git'"},
-		"git-upload-pack 'hello/world.git'":  {"git-upload-pack", "hello/world", "git-upload-pack 'hello/world.git'"},
-		"git-receive-pack 'hello.git'":       {"git-receive-pack", "hello", "git-receive-pack 'hello.git'"},
-		"git receive-pack 'hello.git'":       {"git receive-pack", "hello", "git receive-pack 'hello.git'"},
-		"git-upload-archive 'hello.git'":     {"git-upload-archive", "hello", "git-upload-archive 'hello.git'"},
-		"git upload-archive 'hello.git'":     {"git upload-archive", "hello", "git upload-archive 'hello.git'"},
-		"git upload-archive 'hello'":         {"git upload-archive", "hello", "git upload-archive 'hello.git'"},
+		"git-upload-pack 'hello.git'":        {Command: "git-upload-pack", Repo: "hello", Original: "git-upload-pack 'hello.git'"},
+		"git upload-pack 'hello.git'":        {Command: "git upload-pack", Repo: "hello", Original: "git upload-pack 'hello.git'"},
+		"git-upload-pack '/hello.git'":       {Command: "git-upload-pack", Repo: "hello", Original: "git-upload-pack 'hello.git'"},
+		"git-upload-pack '/hello/world.git'": {Command: "git-upload-pack", Repo: "hello/world", Original: "git-upload-pack 'hello/world.git'"},
+		"git-upload-pack 'hello/world.git'":  {Command: "git-upload-pack", Repo: "hello/world", Original: "git-upload-pack 'hello/world.git'"},
+		"git-receive-pack 'hello.git'":       {Command: "git-receive-pack", Repo: "hello", Original: "git-receive-pack 'hello.git'"},
+		"git receive-pack 'hello.git'":       {Command: "git receive-pack", Repo: "hello", Original: "git receive-pack 'hello.git'"},
+		"git-upload-archive 'hello.git'":     {Command: "git-upload-archive", Repo: "hello", Original: "git-upload-archive 'hello.git'"},
+		"git upload-archive 'hello.git'":     {Command: "git upload-archive", Repo: "hello", Original: "git upload-archive 'hello.git'"},
+		"git upload-archive 'hello'":         {Command: "git upload-archive", Repo: "hello", Original: "git upload-archive 'hello.git'"},
+		"git-upload-archive hello.git":       {Command: "git-upload-archive", Repo: "hello", Original: "git-upload-archive hello.git"},
+		"git-upload-archive 'it'\\''s.git'":  {Command: "git-upload-archive", Repo: "it's", Original: "git-upload-archive 'it'\\''s.git'"},
+		"git-upload-archive 'a'\\!'b.git'":   {Command: "git-upload-archive", Repo: "a!b", Original: "git-upload-archive 'a'\\!'b.git'"},
+		"git-upload-archive 'my repo.git'":   {Command: "git-upload-archive", Repo: "my repo", Original: "git-upload-archive 'my repo.git'"},
 	}
 
 	for name, gc := range tests {
@@ -45,3 +52,176 @@ func TestParseGitCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestParseGitCommand_Path(t *testing.T) {
+	for cmd, expect := range map[string]string{
+		"git-upload-pack 'hello.git'":          "hello.git",
+		"git-upload-pack '/srv/git/hello.git'": "/srv/git/hello.git",
+		"git-upload-pack '~alice/hello.git'":   "~alice/hello.git",
+	} {
+		t.Run(cmd, func(t *testing.T) {
+			gitcmd, err := ParseGitCommand(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if gitcmd.Path != expect {
+				t.Errorf("expected %q, received %q", expect, gitcmd.Path)
+			}
+		})
+	}
+}
+
+func TestGitCommand_IsWrite(t *testing.T) {
+	for cmd, expect := range map[string]bool{
+		"git-receive-pack":   true,
+		"git receive-pack":   true,
+		"git-upload-pack":    false,
+		"git upload-archive": false,
+	} {
+		t.Run(cmd, func(t *testing.T) {
+			if rcvd := (GitCommand{Command: cmd}).IsWrite(); rcvd != expect {
+				t.Errorf("expected %v, received %v", expect, rcvd)
+			}
+		})
+	}
+}
+
+func TestParseGitCommand_InvalidRepo(t *testing.T) {
+	for _, cmd := range []string{
+		"git-upload-pack '../../etc.git'",
+		"git-upload-pack '//etc/passwd'",
+		"git-upload-pack 'org/../../hello.git'",
+		"git-upload-pack ''",
+		"git-upload-pack 'hello.git",
+		"git-upload-pack hello world.git",
+	} {
+		t.Run(cmd, func(t *testing.T) {
+			if _, err := ParseGitCommand(cmd); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseGitCommand_Args(t *testing.T) {
+	for cmd, expect := range map[string]struct {
+		repo string
+		args []string
+	}{
+		"git-upload-pack 'hello.git'":                       {"hello", nil},
+		"git-upload-pack --strict 'hello.git'":              {"hello", []string{"--strict"}},
+		"git-upload-pack --strict --timeout=60 'hello.git'": {"hello", []string{"--strict", "--timeout=60"}},
+		"git upload-pack '--timeout=5' 'hello.git'":         {"hello", []string{"--timeout=5"}},
+		"git-upload-archive --remote='hello.git'":           {"hello", nil},
+		"git-upload-archive '--remote=my repo.git'":         {"my repo", nil},
+	} {
+		t.Run(cmd, func(t *testing.T) {
+			gitcmd, err := ParseGitCommand(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if gitcmd.Repo != expect.repo {
+				t.Errorf("expected repo %q, received %q", expect.repo, gitcmd.Repo)
+			}
+
+			if strings.Join(gitcmd.Args, "|") != strings.Join(expect.args, "|") {
+				t.Errorf("expected args %q, received %q", expect.args, gitcmd.Args)
+			}
+		})
+	}
+}
+
+func TestParseGitCommand_InvalidArgs(t *testing.T) {
+	for _, cmd := range []string{
+		"git-upload-pack --stateless-rpc 'hello.git'",
+		"git-upload-pack --advertise-refs 'hello.git'",
+		"git-upload-pack --strict=yes 'hello.git'",
+		"git-upload-pack --timeout 'hello.git'",
+		"git-upload-pack --timeout=soon 'hello.git'",
+		"git-upload-pack --timeout=-1 'hello.git'",
+		"git-upload-pack --remote=hello.git",
+		"git-receive-pack --strict 'hello.git'",
+		"git-receive-pack --skip-connectivity-check 'hello.git'",
+		"git-upload-archive --remote=hello.git 'other.git'",
+		"git-upload-pack --strict",
+		"git-upload-pack '-hello.git'",
+	} {
+		t.Run(cmd, func(t *testing.T) {
+			if _, err := ParseGitCommand(cmd); !errors.Is(err, ErrInvalidCommand) {
+				t.Errorf("expected ErrInvalidCommand, received %v", err)
+			}
+		})
+	}
+}
+
+func TestGitCommand_Flag(t *testing.T) {
+	gitcmd := GitCommand{Args: []string{"--strict", "--timeout=60", "--timeout=5"}}
+
+	if value, ok := gitcmd.Flag("--strict"); !ok || value != "" {
+		t.Errorf("expected --strict without a value, received %q, %v", value, ok)
+	}
+
+	if value, ok := gitcmd.Flag("--timeout"); !ok || value != "5" {
+		t.Errorf("expected the last --timeout, received %q, %v", value, ok)
+	}
+
+	if _, ok := gitcmd.Flag("--quiet"); ok {
+		t.Error("expected --quiet to be missing")
+	}
+}
+
+func TestSSH_GitCommandArgs(t *testing.T) {
+	var args []string
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthoriseOperationFunc = func(_ context.Context, cmd *GitCommand) error {
+			if cmd.SubCommand() == OperationUploadPack {
+				args = cmd.Args
+			}
+
+			return nil
+		}
+	})
+
+	if out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	// upload-pack gives up once the client sends nothing after the refs
+	out, _ := testSSHRun(t, s, "git-upload-pack --strict --timeout=5 'test.git'")
+	if !strings.Contains(out, "refs/heads/main") {
+		t.Errorf("expected refs to be advertised, received %q", out)
+	}
+
+	if strings.Join(args, " ") != "--strict --timeout=5" {
+		t.Errorf("expected flags to be authorised, received %q", args)
+	}
+
+	if _, err := testSSHRun(t, s, "git-upload-pack --upload-pack=evil 'test.git'"); err == nil {
+		t.Error("expected unsupported flags to be refused")
+	}
+}
+
+func Test_shellSplit(t *testing.T) {
+	for cmd, expect := range map[string][]string{
+		"gitkit sessions":       {"gitkit", "sessions"},
+		"  gitkit   gc  'a b' ": {"gitkit", "gc", "a b"},
+		"gitkit gc 'it'\\''s'":  {"gitkit", "gc", "it's"},
+		"gitkit gc ''":          {"gitkit", "gc", ""},
+		"gitkit gc a\\ b":       {"gitkit", "gc", "a b"},
+		"":                      nil,
+	} {
+		t.Run(cmd, func(t *testing.T) {
+			rcvd, err := shellSplit(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(rcvd, "|") != strings.Join(expect, "|") || len(rcvd) != len(expect) {
+				t.Errorf("expected %q, received %q", expect, rcvd)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Package gitkittest runs gitkit SSH servers for integration tests. Each
+// server listens on a random local port with host keys generated into a
+// temporary directory, and is stopped when the test ends:
+//
+//	s := gitkittest.NewTestServer(t, gitkit.Config{AutoCreate: true})
+//
+//	work := s.WorkTree()
+//	if out, err := s.Push(work, "app.git", "HEAD"); err != nil {
+//		t.Fatalf("push failed: %v\n%s", err, out)
+//	}
+//
+//	clone := s.Clone("app.git")
+//
+// Clients are the system git and ssh binaries, which must be on PATH. They
+// are run without the user's or system's git and ssh configuration, so
+// that tests behave the same on every machine.
+package gitkittest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jspc/gitkit"
+	"golang.org/x/crypto/ssh"
+)
+
+// ClientKeyID is the id of the PublicKey clients authenticate as, when the
+// server requires authentication and no PublicKeyLookupFunc is set
+const ClientKeyID = "gitkittest"
+
+// Option configures the server before it starts serving, such as by setting
+// callbacks like AuthorisePushFunc
+type Option func(*gitkit.SSH)
+
+// Server is a running gitkit SSH server, along with a client key for git
+// to connect with
+type Server struct {
+	*gitkit.SSH
+
+	// ClientKey is the key the test's git client authenticates with
+	ClientKey ssh.PublicKey
+
+	t       testing.TB
+	user    string
+	branch  string
+	keyPath string
+}
+
+// NewTestServer starts an SSH server for config. Dir and KeyDir default to
+// temporary directories and DefaultBranch to main, and when config.Auth is
+// set without a PublicKeyLookupFunc, only ClientKey is accepted.
+func NewTestServer(t testing.TB, config gitkit.Config, opts ...Option) *Server {
+	t.Helper()
+
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+
+	if config.KeyDir == "" && len(config.HostKeys) == 0 {
+		config.KeyDir = t.TempDir()
+	}
+
+	// Set, so that neither the server nor WorkTree follow the host git's
+	// init.defaultBranch
+	if config.DefaultBranch == "" {
+		config.DefaultBranch = "main"
+	}
+
+	s := &Server{
+		t:      t,
+		user:   config.GitUser,
+		branch: config.DefaultBranch,
+	}
+
+	if s.user == "" {
+		s.user = "git"
+	}
+
+	s.writeClientKey()
+
+	s.SSH = gitkit.NewSSH(config)
+	if config.Auth {
+		s.PublicKeyLookupFunc = s.lookupClientKey
+	}
+
+	for _, opt := range opts {
+		opt(s.SSH)
+	}
+
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("gitkittest: %v", err)
+	}
+
+	go s.Serve()
+	t.Cleanup(func() { s.Stop() })
+
+	return s
+}
+
+// writeClientKey generates the client key, in a form ssh can read
+func (s *Server) writeClientKey() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatalf("gitkittest: %v", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		s.t.Fatalf("gitkittest: %v", err)
+	}
+
+	s.keyPath = filepath.Join(s.t.TempDir(), "id_ecdsa")
+
+	err = os.WriteFile(s.keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		s.t.Fatalf("gitkittest: %v", err)
+	}
+
+	s.ClientKey, err = ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		s.t.Fatalf("gitkittest: %v", err)
+	}
+}
+
+func (s *Server) lookupClientKey(_ context.Context, key gitkit.PublicKeyLookup) (*gitkit.PublicKey, error) {
+	if key.Fingerprint != ssh.FingerprintSHA256(s.ClientKey) {
+		return nil, fmt.Errorf("gitkittest: unknown key %s", key.Fingerprint)
+	}
+
+	return &gitkit.PublicKey{Id: ClientKeyID, Name: ClientKeyID, Content: key.Payload}, nil
+}
+
+// URL returns the address git clients use for repo
+func (s *Server) URL(repo string) string {
+	return fmt.Sprintf("ssh://%s@%s/%s", s.user, s.Address(), repo)
+}
+
+// Git runs git in dir, connecting to the server with ClientKey, and
+// returns its combined output
+func (s *Server) Git(dir string, args ...string) (string, error) {
+	_, port, _ := net.SplitHostPort(s.Address())
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1", "GIT_TERMINAL_PROMPT=0",
+		"GIT_SSH_COMMAND=ssh -F /dev/null -o IdentitiesOnly=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR -i "+s.keyPath+" -p "+port,
+		"GIT_AUTHOR_NAME=gitkittest", "GIT_AUTHOR_EMAIL=gitkittest@example.com",
+		"GIT_COMMITTER_NAME=gitkittest", "GIT_COMMITTER_EMAIL=gitkittest@example.com",
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	return string(out), err
+}
+
+// mustGit runs git, failing the test should it fail
+func (s *Server) mustGit(dir string, args ...string) string {
+	s.t.Helper()
+
+	out, err := s.Git(dir, args...)
+	if err != nil {
+		s.t.Fatalf("gitkittest: git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return out
+}
+
+// WorkTree creates a local repository with a single commit on the server's
+// DefaultBranch, which repositories it creates point HEAD at
+func (s *Server) WorkTree() string {
+	s.t.Helper()
+
+	dir := s.t.TempDir()
+
+	s.mustGit(dir, "init", "-q", "-b", s.branch)
+	s.mustGit(dir, "commit", "-q", "--allow-empty", "-m", "initial")
+
+	return dir
+}
+
+// Commit writes content to name in the work tree dir and commits it
+func (s *Server) Commit(dir, name, content string) {
+	s.t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		s.t.Fatalf("gitkittest: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		s.t.Fatalf("gitkittest: %v", err)
+	}
+
+	s.mustGit(dir, "add", name)
+	s.mustGit(dir, "commit", "-q", "-m", "update "+name)
+}
+
+// Push pushes refspecs from the work tree dir to repo. Errors are returned,
+// along with git's output, so that tests may check rejected pushes.
+func (s *Server) Push(dir, repo string, refspecs ...string) (string, error) {
+	return s.Git(dir, append([]string{"push", s.URL(repo)}, refspecs...)...)
+}
+
+// Clone clones repo into a new temporary directory, which is returned
+func (s *Server) Clone(repo string) string {
+	s.t.Helper()
+
+	dir := s.t.TempDir()
+	s.mustGit(dir, "clone", "-q", s.URL(repo), ".")
+
+	return dir
+}
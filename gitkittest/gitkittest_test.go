@@ -0,0 +1,45 @@
+package gitkittest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jspc/gitkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTestServer(t *testing.T) {
+	s := NewTestServer(t, gitkit.Config{AutoCreate: true})
+
+	work := s.WorkTree()
+	s.Commit(work, "docs/README", "hello")
+
+	out, err := s.Push(work, "app.git", "HEAD")
+	assert.NoError(t, err, out)
+
+	clone := s.Clone("app.git")
+
+	content, err := os.ReadFile(filepath.Join(clone, "docs", "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+}
+
+func TestNewTestServer_Auth(t *testing.T) {
+	var keyID string
+
+	s := NewTestServer(t, gitkit.Config{AutoCreate: true, Auth: true}, func(s *gitkit.SSH) {
+		s.AuthorisePushFunc = func(ctx context.Context, _ *gitkit.GitCommand, _ *gitkit.PushRequest) error {
+			keyID = ctx.Value(gitkit.PublicKeyContextKey{}).(gitkit.PublicKey).Id
+
+			return fmt.Errorf("no pushes today")
+		}
+	})
+
+	out, err := s.Push(s.WorkTree(), "app.git", "HEAD")
+	assert.Error(t, err)
+	assert.Contains(t, out, "no pushes today")
+	assert.Equal(t, ClientKeyID, keyID)
+}
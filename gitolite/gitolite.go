@@ -0,0 +1,528 @@
+// Package gitolite provides access control for gitkit SSH servers, driven
+// by a gitolite style configuration file and key directory, so that small
+// teams can move from gitolite without rewriting their rules.
+//
+// A configuration looks like:
+//
+//	@admins = alice bob
+//	@devs   = carol @admins
+//
+//	repo gitolite-admin
+//	    RW+ = @admins
+//
+//	repo team/..*
+//	    C            = @devs
+//	    RW+ dev/     = @devs
+//	    RW  main     = @devs
+//	    -   main     = carol
+//	    R            = @all
+//	    T   v[0-9]   = @release
+//	    T+           = @admins
+//
+// Permissions are R (read), RW (push), RW+ (push, rewind and delete), C
+// (create repositories matching a pattern) and - (deny). Refexes which do
+// not start with refs/ are taken to be under refs/heads/. config and option
+// lines are ignored; include and VREF rules are not supported.
+//
+// Tags may be given their own permissions, so that release managers can tag
+// without being able to push branches and developers can push branches
+// without being able to tag: T creates tags, and T+ also moves and deletes
+// them. Refexes in T rules are taken to be under refs/tags/. Repositories
+// with no T rules treat tags like any other ref, as gitolite does.
+package gitolite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jspc/gitkit"
+	"golang.org/x/crypto/ssh"
+)
+
+// AllGroup matches every user
+const AllGroup = "@all"
+
+var (
+	ErrUnknownKey   = errors.New("gitolite: unknown key")
+	ErrAccessDenied = errors.New("gitolite: access denied")
+)
+
+// reRepoName matches plain repository names; anything else in a repo line
+// is treated as an anchored regular expression, as in gitolite
+var reRepoName = regexp.MustCompile(`^@?[0-9a-zA-Z][-0-9a-zA-Z._@/+]*$`)
+
+type rule struct {
+	perm  string
+	refex *regexp.Regexp // nil matches every ref
+	users []string
+	tag   bool // T or T+, which apply only to tags
+}
+
+type repoBlock struct {
+	names    []string
+	patterns []*regexp.Regexp
+	rules    []rule
+}
+
+// ACL holds parsed access rules and the keys users authenticate with
+type ACL struct {
+	groups map[string][]string
+	repos  []*repoBlock
+
+	mu   sync.RWMutex
+	keys map[string]string // fingerprint to user
+}
+
+// Load reads the configuration at confPath and, when keyDir is set, the
+// users' public keys from it
+func Load(confPath, keyDir string) (*ACL, error) {
+	f, err := os.Open(confPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl, err := Parse(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyDir != "" {
+		err = acl.LoadKeys(keyDir)
+	}
+
+	return acl, err
+}
+
+// Parse reads a gitolite style configuration
+func Parse(r io.Reader) (*ACL, error) {
+	acl := &ACL{
+		groups: make(map[string][]string),
+		keys:   make(map[string]string),
+	}
+
+	var current *repoBlock
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+
+		switch {
+		case strings.HasPrefix(fields[0], "@") && len(fields) > 1 && fields[1] == "=":
+			acl.groups[fields[0]] = append(acl.groups[fields[0]], fields[2:]...)
+
+		case fields[0] == "repo":
+			current, err = parseRepoLine(fields[1:])
+			if err == nil {
+				acl.repos = append(acl.repos, current)
+			}
+
+		case fields[0] == "config" || fields[0] == "option":
+			// Not relevant to access control
+
+		case fields[0] == "include" || fields[0] == "subconf":
+			err = fmt.Errorf("%s is not supported", fields[0])
+
+		default:
+			if current == nil {
+				err = fmt.Errorf("rule outside of a repo block")
+				break
+			}
+
+			var rules []rule
+			rules, err = parseRuleLine(fields)
+			current.rules = append(current.rules, rules...)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("gitolite: line %d: %w", n, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+func parseRepoLine(names []string) (*repoBlock, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("repo line names no repositories")
+	}
+
+	block := new(repoBlock)
+	for _, name := range names {
+		if reRepoName.MatchString(name) {
+			block.names = append(block.names, name)
+			continue
+		}
+
+		re, err := regexp.Compile("^(?:" + name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid repo pattern %q: %w", name, err)
+		}
+
+		block.patterns = append(block.patterns, re)
+	}
+
+	return block, nil
+}
+
+func parseRuleLine(fields []string) ([]rule, error) {
+	eq := -1
+	for i, f := range fields {
+		if f == "=" {
+			eq = i
+			break
+		}
+	}
+
+	if eq < 1 || eq == len(fields)-1 {
+		return nil, fmt.Errorf("malformed rule %q", strings.Join(fields, " "))
+	}
+
+	perm := fields[0]
+	switch perm {
+	case "R", "RW", "RW+", "C", "-", "T", "T+":
+	default:
+		return nil, fmt.Errorf("unsupported permission %q", perm)
+	}
+
+	users := fields[eq+1:]
+	refexes := fields[1:eq]
+	tag := strings.HasPrefix(perm, "T")
+
+	if len(refexes) == 0 {
+		return []rule{{perm: perm, users: users, tag: tag}}, nil
+	}
+
+	rules := make([]rule, 0, len(refexes))
+	for _, refex := range refexes {
+		if strings.HasPrefix(refex, "VREF/") {
+			return nil, fmt.Errorf("VREF rules are not supported")
+		}
+
+		if !strings.HasPrefix(refex, "refs/") {
+			if tag {
+				refex = "refs/tags/" + refex
+			} else {
+				refex = "refs/heads/" + refex
+			}
+		}
+
+		re, err := regexp.Compile("^" + refex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refex %q: %w", refex, err)
+		}
+
+		rules = append(rules, rule{perm: perm, refex: re, users: users, tag: tag})
+	}
+
+	return rules, nil
+}
+
+// LoadKeys reads public keys from the *.pub files in dir, and any
+// subdirectories. As with gitolite the file name, less any @location suffix,
+// names the user: alice.pub and alice@laptop.pub are both keys for alice,
+// while bob@example.com.pub is a key for bob@example.com.
+func (a *ACL) LoadKeys(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(p) != ".pub" {
+			return err
+		}
+
+		// A suffix without dots names a location; one with dots is part of
+		// an email style user name
+		user := strings.TrimSuffix(d.Name(), ".pub")
+		if i := strings.LastIndex(user, "@"); i > 0 && !strings.Contains(user[i:], ".") {
+			user = user[:i]
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		for len(data) > 0 {
+			var key ssh.PublicKey
+
+			key, _, _, data, err = ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				break
+			}
+
+			a.AddKey(user, key)
+		}
+
+		return nil
+	})
+}
+
+// AddKey allows user to authenticate with key
+func (a *ACL) AddKey(user string, key ssh.PublicKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.keys[ssh.FingerprintSHA256(key)] = user
+}
+
+// Wire installs the ACL's callbacks on s
+func (a *ACL) Wire(s *gitkit.SSH) {
+	s.PublicKeyLookupFunc = a.PublicKeyLookup
+	s.AuthoriseOperationFunc = a.AuthoriseOperation
+	s.AuthorisePushFunc = a.AuthorisePush
+	s.AutoCreateAuthoriseFunc = a.AuthoriseCreate
+}
+
+// PublicKeyLookup identifies the user owning key
+func (a *ACL) PublicKeyLookup(_ context.Context, key gitkit.PublicKeyLookup) (*gitkit.PublicKey, error) {
+	a.mu.RLock()
+	user, ok := a.keys[key.Fingerprint]
+	a.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return &gitkit.PublicKey{
+		Id:          user,
+		Name:        user,
+		Fingerprint: key.Fingerprint,
+		Content:     key.Payload,
+	}, nil
+}
+
+// AuthoriseOperation allows reads to users with R on the repository, and
+// pushes to those with W or T on at least one ref. Individual refs are
+// checked by AuthorisePush.
+func (a *ACL) AuthoriseOperation(ctx context.Context, cmd *gitkit.GitCommand) error {
+	user := userFromContext(ctx)
+
+	allowed := a.hasAny(user, cmd.Repo, "R")
+	if cmd.IsWrite() {
+		allowed = a.hasAny(user, cmd.Repo, "W") || a.hasAny(user, cmd.Repo, "T")
+	}
+
+	if !allowed {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+// AuthoriseCreate allows users with C on a matching repo pattern to create
+// repositories
+func (a *ACL) AuthoriseCreate(ctx context.Context, cmd *gitkit.GitCommand) error {
+	if !a.hasAny(userFromContext(ctx), cmd.Repo, "C") {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+// AuthorisePush checks each ref update. Deletes need RW+. Since whether an
+// update rewinds a ref cannot be known until objects are received, pushes
+// touching any ref the user may not rewind are applied with
+// receive.denyNonFastForwards set. In repositories with T rules, tag
+// creation needs T and moving or deleting a tag needs T+.
+func (a *ACL) AuthorisePush(ctx context.Context, cmd *gitkit.GitCommand, push *gitkit.PushRequest) error {
+	user := userFromContext(ctx)
+	denyRewind := false
+	tagRules := a.hasTagRules(cmd.Repo)
+
+	for _, u := range push.Updates {
+		if tagRules && strings.HasPrefix(u.Ref, "refs/tags/") {
+			need := "T"
+			if u.OldRev != gitkit.ZeroSHA {
+				need = "+"
+			}
+
+			if !a.allowed(user, cmd.Repo, u.Ref, need, true) {
+				return fmt.Errorf("%w: %s may not %s %s", ErrAccessDenied, user, describeTag(u), u.Ref)
+			}
+
+			continue
+		}
+
+		need := "W"
+		if u.NewRev == gitkit.ZeroSHA {
+			need = "+"
+		}
+
+		if !a.allowed(user, cmd.Repo, u.Ref, need, false) {
+			return fmt.Errorf("%w: %s may not %s %s", ErrAccessDenied, user, describe(need), u.Ref)
+		}
+
+		if !a.allowed(user, cmd.Repo, u.Ref, "+", false) {
+			denyRewind = true
+		}
+	}
+
+	if denyRewind {
+		push.GitConfig = append(push.GitConfig, "receive.denyNonFastForwards=true")
+	}
+
+	return nil
+}
+
+func describe(need string) string {
+	if need == "+" {
+		return "delete"
+	}
+
+	return "push to"
+}
+
+func describeTag(u gitkit.RefUpdate) string {
+	switch {
+	case u.NewRev == gitkit.ZeroSHA:
+		return "delete"
+	case u.OldRev != gitkit.ZeroSHA:
+		return "move"
+	}
+
+	return "create"
+}
+
+// allowed applies gitolite's ref level rules: the first rule for the user
+// and ref which either grants the permission or denies access decides.
+// Tag checks consider only T rules, and branch checks only the others;
+// deny rules apply to both.
+func (a *ACL) allowed(user, repo, ref, need string, tags bool) bool {
+	for _, r := range a.rulesFor(repo) {
+		if r.refex != nil && !r.refex.MatchString(ref) {
+			continue
+		}
+
+		if r.perm != "-" && r.tag != tags {
+			continue
+		}
+
+		if !a.matchesUser(r.users, user) {
+			continue
+		}
+
+		if r.perm == "-" {
+			return false
+		}
+
+		if strings.Contains(r.perm, need) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasAny reports whether any rule for the repository grants user perm,
+// regardless of ref. Deny rules do not apply, as with gitolite's default
+// treatment of read access.
+func (a *ACL) hasAny(user, repo, perm string) bool {
+	for _, r := range a.rulesFor(repo) {
+		if r.perm != "-" && strings.Contains(r.perm, perm) && a.matchesUser(r.users, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *ACL) hasTagRules(repo string) bool {
+	for _, r := range a.rulesFor(repo) {
+		if r.tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *ACL) rulesFor(repo string) []rule {
+	rules := []rule{}
+
+	for _, block := range a.repos {
+		if a.matchesRepo(block, repo) {
+			rules = append(rules, block.rules...)
+		}
+	}
+
+	return rules
+}
+
+func (a *ACL) matchesRepo(block *repoBlock, repo string) bool {
+	for _, re := range block.patterns {
+		if re.MatchString(repo) {
+			return true
+		}
+	}
+
+	for _, name := range a.expand(block.names, nil) {
+		if name == repo || name == AllGroup {
+			return true
+		}
+
+		if !reRepoName.MatchString(name) {
+			if ok, _ := regexp.MatchString("^(?:"+name+")$", repo); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *ACL) matchesUser(users []string, user string) bool {
+	for _, u := range a.expand(users, nil) {
+		if u == user || u == AllGroup {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expand resolves group references, guarding against cycles
+func (a *ACL) expand(names []string, seen map[string]bool) []string {
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+
+	out := []string{}
+	for _, name := range names {
+		members, isGroup := a.groups[name]
+		if !isGroup || seen[name] {
+			out = append(out, name)
+			continue
+		}
+
+		seen[name] = true
+		out = append(out, a.expand(members, seen)...)
+	}
+
+	return out
+}
+
+func userFromContext(ctx context.Context) string {
+	pk, _ := ctx.Value(gitkit.PublicKeyContextKey{}).(gitkit.PublicKey)
+
+	return pk.Name
+}
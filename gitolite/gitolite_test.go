@@ -0,0 +1,209 @@
+package gitolite
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jspc/gitkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+const testConfig = `
+# Sample configuration
+@admins = alice
+@devs   = carol @admins
+
+repo gitolite-admin
+    RW+ = @admins
+
+repo team/..*
+    C             = @devs
+    RW+ dev/      = @devs
+    -   main      = carol
+    RW  main      = @devs
+    R             = @all
+
+repo public
+    R   = @all
+    config hooks.mailinglist = list@example.com
+
+@release = erin
+
+repo product
+    RW+         = @devs
+    T   v[0-9]  = @release @admins
+    T+          = @admins
+    R           = @all
+`
+
+const sha = "e285100b636ac67fa28d85685072158edaa01685"
+
+func testACL(t *testing.T) *ACL {
+	t.Helper()
+
+	acl, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return acl
+}
+
+func userContext(user string) context.Context {
+	return context.WithValue(context.Background(), gitkit.PublicKeyContextKey{}, gitkit.PublicKey{Name: user})
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for name, conf := range map[string]string{
+		"Rule outside repo": "RW = alice",
+		"Bad permission":    "repo a\n  RWX = alice",
+		"Missing users":     "repo a\n  RW =",
+		"Include":           "include foo.conf",
+		"VREF":              "repo a\n  - VREF/NAME/secret = alice",
+		"Bad repo pattern":  "repo a[",
+		"Empty repo line":   "repo",
+		"Missing equals":    "repo a\n  RW alice",
+		"Invalid refex":     "repo a\n  RW ma(in = alice",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(conf))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestACL_AuthoriseOperation(t *testing.T) {
+	acl := testACL(t)
+
+	for _, test := range []struct {
+		user   string
+		cmd    string
+		repo   string
+		expect bool
+	}{
+		{"alice", "git-receive-pack", "gitolite-admin", true},
+		{"carol", "git-upload-pack", "gitolite-admin", false},
+		{"carol", "git-receive-pack", "team/project", true},
+		{"dave", "git-upload-pack", "team/project", true},
+		{"dave", "git-receive-pack", "team/project", false},
+		{"dave", "git-upload-pack", "public", true},
+		{"dave", "git-upload-pack", "private", false},
+	} {
+		t.Run(test.user+" "+test.cmd+" "+test.repo, func(t *testing.T) {
+			err := acl.AuthoriseOperation(userContext(test.user), &gitkit.GitCommand{Command: test.cmd, Repo: test.repo})
+			assert.Equal(t, test.expect, err == nil, err)
+		})
+	}
+}
+
+func TestACL_AuthoriseCreate(t *testing.T) {
+	acl := testACL(t)
+
+	assert.NoError(t, acl.AuthoriseCreate(userContext("carol"), &gitkit.GitCommand{Repo: "team/new"}))
+	assert.Error(t, acl.AuthoriseCreate(userContext("dave"), &gitkit.GitCommand{Repo: "team/new"}))
+	assert.Error(t, acl.AuthoriseCreate(userContext("carol"), &gitkit.GitCommand{Repo: "elsewhere"}))
+}
+
+func TestACL_AuthorisePush(t *testing.T) {
+	acl := testACL(t)
+	cmd := &gitkit.GitCommand{Command: "git-receive-pack", Repo: "team/project"}
+
+	for _, test := range []struct {
+		name             string
+		user             string
+		update           gitkit.RefUpdate
+		expectAllowed    bool
+		expectDenyRewind bool
+	}{
+		{"Admin pushes main", "alice", gitkit.RefUpdate{OldRev: sha, NewRev: sha, Ref: "refs/heads/main"}, true, true},
+		{"Denied user pushes main", "carol", gitkit.RefUpdate{OldRev: sha, NewRev: sha, Ref: "refs/heads/main"}, false, false},
+		{"Dev pushes dev branch", "carol", gitkit.RefUpdate{OldRev: sha, NewRev: sha, Ref: "refs/heads/dev/feature"}, true, false},
+		{"Dev deletes dev branch", "carol", gitkit.RefUpdate{OldRev: sha, NewRev: gitkit.ZeroSHA, Ref: "refs/heads/dev/feature"}, true, false},
+		{"Admin deletes main", "alice", gitkit.RefUpdate{OldRev: sha, NewRev: gitkit.ZeroSHA, Ref: "refs/heads/main"}, false, false},
+		{"Dev pushes tag", "carol", gitkit.RefUpdate{OldRev: gitkit.ZeroSHA, NewRev: sha, Ref: "refs/tags/v1"}, false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			push := &gitkit.PushRequest{Updates: []gitkit.RefUpdate{test.update}}
+
+			err := acl.AuthorisePush(userContext(test.user), cmd, push)
+			assert.Equal(t, test.expectAllowed, err == nil, err)
+
+			if test.expectAllowed {
+				assert.Equal(t, test.expectDenyRewind, len(push.GitConfig) > 0)
+			}
+		})
+	}
+}
+
+func TestACL_AuthorisePush_Tags(t *testing.T) {
+	acl := testACL(t)
+	cmd := &gitkit.GitCommand{Command: "git-receive-pack", Repo: "product"}
+
+	for _, test := range []struct {
+		name          string
+		user          string
+		update        gitkit.RefUpdate
+		expectAllowed bool
+	}{
+		{"Release manager creates tag", "erin", gitkit.RefUpdate{OldRev: gitkit.ZeroSHA, NewRev: sha, Ref: "refs/tags/v1.0"}, true},
+		{"Release manager creates unmatched tag", "erin", gitkit.RefUpdate{OldRev: gitkit.ZeroSHA, NewRev: sha, Ref: "refs/tags/nightly"}, false},
+		{"Release manager moves tag", "erin", gitkit.RefUpdate{OldRev: sha, NewRev: sha, Ref: "refs/tags/v1.0"}, false},
+		{"Release manager deletes tag", "erin", gitkit.RefUpdate{OldRev: sha, NewRev: gitkit.ZeroSHA, Ref: "refs/tags/v1.0"}, false},
+		{"Release manager pushes branch", "erin", gitkit.RefUpdate{OldRev: sha, NewRev: sha, Ref: "refs/heads/main"}, false},
+		{"Dev pushes branch", "carol", gitkit.RefUpdate{OldRev: sha, NewRev: sha, Ref: "refs/heads/main"}, true},
+		{"Dev creates tag", "carol", gitkit.RefUpdate{OldRev: gitkit.ZeroSHA, NewRev: sha, Ref: "refs/tags/v1.0"}, false},
+		{"Admin deletes tag", "alice", gitkit.RefUpdate{OldRev: sha, NewRev: gitkit.ZeroSHA, Ref: "refs/tags/nightly"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			push := &gitkit.PushRequest{Updates: []gitkit.RefUpdate{test.update}}
+
+			err := acl.AuthorisePush(userContext(test.user), cmd, push)
+			assert.Equal(t, test.expectAllowed, err == nil, err)
+		})
+	}
+
+	// Tag permissions are enough to push at all
+	assert.NoError(t, acl.AuthoriseOperation(userContext("erin"), cmd))
+	assert.Error(t, acl.AuthoriseOperation(userContext("dave"), cmd))
+}
+
+func TestACL_LoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	keys := map[string]ssh.PublicKey{}
+
+	for _, file := range []string{"alice.pub", "alice@laptop.pub", "sub/bob@example.com.pub"} {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+
+		key, err := ssh.NewPublicKey(pub)
+		assert.NoError(t, err)
+
+		keys[file] = key
+
+		p := filepath.Join(dir, file)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, os.WriteFile(p, ssh.MarshalAuthorizedKey(key), 0644))
+	}
+
+	acl := testACL(t)
+	assert.NoError(t, acl.LoadKeys(dir))
+
+	for file, user := range map[string]string{
+		"alice.pub":               "alice",
+		"alice@laptop.pub":        "alice",
+		"sub/bob@example.com.pub": "bob@example.com",
+	} {
+		pk, err := acl.PublicKeyLookup(context.Background(), gitkit.PublicKeyLookup{Fingerprint: ssh.FingerprintSHA256(keys[file])})
+		assert.NoError(t, err)
+		assert.Equal(t, user, pk.Name)
+	}
+
+	_, err := acl.PublicKeyLookup(context.Background(), gitkit.PublicKeyLookup{Fingerprint: "SHA256:unknown"})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
@@ -0,0 +1,85 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// HealthStatus describes the state of the server and the things it
+// depends on in order to serve git operations
+type HealthStatus struct {
+	Healthy    bool     `json:"healthy"`
+	Listening  bool     `json:"listening"`
+	DiskFree   uint64   `json:"disk_free"`
+	GitVersion string   `json:"git_version"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// Healthz checks whether the server is listening, whether Config.Dir has
+// enough free space, and whether the git binary can be executed
+func (s *SSH) Healthz() HealthStatus {
+	status := checkHealth(s.config)
+
+	status.Listening = s.currentListener() != nil
+	if !status.Listening {
+		status.Errors = append(status.Errors, "listener: not started")
+	}
+
+	status.Healthy = len(status.Errors) == 0
+
+	return status
+}
+
+// HealthHandler returns an http.Handler suitable for liveness and readiness
+// probes. /healthz always succeeds while the process is able to respond, and
+// /readyz responds with 503 Service Unavailable when Healthz reports errors
+func (s *SSH) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := s.Healthz()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(status)
+	})
+
+	return mux
+}
+
+func checkHealth(cfg *Config) (status HealthStatus) {
+	free, err := diskFree(cfg.Dir)
+	switch {
+	case errors.Is(err, errDiskFreeUnsupported):
+		// Free space cannot be told here, so is not checked
+
+	case err != nil:
+		status.Errors = append(status.Errors, fmt.Sprintf("disk: %v", err))
+
+	case cfg.MinDiskFree > 0 && free < cfg.MinDiskFree:
+		status.Errors = append(status.Errors, fmt.Sprintf("disk: %d bytes free, want at least %d", free, cfg.MinDiskFree))
+	}
+	status.DiskFree = free
+
+	out, err := exec.Command(cfg.GitPath, "version").Output()
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("git: %v", err))
+	}
+	status.GitVersion = strings.TrimSpace(string(out))
+
+	return
+}
+
+var errDiskFreeUnsupported = errors.New("disk free space is only reported on linux, darwin and freebsd")
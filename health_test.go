@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSSH_Healthz(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		config        Config
+		expectHealthy bool
+	}{
+		{"Missing listener is unhealthy", Config{Dir: t.TempDir()}, false},
+		{"Missing git binary is unhealthy", Config{Dir: t.TempDir(), GitPath: "/does/not/exist"}, false},
+		{"Missing repo dir is unhealthy", Config{Dir: "/does/not/exist"}, false},
+		{"Unreachable disk threshold is unhealthy", Config{Dir: t.TempDir(), MinDiskFree: 1 << 62}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSSH(test.config)
+
+			status := s.Healthz()
+			if status.Healthy != test.expectHealthy {
+				t.Errorf("expected healthy %v, received %v (%v)", test.expectHealthy, status.Healthy, status.Errors)
+			}
+		})
+	}
+}
+
+func TestSSH_HealthHandler(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir()})
+	h := s.HealthHandler()
+
+	for path, expect := range map[string]int{
+		"/healthz": http.StatusOK,
+		"/readyz":  http.StatusServiceUnavailable,
+	} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+			if w.Code != expect {
+				t.Errorf("expected %d, received %d", expect, w.Code)
+			}
+		})
+	}
+}
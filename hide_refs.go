@@ -0,0 +1,25 @@
+package gitkit
+
+// hideRefsConfig returns the -c options hiding refs from the client running
+// gitcmd, under the hideRefs setting of its subcommand. Each of refs is a
+// prefix, such as refs/pull/, or a pattern git's hideRefs accepts, such as
+// !refs/pull/1/ to show one ref beneath a hidden prefix.
+func hideRefsConfig(gitcmd *GitCommand, refs []string) []string {
+	var section string
+
+	switch gitcmd.SubCommand() {
+	case OperationReceivePack:
+		section = "receive"
+	case OperationUploadPack:
+		section = "uploadpack"
+	default:
+		return nil
+	}
+
+	args := []string{}
+	for _, ref := range refs {
+		args = append(args, "-c", section+".hideRefs="+ref)
+	}
+
+	return args
+}
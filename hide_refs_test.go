@@ -0,0 +1,66 @@
+package gitkit
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hideRefsConfig(t *testing.T) {
+	refs := []string{"refs/pull/", "!refs/pull/1/"}
+
+	assert.Equal(t, []string{
+		"-c", "uploadpack.hideRefs=refs/pull/",
+		"-c", "uploadpack.hideRefs=!refs/pull/1/",
+	}, hideRefsConfig(&GitCommand{Command: "git-upload-pack"}, refs))
+
+	assert.Equal(t, []string{
+		"-c", "receive.hideRefs=refs/pull/",
+		"-c", "receive.hideRefs=!refs/pull/1/",
+	}, hideRefsConfig(&GitCommand{Command: "git receive-pack"}, refs))
+
+	assert.Empty(t, hideRefsConfig(&GitCommand{Command: "git-upload-archive"}, refs))
+	assert.Empty(t, hideRefsConfig(&GitCommand{Command: "git-upload-pack"}, nil))
+}
+
+func TestSSH_HideRefsFunc(t *testing.T) {
+	var hide atomic.Bool
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.HideRefsFunc = func(_ context.Context, cmd *GitCommand) []string {
+			if !hide.Load() {
+				return nil
+			}
+
+			return []string{"refs/pull/"}
+		}
+	})
+
+	remote := testRemote(s, "test.git")
+	work := testWorkTree(t, s)
+
+	if out, err := testGit(t, s, work, "push", remote, "main", "main:refs/pull/1/head"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	hide.Store(true)
+
+	out, err := testGit(t, s, work, "ls-remote", remote)
+	if assert.NoError(t, err, out) {
+		assert.Contains(t, out, "refs/heads/main")
+		assert.NotContains(t, out, "refs/pull/")
+	}
+
+	out, err = testGit(t, s, work, "push", remote, "main:refs/pull/2/head")
+	assert.Error(t, err, out)
+
+	hide.Store(false)
+
+	out, err = testGit(t, s, work, "ls-remote", remote)
+	if assert.NoError(t, err, out) {
+		assert.Contains(t, out, "refs/pull/1/head")
+		assert.NotContains(t, out, "refs/pull/2/head")
+	}
+}
@@ -0,0 +1,51 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Environment variables git, and so its hooks, are run with, describing
+// who ran the command and from where
+const (
+	HookEnvKey        = "GITKIT_KEY"         // PublicKey.Id
+	HookEnvKeyName    = "GITKIT_KEY_NAME"    // PublicKey.Name
+	HookEnvUser       = "GITKIT_USER"        // ssh user the client logged in as
+	HookEnvRemoteAddr = "GITKIT_REMOTE_ADDR" // Client address, as host:port
+)
+
+// hookEnv returns the environment git runs gitcmd with: whatever
+// HookEnvFunc adds, then gitkit's own variables, which may not be replaced
+func (s SSH) hookEnv(ctx context.Context, gitcmd *GitCommand) []string {
+	env := []string{}
+
+	if s.HookEnvFunc != nil {
+		extra := s.HookEnvFunc(ctx, gitcmd)
+
+		for k, v := range extra {
+			if k == "" || strings.ContainsAny(k, "=\x00") || strings.ContainsRune(v, 0) {
+				logError("hook env", fmt.Errorf("ignoring invalid variable %q", k))
+
+				continue
+			}
+
+			env = append(env, k+"="+v)
+		}
+
+		sort.Strings(env)
+	}
+
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+	user, _ := ctx.Value(UserContextKey{}).(string)
+	addr, _ := ctx.Value(RemoteAddrContextKey{}).(string)
+
+	// Later values win, so these are kept whatever HookEnvFunc returns
+	return append(env,
+		HookEnvKey+"="+pk.Id,
+		HookEnvKeyName+"="+pk.Name,
+		HookEnvUser+"="+user,
+		HookEnvRemoteAddr+"="+addr,
+	)
+}
@@ -0,0 +1,117 @@
+package gitkit
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_hookEnv(t *testing.T) {
+	s := NewSSH(Config{})
+	s.HookEnvFunc = func(_ context.Context, cmd *GitCommand) map[string]string {
+		return map[string]string{
+			"TEAM":        "infra",
+			"REPO":        cmd.Repo,
+			"GITKIT_USER": "root",
+			"BAD=NAME":    "x",
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "1", Name: "alice"})
+	ctx = context.WithValue(ctx, UserContextKey{}, "git")
+	ctx = context.WithValue(ctx, RemoteAddrContextKey{}, "192.0.2.1:56324")
+
+	assert.Equal(t, []string{
+		"GITKIT_USER=root",
+		"REPO=team/app",
+		"TEAM=infra",
+		"GITKIT_KEY=1",
+		"GITKIT_KEY_NAME=alice",
+		"GITKIT_USER=git",
+		"GITKIT_REMOTE_ADDR=192.0.2.1:56324",
+	}, s.hookEnv(ctx, &GitCommand{Command: "git-receive-pack", Repo: "team/app"}))
+}
+
+func TestSSH_HookEnvFunc(t *testing.T) {
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.HookEnvFunc = func(_ context.Context, cmd *GitCommand) map[string]string {
+			return map[string]string{"GITKIT_OPERATION": cmd.SubCommand(), "GITKIT_USER": "root"}
+		}
+	})
+
+	repo := filepath.Join(s.config.Dir, "test")
+	if err := initRepo(repo, s.config); err != nil {
+		t.Fatal(err)
+	}
+
+	envFile := filepath.Join(t.TempDir(), "env")
+	hook := "#!/bin/sh\ncat >/dev/null\nenv | grep ^GITKIT_ | sort > " + envFile + "\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	out, err := os.ReadFile(envFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	env := strings.Split(strings.TrimSpace(string(out)), "\n")
+	assert.Contains(t, env, "GITKIT_OPERATION=receive-pack")
+	// Without Auth no user is known, but HookEnvFunc still cannot claim one
+	assert.Contains(t, env, "GITKIT_USER=")
+	assert.Contains(t, env, "GITKIT_KEY_NAME=")
+
+	var addr string
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "GITKIT_REMOTE_ADDR="); ok {
+			addr = v
+		}
+	}
+
+	assert.True(t, strings.HasPrefix(addr, "127.0.0.1:"), addr)
+}
+
+func TestSSH_hookEnv_ClientEnv(t *testing.T) {
+	s := startTestSSH(t, Config{AllowedEnv: []string{"GIT_PROTOCOL", HookEnvUser}}, nil)
+
+	repo := filepath.Join(s.config.Dir, "test")
+	if err := initRepo(repo, s.config); err != nil {
+		t.Fatal(err)
+	}
+
+	envFile := filepath.Join(t.TempDir(), "env")
+	hook := "#!/bin/sh\ncat >/dev/null\nenv | grep ^GITKIT_USER= > " + envFile + "\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(s.Address())
+
+	// Even where allowed, clients cannot set gitkit's own variables
+	cmd := exec.Command("git", "push", testRemote(s, "test.git"), "main")
+	cmd.Dir = testWorkTree(t, s)
+	cmd.Env = append(os.Environ(),
+		"GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR -o SetEnv="+HookEnvUser+"=root -p "+port,
+	)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	out, err := os.ReadFile(envFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "GITKIT_USER=", strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,239 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrHostKeyRotating   = errors.New("a host key rotation is already in progress")
+	ErrNoHostKeyRotation = errors.New("no host key rotation is in progress")
+	ErrHostKeysFixed     = errors.New("host keys can only be rotated once Listen has set up the server's own ssh config")
+)
+
+// HostKeyRotation describes a new host key while both it and the keys it
+// replaces are served. The new key is always ed25519. Clients are offered
+// whichever key their known_hosts asks for, except where an old key has the
+// same type as the new one: ssh servers offer a single key of each type, so
+// clients keep seeing the old key until the rotation finishes, and should
+// be given the new one beforehand.
+type HostKeyRotation struct {
+	PublicKey     ssh.PublicKey
+	Fingerprint   string
+	AuthorizedKey string    // The new key in authorized_keys format, as known_hosts takes after the host name
+	PrivateKey    []byte    // PEM encoded; only kept in KeyDir when the server's keys come from there
+	Started       time.Time // When RotateHostKey was called
+	Ends          time.Time // When the old keys stop being served. Zero for rotations found in KeyDir at startup, which finish with FinishHostKeyRotation.
+}
+
+// hostKeyRing holds the host keys served, and any rotation in progress.
+// Once keys have been rotated, each connection's ssh config is built from
+// base, since keys cannot be removed from an ssh.ServerConfig.
+type hostKeyRing struct {
+	mu       sync.Mutex
+	base     *ssh.ServerConfig // Server config without host keys; nil when given with SetSSHConfig
+	signers  []ssh.Signer
+	next     ssh.Signer
+	rotation *HostKeyRotation
+	rotated  bool
+	timer    *time.Timer
+}
+
+// serverConfig returns the ssh config for a new connection, or nil when
+// the keys have never been rotated and the server's own config serves
+func (r *hostKeyRing) serverConfig() *ssh.ServerConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.rotated {
+		return nil
+	}
+
+	config := *r.base
+
+	// The new key goes first, so that old keys of the same type take its
+	// place until the rotation finishes
+	if r.next != nil {
+		config.AddHostKey(r.next)
+	}
+
+	for _, signer := range r.signers {
+		config.AddHostKey(signer)
+	}
+
+	return &config
+}
+
+func (r *hostKeyRing) add(signer ssh.Signer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.signers = append(r.signers, signer)
+}
+
+// RotateHostKey generates a new host key and serves it alongside the
+// existing ones for grace, after which only the new key is served. When the
+// server's key is kept in KeyDir the new key is written next to it, as
+// gitkit.rsa.next, and replaces it once the rotation finishes; otherwise the
+// new key is only held in memory, and should be stored from
+// HostKeyRotation.PrivateKey by the caller.
+func (s *SSH) RotateHostKey(grace time.Duration) (HostKeyRotation, error) {
+	s.hostKeys.mu.Lock()
+	defer s.hostKeys.mu.Unlock()
+
+	if s.hostKeys.base == nil {
+		return HostKeyRotation{}, ErrHostKeysFixed
+	}
+
+	if s.hostKeys.next != nil {
+		return HostKeyRotation{}, ErrHostKeyRotating
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return HostKeyRotation{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return HostKeyRotation{}, err
+	}
+
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return HostKeyRotation{}, err
+	}
+
+	if s.keysFromDir() {
+		if err := writeHostKey(s.nextKeyPath(), privateKey, signer.PublicKey()); err != nil {
+			return HostKeyRotation{}, fmt.Errorf("unable to write new host key: %w", err)
+		}
+	}
+
+	rotation := newHostKeyRotation(signer, privateKey)
+	rotation.Ends = rotation.Started.Add(grace)
+
+	s.hostKeys.next, s.hostKeys.rotation, s.hostKeys.rotated = signer, rotation, true
+	s.hostKeys.timer = time.AfterFunc(grace, func() {
+		if err := s.FinishHostKeyRotation(); err != nil && !errors.Is(err, ErrNoHostKeyRotation) {
+			logError("host key rotation", err)
+		}
+	})
+
+	return *rotation, nil
+}
+
+// FinishHostKeyRotation stops serving the old host keys straight away,
+// rather than waiting for the grace period to end
+func (s *SSH) FinishHostKeyRotation() error {
+	s.hostKeys.mu.Lock()
+	defer s.hostKeys.mu.Unlock()
+
+	if s.hostKeys.next == nil {
+		return ErrNoHostKeyRotation
+	}
+
+	if s.keysFromDir() {
+		keyPath := s.config.KeyPath()
+
+		for _, move := range [][2]string{
+			{keyPath, keyPath + ".old"},
+			{keyPath + ".pub", keyPath + ".old.pub"},
+			{s.nextKeyPath(), keyPath},
+			{s.nextKeyPath() + ".pub", keyPath + ".pub"},
+		} {
+			err := os.Rename(move[0], move[1])
+			if err != nil && !(os.IsNotExist(err) && strings.HasSuffix(move[0], ".pub")) {
+				return fmt.Errorf("unable to replace host key: %w", err)
+			}
+		}
+	}
+
+	if s.hostKeys.timer != nil {
+		s.hostKeys.timer.Stop()
+	}
+
+	s.hostKeys.signers = []ssh.Signer{s.hostKeys.next}
+	s.hostKeys.next, s.hostKeys.rotation, s.hostKeys.timer = nil, nil, nil
+
+	return nil
+}
+
+// HostKeyRotation returns the host key rotation in progress, if any
+func (s *SSH) HostKeyRotation() (HostKeyRotation, bool) {
+	s.hostKeys.mu.Lock()
+	defer s.hostKeys.mu.Unlock()
+
+	if s.hostKeys.rotation == nil {
+		return HostKeyRotation{}, false
+	}
+
+	return *s.hostKeys.rotation, true
+}
+
+func newHostKeyRotation(signer ssh.Signer, privateKey []byte) *HostKeyRotation {
+	return &HostKeyRotation{
+		PublicKey:     signer.PublicKey(),
+		Fingerprint:   ssh.FingerprintSHA256(signer.PublicKey()),
+		AuthorizedKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		PrivateKey:    privateKey,
+		Started:       time.Now(),
+	}
+}
+
+// keysFromDir reports whether the server's host key is the one kept in
+// KeyDir, rather than given with AddHostSigner or Config.HostKeys
+func (s *SSH) keysFromDir() bool {
+	return len(s.hostSigners) == 0 && len(s.config.HostKeys) == 0
+}
+
+func (s *SSH) nextKeyPath() string {
+	return s.config.KeyPath() + ".next"
+}
+
+// loadNextHostKey picks up a rotation left unfinished in KeyDir by a
+// previous run, so that both keys carry on being served
+func (s *SSH) loadNextHostKey() error {
+	privateKey, err := os.ReadFile(s.nextKeyPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("new host key: %w", err)
+	}
+
+	s.hostKeys.next, s.hostKeys.rotated = signer, true
+	s.hostKeys.rotation = newHostKeyRotation(signer, privateKey)
+
+	if info, err := os.Stat(s.nextKeyPath()); err == nil {
+		s.hostKeys.rotation.Started = info.ModTime()
+	}
+
+	return nil
+}
+
+func writeHostKey(path string, privateKey []byte, pub ssh.PublicKey) error {
+	if err := os.WriteFile(path, privateKey, 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(pub), 0644)
+}
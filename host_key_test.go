@@ -0,0 +1,144 @@
+package gitkit
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testHostKeyDial connects to s offering only algorithm, and returns the
+// host key the server presented
+func testHostKeyDial(t *testing.T, s *SSH, algorithm string) (ssh.PublicKey, error) {
+	t.Helper()
+
+	var hostKey ssh.PublicKey
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:              "git",
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client.Close()
+
+	return hostKey, nil
+}
+
+func TestSSH_RotateHostKey(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+
+	oldKey, err := testHostKeyDial(t, s, ssh.KeyAlgoRSASHA256)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = testHostKeyDial(t, s, ssh.KeyAlgoED25519)
+	assert.Error(t, err)
+
+	rotation, err := s.RotateHostKey(time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, ssh.FingerprintSHA256(rotation.PublicKey), rotation.Fingerprint)
+	assert.Equal(t, rotation.Started.Add(time.Hour), rotation.Ends)
+
+	_, err = s.RotateHostKey(time.Hour)
+	assert.ErrorIs(t, err, ErrHostKeyRotating)
+
+	current, ok := s.HostKeyRotation()
+	assert.True(t, ok)
+	assert.Equal(t, rotation.Fingerprint, current.Fingerprint)
+
+	// Both keys are served while the rotation runs
+	key, err := testHostKeyDial(t, s, ssh.KeyAlgoRSASHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey.Marshal(), key.Marshal())
+
+	key, err = testHostKeyDial(t, s, ssh.KeyAlgoED25519)
+	assert.NoError(t, err)
+	assert.Equal(t, rotation.PublicKey.Marshal(), key.Marshal())
+
+	// A restart part way through carries on serving both
+	restarted := startTestSSH(t, Config{KeyDir: s.config.KeyDir}, nil)
+
+	pending, ok := restarted.HostKeyRotation()
+	assert.True(t, ok)
+	assert.Equal(t, rotation.Fingerprint, pending.Fingerprint)
+	assert.True(t, pending.Ends.IsZero())
+
+	_, err = testHostKeyDial(t, restarted, ssh.KeyAlgoRSASHA256)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.FinishHostKeyRotation())
+	assert.ErrorIs(t, s.FinishHostKeyRotation(), ErrNoHostKeyRotation)
+
+	_, ok = s.HostKeyRotation()
+	assert.False(t, ok)
+
+	_, err = testHostKeyDial(t, s, ssh.KeyAlgoRSASHA256)
+	assert.Error(t, err)
+
+	key, err = testHostKeyDial(t, s, ssh.KeyAlgoED25519)
+	assert.NoError(t, err)
+	assert.Equal(t, rotation.PublicKey.Marshal(), key.Marshal())
+
+	// The new key has taken the old one's place in KeyDir
+	data, err := os.ReadFile(s.config.KeyPath())
+	assert.NoError(t, err)
+
+	signer, err := ssh.ParsePrivateKey(data)
+	assert.NoError(t, err)
+	assert.Equal(t, rotation.Fingerprint, ssh.FingerprintSHA256(signer.PublicKey()))
+
+	_, err = os.Stat(s.config.KeyPath() + ".old")
+	assert.NoError(t, err)
+
+	_, err = os.Stat(s.nextKeyPath())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSSH_RotateHostKey_Grace(t *testing.T) {
+	s := startTestSSH(t, Config{HostKeys: [][]byte{testHostKeyPEM(t)}, KeyDir: t.TempDir()}, nil)
+
+	rotation, err := s.RotateHostKey(10 * time.Millisecond)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Keys given in config are not written to KeyDir, so are left to the
+	// caller to store
+	signer, err := ssh.ParsePrivateKey(rotation.PrivateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, rotation.Fingerprint, ssh.FingerprintSHA256(signer.PublicKey()))
+
+	files, _ := filepath.Glob(filepath.Join(s.config.KeyDir, "*"))
+	assert.Empty(t, files)
+
+	assert.Eventually(t, func() bool {
+		_, ok := s.HostKeyRotation()
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = testHostKeyDial(t, s, ssh.KeyAlgoRSASHA256)
+	assert.Error(t, err)
+}
+
+func TestSSH_RotateHostKey_SetSSHConfig(t *testing.T) {
+	s := NewSSH(Config{})
+	s.SetSSHConfig(&ssh.ServerConfig{})
+
+	_, err := s.RotateHostKey(time.Hour)
+	assert.ErrorIs(t, err, ErrHostKeysFixed)
+}
@@ -2,12 +2,16 @@ package gitkit
 
 import (
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 	"syscall"
 )
@@ -23,6 +27,39 @@ type Server struct {
 	config   Config
 	services []service
 	AuthFunc func(Credential, *Request) (bool, error)
+
+	// BasicAuthFunc and BearerTokenFunc authenticate requests when
+	// Config.Auth is set, taking the place of AuthFunc. They return the
+	// identity to serve the request as, in the same form as SSH key
+	// lookups, so that callbacks written for SSH, such as a gitolite ACL,
+	// can protect both transports.
+	BasicAuthFunc   func(ctx context.Context, user, pass string) (*PublicKey, error)
+	BearerTokenFunc func(ctx context.Context, token string) (*PublicKey, error)
+
+	// AuthoriseOperationFunc is called for every request with the git
+	// command an ssh client would run for it, git-upload-pack for fetches
+	// and git-receive-pack for pushes. Returning an error refuses the
+	// request.
+	AuthoriseOperationFunc func(ctx context.Context, cmd *GitCommand) error
+
+	// AuthoriseRequestFunc is called after AuthoriseOperationFunc with the
+	// same command and details of the request, such as the client's
+	// identity, address and protocol version. Returning an error refuses
+	// the request.
+	AuthoriseRequestFunc func(ctx context.Context, req *OperationRequest) error
+
+	// AutoCreateAuthoriseFunc, when set, is called before AutoCreate
+	// initialises a missing repository. Returning an error prevents creation.
+	AutoCreateAuthoriseFunc func(*Request) error
+
+	// RepoCreatedFunc, when set, is called once AutoCreate has initialised
+	// a repository, with the identity of the client, as SSH.RepoCreatedFunc
+	// is
+	RepoCreatedFunc func(ctx context.Context, repo string, pk PublicKey)
+
+	// Store, when set to the Store an SSH server keeps its state in, has
+	// requests for repositories it quarantines refused
+	Store Store
 }
 
 type Request struct {
@@ -49,6 +86,10 @@ func New(cfg Config) *Server {
 
 // findService returns a matching git subservice and parsed repository name
 func (s *Server) findService(req *http.Request) (*service, string) {
+	if repo, _, ok := findArchive(req); ok {
+		return &service{http.MethodGet, "", s.getArchive, ""}, repo
+	}
+
 	for _, svc := range s.services {
 		if svc.method == req.Method && strings.HasSuffix(req.URL.Path, svc.suffix) {
 			path := strings.Replace(req.URL.Path, svc.suffix, "", 1)
@@ -82,55 +123,117 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		RepoPath: path.Join(s.config.Dir, repoNamespace, repoName),
 	}
 
-	if s.config.Auth {
-		if s.AuthFunc == nil {
-			logError("auth", fmt.Errorf("no auth backend provided"))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if err := s.config.RepoNames.Validate(req.RepoName); err != nil {
+		logError("auth", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if !withinDir(s.config.Dir, req.RepoPath) {
+		logError("auth", fmt.Errorf("%w: %s", ErrPathTraversal, repoUrlPath))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-		cred, err := getCredential(r)
-		if err != nil {
-			logError("auth", err)
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	rpc := "git-upload-pack"
+	if svc.rpc == "git-receive-pack" || r.URL.Query().Get("service") == "git-receive-pack" {
+		rpc = "git-receive-pack"
+	}
 
-		allow, err := s.AuthFunc(cred, req)
-		if !allow || err != nil {
-			if err != nil {
-				logError("auth", err)
-			}
+	op := subCommand(rpc)
+	if _, _, ok := findArchive(r); ok {
+		op = OperationUploadArchive
+	}
 
-			logError("auth", fmt.Errorf("rejected user %s", cred.Username))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if !s.config.operationAllowed(op) {
+		logError("auth", fmt.Errorf("%w: %s", ErrOperationDisabled, op))
+		http.Error(w, "Forbidden: operation is disabled", http.StatusForbidden)
+		return
+	}
+
+	ctx, ok := s.authenticate(w, req, rpc == "git-receive-pack")
+	if !ok {
+		return
 	}
 
-	if !repoExists(req.RepoPath) && s.config.AutoCreate {
-		err := initRepo(req.RepoName, &s.config)
+	req.Request = r.WithContext(ctx)
+
+	if err := s.authoriseOperation(ctx, req, rpc); err != nil {
+		logError("auth", err)
+		http.Error(w, clientMessage(err, "Forbidden"), http.StatusForbidden)
+		return
+	}
+
+	if s.config.ReadOnly && rpc == "git-receive-pack" {
+		logError("read-only", fmt.Errorf("rejected push to %s", req.RepoName))
+		http.Error(w, "Forbidden: server is read-only", http.StatusForbidden)
+		return
+	}
+
+	if !repoExists(req.RepoPath) && s.config.autoCreate() {
+		err := s.authoriseAutoCreate(req)
+		if err == nil {
+			err = initRepo(req.RepoPath, &s.config)
+		}
+
 		if err != nil {
 			logError("repo-init", err)
+		} else if s.RepoCreatedFunc != nil {
+			pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+			s.RepoCreatedFunc(ctx, req.RepoName, pk)
 		}
 	}
 
 	if !repoExists(req.RepoPath) {
-		logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
+		logError("repo-init", fmt.Errorf("%w: %s", ErrRepoNotFound, req.RepoName))
 		http.NotFound(w, r)
 		return
 	}
 
+	if msg, err := s.config.refuseForState("", req.RepoPath, &GitCommand{Command: rpc, Repo: req.RepoName}); err != nil {
+		logError("repo-state", err)
+
+		status := http.StatusForbidden
+		if errors.Is(err, ErrRepoNotFound) {
+			status = http.StatusNotFound
+		}
+
+		http.Error(w, strings.TrimSpace(msg), status)
+		return
+	}
+
+	if held, err := quarantined(s.Store, req.RepoPath); held || err != nil {
+		if err == nil {
+			err = fmt.Errorf("%w: %s", ErrQuarantined, req.RepoName)
+		}
+
+		logError("quarantine", err)
+		http.Error(w, strings.TrimSpace(s.config.Message("", MsgQuarantined, &GitCommand{Command: rpc, Repo: req.RepoName})), http.StatusForbidden)
+		return
+	}
+
+	if rpc == "git-receive-pack" {
+		release, err := lockForWrite(req.RepoPath)
+		if err != nil {
+			logError("repo-lock", err)
+			http.Error(w, strings.TrimSpace(s.config.Message("", MsgRepoLocked, &GitCommand{Command: rpc, Repo: req.RepoName})), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
 	svc.handler(svc.rpc, w, req)
 }
 
+func (s *Server) authoriseAutoCreate(req *Request) error {
+	if s.AutoCreateAuthoriseFunc == nil {
+		return nil
+	}
+
+	return s.AutoCreateAuthoriseFunc(req)
+}
+
 func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 	context := "get-info-refs"
 	rpc := r.URL.Query().Get("service")
@@ -140,7 +243,7 @@ func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 		return
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
+	cmd, pipe := gitCommand(&s.config, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
 	if err := cmd.Start(); err != nil {
 		fail500(w, context, err)
 		return
@@ -185,7 +288,7 @@ func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 		}
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
+	cmd, pipe := gitCommand(&s.config, subCommand(rpc), "--stateless-rpc", r.RepoPath)
 	defer pipe.Close()
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -224,29 +327,88 @@ func (s *Server) Setup() error {
 	return s.config.Setup()
 }
 
-func initRepo(name string, config *Config) error {
-	fullPath := path.Join(config.Dir, name)
+func initRepo(fullPath string, config *Config) error {
+	return initRepoFromTemplate(fullPath, config, config.RepoTemplate)
+}
+
+// initRepoFromTemplate initialises a bare repository, seeding it from tmpl
+// when set
+func initRepoFromTemplate(fullPath string, config *Config, tmpl *RepoTemplate) error {
+	if config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// Namespaced repositories, such as team/project, need their parent
+	// directories creating first
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
 
 	if err := exec.Command(config.GitPath, "init", "--bare", fullPath).Run(); err != nil {
 		return err
 	}
 
-	if config.AutoHooks && config.Hooks != nil {
+	// Setting HEAD after the fact, rather than with --initial-branch, works
+	// with versions of git from before 2.28
+	if config.DefaultBranch != "" {
+		if out, err := exec.Command(config.GitPath, "--git-dir", fullPath, "symbolic-ref", "HEAD", "refs/heads/"+config.DefaultBranch).CombinedOutput(); err != nil {
+			return fmt.Errorf("default branch %q: %w: %s", config.DefaultBranch, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if tmpl != nil {
+		if err := tmpl.apply(config.GitPath, config.TmpDir, fullPath); err != nil {
+			return err
+		}
+	}
+
+	if config.AutoHooks && config.Hooks != nil && !config.ReadOnly {
 		return config.Hooks.setupInDir(fullPath)
 	}
 
 	return nil
 }
 
+// listRepos walks dir and returns the names of all bare repositories,
+// including those nested under namespaces
+func listRepos(dir string) ([]string, error) {
+	repos := []string{}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() || p == dir {
+			return nil
+		}
+
+		if repoExists(p) {
+			name, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+
+			repos = append(repos, name)
+
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	return repos, err
+}
+
 func repoExists(p string) bool {
 	_, err := os.Stat(path.Join(p, "objects"))
 	return err == nil
 }
 
-func gitCommand(name string, args ...string) (*exec.Cmd, io.ReadCloser) {
-	cmd := exec.Command(name, args...)
+func gitCommand(config *Config, args ...string) (*exec.Cmd, io.ReadCloser) {
+	cmd := exec.Command(config.GitPath, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	cmd.Env = os.Environ()
+	cmd.Env = append(os.Environ(), config.tmpEnv()...)
 
 	r, _ := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
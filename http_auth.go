@@ -0,0 +1,150 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// authenticate checks the request's credentials when Config.Auth is set,
+// returning the context to serve it with: one carrying the PublicKey and
+// user the credentials belong to, as SSH connections do. On failure the
+// response has already been written.
+func (s *Server) authenticate(w http.ResponseWriter, req *Request, write bool) (context.Context, bool) {
+	ctx := context.WithValue(req.Context(), RemoteAddrContextKey{}, req.RemoteAddr)
+
+	if !s.config.Auth {
+		return ctx, true
+	}
+
+	if s.AuthFunc == nil && s.BasicAuthFunc == nil && s.BearerTokenFunc == nil {
+		logError("auth", fmt.Errorf("no auth backend provided"))
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return nil, false
+	}
+
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		if s.config.AnonymousRead && !write {
+			return ctx, true
+		}
+
+		s.challenge(w)
+
+		return nil, false
+	}
+
+	pk, err := s.credentialKey(ctx, req, header)
+	if err != nil {
+		logError("auth", err)
+		s.challenge(w)
+
+		return nil, false
+	}
+
+	ctx = context.WithValue(ctx, PublicKeyContextKey{}, *pk)
+	ctx = context.WithValue(ctx, UserContextKey{}, pk.Name)
+
+	return ctx, true
+}
+
+// credentialKey authenticates the Authorization header with BearerTokenFunc
+// or BasicAuthFunc, falling back to AuthFunc for basic credentials
+func (s *Server) credentialKey(ctx context.Context, req *Request, header string) (*PublicKey, error) {
+	var (
+		pk  *PublicKey
+		err error
+	)
+
+	scheme, token, _ := strings.Cut(header, " ")
+
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		if s.BearerTokenFunc == nil {
+			return nil, fmt.Errorf("bearer tokens are not accepted")
+		}
+
+		pk, err = s.BearerTokenFunc(ctx, strings.TrimSpace(token))
+
+	case s.BasicAuthFunc != nil:
+		cred, cerr := getCredential(req.Request)
+		if cerr != nil {
+			return nil, cerr
+		}
+
+		pk, err = s.BasicAuthFunc(ctx, cred.Username, cred.Password)
+
+	case s.AuthFunc != nil:
+		cred, cerr := getCredential(req.Request)
+		if cerr != nil {
+			return nil, cerr
+		}
+
+		allow, aerr := s.AuthFunc(cred, req)
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		if !allow {
+			return nil, fmt.Errorf("rejected user %s", cred.Username)
+		}
+
+		pk = &PublicKey{Id: cred.Username, Name: cred.Username}
+
+	default:
+		return nil, fmt.Errorf("basic credentials are not accepted")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pk == nil {
+		return nil, fmt.Errorf("auth handler did not return a key")
+	}
+
+	return pk, nil
+}
+
+// challenge asks the client for credentials it may offer
+func (s *Server) challenge(w http.ResponseWriter) {
+	if s.AuthFunc != nil || s.BasicAuthFunc != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm=""`)
+	}
+
+	if s.BearerTokenFunc != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm=""`)
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// authoriseOperation passes the request to AuthoriseOperationFunc and
+// AuthoriseRequestFunc as the git command an ssh client would have run for
+// it
+func (s *Server) authoriseOperation(ctx context.Context, req *Request, rpc string) error {
+	gitcmd := &GitCommand{
+		Command:  rpc,
+		Repo:     req.RepoName,
+		Original: fmt.Sprintf("%s '%s'", rpc, req.RepoName),
+	}
+
+	if s.AuthoriseOperationFunc != nil {
+		if err := s.AuthoriseOperationFunc(ctx, gitcmd); err != nil {
+			return err
+		}
+	}
+
+	if s.AuthoriseRequestFunc == nil {
+		return nil
+	}
+
+	env := map[string]string{}
+	if v := req.Header.Get("Git-Protocol"); v != "" {
+		env["GIT_PROTOCOL"] = v
+	}
+
+	return s.AuthoriseRequestFunc(ctx, newOperationRequest(ctx, gitcmd, env))
+}
@@ -0,0 +1,198 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestHTTP serves a Server with an empty team/test.git repository
+func startTestHTTP(t *testing.T, cfg Config, setup func(*Server)) *httptest.Server {
+	t.Helper()
+
+	cfg.Dir, cfg.GitPath = t.TempDir(), "git"
+
+	if err := initRepo(filepath.Join(cfg.Dir, "team", "test.git"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(cfg)
+	if setup != nil {
+		setup(s)
+	}
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func testHTTPRefs(t *testing.T, srv *httptest.Server, service string, auth func(*http.Request)) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/team/test.git/info/refs?service="+service, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != nil {
+		auth(req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	return resp
+}
+
+func basicAuth(user, pass string) func(*http.Request) {
+	return func(req *http.Request) { req.SetBasicAuth(user, pass) }
+}
+
+func bearerAuth(token string) func(*http.Request) {
+	return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func TestServer_BasicAuthFunc(t *testing.T) {
+	var mu sync.Mutex
+	users := []string{}
+
+	srv := startTestHTTP(t, Config{Auth: true}, func(s *Server) {
+		s.BasicAuthFunc = func(_ context.Context, user, pass string) (*PublicKey, error) {
+			if user != "alice" || pass != "secret" {
+				return nil, errors.New("bad credentials")
+			}
+
+			return &PublicKey{Id: "1", Name: user}, nil
+		}
+
+		s.AuthoriseOperationFunc = func(ctx context.Context, cmd *GitCommand) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			users = append(users, ctx.Value(PublicKeyContextKey{}).(PublicKey).Name)
+
+			return nil
+		}
+	})
+
+	resp := testHTTPRefs(t, srv, "git-upload-pack", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, []string{`Basic realm=""`}, resp.Header.Values("WWW-Authenticate"))
+
+	resp = testHTTPRefs(t, srv, "git-upload-pack", basicAuth("alice", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-upload-pack", bearerAuth("secret"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-upload-pack", basicAuth("alice", "secret"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{"alice"}, users)
+}
+
+func TestServer_BearerTokenFunc(t *testing.T) {
+	srv := startTestHTTP(t, Config{Auth: true}, func(s *Server) {
+		s.BearerTokenFunc = func(_ context.Context, token string) (*PublicKey, error) {
+			if token != "t0ken" {
+				return nil, errors.New("unknown token")
+			}
+
+			return &PublicKey{Id: "ci", Name: "ci"}, nil
+		}
+	})
+
+	resp := testHTTPRefs(t, srv, "git-upload-pack", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, []string{`Bearer realm=""`}, resp.Header.Values("WWW-Authenticate"))
+
+	resp = testHTTPRefs(t, srv, "git-upload-pack", bearerAuth("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-upload-pack", basicAuth("ci", "t0ken"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-receive-pack", bearerAuth("t0ken"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_AnonymousRead(t *testing.T) {
+	srv := startTestHTTP(t, Config{Auth: true, AnonymousRead: true}, func(s *Server) {
+		s.BasicAuthFunc = func(_ context.Context, user, _ string) (*PublicKey, error) {
+			return &PublicKey{Name: user}, nil
+		}
+	})
+
+	resp := testHTTPRefs(t, srv, "git-upload-pack", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-receive-pack", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-receive-pack", basicAuth("alice", "secret"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_AuthoriseOperationFunc(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		cmds []GitCommand
+	)
+
+	srv := startTestHTTP(t, Config{}, func(s *Server) {
+		s.AuthoriseOperationFunc = func(_ context.Context, cmd *GitCommand) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			cmds = append(cmds, *cmd)
+
+			if cmd.IsWrite() {
+				return errors.New("read only for you")
+			}
+
+			return nil
+		}
+	})
+
+	resp := testHTTPRefs(t, srv, "git-upload-pack", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-receive-pack", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []GitCommand{
+		{Command: "git-upload-pack", Repo: "team/test.git", Original: "git-upload-pack 'team/test.git'"},
+		{Command: "git-receive-pack", Repo: "team/test.git", Original: "git-receive-pack 'team/test.git'"},
+	}, cmds)
+}
+
+func TestServer_AuthFunc(t *testing.T) {
+	srv := startTestHTTP(t, Config{Auth: true}, func(s *Server) {
+		s.AuthFunc = func(cred Credential, _ *Request) (bool, error) {
+			return cred.Username == "alice" && cred.Password == "secret", nil
+		}
+	})
+
+	resp := testHTTPRefs(t, srv, "git-upload-pack", basicAuth("alice", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testHTTPRefs(t, srv, "git-upload-pack", basicAuth("alice", "secret"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
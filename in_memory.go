@@ -0,0 +1,183 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+)
+
+// storerLoader serves a single repository's storage to a go-git server
+type storerLoader struct {
+	st storer.Storer
+}
+
+func (l storerLoader) Load(*transport.Endpoint) (storer.Storer, error) {
+	return l.st, nil
+}
+
+// checkInMemory refuses callbacks and ref policies which pushes served in
+// memory would skip, as go-git applies them without gitkit reading them first, so that
+// policies are not configured only to go unenforced
+func (s *SSH) checkInMemory() error {
+	if !s.config.InMemory {
+		return nil
+	}
+
+	if err := s.config.checkRefPolicyInMemory(); err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"AuthoriseRefUpdateFunc", s.AuthoriseRefUpdateFunc != nil},
+		{"AuthorisePushFunc", s.AuthorisePushFunc != nil},
+		{"VerifyPushCertificateFunc", s.VerifyPushCertificateFunc != nil},
+	} {
+		if f.set {
+			return fmt.Errorf("%s: %w in memory", f.name, ErrOperationDisabled)
+		}
+	}
+
+	return nil
+}
+
+// serveInMemory serves gitcmd from s.Repositories with go-git, in place of
+// running git against loc.Path. Archives are not available in memory.
+func (s SSH) serveInMemory(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, loc repoLocation) (err error) {
+	if gitcmd.SubCommand() == OperationUploadArchive {
+		ch.Write([]byte(s.message(ctx, sess, MsgOperationDisabled)))
+
+		return fmt.Errorf("%w: %s in memory", ErrOperationDisabled, gitcmd.SubCommand())
+	}
+
+	st, err := s.Repositories.Open(loc.Name)
+	if errors.Is(err, ErrRepoNotFound) && loc.AutoCreate && !loc.ReadOnly {
+		if err = s.authoriseAutoCreate(ctx, sess, ch, gitcmd); err != nil {
+			return err
+		}
+
+		if st, err = s.Repositories.Create(loc.Name); err == nil {
+			s.repoCreated(ctx, gitcmd.Repo)
+		}
+	}
+
+	if errors.Is(err, ErrRepoNotFound) {
+		ch.Write([]byte(s.message(ctx, sess, MsgRepoNotFound)))
+
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx, span := s.startSpan(ctx, "gitkit.exec", attribute.String("gitkit.backend", "memory"))
+	defer func() { endSpan(span, err) }()
+
+	ep, err := transport.NewEndpoint(loc.Name)
+	if err != nil {
+		return err
+	}
+
+	req.Reply(true, nil)
+
+	srv := server.NewServer(storerLoader{st: st})
+
+	if gitcmd.IsWrite() {
+		err = serveReceivePack(ctx, srv, ep, ch)
+	} else {
+		err = serveUploadPack(ctx, srv, ep, ch)
+	}
+
+	if err != nil {
+		sendExitStatus(ch, 1)
+
+		return fmt.Errorf("ssh: in-memory %s: %w", gitcmd.SubCommand(), err)
+	}
+
+	return sendExitStatus(ch, 0)
+}
+
+func serveUploadPack(ctx context.Context, srv transport.Transport, ep *transport.Endpoint, rw io.ReadWriter) error {
+	sess, err := srv.NewUploadPackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ar.Encode(rw); err != nil {
+		return err
+	}
+
+	upreq := packp.NewUploadPackRequest()
+	if err := upreq.Decode(rw); err != nil {
+		// Clients which want nothing, such as those already up to date or
+		// cloning an empty repository, hang up once refs are advertised
+		if errors.Is(err, io.EOF) || upreq.IsEmpty() {
+			return nil
+		}
+
+		return err
+	}
+
+	resp, err := sess.UploadPack(ctx, upreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	return resp.Encode(rw)
+}
+
+func serveReceivePack(ctx context.Context, srv transport.Transport, ep *transport.Endpoint, rw io.ReadWriter) error {
+	sess, err := srv.NewReceivePackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ar.Encode(rw); err != nil {
+		return err
+	}
+
+	// The packfile is closed once read, which must not close the channel
+	// before the report status is sent
+	rur := packp.NewReferenceUpdateRequest()
+	if err := rur.Decode(struct{ io.Reader }{rw}); err != nil {
+		// Clients with nothing to push hang up once refs are advertised
+		if errors.Is(err, io.EOF) || errors.Is(err, packp.ErrEmpty) {
+			return nil
+		}
+
+		return err
+	}
+
+	rs, err := sess.ReceivePack(ctx, rur)
+	if rs != nil {
+		if encErr := rs.Encode(rw); encErr != nil && err == nil {
+			err = encErr
+		}
+	}
+
+	return err
+}
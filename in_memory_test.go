@@ -0,0 +1,149 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_InMemory(t *testing.T) {
+	store := NewMemoryRepositoryStore()
+
+	s := startTestSSH(t, Config{InMemory: true, AutoCreate: true}, func(s *SSH) {
+		s.Repositories = store
+	})
+
+	work := testWorkTree(t, s)
+	if err := os.WriteFile(filepath.Join(work, "README"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"add", "README"},
+		{"commit", "-q", "-m", "readme"},
+		{"push", testRemote(s, "test.git"), "main"},
+	} {
+		if out, err := testGit(t, s, work, args...); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	repo, err := store.Repository("test")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	head, err := testGit(t, s, work, "rev-parse", "main")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName("main"), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, head[:40], ref.Hash().String())
+	}
+
+	clone := t.TempDir()
+	if out, err := testGit(t, s, clone, "clone", "-q", "-b", "main", testRemote(s, "test.git"), "."); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	readme, err := os.ReadFile(filepath.Join(clone, "README"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello\n", string(readme))
+	}
+
+	// Later pushes and fetches send only what the other side lacks
+	for _, step := range []struct {
+		dir  string
+		args []string
+	}{
+		{clone, []string{"commit", "-q", "--allow-empty", "-m", "second"}},
+		{clone, []string{"push", "-q", "origin", "main"}},
+		{work, []string{"pull", "-q", "--ff-only", testRemote(s, "test.git"), "main"}},
+		{clone, []string{"fetch", "-q", "origin"}},
+	} {
+		if out, err := testGit(t, s, step.dir, step.args...); err != nil {
+			t.Fatalf("git %v: %v\n%s", step.args, err, out)
+		}
+	}
+
+	entries, err := os.ReadDir(s.config.Dir)
+	if assert.NoError(t, err) {
+		assert.Empty(t, entries)
+	}
+
+	repos, err := s.listAllRepos()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test"}, repos)
+}
+
+func TestSSH_InMemory_Refused(t *testing.T) {
+	s := startTestSSH(t, Config{InMemory: true}, nil)
+	work := testWorkTree(t, s)
+
+	if out, err := testGit(t, s, work, "push", testRemote(s, "missing.git"), "main"); err == nil {
+		t.Fatalf("expected push to a missing repository to fail\n%s", out)
+	}
+
+	assert.True(t, errors.Is(s.Report().LastError, ErrRepoNotFound))
+
+	if _, err := s.Repositories.Create("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := testGit(t, s, work, "archive", "--remote", testRemote(s, "test.git"), "main"); err == nil {
+		t.Fatalf("expected archive to be refused\n%s", out)
+	}
+
+	assert.True(t, errors.Is(s.Report().LastError, ErrOperationDisabled))
+}
+
+func TestSSH_InMemory_PushChecks(t *testing.T) {
+	for name, setup := range map[string]func(*SSH){
+		"AuthoriseRefUpdateFunc": func(s *SSH) {
+			s.AuthoriseRefUpdateFunc = func(context.Context, *GitCommand, RefUpdate, string) error { return nil }
+		},
+		"AuthorisePushFunc": func(s *SSH) {
+			s.AuthorisePushFunc = func(context.Context, *GitCommand, *PushRequest) error { return nil }
+		},
+		"VerifyPushCertificateFunc": func(s *SSH) {
+			s.VerifyPushCertificateFunc = func(context.Context, *GitCommand, *PushCertificate) error { return nil }
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := NewSSH(Config{InMemory: true, KeyDir: t.TempDir()})
+			setup(s)
+
+			err := s.Listen("127.0.0.1:0")
+			if !assert.ErrorIs(t, err, ErrOperationDisabled) {
+				s.Stop()
+			}
+		})
+	}
+}
+
+func TestSSH_InMemory_RefPolicy(t *testing.T) {
+	for name, config := range map[string]Config{
+		"config":  {InMemory: true, RefPolicy: RefPolicy{Protected: []string{"main"}}},
+		"deletes": {InMemory: true, RefPolicy: RefPolicy{DenyDeletes: true}},
+		"route":   {InMemory: true, Routes: []Route{{Pattern: "team/*", RefPolicy: &RefPolicy{DenyForcePush: true}}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config.KeyDir = t.TempDir()
+
+			s := NewSSH(config)
+			if err := s.Listen("127.0.0.1:0"); !assert.ErrorIs(t, err, ErrOperationDisabled) {
+				s.Stop()
+			}
+		})
+	}
+
+	s := startTestSSH(t, Config{InMemory: true}, nil)
+	assert.ErrorIs(t, s.ReloadConfig(Config{InMemory: true, RefPolicy: RefPolicy{DenyTagDeletion: true}}), ErrOperationDisabled)
+}
@@ -0,0 +1,77 @@
+package gitkit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKeepaliveCountMax is how many keepalives in a row may go
+// unanswered before a connection is closed, when Config.KeepaliveCountMax
+// is not set
+const DefaultKeepaliveCountMax = 3
+
+// keepaliveRequest is the global request OpenSSH servers send as a
+// keepalive. Clients answer it, if only to refuse it, which is enough to
+// show they are still there.
+const keepaliveRequest = "keepalive@openssh.com"
+
+// keepalive sends a keepalive request over conn every
+// Config.KeepaliveInterval until ctx is done, so that NAT and firewalls in
+// between keep the connection open while git is quiet, such as when
+// pack-objects is counting objects for a large clone. Connections leaving
+// Config.KeepaliveCountMax requests in a row unanswered are closed.
+func (s SSH) keepalive(ctx context.Context, conn ssh.Conn) {
+	interval := s.config.KeepaliveInterval
+	if interval <= 0 {
+		return
+	}
+
+	max := s.config.KeepaliveCountMax
+	if max <= 0 {
+		max = DefaultKeepaliveCountMax
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// One request is outstanding at a time, so the reply never blocks
+	replies := make(chan struct{}, 1)
+
+	var (
+		pending bool
+		missed  int
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-replies:
+			pending, missed = false, 0
+
+		case <-ticker.C:
+			if pending {
+				if missed++; missed >= max {
+					log.Printf("ssh: closing connection from %s after %d unanswered keepalives", conn.RemoteAddr(), missed)
+					conn.Close()
+
+					return
+				}
+
+				continue
+			}
+
+			pending = true
+
+			go func() {
+				if _, _, err := conn.SendRequest(keepaliveRequest, true, nil); err == nil {
+					replies <- struct{}{}
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gitkit
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testKeepaliveClient connects to s, handing the server's global requests
+// to handle
+func testKeepaliveClient(t *testing.T, s *SSH, handle func(*ssh.Request)) ssh.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	go func() {
+		for req := range reqs {
+			handle(req)
+		}
+	}()
+
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "no channels")
+		}
+	}()
+
+	return c
+}
+
+func TestSSH_Keepalive(t *testing.T) {
+	s := startTestSSH(t, Config{KeepaliveInterval: 20 * time.Millisecond, KeepaliveCountMax: 2}, nil)
+
+	var received atomic.Int32
+
+	// Refusing the request, as OpenSSH clients do, still counts as an answer
+	c := testKeepaliveClient(t, s, func(req *ssh.Request) {
+		if req.Type == keepaliveRequest {
+			received.Add(1)
+		}
+
+		req.Reply(false, nil)
+	})
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.GreaterOrEqual(t, received.Load(), int32(3))
+
+	// The connection is still open
+	_, _, err := c.SendRequest("ping@example.com", true, nil)
+	assert.NoError(t, err)
+}
+
+func TestSSH_Keepalive_Unanswered(t *testing.T) {
+	s := startTestSSH(t, Config{KeepaliveInterval: 20 * time.Millisecond, KeepaliveCountMax: 2}, nil)
+
+	c := testKeepaliveClient(t, s, func(*ssh.Request) {})
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Wait() }()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to close the connection")
+	}
+}
+
+func TestSSH_Keepalive_Disabled(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+
+	var received atomic.Int32
+	testKeepaliveClient(t, s, func(req *ssh.Request) {
+		received.Add(1)
+		req.Reply(false, nil)
+	})
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Zero(t, received.Load())
+}
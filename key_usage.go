@@ -0,0 +1,53 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// KeyUsage describes a key being used to run a command
+type KeyUsage struct {
+	PublicKey PublicKey
+	Time      time.Time
+	RemoteIP  string // Client address, without its port
+	Operation string // git subcommand, such as upload-pack or receive-pack
+	Repo      string
+}
+
+// KeyUsageRecorder records each use of a key, such as to show when it was
+// last used or to disable keys which have gone stale. It is told of every
+// command a key-authenticated client is authorised to run, before the
+// command starts. Failing to record a use does not refuse the command; the
+// error is recorded in the server's Report.
+type KeyUsageRecorder interface {
+	RecordKeyUsage(ctx context.Context, usage KeyUsage) error
+}
+
+// recordKeyUsage tells KeyUsageRecorder, if set, that the client's key is
+// running gitcmd
+func (s SSH) recordKeyUsage(ctx context.Context, gitcmd *GitCommand) {
+	if s.KeyUsageRecorder == nil || !s.config.Auth {
+		return
+	}
+
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+	addr, _ := ctx.Value(RemoteAddrContextKey{}).(string)
+
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+
+	err := s.KeyUsageRecorder.RecordKeyUsage(ctx, KeyUsage{
+		PublicKey: pk,
+		Time:      time.Now(),
+		RemoteIP:  ip,
+		Operation: gitcmd.SubCommand(),
+		Repo:      gitcmd.Repo,
+	})
+	if err != nil {
+		s.state.recordError(fmt.Errorf("recording key usage: %w", err))
+	}
+}
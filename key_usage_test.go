@@ -0,0 +1,70 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type testKeyUsageRecorder struct {
+	mu    sync.Mutex
+	usage []KeyUsage
+	err   error
+}
+
+func (r *testKeyUsageRecorder) RecordKeyUsage(_ context.Context, usage KeyUsage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.usage = append(r.usage, usage)
+
+	return r.err
+}
+
+func TestSSH_KeyUsageRecorder(t *testing.T) {
+	signer := testClientSigner(t)
+	recorder := &testKeyUsageRecorder{err: errors.New("database is down")}
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "1", Name: "alice"},
+	}, func(s *SSH) {
+		s.config.AutoCreate = true
+		s.KeyUsageRecorder = recorder
+	})
+
+	client, err := testKeyDial(s, signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+
+	// Commands still run when their use cannot be recorded
+	sess.Stdin = strings.NewReader("0000")
+	out, err := sess.Output("git-upload-pack 'test.git'")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, out)
+	assert.ErrorContains(t, s.Report().LastError, "database is down")
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if assert.Len(t, recorder.usage, 1) {
+		usage := recorder.usage[0]
+		assert.Equal(t, "alice", usage.PublicKey.Name)
+		assert.Equal(t, "127.0.0.1", usage.RemoteIP)
+		assert.Equal(t, OperationUploadPack, usage.Operation)
+		assert.Equal(t, "test", usage.Repo)
+		assert.False(t, usage.Time.IsZero())
+	}
+}
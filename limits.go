@@ -0,0 +1,199 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults for the limits placed on what clients send, used when the
+// equivalent Config fields are zero
+const (
+	DefaultMaxHandshakeBytes = 8 << 20
+	DefaultMaxRequestPayload = 8 << 10
+)
+
+// Security event types, emitted before abusive connections are closed
+const (
+	EventMalformedInput = "security.malformed_input"
+	EventLimitExceeded  = "security.limit_exceeded"
+)
+
+var (
+	ErrMalformedInput = errors.New("malformed pkt-line from client")
+	ErrLimitExceeded  = errors.New("client exceeded request limits")
+)
+
+type connContextKey struct{}
+
+func (c *Config) maxHandshakeBytes() int64 {
+	if c.MaxHandshakeBytes > 0 {
+		return c.MaxHandshakeBytes
+	}
+
+	return DefaultMaxHandshakeBytes
+}
+
+func (c *Config) maxRequestPayload() int {
+	if c.MaxRequestPayload > 0 {
+		return c.MaxRequestPayload
+	}
+
+	return DefaultMaxRequestPayload
+}
+
+// claimSession counts the connection in ctx against pk's
+// Config.MaxSessionsPerKey, refusing the key should it have as many
+// connections as it is allowed
+func (s SSH) claimSession(ctx context.Context, pk PublicKey) error {
+	max := s.config.MaxSessionsPerKey
+	if max <= 0 {
+		return nil
+	}
+
+	tc, ok := ctx.Value(trackedConnContextKey{}).(*trackedConn)
+	if !ok || s.state.claimKey(tc, pk.Fingerprint, max) {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: key %s already has %d sessions", ErrLimitExceeded, pk.Fingerprint, max)
+
+	addr, _ := ctx.Value(RemoteAddrContextKey{}).(string)
+
+	s.emit(context.WithValue(ctx, PublicKeyContextKey{}, pk), Event{Type: EventLimitExceeded, Data: map[string]string{
+		"error":       err.Error(),
+		"remote_addr": addr,
+	}})
+
+	return err
+}
+
+// reject emits a security event of type kind and closes the client's
+// connection
+func (s SSH) reject(ctx context.Context, kind string, err error) {
+	addr, _ := ctx.Value(RemoteAddrContextKey{}).(string)
+
+	s.emit(ctx, Event{Type: kind, Data: map[string]string{
+		"error":       err.Error(),
+		"remote_addr": addr,
+	}})
+
+	if conn, ok := ctx.Value(connContextKey{}).(ssh.Conn); ok {
+		conn.Close()
+	}
+}
+
+// checkRequestPayload rejects ssh requests with oversized payloads
+func (s SSH) checkRequestPayload(ctx context.Context, req *ssh.Request) error {
+	if len(req.Payload) <= s.config.maxRequestPayload() {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %s request payload of %d bytes", ErrLimitExceeded, req.Type, len(req.Payload))
+	s.reject(ctx, EventLimitExceeded, err)
+
+	return err
+}
+
+// guardInput wraps what a client sends to git, checking that it opens with
+// well formed pkt-lines and that the first section, up to a flush-pkt, is
+// within Config.MaxHandshakeBytes. Anything after is passed on unchecked,
+// since pushes go on to send packfiles.
+func (s SSH) guardInput(ctx context.Context, r io.Reader) io.Reader {
+	return &handshakeGuard{
+		r:     r,
+		limit: s.config.maxHandshakeBytes(),
+		fail: func(kind string, err error) {
+			s.reject(ctx, kind, err)
+		},
+	}
+}
+
+type handshakeGuard struct {
+	r     io.Reader
+	limit int64
+	fail  func(kind string, err error)
+
+	read   int64
+	header []byte // header of the current pkt-line, while incomplete
+	remain int    // payload bytes left in the current pkt-line
+	done   bool
+	err    error
+}
+
+func (g *handshakeGuard) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+
+	n, err := g.r.Read(p)
+	if g.done || n == 0 {
+		return n, err
+	}
+
+	g.read += int64(n)
+
+	kind, verr := g.scan(p[:n])
+	if verr == nil && !g.done && g.read > g.limit {
+		kind, verr = EventLimitExceeded, fmt.Errorf("%w: no flush-pkt within %d bytes", ErrLimitExceeded, g.limit)
+	}
+
+	if verr != nil {
+		g.err = verr
+		g.fail(kind, verr)
+
+		return 0, verr
+	}
+
+	return n, err
+}
+
+// scan follows pkt-line boundaries through p until a flush-pkt is seen
+func (g *handshakeGuard) scan(p []byte) (string, error) {
+	for len(p) > 0 && !g.done {
+		if g.remain > 0 {
+			skip := g.remain
+			if skip > len(p) {
+				skip = len(p)
+			}
+
+			g.remain -= skip
+			p = p[skip:]
+
+			continue
+		}
+
+		g.header = append(g.header, p[0])
+		p = p[1:]
+
+		if len(g.header) < 4 {
+			continue
+		}
+
+		l, err := strconv.ParseUint(string(g.header), 16, 16)
+		g.header = g.header[:0]
+
+		switch {
+		case err != nil:
+			return EventMalformedInput, fmt.Errorf("%w: invalid length header", ErrMalformedInput)
+
+		case l == 0:
+			g.done = true
+
+		case l == 1 || l == 2:
+			// delim-pkt and response-end-pkt, from protocol v2
+
+		case l == 3 || l > maxPktLen:
+			return EventMalformedInput, fmt.Errorf("%w: invalid length %d", ErrMalformedInput, l)
+
+		default:
+			g.remain = int(l) - 4
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,125 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeGuard(t *testing.T) {
+	for name, test := range map[string]struct {
+		input  string
+		limit  int64
+		expect error
+	}{
+		"Valid":              {"0032want e285100b636ac67fa28d85685072158edaa01685\n0000PACK garbage", 1024, nil},
+		"Protocol v2":        {"0014command=ls-refs\n00010009peel\n0000", 1024, nil},
+		"Garbage":            {"GET / HTTP/1.1\r\n", 1024, ErrMalformedInput},
+		"Reserved length":    {"0003", 1024, ErrMalformedInput},
+		"Oversized pkt-line": {"fff1", 1024, ErrMalformedInput},
+		"No flush":           {strings.Repeat("0008abcd", 20), 64, ErrLimitExceeded},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var failed string
+
+			g := &handshakeGuard{
+				r:     bytes.NewReader([]byte(test.input)),
+				limit: test.limit,
+				fail:  func(kind string, _ error) { failed = kind },
+			}
+
+			// Read a byte at a time to exercise split headers
+			_, err := io.Copy(io.Discard, oneByteReader{g})
+
+			if !errors.Is(err, test.expect) {
+				t.Errorf("expected %v, received %v", test.expect, err)
+			}
+
+			if (test.expect != nil) != (failed != "") {
+				t.Errorf("unexpected failure callback %q", failed)
+			}
+		})
+	}
+}
+
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return o.r.Read(p[:1])
+}
+
+func TestSSH_MalformedInput(t *testing.T) {
+	events := make(chan Event, 10)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) { events <- e }
+	})
+
+	client := testSSHClient(t, s)
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	stdin, _ := sess.StdinPipe()
+	stdout, _ := sess.StdoutPipe()
+
+	if err := sess.Start("git-receive-pack 'test.git'"); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin.Write([]byte("this is not a pkt-line\n"))
+	io.Copy(io.Discard, stdout)
+
+	select {
+	case e := <-events:
+		if e.Type != EventMalformedInput {
+			t.Errorf("expected %s, received %s", EventMalformedInput, e.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected security event")
+	}
+
+	if err := client.Wait(); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
+
+func TestSSH_MaxRequestPayload(t *testing.T) {
+	events := make(chan Event, 10)
+
+	s := startTestSSH(t, Config{MaxRequestPayload: 64}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) { events <- e }
+	})
+
+	client := testSSHClient(t, s)
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	if err := sess.Run("git-upload-pack '" + strings.Repeat("a", 128) + ".git'"); err == nil {
+		t.Error("expected error")
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != EventLimitExceeded {
+			t.Errorf("expected %s, received %s", EventLimitExceeded, e.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected security event")
+	}
+}
@@ -0,0 +1,142 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables systemd passes sockets to activated services with
+const (
+	ListenPIDEnv     = "LISTEN_PID"
+	ListenFDsEnv     = "LISTEN_FDS"
+	ListenFDNamesEnv = "LISTEN_FDNAMES"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets as
+const listenFDsStart = 3
+
+// ErrNoActivation is returned by ListenSystemd when the process was not
+// started by systemd socket activation
+var ErrNoActivation = errors.New("no sockets passed by systemd")
+
+// ListenUnix listens on a unix socket at path, for running behind a local
+// proxy without binding a tcp port. A socket left at path by a server which
+// is no longer running is replaced.
+func (s *SSH) ListenUnix(path string) error {
+	return s.Listen("unix:" + path)
+}
+
+// ListenSystemd listens on the sockets systemd passed the process through
+// socket activation, as given in LISTEN_FDS. The activation variables are
+// unset, so that git and hooks do not take the sockets for their own.
+func (s *SSH) ListenSystemd() error {
+	return s.listenWith(systemdListeners)
+}
+
+// listenAll binds each of binds, closing those already bound should one
+// fail
+func listenAll(binds []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(binds))
+	for _, bind := range binds {
+		listener, err := listen(bind)
+		if err != nil {
+			closeListeners(listeners)
+
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// listen binds a tcp address, or a unix socket when bind begins unix:
+func listen(bind string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(bind, "unix:")
+	if !ok {
+		return net.Listen("tcp", bind)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket removes a socket at path which nothing is listening on,
+// as left by a server which did not shut down cleanly. Anything else at
+// path is left for net.Listen to refuse.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+
+		return nil
+	}
+
+	return os.Remove(path)
+}
+
+// systemdListeners returns listeners for the sockets systemd passed to
+// this process
+func systemdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv(ListenPIDEnv)
+		os.Unsetenv(ListenFDsEnv)
+		os.Unsetenv(ListenFDNamesEnv)
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv(ListenPIDEnv)); err != nil || pid != os.Getpid() {
+		return nil, ErrNoActivation
+	}
+
+	n, err := strconv.Atoi(os.Getenv(ListenFDsEnv))
+	if err != nil || n < 1 {
+		return nil, ErrNoActivation
+	}
+
+	return fileListeners(listenFDsStart, n, strings.Split(os.Getenv(ListenFDNamesEnv), ":"))
+}
+
+// fileListeners returns listeners for the n sockets open as consecutive
+// file descriptors from start, named by names where given
+func fileListeners(start, n int, names []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(start+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(start+i), name)
+
+		listener, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			closeListeners(listeners)
+
+			return nil, fmt.Errorf("ssh: socket %s from systemd: %w", name, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
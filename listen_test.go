@@ -0,0 +1,119 @@
+package gitkit
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSocketPath returns a path for a unix socket, which are limited to
+// around 100 bytes, more than t.TempDir may give
+func testSocketPath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "gitkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "ssh.sock")
+}
+
+func TestSSH_ListenUnix(t *testing.T) {
+	sock := testSocketPath(t)
+
+	// A socket left behind by a server which went away
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+	if !assert.NoError(t, s.ListenUnix(sock)) {
+		return
+	}
+
+	go s.Serve()
+	defer s.Stop()
+
+	client, err := ssh.Dial("unix", sock, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+
+	// Sockets in use are not
+	other := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+	assert.Error(t, other.ListenUnix(sock))
+}
+
+func TestSSH_ListenSystemd_NoActivation(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"unset":         {},
+		"another pid":   {ListenPIDEnv: strconv.Itoa(os.Getpid() + 1), ListenFDsEnv: "1"},
+		"no sockets":    {ListenPIDEnv: strconv.Itoa(os.Getpid()), ListenFDsEnv: "0"},
+		"invalid count": {ListenPIDEnv: strconv.Itoa(os.Getpid()), ListenFDsEnv: "many"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+
+			s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+			assert.ErrorIs(t, s.ListenSystemd(), ErrNoActivation)
+
+			_, set := os.LookupEnv(ListenFDsEnv)
+			assert.False(t, set)
+		})
+	}
+}
+
+func Test_fileListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// As systemd would pass it, on a descriptor of the process's own
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := fileListeners(fd, 1, []string{"gitkit.socket"})
+	if !assert.NoError(t, err) || !assert.Len(t, listeners, 1) {
+		return
+	}
+	defer listeners[0].Close()
+
+	assert.Equal(t, l.Addr().String(), listeners[0].Addr().String())
+
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+	if !assert.NoError(t, s.listenWith(func() ([]net.Listener, error) { return listeners, nil })) {
+		return
+	}
+
+	go s.Serve()
+	defer s.Stop()
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ErrMaintenanceRunning is returned when maintenance is requested for a
+// repository which already has maintenance in progress
+var ErrMaintenanceRunning = errors.New("maintenance already running for repository")
+
+// maintenanceLocks ensures only one maintenance task runs against a
+// repository at any one time
+type maintenanceLocks struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func (m *maintenanceLocks) acquire(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running == nil {
+		m.running = make(map[string]bool)
+	}
+
+	if m.running[path] {
+		return false
+	}
+
+	m.running[path] = true
+
+	return true
+}
+
+func (m *maintenanceLocks) release(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.running, path)
+}
+
+// maintain runs each git command in turn against repo while holding its
+// maintenance lock, emitting kind.started, kind.completed and kind.failed
+// events
+func (s *SSH) maintain(ctx context.Context, kind, repo string, commands ...[]string) error {
+	loc, err := s.current().resolveRepo(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	if !repoExists(loc.Path) {
+		return fmt.Errorf("%s: repository %s does not exist", kind, repo)
+	}
+
+	if !s.maintenance.acquire(loc.Path) {
+		return ErrMaintenanceRunning
+	}
+	defer s.maintenance.release(loc.Path)
+
+	release, err := lockForMaintenance(loc.Path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", kind, err)
+	}
+	defer release()
+
+	start := time.Now()
+	s.emit(ctx, Event{Type: kind + ".started", Repo: repo})
+
+	for _, args := range commands {
+		cmd := exec.CommandContext(ctx, s.config.GitPath, append([]string{"-C", loc.Path}, args...)...)
+		cmd.Env = append(os.Environ(), s.config.tmpEnv()...)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%s: git %s: %w: %s", kind, args[0], err, out)
+
+			s.emit(ctx, Event{Type: kind + ".failed", Repo: repo, Data: map[string]string{"error": err.Error()}})
+
+			return err
+		}
+	}
+
+	s.emit(ctx, Event{Type: kind + ".completed", Repo: repo, Data: map[string]string{
+		"duration": time.Since(start).String(),
+	}})
+
+	return nil
+}
+
+// Prewarm prepares a repository for heavy load, such as ahead of a release:
+// objects are repacked into a single pack with a reachability bitmap, which
+// clones can stream without recompressing, and a commit-graph is written to
+// speed up negotiation and history walks. Events of type prewarm.started,
+// prewarm.completed and prewarm.failed report progress. Repositories with
+// forks keep the objects they no longer refer to, which forks may.
+//
+// With PackCache and PackCacheMaxBytes set, the response to a full clone is
+// then generated and kept, so that the first protocol v2 clones after a
+// prewarm are served from the cache too. Only clones asking for exactly what
+// git clone asks for without a terminal, such as those CI runners make,
+// match it.
+func (s *SSH) Prewarm(ctx context.Context, repo string) error {
+	forks, err := s.Forks(repo)
+	if err != nil {
+		return fmt.Errorf("prewarm: unable to list forks: %w", err)
+	}
+
+	commands := [][]string{{"repack", "-a", "-d", "-b"}}
+	if len(forks) > 0 {
+		commands = [][]string{keepForkObjectsArgs, {"repack", "-a", "-d", "-k", "-b"}}
+	}
+
+	err = s.maintain(ctx, "prewarm", repo, append(commands,
+		[]string{"commit-graph", "write", "--reachable", "--changed-paths"},
+	)...)
+	if err != nil {
+		return err
+	}
+
+	// The pack cache only speeds clones up, so failing to prime it is
+	// logged rather than failing the prewarm
+	if err = s.primePackCache(ctx, repo); err != nil {
+		logError("prewarm", err)
+	}
+
+	return nil
+}
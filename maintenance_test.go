@@ -0,0 +1,102 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSH_Prewarm(t *testing.T) {
+	events := []string{}
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			events = append(events, e.Type)
+		}
+	})
+
+	work := testWorkTree(t, s)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	assert.NoError(t, s.Prewarm(context.Background(), "test"))
+	assert.Equal(t, []string{EventPrewarmStarted, EventPrewarmCompleted}, events)
+
+	bitmaps, _ := filepath.Glob(filepath.Join(s.config.Dir, "test", "objects", "pack", "*.bitmap"))
+	assert.Len(t, bitmaps, 1)
+
+	_, err := os.Stat(filepath.Join(s.config.Dir, "test", "objects", "info", "commit-graph"))
+	assert.NoError(t, err)
+
+	assert.Error(t, s.Prewarm(context.Background(), "missing"))
+}
+
+func TestSSH_Prewarm_PackCache(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, PackCache: true, PackCacheMaxBytes: 1 << 20}, nil)
+
+	work := testWorkTree(t, s)
+	testGit(t, s, work, "tag", "-a", "-m", "release", "v1.0.0")
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main", "v1.0.0")
+	require.NoError(t, err, out)
+
+	var runs atomic.Int32
+	run := s.packCache.run
+	s.packCache.run = func(ctx context.Context, path string, req []byte, w io.Writer) error {
+		runs.Add(1)
+		return run(ctx, path, req, w)
+	}
+
+	require.NoError(t, s.Prewarm(context.Background(), "test"))
+	assert.Equal(t, int32(1), runs.Load())
+
+	// The first clone after prewarming is served from the kept pack
+	out, err = testGit(t, s, t.TempDir(), "-c", "protocol.version=2", "clone", "-q", testRemote(s, "test.git"), ".")
+	assert.NoError(t, err, out)
+	assert.Equal(t, int32(1), runs.Load())
+}
+
+func TestSSH_Prewarm_Locked(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir()})
+	p := filepath.Join(s.config.Dir, "test")
+	assert.NoError(t, initRepo(p, s.config))
+
+	s.maintenance.acquire(p)
+	assert.ErrorIs(t, s.Prewarm(context.Background(), "test"), ErrMaintenanceRunning)
+}
+
+func TestSSH_Prewarm_Forked(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testWorkTree(t, s)
+	testGit(t, s, work, "checkout", "-q", "-b", "feature")
+	testGit(t, s, work, "commit", "-q", "--allow-empty", "-m", "feature")
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main", "feature")
+	require.NoError(t, err, out)
+
+	// The pushed objects are packed, where repacking drops those no longer
+	// referred to
+	src := filepath.Join(s.config.Dir, "test")
+	require.NoError(t, exec.Command("git", "-C", src, "repack", "-a", "-d").Run())
+	require.NoError(t, s.Fork(context.Background(), "test", "fork"))
+
+	pruneExpire, err := exec.Command("git", "-C", src, "config", "gc.pruneExpire").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "never\n", string(pruneExpire))
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), ":feature")
+	require.NoError(t, err, out)
+
+	assert.NoError(t, s.Prewarm(context.Background(), "test"))
+
+	out, err = testGit(t, s, t.TempDir(), "clone", "-q", "-b", "feature", testRemote(s, "fork.git"), ".")
+	assert.NoError(t, err, out)
+}
@@ -0,0 +1,141 @@
+package gitkit
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+// Message identifiers used when looking up text in a MessageCatalog
+const (
+	MsgBanner            = "banner"
+	MsgInvalidCommand    = "invalid-command"
+	MsgReadOnly          = "read-only"
+	MsgAccessDenied      = "access-denied"
+	MsgPushConflict      = "push-conflict"
+	MsgPushRejected      = "push-rejected"
+	MsgQuarantined       = "quarantined"
+	MsgRepoArchived      = "repo-archived"
+	MsgRepoLocked        = "repo-locked"
+	MsgRepoNotFound      = "repo-not-found"
+	MsgOperationDisabled = "operation-disabled"
+	MsgNodeUnavailable   = "node-unavailable"
+
+	MsgUpstreamUnavailable = "upstream-unavailable"
+	MsgProtocolV2Required  = "protocol-v2-required"
+	MsgMirrorReadOnly      = "mirror-read-only"
+
+	MsgPackTooLarge      = "pack-too-large"
+	MsgRepoQuotaExceeded = "repo-quota-exceeded"
+	MsgRepoOverQuota     = "repo-over-quota"
+	MsgRepoQuotaWarning  = "repo-quota-warning"
+
+	MsgOperationTimeout = "operation-timeout"
+	MsgDepthExceeded    = "depth-exceeded"
+	MsgFilterRequired   = "filter-required"
+	MsgBlobTooLarge     = "blob-too-large"
+
+	MsgKeyExpired = "key-expired"
+	MsgKeyRevoked = "key-revoked"
+
+	MsgWhoami = "whoami"
+)
+
+// DefaultLocale is used when a client provides no locale hint, or when
+// the catalog has no entry for the locale they asked for
+const DefaultLocale = "en"
+
+// MessageCatalog maps a locale, such as "en" or "pt_BR", to message
+// templates keyed by message identifier. Templates are parsed with
+// text/template and have access to BannerFuncs.
+type MessageCatalog map[string]map[string]string
+
+// DefaultMessages holds the built-in English messages
+var DefaultMessages = MessageCatalog{
+	DefaultLocale: {
+		MsgInvalidCommand:    "Invalid command.\r\n",
+		MsgReadOnly:          "This server is read-only, pushes are not accepted.\r\n",
+		MsgAccessDenied:      "Access denied.\r\n",
+		MsgPushConflict:      "Another push updated {{ .Ref }} at the same time as yours. Fetch, then push again.\r\n",
+		MsgPushRejected:      "Push rejected: {{ .Reason }}\r\n",
+		MsgQuarantined:       "This repository is unavailable while it is quarantined.\r\n",
+		MsgRepoArchived:      "{{ .Repo }} is archived and no longer accepts pushes.\r\n",
+		MsgRepoLocked:        "{{ .Repo }} is locked for maintenance. Try pushing again shortly.\r\n",
+		MsgRepoNotFound:      "Repository not found.\r\n",
+		MsgOperationDisabled: "This operation is not available on this server.\r\n",
+		MsgNodeUnavailable:   "{{ .Repo }} is unavailable at the moment. Try again shortly.\r\n",
+
+		MsgUpstreamUnavailable: "{{ .Repo }} is unavailable at the moment. Try again shortly.\r\n",
+		MsgProtocolV2Required:  "{{ .Repo }} can only be fetched with git protocol version 2. Run git config --global protocol.version 2, then try again.\r\n",
+		MsgMirrorReadOnly:      "{{ .Repo }} is a read-only mirror. Push to its upstream instead.\r\n",
+
+		MsgPackTooLarge:      "Push rejected: pushes to {{ .Repo }} may be at most {{ bytes .Limit }}.\r\n",
+		MsgRepoQuotaExceeded: "Push rejected: {{ .Repo }} has used {{ bytes .Used }} of its {{ bytes .Limit }} quota, which this push would exceed.\r\n",
+		MsgRepoOverQuota:     "{{ .Repo }} is now using {{ bytes .Used }}, over its {{ bytes .Limit }} quota. Further pushes will be rejected.\r\n",
+		MsgRepoQuotaWarning:  "Warning: {{ .Repo }} is using {{ bytes .Used }} of its {{ bytes .Limit }} quota.\r\n",
+
+		MsgOperationTimeout: "Your {{ .Operation }} of {{ .Repo }} was stopped after {{ .Timeout }}, the longest allowed.\r\n",
+		MsgDepthExceeded:    "Shallow fetches of {{ .Repo }} may be at most {{ .Limit }} commits deep.\r\n",
+		MsgFilterRequired:   "Fetches of {{ .Repo }} must leave out blobs over {{ bytes .Limit }}, such as with --filter=blob:limit={{ .Limit }}.\r\n",
+		MsgBlobTooLarge:     "{{ .Repo }} serves blobs of at most {{ bytes .Limit }}.\r\n",
+
+		MsgKeyExpired: "Your key {{ .PublicKey.Name }} has expired.\r\n",
+		MsgKeyRevoked: "Your key {{ .PublicKey.Name }} has been revoked.\r\n",
+
+		MsgWhoami: "Hi {{ .Name }}! You've authenticated with {{ .PublicKey.Fingerprint }}, but shell access is not provided.\r\n" +
+			"{{ range .Access }}{{ if .Write }}RW{{ else }}R {{ end }} {{ .Repo }}\r\n{{ end }}",
+	},
+}
+
+// lookup finds the template for id, trying the full locale ("pt_BR.UTF-8"
+// is treated as "pt_BR"), then its language ("pt") and finally DefaultLocale
+func (c MessageCatalog) lookup(locale, id string) (string, bool) {
+	locale, _, _ = strings.Cut(locale, ".")
+	lang, _, _ := strings.Cut(locale, "_")
+
+	for _, l := range []string{locale, lang, DefaultLocale} {
+		if msg, ok := c[l][id]; ok {
+			return msg, true
+		}
+	}
+
+	return "", false
+}
+
+// Message renders message id for locale, preferring entries in
+// Config.Messages over DefaultMessages
+func (c Config) Message(locale, id string, data any) string {
+	tmpl, ok := c.Messages.lookup(locale, id)
+	if !ok {
+		tmpl, ok = DefaultMessages.lookup(locale, id)
+	}
+
+	if !ok {
+		return id
+	}
+
+	t, err := template.New(id).Funcs(BannerFuncs).Parse(tmpl)
+	if err != nil {
+		logError("messages", err)
+		return tmpl
+	}
+
+	out := new(bytes.Buffer)
+	if err := t.Execute(out, data); err != nil {
+		logError("messages", err)
+		return tmpl
+	}
+
+	return out.String()
+}
+
+// localeFromEnv returns the locale named by a LANG or LC_ALL style value
+// such as "de_DE.UTF-8". The POSIX "C" locales carry no language, so are
+// ignored
+func localeFromEnv(value string) string {
+	if value == "" || value == "C" || value == "POSIX" || strings.HasPrefix(value, "C.") {
+		return ""
+	}
+
+	return value
+}
@@ -0,0 +1,108 @@
+package gitkit
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConfig_Message(t *testing.T) {
+	c := Config{
+		Messages: MessageCatalog{
+			"de": {MsgAccessDenied: "Zugriff verweigert.\r\n"},
+			"pt_BR": {
+				MsgAccessDenied: "Acesso negado, {{ .Name }}.\r\n",
+			},
+		},
+	}
+
+	data := BannerData{PublicKey: PublicKey{Name: "test-user"}}
+
+	for _, test := range []struct {
+		locale string
+		id     string
+		expect string
+	}{
+		{"", MsgAccessDenied, "Access denied.\r\n"},
+		{"fr_FR.UTF-8", MsgAccessDenied, "Access denied.\r\n"},
+		{"de", MsgAccessDenied, "Zugriff verweigert.\r\n"},
+		{"de_AT.UTF-8", MsgAccessDenied, "Zugriff verweigert.\r\n"},
+		{"pt_BR.UTF-8", MsgAccessDenied, "Acesso negado, test-user.\r\n"},
+		{"de", MsgInvalidCommand, "Invalid command.\r\n"},
+		{"de", "unknown-message", "unknown-message"},
+	} {
+		t.Run(test.locale+"/"+test.id, func(t *testing.T) {
+			rcvd := c.Message(test.locale, test.id, data)
+			if rcvd != test.expect {
+				t.Errorf("expected %q, received %q", test.expect, rcvd)
+			}
+		})
+	}
+}
+
+func TestConfig_CompileBanner_Localised(t *testing.T) {
+	c := Config{
+		BannerTemplate: "Hello {{ .Name }}",
+		Messages: MessageCatalog{
+			"es": {MsgBanner: "Hola {{ .Name }}"},
+		},
+	}
+
+	for locale, expect := range map[string]string{
+		"":            "Hello test-user",
+		"es_ES.UTF-8": "Hola test-user",
+	} {
+		rcvd, err := c.CompileBanner(BannerData{PublicKey: PublicKey{Name: "test-user"}, Locale: locale})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(rcvd) != expect {
+			t.Errorf("expected %q, received %q", expect, rcvd)
+		}
+	}
+}
+
+func Test_localeFromEnv(t *testing.T) {
+	for value, expect := range map[string]string{
+		"":            "",
+		"C":           "",
+		"C.UTF-8":     "",
+		"POSIX":       "",
+		"en_GB.UTF-8": "en_GB.UTF-8",
+	} {
+		if rcvd := localeFromEnv(value); rcvd != expect {
+			t.Errorf("%q: expected %q, received %q", value, expect, rcvd)
+		}
+	}
+}
+
+func TestSSH_message_Repos(t *testing.T) {
+	var listed atomic.Int32
+
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.ListReposFunc = func(context.Context) ([]string, error) {
+			listed.Add(1)
+
+			return []string{"team/project"}, nil
+		}
+	})
+
+	if _, err := testSSHRun(t, s, "frobnicate"); err == nil {
+		t.Fatal("expected an unknown command to fail")
+	}
+
+	sess, err := testSSHClient(t, s).NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// The banner is written without replying to the request, then the
+	// channel closed, which the client reports as an error
+	sess.Shell()
+
+	if n := listed.Load(); n != 1 {
+		t.Errorf("repositories listed %d times, expected once for the banner alone", n)
+	}
+}
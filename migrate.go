@@ -0,0 +1,159 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	layoutVersionFile = ".gitkit-layout"
+	layoutLockFile    = ".gitkit-layout.lock"
+)
+
+var (
+	ErrLayoutTooNew     = errors.New("repository layout is newer than this version of gitkit supports")
+	ErrMigrationRunning = errors.New("another migration is already in progress")
+)
+
+// Migration upgrades the on-disk layout under Config.Dir to Version from
+// the version immediately preceding it. Up must be safe to re-run should
+// a previous attempt have failed part way through
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(cfg *Config) error
+}
+
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "record layout version",
+		Up:          func(*Config) error { return nil },
+	},
+}
+
+// RegisterMigration adds a migration to the set run by Config.Migrate.
+// It panics if a migration with the same version already exists, since
+// that is always a programming error
+func RegisterMigration(m Migration) {
+	for _, existing := range migrations {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("gitkit: migration %d already registered", m.Version))
+		}
+	}
+
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+}
+
+// CurrentLayoutVersion is the layout version this build of gitkit expects
+func CurrentLayoutVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].Version
+}
+
+// LayoutVersion returns the layout version recorded under dir. Directories
+// which predate the migration framework are reported as version 0
+func LayoutVersion(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, layoutVersionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Migrate brings the layout under c.Dir up to CurrentLayoutVersion, returning
+// the migrations which were (or, when dryRun is set, would be) applied
+func (c *Config) Migrate(dryRun bool) (applied []Migration, err error) {
+	version, err := LayoutVersion(c.Dir)
+	if err != nil {
+		return
+	}
+
+	if version > CurrentLayoutVersion() {
+		return nil, fmt.Errorf("%w: found %d, supports %d", ErrLayoutTooNew, version, CurrentLayoutVersion())
+	}
+
+	pending := []Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+
+	// The lock file is flocked rather than created exclusively, so that a
+	// migration which crashed does not leave it held. It is not removed, as
+	// another migration may have opened it already.
+	lock, err := os.OpenFile(filepath.Join(c.Dir, layoutLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+
+	switch err = flockFile(lock, true); {
+	case errors.Is(err, ErrRepoLocked):
+		return nil, ErrMigrationRunning
+
+	case errors.Is(err, errFlockUnsupported):
+		// Migrations cannot be kept apart here, as locks cannot be taken
+
+	case err != nil:
+		return
+	}
+
+	// A migration which held the lock may have finished meanwhile
+	if version, err = LayoutVersion(c.Dir); err != nil {
+		return
+	}
+
+	for _, m := range pending {
+		if m.Version <= version {
+			continue
+		}
+
+		logInfo("migrate", fmt.Sprintf("applying layout migration %d: %s", m.Version, m.Description))
+
+		if err = m.Up(c); err != nil {
+			return applied, fmt.Errorf("migration %d failed: %w", m.Version, err)
+		}
+
+		if err = writeLayoutVersion(c.Dir, m.Version); err != nil {
+			return
+		}
+
+		applied = append(applied, m)
+	}
+
+	return
+}
+
+// writeLayoutVersion records version via a rename, so that a crash never
+// leaves a truncated version file behind
+func writeLayoutVersion(dir string, version int) error {
+	tmp := filepath.Join(dir, layoutVersionFile+".tmp")
+
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(version)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, layoutVersionFile))
+}
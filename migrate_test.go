@@ -0,0 +1,67 @@
+package gitkit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Migrate(t *testing.T) {
+	c := Config{Dir: t.TempDir()}
+
+	version, err := LayoutVersion(c.Dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	pending, err := c.Migrate(true)
+	assert.NoError(t, err)
+	assert.Len(t, pending, len(migrations))
+
+	version, _ = LayoutVersion(c.Dir)
+	assert.Equal(t, 0, version, "dry run should not modify layout")
+
+	applied, err := c.Migrate(false)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(pending))
+
+	version, _ = LayoutVersion(c.Dir)
+	assert.Equal(t, CurrentLayoutVersion(), version)
+
+	applied, err = c.Migrate(false)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestConfig_Migrate_TooNew(t *testing.T) {
+	c := Config{Dir: t.TempDir()}
+	assert.NoError(t, writeLayoutVersion(c.Dir, CurrentLayoutVersion()+1))
+
+	_, err := c.Migrate(false)
+	assert.ErrorIs(t, err, ErrLayoutTooNew)
+}
+
+func TestConfig_Migrate_Locked(t *testing.T) {
+	c := Config{Dir: t.TempDir()}
+
+	f, err := os.OpenFile(filepath.Join(c.Dir, layoutLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	assert.NoError(t, err)
+
+	if err = flockFile(f, true); errors.Is(err, errFlockUnsupported) {
+		t.Skip(err)
+	}
+
+	assert.NoError(t, err)
+
+	_, err = c.Migrate(false)
+	assert.ErrorIs(t, err, ErrMigrationRunning)
+
+	// A lock file left by a migration which crashed holds nothing
+	f.Close()
+
+	applied, err := c.Migrate(false)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+}
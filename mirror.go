@@ -0,0 +1,231 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultMirrorTTL is how long a mirror's refs are served before they are
+// fetched again, when Mirror.TTL is not set
+const DefaultMirrorTTL = time.Minute
+
+// Event types emitted as mirrors are fetched
+const (
+	EventMirrorFetched = "mirror.fetched"
+	EventMirrorFailed  = "mirror.failed"
+)
+
+// ErrMirrorReadOnly is returned for pushes to mirrored repositories
+var ErrMirrorReadOnly = errors.New("repository is a read-only mirror")
+
+// Mirror is where a mirrored repository is fetched from, as MirrorFunc
+// gives it
+type Mirror struct {
+	// URL of the repository to mirror, in any form git clone accepts
+	URL string
+
+	// Username and Password are sent to http upstreams with basic auth,
+	// when set. They are given to git in its environment for each fetch,
+	// rather than kept in the mirror's configuration, and are left out of
+	// errors and events.
+	Username string
+	Password string
+
+	// SSHCommand, when set, is the GIT_SSH_COMMAND used to fetch from ssh
+	// upstreams, such as to choose the server's key with -i
+	SSHCommand string
+
+	// TTL is how long the refs fetched are served for before they are
+	// fetched again. Defaults to DefaultMirrorTTL.
+	TTL time.Duration
+}
+
+// mirrors records when each mirror was last fetched, so that a fetch
+// starting while another is in progress waits on it rather than fetching
+// again
+type mirrors struct {
+	mu    sync.Mutex
+	repos map[string]*mirrorState
+}
+
+type mirrorState struct {
+	mu      sync.Mutex
+	fetched time.Time
+}
+
+func (m *mirrors) state(path string) *mirrorState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.repos == nil {
+		m.repos = make(map[string]*mirrorState)
+	}
+
+	state, ok := m.repos[path]
+	if !ok {
+		state = new(mirrorState)
+		m.repos[path] = state
+	}
+
+	return state
+}
+
+// refreshMirror brings loc up to date from the upstream MirrorFunc gives
+// for gitcmd, cloning it on first use, so that it can be served locally.
+// When a fetch fails, what was fetched before is served.
+func (s SSH) refreshMirror(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand, loc repoLocation) error {
+	if s.MirrorFunc == nil {
+		return nil
+	}
+
+	mirror, err := s.MirrorFunc(ctx, gitcmd)
+	if err != nil || mirror == nil {
+		if err != nil {
+			ch.Stderr().Write([]byte(clientLine(err, s.config.Message(s.sessionLocale(ctx, sess), MsgUpstreamUnavailable, gitcmd))))
+		}
+
+		return err
+	}
+
+	if gitcmd.IsWrite() {
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgMirrorReadOnly, gitcmd)))
+
+		return fmt.Errorf("mirror: %w: %s", ErrMirrorReadOnly, gitcmd.Repo)
+	}
+
+	ttl := mirror.TTL
+	if ttl <= 0 {
+		ttl = DefaultMirrorTTL
+	}
+
+	state := s.mirrors.state(loc.Path)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if time.Since(state.fetched) < ttl {
+		return nil
+	}
+
+	start := time.Now()
+
+	cloned := !repoExists(loc.Path)
+	if cloned {
+		err = s.cloneMirror(ctx, mirror, loc.Path)
+	} else {
+		// Fetched from the URL given, which may have changed since the clone
+		err = s.mirrorGit(ctx, mirror, "-C", loc.Path, "fetch", "--prune", "--quiet", mirror.URL, "+refs/*:refs/*")
+	}
+
+	if err != nil {
+		s.emit(ctx, Event{Type: EventMirrorFailed, Repo: gitcmd.Repo, Data: map[string]string{"error": err.Error()}})
+
+		if cloned {
+			ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgUpstreamUnavailable, gitcmd)))
+
+			return fmt.Errorf("mirror: %w: %w", ErrUpstreamUnavailable, err)
+		}
+
+		log.Printf("mirror: serving %s as last fetched: %v", gitcmd.Repo, err)
+
+		return nil
+	}
+
+	state.fetched = time.Now()
+
+	s.emit(ctx, Event{Type: EventMirrorFetched, Repo: gitcmd.Repo, Data: map[string]string{
+		"duration": time.Since(start).String(),
+		"cloned":   fmt.Sprint(cloned),
+	}})
+
+	return nil
+}
+
+// cloneMirror clones mirror to path, by way of a directory alongside it
+// so that clients never see a partial clone
+func (s SSH) cloneMirror(ctx context.Context, mirror *Mirror, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(path), ".mirror-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err = s.mirrorGit(ctx, mirror, "clone", "--mirror", "--quiet", mirror.URL, tmp); err != nil {
+		return err
+	}
+
+	// MkdirTemp makes the directory private to the server
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// mirrorGit runs git with the mirror's credentials, never prompting for
+// others. Errors leave out the credentials, which may appear in git's
+// output as part of the URL.
+func (s SSH) mirrorGit(ctx context.Context, mirror *Mirror, args ...string) error {
+	cmd := exec.CommandContext(ctx, s.config.GitPath, args...)
+	cmd.Env = append(os.Environ(), append(s.config.tmpEnv(), mirror.gitEnv()...)...)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git: %w: %s", err, mirror.redact(string(bytes.TrimSpace(out))))
+	}
+
+	return nil
+}
+
+// gitEnv returns the environment git fetches mirror with. Credentials are
+// given as configuration in the environment, where, unlike arguments,
+// other users cannot see them.
+func (mirror *Mirror) gitEnv() []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	if mirror.Username != "" || mirror.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(mirror.Username + ":" + mirror.Password))
+
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+
+	if mirror.SSHCommand != "" {
+		env = append(env, "GIT_SSH_COMMAND="+mirror.SSHCommand)
+	}
+
+	return env
+}
+
+// redact replaces mirror's URL in text with one without its password, and
+// removes the Password wherever else it appears
+func (mirror *Mirror) redact(text string) string {
+	if u, err := url.Parse(mirror.URL); err == nil && u.User != nil {
+		text = strings.ReplaceAll(text, mirror.URL, u.Redacted())
+	}
+
+	if mirror.Password != "" {
+		text = strings.ReplaceAll(text, mirror.Password, "xxxxx")
+	}
+
+	return text
+}
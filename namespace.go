@@ -0,0 +1,63 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidNamespace is returned for namespaces which cannot be used in ref
+// names
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// resolveNamespace sets gitcmd's Namespace from NamespaceFunc, when set,
+// checking whatever namespace it ends up with
+func (s SSH) resolveNamespace(ctx context.Context, gitcmd *GitCommand) error {
+	if s.NamespaceFunc != nil {
+		ns, err := s.NamespaceFunc(ctx, gitcmd)
+		if err != nil {
+			return err
+		}
+
+		gitcmd.Namespace = ns
+	}
+
+	if gitcmd.Namespace == "" {
+		return nil
+	}
+
+	if s.config.InMemory {
+		return fmt.Errorf("namespaces: %w in memory", ErrOperationDisabled)
+	}
+
+	return validateNamespace(gitcmd.Namespace)
+}
+
+// namespaceRefPrefix is where git keeps the refs of namespace ns, as seen
+// from outside it, such as by for-each-ref. Empty namespaces have none.
+func namespaceRefPrefix(ns string) string {
+	prefix := ""
+	for _, part := range strings.Split(ns, "/") {
+		if part != "" {
+			prefix += "refs/namespaces/" + part + "/"
+		}
+	}
+
+	return prefix
+}
+
+// validateNamespace checks ns can be used as GIT_NAMESPACE: git nests each
+// slash separated part under refs/namespaces/, so each must be a valid ref
+// name component
+func validateNamespace(ns string) error {
+	for _, part := range strings.Split(ns, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") ||
+			strings.Contains(part, "..") || strings.Contains(part, "@{") ||
+			strings.ContainsAny(part, " ~^:?*[\\\x7f") || strings.IndexFunc(part, func(r rune) bool { return r < ' ' }) >= 0 {
+			return fmt.Errorf("%w: %q", ErrInvalidNamespace, ns)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateNamespace(t *testing.T) {
+	for _, ns := range []string{"project", "team/project-42", "a.b"} {
+		assert.NoError(t, validateNamespace(ns), ns)
+	}
+
+	for _, ns := range []string{"team//project", ".hidden", "a..b", "x.lock", "sp ace", "star*", "up/", "a@{b"} {
+		assert.ErrorIs(t, validateNamespace(ns), ErrInvalidNamespace, ns)
+	}
+}
+
+func TestSSH_NamespaceFunc(t *testing.T) {
+	var shared string
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		shared = filepath.Join(s.config.Dir, "shared")
+
+		// Every repository is a namespace of the one shared repository
+		s.ResolveRepoFunc = func(context.Context, string) (string, error) {
+			return shared, nil
+		}
+
+		s.NamespaceFunc = func(_ context.Context, cmd *GitCommand) (string, error) {
+			if cmd.Repo == "refused" {
+				return "", NewClientError(errors.New("no namespace"), "No such project")
+			}
+
+			return cmd.Repo, nil
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	for _, repo := range []string{"alpha.git", "beta.git"} {
+		out, err := testGit(t, s, work, "push", testRemote(s, repo), "main:"+strings.TrimSuffix(repo, ".git"))
+		if !assert.NoError(t, err, out) {
+			return
+		}
+	}
+
+	refs, err := exec.Command("git", "-C", shared, "for-each-ref", "--format=%(refname)").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "refs/namespaces/alpha/refs/heads/alpha\nrefs/namespaces/beta/refs/heads/beta\n", string(refs))
+
+	// Each namespace only sees its own refs
+	out, err := testGit(t, s, work, "ls-remote", testRemote(s, "alpha.git"))
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "refs/heads/alpha")
+	assert.NotContains(t, out, "beta")
+
+	out, err = testGit(t, s, work, "ls-remote", testRemote(s, "refused.git"))
+	assert.Error(t, err)
+	assert.Contains(t, out, "No such project")
+}
+
+func TestSSH_NamespaceFunc_PushCompleted(t *testing.T) {
+	var mu sync.Mutex
+	events := []Event{}
+
+	s := startTestSSH(t, Config{AutoCreate: true, PushHistory: true}, func(s *SSH) {
+		s.NamespaceFunc = func(context.Context, *GitCommand) (string, error) {
+			return "team/project", nil
+		}
+
+		s.EventFunc = func(_ context.Context, e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if e.Type == EventPushCompleted {
+				events = append(events, e)
+			}
+		}
+	})
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	if !assert.NoError(t, err, out) {
+		return
+	}
+
+	// Updates are told applied from the namespace's own refs
+	mu.Lock()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "refs/heads/main", events[0].Data["refs"])
+	}
+	mu.Unlock()
+
+	pushes, err := s.Pushes(PushQuery{Repo: "test"})
+	if assert.NoError(t, err) && assert.Len(t, pushes, 1) {
+		assert.Equal(t, 1, pushes[0].Created)
+	}
+}
@@ -0,0 +1,102 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// operationOutput returns the writer OperationOutputFunc gives for gitcmd,
+// made safe for stdout and stderr to share, or nil when there is none
+func (s SSH) operationOutput(ctx context.Context, gitcmd *GitCommand) *outputWriter {
+	if s.OperationOutputFunc == nil {
+		return nil
+	}
+
+	w := s.OperationOutputFunc(ctx, gitcmd)
+	if w == nil {
+		return nil
+	}
+
+	return &outputWriter{w: w}
+}
+
+// outputWriter serialises writes to an OperationOutputFunc writer and
+// swallows its errors: a failing audit log should not fail the push
+type outputWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.w.Write(p)
+
+	return len(p), nil
+}
+
+// Close closes the underlying writer, if it is an io.Closer
+func (o *outputWriter) Close() error {
+	if c, ok := o.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// sidebandTee passes git's stdout through to w untouched, copying the
+// payload of side-band progress packets to out. Clients which support
+// side-band have git's progress and hook output sent this way rather than
+// on stderr. Scanning stops at the first data which is not a pkt-line, as
+// when a pack is sent without side-band.
+type sidebandTee struct {
+	w    io.Writer
+	out  io.Writer
+	buf  []byte
+	done bool
+}
+
+func (t *sidebandTee) Write(p []byte) (int, error) {
+	if !t.done {
+		t.scan(p)
+	}
+
+	return t.w.Write(p)
+}
+
+func (t *sidebandTee) scan(p []byte) {
+	t.buf = append(t.buf, p...)
+
+	for len(t.buf) >= 4 {
+		n, err := strconv.ParseUint(string(t.buf[:4]), 16, 16)
+		if err != nil || n > maxPktLen {
+			t.done = true
+			t.buf = nil
+
+			return
+		}
+
+		// Flush, delimiter and response-end packets have no payload
+		if n < 4 {
+			t.buf = t.buf[4:]
+
+			continue
+		}
+
+		if len(t.buf) < int(n) {
+			break
+		}
+
+		if payload := t.buf[4:n]; len(payload) > 1 && payload[0] == 2 {
+			t.out.Write(payload[1:])
+		}
+
+		t.buf = t.buf[n:]
+	}
+
+	// Keep the partial packet, without holding on to the larger array
+	t.buf = append([]byte{}, t.buf...)
+}
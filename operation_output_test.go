@@ -0,0 +1,154 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sidebandTee(t *testing.T) {
+	var client, out bytes.Buffer
+
+	stream := "0008NAK\n" + "0011\x02Counting: 1\r" + "0009\x01PACK" + "0000" + "000f\x02hook says\n" + "0000"
+	tee := &sidebandTee{w: &client, out: &out}
+
+	// Packets split across writes are still found
+	for _, b := range []byte(stream) {
+		_, err := tee.Write([]byte{b})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, stream, client.String())
+	assert.Equal(t, "Counting: 1\rhook says\n", out.String())
+
+	// A pack sent without side-band ends scanning
+	client.Reset()
+	out.Reset()
+
+	tee = &sidebandTee{w: &client, out: &out}
+	tee.Write([]byte("0008NAK\nPACK\x00\x00\x00\x020011\x02not progress"))
+
+	assert.Empty(t, out.String())
+	assert.True(t, tee.done)
+}
+
+type testOutput struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed chan struct{}
+}
+
+func (o *testOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.buf.Write(p)
+}
+
+func (o *testOutput) Close() error {
+	close(o.closed)
+
+	return nil
+}
+
+func TestSSH_OperationOutputFunc(t *testing.T) {
+	outputs := make(chan *testOutput, 4)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.OperationOutputFunc = func(_ context.Context, cmd *GitCommand) io.Writer {
+			if !cmd.IsWrite() {
+				return nil
+			}
+
+			o := &testOutput{closed: make(chan struct{})}
+			outputs <- o
+
+			return o
+		}
+	})
+
+	work := testWorkTree(t, s)
+	remote := testRemote(s, "test.git")
+
+	out, err := testGit(t, s, work, "push", remote, "main")
+	require.NoError(t, err, out)
+	<-outputs
+
+	hook := filepath.Join(s.config.Dir, "test", "hooks", "pre-receive")
+	require.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\necho policy: ok\necho policy: warned >&2\n"), 0755))
+
+	out, err = testGit(t, s, work, "push", remote, "main:other")
+	require.NoError(t, err, out)
+	assert.Contains(t, out, "policy: ok", "output should still reach the client")
+
+	// Fetches are left uncaptured
+	out, err = testGit(t, s, t.TempDir(), "clone", remote, "clone")
+	require.NoError(t, err, out)
+
+	o := <-outputs
+	select {
+	case <-o.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output was not closed")
+	}
+
+	assert.Contains(t, o.buf.String(), "policy: ok")
+	assert.Contains(t, o.buf.String(), "policy: warned")
+	assert.Empty(t, outputs)
+}
+
+func TestSSH_OperationOutputFunc_AuthorisedPush(t *testing.T) {
+	var calls atomic.Int32
+	outputs := make(chan *testOutput, 4)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthorisePushFunc = func(context.Context, *GitCommand, *PushRequest) error {
+			return nil
+		}
+
+		s.OperationOutputFunc = func(_ context.Context, cmd *GitCommand) io.Writer {
+			calls.Add(1)
+
+			o := &testOutput{closed: make(chan struct{})}
+			outputs <- o
+
+			return o
+		}
+	})
+
+	hook := filepath.Join(s.config.Dir, "test", "hooks", "pre-receive")
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	require.NoError(t, err, out)
+
+	// Refs are advertised, then receive-pack run again for the push, all
+	// captured by the one writer, which is closed once
+	assert.Equal(t, int32(1), calls.Load())
+
+	o := <-outputs
+	select {
+	case <-o.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output was not closed")
+	}
+
+	require.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\necho policy: ok\n"), 0755))
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main:other")
+	require.NoError(t, err, out)
+	assert.Equal(t, int32(2), calls.Load())
+
+	o = <-outputs
+	<-o.closed
+	assert.Contains(t, o.buf.String(), "policy: ok")
+}
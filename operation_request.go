@@ -0,0 +1,61 @@
+package gitkit
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// OperationRequest describes a git command a client asked to run, along
+// with who asked and how, as passed to AuthoriseRequestFunc
+type OperationRequest struct {
+	Command    *GitCommand
+	PublicKey  PublicKey // The client's identity; empty for anonymous clients
+	User       string    // ssh user the client logged in as, or for HTTP the PublicKey's Name
+	RemoteAddr string    // Client address, as host:port
+
+	// ProtocolVersion is the git wire protocol version the client asked
+	// for in GIT_PROTOCOL: 2 for protocol v2, or 0 for the original
+	// protocol when it asked for none
+	ProtocolVersion int
+
+	// Env holds the environment the client sent and Config.AllowedEnv
+	// accepted, such as GIT_PROTOCOL. Over HTTP it holds GIT_PROTOCOL from
+	// the Git-Protocol header.
+	Env map[string]string
+}
+
+// newOperationRequest describes gitcmd as run in ctx, by a client which
+// sent env
+func newOperationRequest(ctx context.Context, gitcmd *GitCommand, env map[string]string) *OperationRequest {
+	req := &OperationRequest{Command: gitcmd, Env: map[string]string{}}
+
+	req.PublicKey, _ = ctx.Value(PublicKeyContextKey{}).(PublicKey)
+	req.User, _ = ctx.Value(UserContextKey{}).(string)
+	req.RemoteAddr, _ = ctx.Value(RemoteAddrContextKey{}).(string)
+
+	for k, v := range env {
+		req.Env[k] = v
+	}
+
+	req.ProtocolVersion = protocolVersion(env["GIT_PROTOCOL"])
+
+	return req
+}
+
+// protocolVersion returns the version asked for by a GIT_PROTOCOL value,
+// a colon separated list such as version=2, the highest winning as git's
+// own servers do
+func protocolVersion(gitProtocol string) int {
+	version := 0
+
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if v, ok := strings.CutPrefix(param, "version="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > version {
+				version = n
+			}
+		}
+	}
+
+	return version
+}
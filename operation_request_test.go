@@ -0,0 +1,124 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_protocolVersion(t *testing.T) {
+	assert.Equal(t, 0, protocolVersion(""))
+	assert.Equal(t, 2, protocolVersion("version=2"))
+	assert.Equal(t, 2, protocolVersion("version=1:version=2"))
+	assert.Equal(t, 1, protocolVersion("other=x:version=1"))
+	assert.Equal(t, 0, protocolVersion("version=two"))
+}
+
+func TestSSH_AuthoriseRequestFunc(t *testing.T) {
+	signer := testClientSigner(t)
+
+	var (
+		mu       sync.Mutex
+		requests []*OperationRequest
+	)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "1", Name: "alice"},
+	}, func(s *SSH) {
+		s.config.AutoCreate = true
+		s.AuthoriseRequestFunc = func(_ context.Context, req *OperationRequest) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			requests = append(requests, req)
+			if req.Command.IsWrite() {
+				return errors.New("pushes are closed")
+			}
+
+			return nil
+		}
+	})
+
+	client, err := testKeyDial(s, signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, sess.Setenv("GIT_PROTOCOL", "version=2"))
+
+	// Only the advertisement is wanted, so the client's flush ends the fetch
+	sess.Stdin = strings.NewReader("0000")
+	_, err = sess.Output("git-upload-pack 'test.git'")
+	assert.NoError(t, err)
+	sess.Close()
+
+	_, err = testClientRun(t, client, "git-receive-pack 'test.git'")
+	assert.Error(t, err)
+	assert.ErrorIs(t, s.Report().LastError, ErrAccessDenied)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !assert.Len(t, requests, 2) {
+		return
+	}
+
+	fetch := requests[0]
+	assert.Equal(t, "test", fetch.Command.Repo)
+	assert.Equal(t, "alice", fetch.PublicKey.Name)
+	assert.Equal(t, "git", fetch.User)
+	assert.Equal(t, client.LocalAddr().String(), fetch.RemoteAddr)
+	assert.Equal(t, 2, fetch.ProtocolVersion)
+	assert.Equal(t, map[string]string{"GIT_PROTOCOL": "version=2"}, fetch.Env)
+
+	assert.Equal(t, 0, requests[1].ProtocolVersion)
+	assert.Empty(t, requests[1].Env)
+}
+
+func TestServer_AuthoriseRequestFunc(t *testing.T) {
+	var received *OperationRequest
+
+	srv := startTestHTTP(t, Config{Auth: true}, func(s *Server) {
+		s.BasicAuthFunc = func(_ context.Context, user, _ string) (*PublicKey, error) {
+			return &PublicKey{Id: "1", Name: user}, nil
+		}
+
+		s.AuthoriseRequestFunc = func(_ context.Context, req *OperationRequest) error {
+			received = req
+			if req.Command.IsWrite() {
+				return errors.New("pushes are closed")
+			}
+
+			return nil
+		}
+	})
+
+	resp := testHTTPRefs(t, srv, "git-upload-pack", func(req *http.Request) {
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set("Git-Protocol", "version=2")
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	if assert.NotNil(t, received) {
+		assert.Equal(t, "team/test.git", received.Command.Repo)
+		assert.Equal(t, "alice", received.PublicKey.Name)
+		assert.Equal(t, "alice", received.User)
+		assert.NotEmpty(t, received.RemoteAddr)
+		assert.Equal(t, 2, received.ProtocolVersion)
+	}
+
+	resp = testHTTPRefs(t, srv, "git-receive-pack", basicAuth("alice", "secret"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,590 @@
+package gitkit
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// packCache lets identical fetches which arrive while a pack is being
+// generated share a single upload-pack run, such as when a fleet of CI
+// runners clones the same commit at once. Output is written to an unlinked
+// temporary file which every client reads back, so that those which join
+// late still receive the response from its start.
+//
+// When maxBytes is set, finished responses are kept too, up to maxBytes in
+// all, with the least recently used evicted first. Kept responses are only
+// served while every object they were asked for is still a ref tip, so
+// that objects no longer in the repository are never handed out.
+type packCache struct {
+	mu      sync.Mutex
+	flights map[string]*packFlight
+
+	maxBytes     int64 // Total size of kept responses; zero keeps none
+	maxPackBytes int64 // Largest response kept; defaults to maxBytes
+	kept         map[string]*list.Element
+	lru          *list.List // *keptPack, most recently used first
+	size         int64
+	tmpDir       string // Where responses are buffered; the system's temporary directory when empty
+
+	// run generates the response to a fetch request for the repository at
+	// path, writing it to w. ctx is that of the client which started the
+	// run, without its cancellation.
+	run func(ctx context.Context, path string, req []byte, w io.Writer) error
+
+	// tips returns the object ids refs in the repository at path point to
+	tips func(path string) (map[string]bool, error)
+}
+
+// keptPack is a finished response kept for later identical fetches
+type keptPack struct {
+	key   string
+	wants []string
+	f     *packFlight
+}
+
+// newPackCache returns a cache for s, running upload-pack as s runs git,
+// such as within its Sandbox
+func newPackCache(s *SSH, gitPath string) *packCache {
+	return &packCache{
+		flights: make(map[string]*packFlight),
+		kept:    make(map[string]*list.Element),
+		lru:     list.New(),
+		run: func(ctx context.Context, path string, req []byte, w io.Writer) error {
+			cmd, err := s.current().gitCommand(ctx, []string{"GIT_PROTOCOL=version=2"}, "upload-pack", "--stateless-rpc", path)
+			if err != nil {
+				return err
+			}
+
+			cmd.Stdin = bytes.NewReader(req)
+			cmd.Stdout = w
+
+			return cmd.Run()
+		},
+		tips: func(path string) (map[string]bool, error) {
+			out, err := exec.Command(gitPath, "-C", path, "for-each-ref", "--format=%(objectname)").Output()
+			if err != nil {
+				return nil, err
+			}
+
+			tips := make(map[string]bool)
+			for _, id := range strings.Fields(string(out)) {
+				tips[id] = true
+			}
+
+			return tips, nil
+		},
+	}
+}
+
+// fetch writes the response to req to w, from a kept response when one is
+// still current, joining a run already in progress for the same key or
+// else starting one
+func (c *packCache) fetch(ctx context.Context, key, path string, req []byte, w io.Writer) error {
+	if f := c.keptFlight(key, path, req); f != nil {
+		defer f.release()
+
+		return f.copyTo(w)
+	}
+
+	c.mu.Lock()
+
+	f, ok := c.flights[key]
+	if !ok {
+		file, err := os.CreateTemp(c.tmpDir, "gitkit-pack-")
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+
+		os.Remove(file.Name())
+
+		f = &packFlight{file: file, readers: 1}
+		f.cond = sync.NewCond(&f.mu)
+		c.flights[key] = f
+
+		go c.generate(context.WithoutCancel(ctx), key, f, path, req)
+	}
+
+	f.readers++
+	c.mu.Unlock()
+
+	defer f.release()
+
+	return f.copyTo(w)
+}
+
+// generate runs upload-pack for a flight. It does not belong to any one
+// client, so carries on should the client which started it go away.
+func (c *packCache) generate(ctx context.Context, key string, f *packFlight, path string, req []byte) {
+	err := c.run(ctx, path, req, f)
+
+	// Clients arriving from now on either read the kept response or get a
+	// run of their own
+	c.mu.Lock()
+	delete(c.flights, key)
+	if err == nil {
+		c.keep(key, fetchWants(req), f)
+	}
+	c.mu.Unlock()
+
+	f.mu.Lock()
+	f.done, f.err = true, err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+
+	f.release()
+}
+
+// keep holds on to the finished flight f as the response for key, if it
+// fits, evicting the least recently used responses to make room. c.mu must
+// be held.
+func (c *packCache) keep(key string, wants []string, f *packFlight) {
+	max := c.maxPackBytes
+	if max <= 0 || max > c.maxBytes {
+		max = c.maxBytes
+	}
+
+	if c.maxBytes <= 0 || f.size > max || len(wants) == 0 {
+		return
+	}
+
+	if e, ok := c.kept[key]; ok {
+		c.evict(e)
+	}
+
+	f.mu.Lock()
+	f.readers++
+	f.mu.Unlock()
+
+	c.kept[key] = c.lru.PushFront(&keptPack{key: key, wants: wants, f: f})
+	c.size += f.size
+
+	for c.size > c.maxBytes {
+		c.evict(c.lru.Back())
+	}
+}
+
+// setLimits changes how much c keeps, and where it buffers responses.
+// Kept responses now too large are evicted, then the least recently used
+// until the rest fit.
+func (c *packCache) setLimits(maxBytes, maxPackBytes int64, tmpDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxBytes, c.maxPackBytes, c.tmpDir = maxBytes, maxPackBytes, tmpDir
+
+	max := maxPackBytes
+	if max <= 0 || max > maxBytes {
+		max = maxBytes
+	}
+
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if e.Value.(*keptPack).f.size > max {
+			c.evict(e)
+		}
+
+		e = prev
+	}
+
+	for c.size > c.maxBytes {
+		c.evict(c.lru.Back())
+	}
+}
+
+// evict drops a kept response. c.mu must be held.
+func (c *packCache) evict(e *list.Element) {
+	kp := c.lru.Remove(e).(*keptPack)
+	delete(c.kept, kp.key)
+	c.size -= kp.f.size
+
+	kp.f.release()
+}
+
+// keptFlight returns the kept response for key, held for the caller to
+// release, provided the objects it was asked for are all still ref tips
+// in the repository at path. Responses which are not are evicted.
+func (c *packCache) keptFlight(key, path string, req []byte) *packFlight {
+	c.mu.Lock()
+
+	e, ok := c.kept[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	kp := e.Value.(*keptPack)
+
+	kp.f.mu.Lock()
+	kp.f.readers++
+	kp.f.mu.Unlock()
+
+	c.mu.Unlock()
+
+	tips, err := c.tips(path)
+	current := err == nil
+	for _, want := range kp.wants {
+		current = current && tips[want]
+	}
+
+	if current {
+		return kp.f
+	}
+
+	c.mu.Lock()
+	if c.kept[key] == e {
+		c.evict(e)
+	}
+	c.mu.Unlock()
+
+	kp.f.release()
+
+	return nil
+}
+
+// packFlight is a single upload-pack run shared by one or more clients
+type packFlight struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File
+	size    int64
+	done    bool
+	err     error
+	readers int // Clients reading the flight, plus one until generate finishes
+}
+
+// Write appends upload-pack output to the flight's file
+func (f *packFlight) Write(p []byte) (int, error) {
+	n, err := f.file.WriteAt(p, f.size)
+
+	f.mu.Lock()
+	f.size += int64(n)
+	f.cond.Broadcast()
+	f.mu.Unlock()
+
+	return n, err
+}
+
+// copyTo writes the flight's output to w as it is generated
+func (f *packFlight) copyTo(w io.Writer) error {
+	pooled := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(pooled)
+
+	buf := *pooled
+
+	var off int64
+	for {
+		f.mu.Lock()
+		for off >= f.size && !f.done {
+			f.cond.Wait()
+		}
+
+		size, done, err := f.size, f.done, f.err
+		f.mu.Unlock()
+
+		for off < size {
+			n := int64(len(buf))
+			if size-off < n {
+				n = size - off
+			}
+
+			read, rerr := f.file.ReadAt(buf[:n], off)
+			if _, werr := w.Write(buf[:read]); werr != nil {
+				return werr
+			}
+
+			if rerr != nil {
+				return rerr
+			}
+
+			off += int64(read)
+		}
+
+		if done {
+			return err
+		}
+	}
+}
+
+// release closes the flight's file once nothing more needs it
+func (f *packFlight) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.readers--
+	if f.readers == 0 {
+		f.file.Close()
+	}
+}
+
+// primePackCache generates and keeps the response to the fetch git clone
+// makes of repo over protocol v2, wanting every branch and tag and HEAD,
+// without progress, so that the next clones are served from the cache.
+// Nothing is done where fetches from repo are not cached.
+func (s *SSH) primePackCache(ctx context.Context, repo string) error {
+	if !s.config.PackCache || s.config.PackCacheMaxBytes <= 0 || s.config.SystemUsers != "" {
+		return nil
+	}
+
+	loc, err := s.current().resolveRepo(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	// As with cacheFetches, which would not look in the cache for these
+	if loc.UploadPack.AllowAnySHA1InWant || len(loc.HideRefs) > 0 {
+		return nil
+	}
+
+	format, err := exec.CommandContext(ctx, s.config.GitPath, "-C", loc.Path, "rev-parse", "--show-object-format").Output()
+	if err != nil {
+		return fmt.Errorf("pack cache: rev-parse: %w", err)
+	}
+
+	refs, err := exec.CommandContext(ctx, s.config.GitPath, "-C", loc.Path, "for-each-ref", "--format=%(objectname)", "refs/heads", "refs/tags").Output()
+	if err != nil {
+		return fmt.Errorf("pack cache: for-each-ref: %w", err)
+	}
+
+	wants := strings.Fields(string(refs))
+	if head, err := exec.CommandContext(ctx, s.config.GitPath, "-C", loc.Path, "rev-parse", "-q", "--verify", "HEAD").Output(); err == nil {
+		wants = append(wants, strings.TrimSpace(string(head)))
+	}
+
+	if len(wants) == 0 {
+		return nil
+	}
+
+	req := new(bytes.Buffer)
+	packLine(req, "command=fetch\n")
+	packLine(req, "object-format="+strings.TrimSpace(string(format))+"\n")
+	req.WriteString("0001")
+
+	for _, arg := range []string{"thin-pack", "no-progress", "ofs-delta"} {
+		packLine(req, arg+"\n")
+	}
+
+	for _, want := range wants {
+		packLine(req, "want "+want+"\n")
+	}
+
+	packLine(req, "done\n")
+	packFlush(req)
+
+	key, ok := packCacheKey(loc.Path, req.Bytes())
+	if !ok {
+		return nil
+	}
+
+	return s.packCache.fetch(ctx, key, loc.Path, req.Bytes(), io.Discard)
+}
+
+// packCacheKey identifies protocol v2 fetch requests which can share a
+// response: those which are done negotiating and have no shallow options,
+// filters or wanted refs, whose output depends only on the objects in the
+// repository and the request's wants and haves. Capabilities which only
+// describe the client, such as its agent, are left out of the key.
+func packCacheKey(path string, req []byte) (string, bool) {
+	lines, ok := splitPktLines(req)
+	if !ok || len(lines) == 0 || lines[0] != "command=fetch" {
+		return "", false
+	}
+
+	parts := []string{}
+	args := false
+	done := false
+
+	for _, line := range lines[1:] {
+		switch {
+		case line == "\x01":
+			args = true
+			continue
+
+		case !args && (strings.HasPrefix(line, "agent=") || strings.HasPrefix(line, "session-id=")):
+			continue
+
+		case args && line == "done":
+			done = true
+
+		case args && (strings.HasPrefix(line, "shallow ") ||
+			strings.HasPrefix(line, "deepen") ||
+			strings.HasPrefix(line, "filter ") ||
+			strings.HasPrefix(line, "want-ref ")):
+			return "", false
+		}
+
+		parts = append(parts, line)
+	}
+
+	if !done {
+		return "", false
+	}
+
+	sort.Strings(parts)
+
+	return path + "\x00" + strings.Join(parts, "\x00"), true
+}
+
+// fetchWants returns the object ids a fetch request asks for
+func fetchWants(req []byte) []string {
+	lines, _ := splitPktLines(req)
+
+	wants := []string{}
+	for _, line := range lines {
+		if want, ok := strings.CutPrefix(line, "want "); ok {
+			wants = append(wants, want)
+		}
+	}
+
+	return wants
+}
+
+// splitPktLines returns the payloads of the pkt-lines in a single request,
+// without trailing newlines. delim-pkts are returned as "\x01".
+func splitPktLines(req []byte) ([]string, bool) {
+	lines := []string{}
+
+	for len(req) >= 4 {
+		n, err := strconv.ParseUint(string(req[:4]), 16, 16)
+		if err != nil {
+			return nil, false
+		}
+
+		switch {
+		case n == 0:
+			return lines, len(req) == 4
+
+		case n == 1:
+			lines = append(lines, "\x01")
+			req = req[4:]
+
+		case n < 4 || int(n) > len(req):
+			return nil, false
+
+		default:
+			lines = append(lines, strings.TrimSuffix(string(req[4:n]), "\n"))
+			req = req[n:]
+		}
+	}
+
+	return nil, false
+}
+
+// fetchInterceptor sits between a protocol v2 client and upload-pack,
+// handing each request to serve and passing those it declines on to git.
+// Responses to requests serve accepts are written by serve itself; clients
+// wait for each response before sending their next request, so these never
+// interleave with git's own output.
+type fetchInterceptor struct {
+	r       io.Reader
+	serve   func(req []byte) (bool, error)
+	pending []byte
+	raw     bool // Pass everything straight through, after input git must judge
+	err     error
+}
+
+func (f *fetchInterceptor) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+
+		if f.raw {
+			return f.r.Read(p)
+		}
+
+		f.readRequest()
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+
+	return n, nil
+}
+
+// readRequest reads pkt-lines up to the next flush-pkt
+func (f *fetchInterceptor) readRequest() {
+	req := new(bytes.Buffer)
+
+	for {
+		head := make([]byte, 4)
+
+		n, err := io.ReadFull(f.r, head)
+		req.Write(head[:n])
+
+		if err != nil {
+			f.pending, f.err = req.Bytes(), err
+			return
+		}
+
+		l, err := strconv.ParseUint(string(head), 16, 16)
+		if err != nil || l == 3 || l > maxPktLen {
+			f.pending, f.raw = req.Bytes(), true
+			return
+		}
+
+		if l == 0 {
+			break
+		}
+
+		if l < 4 {
+			continue
+		}
+
+		if _, err := io.CopyN(req, f.r, int64(l-4)); err != nil {
+			f.pending, f.err = req.Bytes(), err
+			return
+		}
+	}
+
+	served, err := f.serve(req.Bytes())
+	if err != nil {
+		f.err = err
+		return
+	}
+
+	if !served {
+		f.pending = req.Bytes()
+	}
+}
+
+// cacheFetches wraps what a client sends to upload-pack so that cacheable
+// fetches are answered from the pack cache, with responses written to w.
+// Only protocol v2 is handled, since v0 and v1 spread negotiation across
+// several exchanges with a single git process; clients using those, or
+// repositories read as mapped system accounts, are left alone.
+func (s SSH) cacheFetches(ctx context.Context, sess *session, gitcmd *GitCommand, loc repoLocation, in io.Reader, w io.Writer) io.Reader {
+	if !s.config.PackCache || gitcmd.SubCommand() != "upload-pack" || s.config.SystemUsers != "" {
+		return in
+	}
+
+	// The cache runs upload-pack without per-repository options or a
+	// namespace, and so would refuse wants those options allow, or serve
+	// wants for refs hidden from this client or outside its namespace
+	if loc.UploadPack.AllowAnySHA1InWant || len(loc.HideRefs) > 0 || gitcmd.Namespace != "" {
+		return in
+	}
+
+	if sess == nil || !strings.Contains(sess.env["GIT_PROTOCOL"], "version=2") {
+		return in
+	}
+
+	return &fetchInterceptor{r: in, serve: func(req []byte) (bool, error) {
+		key, ok := packCacheKey(loc.Path, req)
+		if !ok {
+			return false, nil
+		}
+
+		return true, s.packCache.fetch(ctx, key, loc.Path, req, throttleWriter(ctx, recordWriter(ctx, RecordToClient, w)))
+	}}
+}
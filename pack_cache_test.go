@@ -0,0 +1,341 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFetchRequest(args ...string) []byte {
+	req := new(bytes.Buffer)
+	packLine(req, "command=fetch\n")
+	packLine(req, "agent=git/2.39.5\n")
+	req.WriteString("0001")
+
+	for _, arg := range args {
+		packLine(req, arg+"\n")
+	}
+
+	packFlush(req)
+
+	return req.Bytes()
+}
+
+func Test_packCacheKey(t *testing.T) {
+	want := "want e285100b636ac67fa28d85685072158edaa01685"
+
+	key, ok := packCacheKey("/srv/test", testFetchRequest("ofs-delta", want, "done"))
+	assert.True(t, ok)
+
+	// Agents differ between clients, and argument order does not matter
+	other := bytes.Replace(testFetchRequest(want, "ofs-delta", "done"), []byte("2.39.5"), []byte("2.43.0"), 1)
+	otherKey, ok := packCacheKey("/srv/test", other)
+	assert.True(t, ok)
+	assert.Equal(t, key, otherKey)
+
+	otherKey, _ = packCacheKey("/srv/other", testFetchRequest("ofs-delta", want, "done"))
+	assert.NotEqual(t, key, otherKey)
+
+	// Fetches done negotiating share responses with others sending the
+	// same haves
+	otherKey, ok = packCacheKey("/srv/test", testFetchRequest("ofs-delta", want, "have 7b4ed2bba7658e7fe751a1c8b9babd6c90bcbcab", "done"))
+	assert.True(t, ok)
+	assert.NotEqual(t, key, otherKey)
+
+	for _, req := range [][]byte{
+		testFetchRequest(want),
+		testFetchRequest(want, "have 7b4ed2bba7658e7fe751a1c8b9babd6c90bcbcab"),
+		testFetchRequest(want, "deepen 1", "done"),
+		testFetchRequest(want, "filter blob:none", "done"),
+		[]byte("0014command=ls-refs\n0000"),
+	} {
+		_, ok := packCacheKey("/srv/test", req)
+		assert.False(t, ok, "%q", req)
+	}
+}
+
+func Test_packCache_fetch(t *testing.T) {
+	release := make(chan struct{})
+	var runs atomic.Int32
+
+	c := newPackCache(nil, "git")
+	c.run = func(_ context.Context, path string, req []byte, w io.Writer) error {
+		runs.Add(1)
+
+		fmt.Fprint(w, "first half,")
+		<-release
+		fmt.Fprint(w, "second half")
+
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	outs := make([]*bytes.Buffer, 5)
+
+	for i := range outs {
+		outs[i] = new(bytes.Buffer)
+
+		wg.Add(1)
+		go func(w io.Writer) {
+			defer wg.Done()
+			assert.NoError(t, c.fetch(context.Background(), "key", "/srv/test", nil, w))
+		}(outs[i])
+	}
+
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		f := c.flights["key"]
+		if f == nil {
+			return false
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		return f.readers == len(outs)+1
+	}, time.Second*5, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), runs.Load())
+	for _, out := range outs {
+		assert.Equal(t, "first half,second half", out.String())
+	}
+
+	// Once finished, the next fetch runs again
+	assert.NoError(t, c.fetch(context.Background(), "key", "/srv/test", nil, io.Discard))
+	assert.Equal(t, int32(2), runs.Load())
+}
+
+func Test_packCache_kept(t *testing.T) {
+	want := "want e285100b636ac67fa28d85685072158edaa01685"
+	tips := map[string]bool{"e285100b636ac67fa28d85685072158edaa01685": true}
+
+	var runs atomic.Int32
+
+	// Responses echo their 106 byte request
+	c := newPackCache(nil, "git")
+	c.maxBytes, c.maxPackBytes = 250, 150
+	c.tips = func(string) (map[string]bool, error) { return tips, nil }
+	c.run = func(_ context.Context, path string, req []byte, w io.Writer) error {
+		runs.Add(1)
+		_, err := w.Write(req)
+
+		return err
+	}
+
+	req := testFetchRequest(want, "done")
+	assert.Len(t, req, 106)
+
+	fetch := func(key string, req []byte, expectRuns int32) {
+		t.Helper()
+
+		out := new(bytes.Buffer)
+		assert.NoError(t, c.fetch(context.Background(), key, "/srv/test", req, out))
+		assert.Equal(t, string(req), out.String())
+		assert.Equal(t, expectRuns, runs.Load(), key)
+	}
+
+	// Kept responses are served again without a run
+	fetch("a", req, 1)
+	fetch("a", req, 1)
+
+	// Room is made by evicting the least recently used
+	fetch("b", req, 2)
+	fetch("a", req, 2)
+	fetch("c", req, 3)
+	fetch("a", req, 3)
+	fetch("b", req, 4)
+
+	// Responses over the per-pack cap are not kept
+	large := testFetchRequest(want, strings.Repeat("x", 100), "done")
+	fetch("large", large, 5)
+	fetch("large", large, 6)
+
+	// Nor are they served once what they were for is no longer a ref tip
+	delete(tips, "e285100b636ac67fa28d85685072158edaa01685")
+	fetch("b", req, 7)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assert.LessOrEqual(t, c.size, c.maxBytes)
+	assert.Equal(t, c.lru.Len(), len(c.kept))
+}
+
+func TestSSH_PackCache(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, PackCache: true}, nil)
+
+	work := testWorkTree(t, s)
+	os.WriteFile(filepath.Join(work, "README"), []byte("hello"), 0644)
+	testGit(t, s, work, "add", "README")
+	testGit(t, s, work, "commit", "-q", "-m", "readme")
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	var runs atomic.Int32
+	run := s.packCache.run
+	s.packCache.run = func(ctx context.Context, path string, req []byte, w io.Writer) error {
+		runs.Add(1)
+		return run(ctx, path, req, w)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			clone := t.TempDir()
+
+			out, err := testGit(t, s, clone, "-c", "protocol.version=2", "clone", "-q", "-b", "main", testRemote(s, "test.git"), ".")
+			assert.NoError(t, err, out)
+
+			readme, err := os.ReadFile(filepath.Join(clone, "README"))
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(readme))
+
+			// Later fetches negotiate with haves, and go to git as usual
+			out, err = testGit(t, s, clone, "fetch", "-q", "origin")
+			assert.NoError(t, err, out)
+			assert.False(t, strings.Contains(out, "fatal"), out)
+		}()
+	}
+
+	wg.Wait()
+
+	// Each clone's initial fetch is served by the cache, whether or not it
+	// shared a run with another
+	assert.NotZero(t, runs.Load())
+	assert.LessOrEqual(t, runs.Load(), int32(3))
+}
+
+func TestSSH_PackCache_Kept(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, PackCache: true, PackCacheMaxBytes: 1 << 20}, nil)
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	var runs atomic.Int32
+	run := s.packCache.run
+	s.packCache.run = func(ctx context.Context, path string, req []byte, w io.Writer) error {
+		runs.Add(1)
+		return run(ctx, path, req, w)
+	}
+
+	clone := func() {
+		t.Helper()
+
+		out, err := testGit(t, s, t.TempDir(), "-c", "protocol.version=2", "clone", "-q", "-b", "main", testRemote(s, "test.git"), ".")
+		assert.NoError(t, err, out)
+	}
+
+	// Clones one after another share a kept pack
+	clone()
+	clone()
+	assert.Equal(t, int32(1), runs.Load())
+
+	// Until a push moves the branch on
+	testGit(t, s, work, "commit", "-q", "--allow-empty", "-m", "second")
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	clone()
+	assert.Equal(t, int32(2), runs.Load())
+}
+
+func TestSSH_PackCache_Namespace(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, PackCache: true}, func(s *SSH) {
+		shared := filepath.Join(s.config.Dir, "shared")
+
+		s.ResolveRepoFunc = func(context.Context, string) (string, error) {
+			return shared, nil
+		}
+
+		s.NamespaceFunc = func(_ context.Context, cmd *GitCommand) (string, error) {
+			return cmd.Repo, nil
+		}
+	})
+
+	var runs atomic.Int32
+	run := s.packCache.run
+	s.packCache.run = func(ctx context.Context, path string, req []byte, w io.Writer) error {
+		runs.Add(1)
+		return run(ctx, path, req, w)
+	}
+
+	work := testWorkTree(t, s)
+
+	for _, repo := range []string{"alpha", "beta"} {
+		testGit(t, s, work, "commit", "-q", "--allow-empty", "-m", repo)
+
+		out, err := testGit(t, s, work, "push", testRemote(s, repo+".git"), "main")
+		require.NoError(t, err, out)
+	}
+
+	// Clones of one namespace must not be served another's pack
+	for _, repo := range []string{"alpha", "beta"} {
+		clone := t.TempDir()
+
+		out, err := testGit(t, s, clone, "-c", "protocol.version=2", "clone", "-q", "-b", "main", testRemote(s, repo+".git"), ".")
+		require.NoError(t, err, out)
+
+		out, err = testGit(t, s, clone, "log", "-1", "--format=%s")
+		assert.NoError(t, err, out)
+		assert.Equal(t, repo+"\n", out)
+	}
+
+	assert.Zero(t, runs.Load())
+}
+
+// recordingSandbox records the arguments of each command it is given
+type recordingSandbox struct {
+	mu   sync.Mutex
+	args [][]string
+}
+
+func (r *recordingSandbox) Sandbox(_ context.Context, cmd *exec.Cmd) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.args = append(r.args, cmd.Args[1:])
+
+	return nil
+}
+
+func TestSSH_PackCache_Sandbox(t *testing.T) {
+	sandbox := new(recordingSandbox)
+
+	s := startTestSSH(t, Config{AutoCreate: true, PackCache: true}, func(s *SSH) {
+		s.Sandbox = sandbox
+	})
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	require.NoError(t, err, out)
+
+	out, err = testGit(t, s, t.TempDir(), "-c", "protocol.version=2", "clone", "-q", testRemote(s, "test.git"), ".")
+	require.NoError(t, err, out)
+
+	sandbox.mu.Lock()
+	defer sandbox.mu.Unlock()
+
+	assert.Contains(t, sandbox.args, []string{"upload-pack", "--stateless-rpc", filepath.Join(s.config.Dir, "test")})
+}
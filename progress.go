@@ -0,0 +1,138 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProgressInterval is how often ProgressFunc is called when
+// Config.ProgressInterval is zero
+const DefaultProgressInterval = time.Second
+
+// TransferStats describes how far a transfer has got
+type TransferStats struct {
+	BytesIn  int64 // Bytes received from the client, such as a pushed pack
+	BytesOut int64 // Bytes sent to the client, such as a fetched pack
+	Started  time.Time
+	Duration time.Duration // How long git has been running
+	Done     bool          // Whether git has exited
+}
+
+// progress samples a running transfer for ProgressFunc. A nil progress
+// counts nothing, so callers need not check whether ProgressFunc is set.
+type progress struct {
+	in, out atomic.Int64
+	started time.Time
+	report  func(TransferStats)
+	done    chan struct{} // Closed to stop sampling
+	exited  chan struct{} // Closed once sampling has stopped
+	once    sync.Once
+}
+
+// startProgress begins sampling a transfer for gitcmd, returning nil when
+// ProgressFunc is not set
+func (s SSH) startProgress(ctx context.Context, gitcmd *GitCommand) *progress {
+	if s.ProgressFunc == nil {
+		return nil
+	}
+
+	interval := s.config.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	p := &progress{
+		started: time.Now(),
+		report:  func(stats TransferStats) { s.ProgressFunc(ctx, gitcmd, stats) },
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.exited)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.report(p.stats(false))
+
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+func (p *progress) stats(done bool) TransferStats {
+	return TransferStats{
+		BytesIn:  p.in.Load(),
+		BytesOut: p.out.Load(),
+		Started:  p.started,
+		Duration: time.Since(p.started),
+		Done:     done,
+	}
+}
+
+// stop ends sampling, reporting the transfer's final stats once no sample
+// can still be being reported
+func (p *progress) stop() {
+	if p == nil {
+		return
+	}
+
+	p.once.Do(func() {
+		close(p.done)
+		<-p.exited
+		p.report(p.stats(true))
+	})
+}
+
+// reader counts bytes read from r as received from the client
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil || r == nil {
+		return r
+	}
+
+	return progressReader{r, &p.in}
+}
+
+// writer counts bytes written to w as sent to the client
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+
+	return progressWriter{w, &p.out}
+}
+
+type progressReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n.Add(int64(n))
+
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n.Add(int64(n))
+
+	return n, err
+}
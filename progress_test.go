@@ -0,0 +1,99 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_progress(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		samples []TransferStats
+	)
+
+	s := NewSSH(Config{ProgressInterval: 10 * time.Millisecond})
+	s.ProgressFunc = func(_ context.Context, _ *GitCommand, stats TransferStats) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		samples = append(samples, stats)
+	}
+
+	p := s.startProgress(context.Background(), &GitCommand{Command: "git-receive-pack", Repo: "test"})
+
+	_, err := io.Copy(p.writer(io.Discard), p.reader(strings.NewReader("pushed")))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(samples) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	p.stop()
+	p.stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	last := samples[len(samples)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(6), last.BytesIn)
+	assert.Equal(t, int64(6), last.BytesOut)
+
+	for _, sample := range samples[:len(samples)-1] {
+		assert.False(t, sample.Done)
+	}
+
+	// Without ProgressFunc nothing is counted
+	var idle *progress
+	r := bytes.NewReader(nil)
+	assert.Equal(t, io.Reader(r), idle.reader(r))
+	idle.stop()
+}
+
+func TestSSH_ProgressFunc(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		final = map[string]TransferStats{}
+	)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.ProgressFunc = func(_ context.Context, cmd *GitCommand, stats TransferStats) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if stats.Done {
+				final[cmd.SubCommand()] = stats
+			}
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	if !assert.NoError(t, err, out) {
+		return
+	}
+
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), "clone")
+	if !assert.NoError(t, err, out) {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	push, clone := final[OperationReceivePack], final[OperationUploadPack]
+	assert.Greater(t, push.BytesIn, int64(0))
+	assert.Greater(t, clone.BytesOut, int64(0))
+	assert.Greater(t, clone.Duration, time.Duration(0))
+}
@@ -0,0 +1,224 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is how long a connection has to send its PROXY
+// protocol header, when Config.ProxyHeaderTimeout is not set
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// ErrProxyHeader is returned for connections which should begin with a
+// PROXY protocol header, but do not
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyV2Signature begins every version 2 PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is a connection accepted from a load balancer, reporting the
+// address of the client the load balancer accepted it from
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// checkTrustedProxies returns an error should any of Config.TrustedProxies
+// not be a CIDR, or ProxyProtocol be set without them, which would let any
+// client claim any address
+func (c *Config) checkTrustedProxies() error {
+	if c.ProxyProtocol && len(c.TrustedProxies) == 0 {
+		return errors.New("trusted proxy: ProxyProtocol needs TrustedProxies naming the load balancers")
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("trusted proxy: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// trustedProxy reports whether conn comes from one of Config.TrustedProxies
+func (c *Config) trustedProxy(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Config) proxyHeaderTimeout() time.Duration {
+	if c.ProxyHeaderTimeout > 0 {
+		return c.ProxyHeaderTimeout
+	}
+
+	return DefaultProxyHeaderTimeout
+}
+
+// proxyConn reads the PROXY protocol header conn begins with, when
+// Config.ProxyProtocol is set and conn comes from a trusted proxy,
+// returning a connection whose RemoteAddr is the client's
+func (s SSH) proxyConn(conn net.Conn) (net.Conn, error) {
+	if !s.config.ProxyProtocol {
+		return conn, nil
+	}
+
+	if !s.config.trustedProxy(conn) {
+		return conn, nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(s.config.proxyHeaderTimeout())); err != nil {
+		return nil, err
+	}
+
+	pc := &proxiedConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr()}
+
+	remote, err := readProxyHeader(pc.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if remote != nil {
+		pc.remote = remote
+	}
+
+	return pc, conn.SetReadDeadline(time.Time{})
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header from r,
+// returning the source address it gives. Headers sent by the proxy on its
+// own behalf, such as for health checks, carry no address, so nil is
+// returned.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	if string(start) == "PROXY" {
+		return readProxyV1(r)
+	}
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil || !bytes.Equal(sig, proxyV2Signature) {
+		return nil, ErrProxyHeader
+	}
+
+	return readProxyV2(r)
+}
+
+// readProxyV1 reads a header of the form
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// Headers are at most 107 bytes, including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if !bytes.HasSuffix(line, []byte("\r\n")) || len(fields) < 2 {
+		return nil, ErrProxyHeader
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, strings.TrimSpace(string(line)))
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, a version and command
+// byte, an address family byte, and the length of the addresses and any
+// TLVs which follow
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrProxyHeader, verCmd>>4)
+	}
+
+	// LOCAL connections are the proxy's own
+	if verCmd&0xf == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+
+	default:
+		// Unix sockets and unspecified families carry no address worth
+		// reporting
+		return nil, nil
+	}
+}
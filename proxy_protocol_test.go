@@ -0,0 +1,166 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testProxyV2 builds a version 2 header for a TCP connection from src,
+// followed by a TLV the parser should skip
+func testProxyV2(cmd byte, src *net.TCPAddr) []byte {
+	var addrs []byte
+
+	family := byte(0x11)
+	if ip := src.IP.To4(); ip != nil {
+		addrs = append(append(addrs, ip...), 192, 0, 2, 254)
+	} else {
+		family = 0x21
+		addrs = append(append(addrs, src.IP.To16()...), net.IPv6loopback...)
+	}
+
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, 22)
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0xff)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+
+	for _, test := range []struct {
+		name   string
+		header []byte
+		expect net.Addr
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n"), v4, false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::1 56324 22\r\n"), v6, false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), nil, false},
+		{"v1 bad address", []byte("PROXY TCP4 example.com 198.51.100.1 56324 22\r\n"), nil, true},
+		{"v1 unterminated", []byte("PROXY TCP4 " + strings.Repeat("1", 120)), nil, true},
+		{"v2 tcp4", testProxyV2(0x1, v4), v4, false},
+		{"v2 tcp6", testProxyV2(0x1, v6), v6, false},
+		{"v2 local", testProxyV2(0x0, v4), nil, false},
+		{"v2 truncated", testProxyV2(0x1, v4)[:20], nil, true},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.0\r\n"), nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Failures are read without the client's bytes following, which
+			// would otherwise pad out truncated headers
+			input := test.header
+			if !test.err {
+				input = append(input, "SSH-2.0-client\r\n"...)
+			}
+
+			r := bufio.NewReader(bytes.NewReader(input))
+
+			addr, err := readProxyHeader(r)
+			if test.err {
+				assert.True(t, errors.Is(err, ErrProxyHeader), "expected ErrProxyHeader, received %v", err)
+
+				return
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, test.expect, addr)
+
+			// The client's own bytes are left for the ssh handshake
+			rest, _ := r.ReadString('\n')
+			assert.Equal(t, "SSH-2.0-client\r\n", rest)
+		})
+	}
+}
+
+// testProxyDial connects to s as a load balancer would, sending header
+// before the ssh handshake
+func testProxyDial(t *testing.T, s *SSH, header []byte) (*ssh.Client, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	client := ssh.NewClient(c, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+
+	return client, nil
+}
+
+func testSessionAddrs(s *SSH) []string {
+	addrs := []string{}
+	for _, info := range s.Sessions() {
+		addrs = append(addrs, info.RemoteAddr)
+	}
+
+	return addrs
+}
+
+func TestSSH_ProxyProtocol(t *testing.T) {
+	s := startTestSSH(t, Config{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.0/8"}, ProxyHeaderTimeout: time.Second}, nil)
+
+	_, err := testProxyDial(t, s, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"192.0.2.1:56324"}, testSessionAddrs(s))
+
+	_, err = testProxyDial(t, s, testProxyV2(0x1, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.ElementsMatch(t, []string{"192.0.2.1:56324", "[2001:db8::1]:443"}, testSessionAddrs(s))
+
+	// Clients reaching the server around the load balancer are refused
+	_, err = testProxyDial(t, s, nil)
+	assert.Error(t, err)
+}
+
+func TestSSH_ProxyProtocol_TrustedProxies(t *testing.T) {
+	s := startTestSSH(t, Config{ProxyProtocol: true, TrustedProxies: []string{"192.0.2.0/24"}}, nil)
+
+	client := testSSHClient(t, s)
+	assert.Equal(t, []string{client.LocalAddr().String()}, testSessionAddrs(s))
+
+	bad := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0"}})
+	assert.Error(t, bad.Listen("127.0.0.1:0"))
+
+	// Without TrustedProxies any client could claim any address
+	bad = NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), ProxyProtocol: true})
+	assert.Error(t, bad.Listen("127.0.0.1:0"))
+}
@@ -0,0 +1,140 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrPushRejected is returned when AuthorisePushFunc refuses a push
+var ErrPushRejected = errors.New("push rejected")
+
+// PushRejection is passed to the MsgPushRejected template
+type PushRejection struct {
+	Repo   string
+	Reason string
+}
+
+// RefUpdate is a single ref change requested by a client
+type RefUpdate struct {
+	OldRev string `json:"old_rev"`
+	NewRev string `json:"new_rev"`
+	Ref    string `json:"ref"`
+}
+
+// Action returns the same action HookInfo reports for this update,
+// such as BranchCreateAction
+func (u RefUpdate) Action() string {
+	info := HookInfo{OldRev: u.OldRev, NewRev: u.NewRev}
+
+	if parts := strings.SplitN(u.Ref, "/", 3); len(parts) == 3 {
+		info.RefType = parts[1]
+	}
+
+	return parseHookAction(info)
+}
+
+// PushRequest describes what a client is pushing, as read from the start
+// of the receive-pack conversation and before any objects are written
+type PushRequest struct {
+	Updates      []RefUpdate
+	Options      []string // Values given with git push -o/--push-option
+	Capabilities []string
+	RepoPath     string
+
+	// Certificate is set for signed pushes, made with git push --signed
+	Certificate *PushCertificate
+
+	// GitConfig holds extra configuration, as key=value, for the
+	// receive-pack which applies this push. AuthorisePushFunc may add to it,
+	// for instance receive.denyNonFastForwards=true for users who may not
+	// force push.
+	GitConfig []string
+}
+
+// HasCapability reports whether the client requested capability c
+func (p PushRequest) HasCapability(c string) bool {
+	for _, cap := range p.Capabilities {
+		if cap == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readPushRequest reads the command list and any push options a client
+// sends to receive-pack. Everything read is also returned verbatim so that
+// it can be replayed to git once the push has been authorised.
+func readPushRequest(r io.Reader) (*PushRequest, []byte, error) {
+	raw := new(bytes.Buffer)
+	tee := io.TeeReader(r, raw)
+
+	push := new(PushRequest)
+
+	for first := true; ; {
+		line, flush, err := readPktLine(tee)
+		if err != nil {
+			return nil, raw.Bytes(), err
+		}
+
+		if flush {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		if bytes.HasPrefix(line, []byte("shallow ")) {
+			continue
+		}
+
+		if first {
+			var caps []byte
+			line, caps, _ = bytes.Cut(line, []byte{0})
+			push.Capabilities = strings.Fields(string(caps))
+			first = false
+		}
+
+		// Signed pushes send their commands within the certificate
+		if string(line) == "push-cert" {
+			cert, err := readPushCertificate(tee)
+			if err != nil {
+				return nil, raw.Bytes(), err
+			}
+
+			push.Certificate = cert
+			push.Updates = append(push.Updates, cert.Updates...)
+
+			continue
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) != 3 {
+			return nil, raw.Bytes(), fmt.Errorf("invalid ref update %q", line)
+		}
+
+		push.Updates = append(push.Updates, RefUpdate{OldRev: fields[0], NewRev: fields[1], Ref: fields[2]})
+	}
+
+	// A client with nothing to push sends only a flush packet
+	if len(push.Updates) == 0 || !push.HasCapability("push-options") {
+		return push, raw.Bytes(), nil
+	}
+
+	for {
+		line, flush, err := readPktLine(tee)
+		if err != nil {
+			return nil, raw.Bytes(), err
+		}
+
+		if flush {
+			break
+		}
+
+		push.Options = append(push.Options, string(bytes.TrimSuffix(line, []byte("\n"))))
+	}
+
+	return push, raw.Bytes(), nil
+}
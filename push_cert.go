@@ -0,0 +1,189 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPushCertNonceSlop is how old a signed push's nonce may be when
+// Config.PushCertNonceSlop is zero
+const DefaultPushCertNonceSlop = 5 * time.Minute
+
+// ErrPushCertificate is returned when VerifyPushCertificateFunc refuses a
+// push
+var ErrPushCertificate = errors.New("push certificate rejected")
+
+// PushCertificate is the certificate a client signs for git push --signed,
+// stating who is pushing which ref updates to where
+type PushCertificate struct {
+	Version   string
+	Pusher    string // Signer's identity, as "Name <email> timestamp tz"
+	Pushee    string // URL the client pushed to
+	Nonce     string
+	Options   []string
+	Updates   []RefUpdate
+	Payload   []byte // The signed part of the certificate
+	Signature []byte // Armoured GPG, or SSH, signature over Payload
+
+	// NonceValid reports whether Nonce was issued by this server, for this
+	// repository, within Config.PushCertNonceSlop, which guards against
+	// certificates being replayed
+	NonceValid bool
+}
+
+// readPushCertificate reads the certificate following a push-cert line, up
+// to push-cert-end
+func readPushCertificate(r io.Reader) (*PushCertificate, error) {
+	data := new(bytes.Buffer)
+
+	for {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if flush {
+			return nil, fmt.Errorf("push certificate: missing push-cert-end")
+		}
+
+		if string(line) == "push-cert-end\n" {
+			break
+		}
+
+		data.Write(line)
+	}
+
+	return parsePushCertificate(data.Bytes())
+}
+
+func parsePushCertificate(data []byte) (*PushCertificate, error) {
+	cert := new(PushCertificate)
+
+	i := bytes.Index(data, []byte("-----BEGIN "))
+	if i == -1 {
+		return nil, fmt.Errorf("push certificate: missing signature")
+	}
+
+	cert.Payload, cert.Signature = data[:i], data[i:]
+
+	header, commands, ok := strings.Cut(string(cert.Payload), "\n\n")
+	if !ok {
+		return nil, fmt.Errorf("push certificate: missing commands")
+	}
+
+	for _, line := range strings.Split(header, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+
+		switch key {
+		case "certificate":
+			cert.Version = strings.TrimPrefix(value, "version ")
+		case "pusher":
+			cert.Pusher = value
+		case "pushee":
+			cert.Pushee = value
+		case "nonce":
+			cert.Nonce = value
+		case "push-option":
+			cert.Options = append(cert.Options, value)
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(commands, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("push certificate: invalid ref update %q", line)
+		}
+
+		cert.Updates = append(cert.Updates, RefUpdate{OldRev: fields[0], NewRev: fields[1], Ref: fields[2]})
+	}
+
+	return cert, nil
+}
+
+// newPushCertSeed returns a random seed for push certificate nonces
+func newPushCertSeed() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// pushCertNonce returns the nonce git's receive-pack issues, with
+// receive.certNonceSeed set to seed, for the repository at path. Note that
+// git keys the HMAC with the path and timestamp, over the seed.
+func pushCertNonce(seed, path string, stamp int64) string {
+	mac := hmac.New(sha1.New, []byte(fmt.Sprintf("%s:%d", path, stamp)))
+	mac.Write([]byte(seed))
+
+	return fmt.Sprintf("%d-%s", stamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// validPushCertNonce reports whether nonce was issued for path, using seed,
+// no more than slop ago
+func validPushCertNonce(seed, path, nonce string, slop time.Duration) bool {
+	stampStr, _, ok := strings.Cut(nonce, "-")
+	if !ok {
+		return false
+	}
+
+	stamp, err := strconv.ParseInt(stampStr, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := time.Since(time.Unix(stamp, 0))
+	if age < -time.Second || age > slop {
+		return false
+	}
+
+	return hmac.Equal([]byte(nonce), []byte(pushCertNonce(seed, path, stamp)))
+}
+
+func (c *Config) pushCertNonceSlop() time.Duration {
+	if c.PushCertNonceSlop > 0 {
+		return c.PushCertNonceSlop
+	}
+
+	return DefaultPushCertNonceSlop
+}
+
+// pushCertGitConfig returns the receive-pack configuration which
+// advertises signed push support, when VerifyPushCertificateFunc is set
+func (s SSH) pushCertGitConfig() []string {
+	if s.VerifyPushCertificateFunc == nil {
+		return nil
+	}
+
+	return []string{
+		"-c", "receive.certNonceSeed=" + s.pushCertSeed,
+		"-c", fmt.Sprintf("receive.certNonceSlop=%d", int64(s.config.pushCertNonceSlop()/time.Second)),
+	}
+}
+
+// verifyPushCertificate passes the push's certificate, or nil for unsigned
+// pushes, to VerifyPushCertificateFunc
+func (s SSH) verifyPushCertificate(ctx context.Context, gitcmd *GitCommand, push *PushRequest) error {
+	if s.VerifyPushCertificateFunc == nil {
+		return nil
+	}
+
+	if cert := push.Certificate; cert != nil {
+		cert.NonceValid = validPushCertNonce(s.pushCertSeed, push.RepoPath, cert.Nonce, s.config.pushCertNonceSlop())
+	}
+
+	if err := s.VerifyPushCertificateFunc(ctx, gitcmd, push.Certificate); err != nil {
+		return fmt.Errorf("%w: %v", ErrPushCertificate, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readPushRequest_Certificate(t *testing.T) {
+	input := new(bytes.Buffer)
+	packLine(input, "push-cert\x00report-status push-options\n")
+	packLine(input, "certificate version 0.1\n")
+	packLine(input, "pusher test <test@example.com> 1700000000 +0000\n")
+	packLine(input, "pushee ssh://example.com/test.git\n")
+	packLine(input, "nonce 1700000000-abc\n")
+	packLine(input, "push-option ci.skip\n")
+	packLine(input, "\n")
+	packLine(input, ZeroSHA+" e285100b636ac67fa28d85685072158edaa01685 refs/heads/main\n")
+	packLine(input, "-----BEGIN SSH SIGNATURE-----\n")
+	packLine(input, "abc\n")
+	packLine(input, "-----END SSH SIGNATURE-----\n")
+	packLine(input, "push-cert-end\n")
+	packFlush(input)
+	packLine(input, "ci.skip\n")
+	packFlush(input)
+
+	push, _, err := readPushRequest(input)
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, push.Certificate) {
+		cert := push.Certificate
+		assert.Equal(t, "0.1", cert.Version)
+		assert.Equal(t, "ssh://example.com/test.git", cert.Pushee)
+		assert.Equal(t, "1700000000-abc", cert.Nonce)
+		assert.Equal(t, []string{"ci.skip"}, cert.Options)
+		assert.True(t, bytes.HasPrefix(cert.Signature, []byte("-----BEGIN SSH SIGNATURE-----")))
+		assert.True(t, bytes.HasSuffix(cert.Payload, []byte("refs/heads/main\n")))
+	}
+
+	assert.Equal(t, []RefUpdate{{ZeroSHA, "e285100b636ac67fa28d85685072158edaa01685", "refs/heads/main"}}, push.Updates)
+	assert.Equal(t, []string{"ci.skip"}, push.Options)
+}
+
+func Test_validPushCertNonce(t *testing.T) {
+	now := time.Now().Unix()
+	nonce := pushCertNonce("seed", "/srv/git/test", now)
+
+	assert.True(t, validPushCertNonce("seed", "/srv/git/test", nonce, time.Minute))
+	assert.False(t, validPushCertNonce("other", "/srv/git/test", nonce, time.Minute))
+	assert.False(t, validPushCertNonce("seed", "/srv/git/other", nonce, time.Minute))
+	assert.False(t, validPushCertNonce("seed", "/srv/git/test", pushCertNonce("seed", "/srv/git/test", now-120), time.Minute))
+	assert.False(t, validPushCertNonce("seed", "/srv/git/test", "garbage", time.Minute))
+}
+
+func TestSSH_VerifyPushCertificateFunc(t *testing.T) {
+	var received *PushCertificate
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.VerifyPushCertificateFunc = func(_ context.Context, _ *GitCommand, cert *PushCertificate) error {
+			if cert == nil {
+				return fmt.Errorf("pushes must be signed")
+			}
+
+			received = cert
+
+			return nil
+		}
+	})
+
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	if err == nil || !strings.Contains(out, "pushes must be signed") {
+		t.Fatalf("expected unsigned push to be rejected\n%s", out)
+	}
+
+	out, err = testGit(t, s, work, "-c", "gpg.format=ssh", "-c", "user.signingkey="+key, "push", "--signed", testRemote(s, "test.git"), "main")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	if received == nil {
+		t.Fatal("expected a certificate")
+	}
+
+	assert.True(t, received.NonceValid)
+	assert.Len(t, received.Updates, 1)
+	assert.True(t, bytes.HasPrefix(received.Signature, []byte("-----BEGIN SSH SIGNATURE-----")))
+}
+
+func Test_pushCertNonce_Git(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "test")
+	if out, err := exec.Command("git", "init", "-q", "--bare", repo).CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	out, err := exec.Command("git", "-c", "receive.certNonceSeed=seed", "receive-pack", "--stateless-rpc", "--advertise-refs", repo).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, nonce, ok := strings.Cut(string(out), "push-cert=")
+	if !ok {
+		t.Fatalf("no nonce advertised\n%s", out)
+	}
+
+	nonce, _, _ = strings.Cut(nonce, " ")
+
+	assert.True(t, validPushCertNonce("seed", repo, nonce, time.Minute), nonce)
+}
@@ -0,0 +1,325 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Push history retention, used when Config.PushHistoryMaxAge and
+// Config.PushHistoryMaxCount are zero
+const (
+	DefaultPushHistoryMaxAge   = 90 * 24 * time.Hour
+	DefaultPushHistoryMaxCount = 1000
+)
+
+// Push outcomes, as recorded in PushSummary.Outcome
+const (
+	PushOutcomeAccepted      = "accepted"
+	PushOutcomeRejected      = "rejected"       // Refused by VerifyPushCertificateFunc or AuthorisePushFunc
+	PushOutcomeQuotaExceeded = "quota-exceeded" // Refused by MaxPackSize or MaxRepoSize
+	PushOutcomeConflict      = "conflict"       // Lost a race with a concurrent push
+	PushOutcomeTimeout       = "timeout"        // Stopped by ReceivePackTimeout
+	PushOutcomeFailed        = "failed"
+)
+
+// PushSummary is the record of a single push kept when Config.PushHistory
+// is set. Updates holds every update the client asked for, while Created,
+// Updated and Deleted count those which were applied.
+type PushSummary struct {
+	ID       string        `json:"id"`
+	Time     time.Time     `json:"time"`
+	Repo     string        `json:"repo"`
+	Pusher   WebhookPusher `json:"pusher"`
+	Updates  []RefUpdate   `json:"updates"`
+	Options  []string      `json:"options,omitempty"`
+	Signed   bool          `json:"signed"`
+	Created  int           `json:"created"`
+	Updated  int           `json:"updated"`
+	Deleted  int           `json:"deleted"`
+	Bytes    int64         `json:"bytes"` // Sent by the client, including the pack
+	Duration time.Duration `json:"duration"`
+	Outcome  string        `json:"outcome"`
+	Reason   string        `json:"reason,omitempty"`
+}
+
+// PushQuery selects push summaries. Zero fields match every push.
+type PushQuery struct {
+	Repo  string
+	KeyID string
+	User  string
+	Since time.Time
+	Until time.Time
+	Limit int // Most summaries returned, newest first
+}
+
+func (q PushQuery) match(p PushSummary) bool {
+	return (q.KeyID == "" || p.Pusher.KeyID == q.KeyID) &&
+		(q.User == "" || p.Pusher.User == q.User) &&
+		(q.Since.IsZero() || !p.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || p.Time.Before(q.Until))
+}
+
+type pushRecordContextKey struct{}
+
+// pushRecord collects a PushSummary while a push is served
+type pushRecord struct {
+	mu      sync.Mutex
+	summary PushSummary
+	push    *PushRequest
+	bytes   atomic.Int64
+}
+
+// startPushRecord returns a context carrying a pushRecord for gitcmd, when
+// it is a push and Config.PushHistory is set
+func (s SSH) startPushRecord(ctx context.Context, gitcmd *GitCommand) (context.Context, *pushRecord) {
+	if !s.config.PushHistory || !gitcmd.IsWrite() {
+		return ctx, nil
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		logError("push history", err)
+		return ctx, nil
+	}
+
+	rec := &pushRecord{summary: PushSummary{
+		ID:     id.String(),
+		Time:   time.Now(),
+		Repo:   gitcmd.Repo,
+		Pusher: pusherFromContext(ctx),
+	}}
+
+	return context.WithValue(ctx, pushRecordContextKey{}, rec), rec
+}
+
+// count wraps what the client sends, adding it to the push's size
+func (r *pushRecord) count(in io.Reader) io.Reader {
+	if r == nil {
+		return in
+	}
+
+	return pushCounter{in, r}
+}
+
+type pushCounter struct {
+	r   io.Reader
+	rec *pushRecord
+}
+
+func (c pushCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.rec.bytes.Add(int64(n))
+
+	return n, err
+}
+
+// recordPushRequest notes the updates a client asked for in the session's
+// push record, if there is one
+func recordPushRequest(ctx context.Context, push *PushRequest) {
+	rec, ok := ctx.Value(pushRecordContextKey{}).(*pushRecord)
+	if !ok {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.push = push
+}
+
+// finishPushRecord completes the summary of a push from its outcome, then
+// stores it and applies the retention policy to the repository's history
+func (s SSH) finishPushRecord(rec *pushRecord, loc repoLocation, namespace string, err error) {
+	if rec == nil {
+		return
+	}
+
+	rec.mu.Lock()
+	sum := rec.summary
+	push := rec.push
+	rec.mu.Unlock()
+
+	sum.Duration = time.Since(sum.Time)
+	sum.Bytes = rec.bytes.Load()
+	sum.Outcome = pushOutcome(err)
+
+	if err != nil {
+		sum.Reason = err.Error()
+	}
+
+	if push != nil {
+		sum.Updates, sum.Options, sum.Signed = push.Updates, push.Options, push.Certificate != nil
+	}
+
+	if sum.Outcome == PushOutcomeAccepted && len(sum.Updates) > 0 {
+		applied, aerr := appliedUpdates(s.config.GitPath, loc.Path, namespace, sum.Updates)
+		if aerr != nil {
+			logError("push history", aerr)
+		}
+
+		for _, u := range applied {
+			switch {
+			case u.OldRev == ZeroSHA:
+				sum.Created++
+			case u.NewRev == ZeroSHA:
+				sum.Deleted++
+			default:
+				sum.Updated++
+			}
+		}
+	}
+
+	if err := s.storePushSummary(sum); err != nil {
+		logError("push history", err)
+	}
+}
+
+func pushOutcome(err error) string {
+	switch {
+	case err == nil:
+		return PushOutcomeAccepted
+	case errors.Is(err, ErrPushRejected):
+		return PushOutcomeRejected
+	case errors.Is(err, ErrQuotaExceeded):
+		return PushOutcomeQuotaExceeded
+	case errors.Is(err, ErrPushConflict):
+		return PushOutcomeConflict
+	case errors.Is(err, ErrOperationTimeout):
+		return PushOutcomeTimeout
+	default:
+		return PushOutcomeFailed
+	}
+}
+
+func pushHistoryPrefix(repo string) string {
+	return "pushes/" + url.PathEscape(repo) + "/"
+}
+
+// pushHistoryKey orders summaries by time within each repository's history
+func pushHistoryKey(sum PushSummary) string {
+	return fmt.Sprintf("%s%020d-%s", pushHistoryPrefix(sum.Repo), sum.Time.UnixNano(), sum.ID)
+}
+
+// pushKeyTime returns the time, in nanoseconds, of the push a history key
+// under prefix records
+func pushKeyTime(prefix, key string) int64 {
+	nanos, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), "-")
+	t, _ := strconv.ParseInt(nanos, 10, 64)
+
+	return t
+}
+
+func (s SSH) storePushSummary(sum PushSummary) error {
+	if s.Store == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Store.Put(pushHistoryKey(sum), data); err != nil {
+		return err
+	}
+
+	return s.prunePushHistory(sum.Repo)
+}
+
+// prunePushHistory deletes summaries of pushes to repo which are older than
+// Config.PushHistoryMaxAge, or beyond the newest Config.PushHistoryMaxCount
+func (s SSH) prunePushHistory(repo string) error {
+	maxAge := s.config.PushHistoryMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultPushHistoryMaxAge
+	}
+
+	maxCount := s.config.PushHistoryMaxCount
+	if maxCount == 0 {
+		maxCount = DefaultPushHistoryMaxCount
+	}
+
+	prefix := pushHistoryPrefix(repo)
+
+	keys, err := s.Store.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+
+	for i, key := range keys {
+		if t := pushKeyTime(prefix, key); t >= cutoff && len(keys)-i <= maxCount {
+			break
+		}
+
+		if err := s.Store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Pushes returns the summaries of the pushes matching q, newest first.
+// Config.PushHistory must be set for pushes to be recorded.
+func (s *SSH) Pushes(q PushQuery) ([]PushSummary, error) {
+	if s.Store == nil {
+		return nil, nil
+	}
+
+	prefix := "pushes/"
+	if q.Repo != "" {
+		prefix = pushHistoryPrefix(q.Repo)
+	}
+
+	keys, err := s.Store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	pushes := []PushSummary{}
+	for _, key := range keys {
+		data, err := s.Store.Get(key)
+		if errors.Is(err, ErrStoreKeyNotFound) {
+			// Pruned since being listed
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var sum PushSummary
+		if err := json.Unmarshal(data, &sum); err != nil {
+			return nil, err
+		}
+
+		if q.match(sum) {
+			pushes = append(pushes, sum)
+		}
+	}
+
+	// Keys only order pushes within a repository
+	sort.SliceStable(pushes, func(i, j int) bool {
+		return pushes[i].Time.After(pushes[j].Time)
+	})
+
+	if q.Limit > 0 && len(pushes) > q.Limit {
+		pushes = pushes[:q.Limit]
+	}
+
+	return pushes, nil
+}
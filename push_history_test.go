@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_PushHistory(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, PushHistory: true}, func(s *SSH) {
+		s.AuthorisePushFunc = func(_ context.Context, _ *GitCommand, push *PushRequest) error {
+			for _, u := range push.Updates {
+				if u.Ref == "refs/heads/protected" {
+					return errors.New("protected is read-only")
+				}
+			}
+
+			return nil
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main", "main:other")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main:protected")
+	assert.Error(t, err, out)
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), ":other")
+	assert.NoError(t, err, out)
+
+	pushes, err := s.Pushes(PushQuery{Repo: "test"})
+	assert.NoError(t, err)
+
+	if !assert.Len(t, pushes, 3) {
+		return
+	}
+
+	deleted, rejected, created := pushes[0], pushes[1], pushes[2]
+
+	assert.Equal(t, PushOutcomeAccepted, created.Outcome)
+	assert.Equal(t, 2, created.Created)
+	assert.Len(t, created.Updates, 2)
+	assert.NotZero(t, created.Bytes)
+	assert.Equal(t, "test", created.Repo)
+
+	assert.Equal(t, PushOutcomeRejected, rejected.Outcome)
+	assert.Contains(t, rejected.Reason, "protected is read-only")
+	assert.Zero(t, rejected.Created)
+	assert.Equal(t, "refs/heads/protected", rejected.Updates[0].Ref)
+
+	assert.Equal(t, PushOutcomeAccepted, deleted.Outcome)
+	assert.Equal(t, 1, deleted.Deleted)
+
+	pushes, err = s.Pushes(PushQuery{Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []PushSummary{deleted}, pushes)
+
+	pushes, err = s.Pushes(PushQuery{Repo: "other"})
+	assert.NoError(t, err)
+	assert.Empty(t, pushes)
+
+	pushes, err = s.Pushes(PushQuery{Until: created.Time.Add(time.Nanosecond)})
+	assert.NoError(t, err)
+	assert.Equal(t, []PushSummary{created}, pushes)
+}
+
+func TestSSH_prunePushHistory(t *testing.T) {
+	s := NewSSH(Config{PushHistoryMaxAge: time.Hour, PushHistoryMaxCount: 2})
+
+	now := time.Now()
+	for i, age := range []time.Duration{2 * time.Hour, 3 * time.Minute, 2 * time.Minute, time.Minute} {
+		assert.NoError(t, s.storePushSummary(PushSummary{ID: string(rune('a' + i)), Repo: "test", Time: now.Add(-age)}))
+	}
+
+	assert.NoError(t, s.storePushSummary(PushSummary{ID: "z", Repo: "test/nested", Time: now}))
+
+	pushes, err := s.Pushes(PushQuery{Repo: "test"})
+	assert.NoError(t, err)
+
+	ids := []string{}
+	for _, p := range pushes {
+		ids = append(ids, p.ID)
+	}
+
+	assert.Equal(t, []string{"d", "c"}, ids)
+
+	// Nested repositories have histories of their own
+	pushes, err = s.Pushes(PushQuery{Repo: "test/nested"})
+	assert.NoError(t, err)
+	assert.Len(t, pushes, 1)
+}
+
+func Test_pushOutcome(t *testing.T) {
+	for err, outcome := range map[error]string{
+		nil:                 PushOutcomeAccepted,
+		ErrPushRejected:     PushOutcomeRejected,
+		ErrQuotaExceeded:    PushOutcomeQuotaExceeded,
+		ErrPushConflict:     PushOutcomeConflict,
+		ErrOperationTimeout: PushOutcomeTimeout,
+		assert.AnError:      PushOutcomeFailed,
+	} {
+		assert.Equal(t, outcome, pushOutcome(err))
+	}
+}
@@ -0,0 +1,58 @@
+package gitkit
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readPushRequest(t *testing.T) {
+	input := new(bytes.Buffer)
+	packLine(input, ZeroSHA+" e285100b636ac67fa28d85685072158edaa01685 refs/heads/main\x00report-status push-options side-band-64k\n")
+	packLine(input, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 "+ZeroSHA+" refs/tags/v1\n")
+	packFlush(input)
+	packLine(input, "ci.skip\n")
+	packFlush(input)
+
+	expectRaw := append([]byte{}, input.Bytes()...)
+	input.WriteString("PACK...")
+
+	push, raw, err := readPushRequest(input)
+
+	assert.NoError(t, err)
+	assert.Equal(t, expectRaw, raw)
+	assert.Equal(t, "PACK...", input.String())
+	assert.Equal(t, []string{"report-status", "push-options", "side-band-64k"}, push.Capabilities)
+	assert.Equal(t, []string{"ci.skip"}, push.Options)
+	assert.Equal(t, []RefUpdate{
+		{ZeroSHA, "e285100b636ac67fa28d85685072158edaa01685", "refs/heads/main"},
+		{"a3d33576d686e7dc1d90ec4b1a6e94e760a893b2", ZeroSHA, "refs/tags/v1"},
+	}, push.Updates)
+	assert.Equal(t, BranchCreateAction, push.Updates[0].Action())
+	assert.Equal(t, TagDeleteAction, push.Updates[1].Action())
+}
+
+func Test_readPushRequest_Empty(t *testing.T) {
+	input := new(bytes.Buffer)
+	packFlush(input)
+
+	push, _, err := readPushRequest(input)
+
+	assert.NoError(t, err)
+	assert.Empty(t, push.Updates)
+}
+
+func Test_readPushRequest_Invalid(t *testing.T) {
+	for name, input := range map[string]string{
+		"Truncated":      "00",
+		"Bad length":     "zzzz",
+		"Short length":   "0002",
+		"Malformed line": "0009hello",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := readPushRequest(bytes.NewBufferString(input))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// pushQuarantine holds the objects a push sent apart from the repository
+// they are for, as receive-pack does while its pre-receive hook runs, so
+// that each ref update can be checked against them before they are kept
+type pushQuarantine struct {
+	dir     string          // Object directory the pack was indexed into
+	objects string          // The repository's own object directory
+	rewound map[string]bool // Refs the push rewinds, by name
+}
+
+// quarantines reports whether push needs its objects before it can be
+// checked, as it updates refs which loc's RefPolicy stops rewinding, or
+// AuthoriseRefUpdateFunc needs to know if it rewinds
+func (s SSH) quarantines(loc repoLocation, push *PushRequest) bool {
+	for _, u := range push.Updates {
+		if u.OldRev != ZeroSHA && u.NewRev != ZeroSHA && (s.AuthoriseRefUpdateFunc != nil || loc.RefPolicy.denyRewind(u.Ref)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quarantinePush indexes the pack the client sends after push into a
+// directory of its own within the repository at path, then tells which of
+// the refs push updates it rewinds. The quarantine must be removed once
+// done with.
+func (s SSH) quarantinePush(ctx context.Context, path string, push *PushRequest, pack io.Reader) (_ *pushQuarantine, err error) {
+	objects, err := filepath.Abs(filepath.Join(path, "objects"))
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	q := &pushQuarantine{dir: filepath.Join(objects, "incoming-gitkit-"+hex.EncodeToString(id)), objects: objects}
+	if err = os.Mkdir(q.dir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			q.remove()
+		}
+	}()
+
+	args := []string{"-C", path, "index-pack", "--stdin", "--fix-thin"}
+	if s.fsckPushes(path) {
+		args = append(args, "--strict")
+	}
+
+	cmd, err := s.gitCommand(ctx, q.env(), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); ok {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+
+		cmd.SysProcAttr.Setpgid = true
+	}
+
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	stop := killOnTimeout(ctx, cmd)
+	defer stop()
+
+	// index-pack stops at the end of the pack, while clients hold their
+	// side open for the result, so as with runGit this copy is not waited for
+	go func() {
+		copyBuffer(input, throttleReader(ctx, pack))
+		input.Close()
+	}()
+
+	if err = cmd.Wait(); err != nil {
+		return nil, timedOut(ctx, fmt.Errorf("index-pack: %w: %s", err, bytes.TrimSpace(stderr.Bytes())))
+	}
+
+	q.rewound = make(map[string]bool)
+	for _, u := range push.Updates {
+		if u.OldRev == ZeroSHA || u.NewRev == ZeroSHA {
+			continue
+		}
+
+		if q.rewound[u.Ref], err = q.rewinds(ctx, s.config.GitPath, path, u); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// fsckPushes reports whether the repository at path has receive-pack
+// check objects pushed to it, which index-pack must do in its place
+func (s SSH) fsckPushes(path string) bool {
+	for _, key := range []string{"receive.fsckObjects", "transfer.fsckObjects"} {
+		out, err := exec.Command(s.config.GitPath, "-C", path, "config", "--bool", key).Output()
+		if err == nil {
+			return strings.TrimSpace(string(out)) == "true"
+		}
+	}
+
+	return false
+}
+
+// env points git at the quarantine, with the repository's objects
+// available as an alternate
+func (q *pushQuarantine) env() []string {
+	return []string{
+		"GIT_OBJECT_DIRECTORY=" + q.dir,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + q.objects,
+		"GIT_QUARANTINE_PATH=" + q.dir,
+	}
+}
+
+// rewinds reports whether u moves its ref to a commit which does not
+// descend from the old one. Updates to objects which are not commits,
+// such as moving a tag between tag objects, cannot be fast forwards so
+// count as rewinds.
+func (q *pushQuarantine) rewinds(ctx context.Context, gitPath, path string, u RefUpdate) (bool, error) {
+	cmd := exec.CommandContext(ctx, gitPath, "-C", path, "merge-base", "--is-ancestor", u.OldRev, u.NewRev)
+	cmd.Env = append(os.Environ(), q.env()...)
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return false, nil
+
+	case errors.As(err, &exitErr):
+		return true, nil
+	}
+
+	return false, fmt.Errorf("merge-base %s: %w", u.Ref, err)
+}
+
+// pushRewinds reports, for RefPolicy and AuthoriseRefUpdateFunc, whether
+// u rewinds its ref. Without a quarantine nothing is known to rewind.
+func (q *pushQuarantine) pushRewinds(u RefUpdate) bool {
+	return q != nil && q.rewound[u.Ref]
+}
+
+// keep moves the quarantined pack into the repository. Index files go
+// last, since git only sees a pack once its index is there.
+func (q *pushQuarantine) keep() error {
+	entries, err := os.ReadDir(filepath.Join(q.dir, "pack"))
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return !strings.HasSuffix(entries[i].Name(), ".idx") && strings.HasSuffix(entries[j].Name(), ".idx")
+	})
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "tmp_") {
+			continue
+		}
+
+		if err = os.Rename(filepath.Join(q.dir, "pack", entry.Name()), filepath.Join(q.objects, "pack", entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *pushQuarantine) remove() {
+	if err := os.RemoveAll(q.dir); err != nil {
+		logError("quarantine", err)
+	}
+}
+
+// emptyPack is a pack holding no objects, which receive-pack is sent in
+// place of one whose objects were quarantined and kept already. hashLen is
+// the length of the repository's object names, in hex.
+func emptyPack(hashLen int) []byte {
+	pack := []byte("PACK")
+	pack = binary.BigEndian.AppendUint32(pack, 2)
+	pack = binary.BigEndian.AppendUint32(pack, 0)
+
+	if hashLen == sha256.Size*2 {
+		sum := sha256.Sum256(pack)
+
+		return append(pack, sum[:]...)
+	}
+
+	sum := sha1.Sum(pack)
+
+	return append(pack, sum[:]...)
+}
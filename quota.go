@@ -0,0 +1,240 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Quota event types. EventQuotaExceeded is emitted when a push is refused
+// for being too large, or leaves a repository over Config.MaxRepoSize, and
+// EventQuotaWarning when a push first takes a repository past its warning
+// threshold.
+const (
+	EventQuotaExceeded = "quota.exceeded"
+	EventQuotaWarning  = "quota.warning"
+)
+
+// ErrQuotaExceeded is returned when a push is larger than Config.MaxPackSize
+// or would take a repository past Config.MaxRepoSize
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaUsage is passed to the MsgPackTooLarge, MsgRepoQuotaExceeded,
+// MsgRepoOverQuota and MsgRepoQuotaWarning templates. Sizes are in bytes,
+// and may be formatted with the bytes template function.
+type QuotaUsage struct {
+	Repo  string `json:"repo"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"`
+}
+
+// pushQuota tracks a single push against the configured size limits
+type pushQuota struct {
+	path      string
+	packLimit int64
+	repoLimit int64
+	warnAt    int64 // Size past which pushes warn the repository is nearly full
+	used      int64 // Size of the repository before the push
+	byRepo    bool  // Whether the repository quota, rather than MaxPackSize, limits the push
+	in        *quotaReader
+}
+
+// startPushQuota measures the repository at loc ahead of a push, returning
+// nil when no limits are configured
+func (s SSH) startPushQuota(loc repoLocation) (*pushQuota, error) {
+	if s.config.MaxPackSize <= 0 && s.config.MaxRepoSize <= 0 {
+		return nil, nil
+	}
+
+	q := &pushQuota{
+		path:      loc.Path,
+		packLimit: s.config.MaxPackSize,
+		repoLimit: s.config.MaxRepoSize,
+	}
+
+	if q.repoLimit > 0 {
+		q.warnAt = int64(loc.QuotaWarning * float64(q.repoLimit))
+
+		used, err := repoSize(loc.Path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("ssh: unable to measure repository: %w", err)
+		}
+
+		q.used = used
+	}
+
+	return q, nil
+}
+
+// full reports whether the repository is already at its quota
+func (q *pushQuota) full() bool {
+	return q != nil && q.repoLimit > 0 && q.used >= q.repoLimit
+}
+
+// limit wraps what the client sends to receive-pack, stopping it once the
+// push exceeds MaxPackSize or the space left in the repository's quota
+func (q *pushQuota) limit(r io.Reader) io.Reader {
+	if q == nil {
+		return r
+	}
+
+	limit := q.packLimit
+	if q.repoLimit > 0 {
+		if remaining := q.repoLimit - q.used; limit <= 0 || remaining < limit {
+			limit, q.byRepo = remaining, true
+		}
+	}
+
+	q.in = &quotaReader{r: r, limit: limit}
+
+	return q.in
+}
+
+// exceeded reports whether the client sent more than it was allowed to
+func (q *pushQuota) exceeded() bool {
+	return q != nil && q.in != nil && q.in.exceeded.Load()
+}
+
+// checkQuota is called once receive-pack has exited. Pushes cut off for
+// being too large are rejected, and clients are warned when a push they
+// were allowed to make has left the repository over quota, as unpacked
+// objects can take more space than the pack they came in, or past its
+// warning threshold.
+func (s SSH) checkQuota(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand, q *pushQuota, gitErr error) error {
+	if q.exceeded() {
+		return s.rejectQuota(ctx, sess, ch, gitcmd, q)
+	}
+
+	if q == nil || q.repoLimit <= 0 || gitErr != nil {
+		return nil
+	}
+
+	used, err := repoSize(q.path)
+	if err != nil {
+		logError("quota", err)
+		return nil
+	}
+
+	info := QuotaUsage{Repo: gitcmd.Repo, Limit: q.repoLimit, Used: used}
+
+	switch {
+	case used > q.repoLimit:
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgRepoOverQuota, info)))
+		s.emitQuotaExceeded(ctx, gitcmd, "repository", info)
+
+	case q.warnAt > 0 && used >= q.warnAt:
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgRepoQuotaWarning, info)))
+
+		// Operators are only told once, as the threshold is crossed,
+		// while pushers hear about it every time
+		if q.used < q.warnAt {
+			s.quotaWarning(ctx, gitcmd, info)
+		}
+	}
+
+	return nil
+}
+
+// quotaWarning emits EventQuotaWarning and notifies webhooks that a
+// repository is nearly full
+func (s SSH) quotaWarning(ctx context.Context, gitcmd *GitCommand, info QuotaUsage) {
+	s.emit(ctx, Event{Type: EventQuotaWarning, Repo: gitcmd.Repo, Data: map[string]string{
+		"limit": strconv.FormatInt(info.Limit, 10),
+		"used":  strconv.FormatInt(info.Used, 10),
+	}})
+
+	if s.webhooks == nil {
+		return
+	}
+
+	payload, err := newWebhookPayload(ctx, gitcmd.Repo, nil)
+	if err == nil {
+		payload.Event = EventQuotaWarning
+		payload.Quota = &info
+		payload.CloneURLs = s.config.CloneURLs(gitcmd.Repo)
+
+		err = s.webhooks.Dispatch(payload)
+	}
+
+	if err != nil {
+		logError("webhook", err)
+	}
+}
+
+// rejectQuota tells the client why their push was refused
+func (s SSH) rejectQuota(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand, q *pushQuota) error {
+	id, kind := MsgPackTooLarge, "pack"
+	info := QuotaUsage{Repo: gitcmd.Repo, Limit: q.packLimit}
+
+	if q.full() || q.byRepo {
+		id, kind = MsgRepoQuotaExceeded, "repository"
+		info.Limit, info.Used = q.repoLimit, q.used
+	}
+
+	ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), id, info)))
+	sendExitStatus(ch, 1)
+
+	s.emitQuotaExceeded(ctx, gitcmd, kind, info)
+
+	return fmt.Errorf("ssh: %w: %s limit of %d bytes for %s", ErrQuotaExceeded, kind, info.Limit, gitcmd.Repo)
+}
+
+func (s SSH) emitQuotaExceeded(ctx context.Context, gitcmd *GitCommand, kind string, info QuotaUsage) {
+	s.emit(ctx, Event{Type: EventQuotaExceeded, Repo: gitcmd.Repo, Data: map[string]string{
+		"kind":  kind,
+		"limit": strconv.FormatInt(info.Limit, 10),
+		"used":  strconv.FormatInt(info.Used, 10),
+	}})
+}
+
+// quotaReader fails reads once more than limit bytes have passed through.
+// It is read by the goroutine feeding git, so its state is atomic.
+type quotaReader struct {
+	r        io.Reader
+	limit    int64
+	read     atomic.Int64
+	exceeded atomic.Bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+
+	if q.read.Add(int64(n)) > q.limit {
+		q.exceeded.Store(true)
+
+		return 0, ErrQuotaExceeded
+	}
+
+	return n, err
+}
+
+// repoSize returns the bytes used by the files of the repository at path
+func repoSize(path string) (size int64, err error) {
+	err = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+
+		return nil
+	})
+
+	return
+}
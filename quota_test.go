@@ -0,0 +1,202 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCommitRandom commits a file of n random bytes, which will not
+// compress, to the repository in dir
+func testCommitRandom(t *testing.T, s *SSH, dir, name string, n int) {
+	t.Helper()
+
+	data := make([]byte, n)
+	rand.Read(data)
+
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"add", name},
+		{"commit", "-q", "-m", "add " + name},
+	} {
+		if out, err := testGit(t, s, dir, args...); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+}
+
+func TestSSH_MaxPackSize(t *testing.T) {
+	for name, setup := range map[string]func(*SSH){
+		"direct": nil,
+		"intercepted": func(s *SSH) {
+			s.AuthorisePushFunc = func(context.Context, *GitCommand, *PushRequest) error { return nil }
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var events []Event
+
+			s := startTestSSH(t, Config{AutoCreate: true, MaxPackSize: 16 << 10}, func(s *SSH) {
+				s.EventFunc = func(_ context.Context, e Event) { events = append(events, e) }
+
+				if setup != nil {
+					setup(s)
+				}
+			})
+
+			work := testWorkTree(t, s)
+
+			out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+			assert.NoError(t, err, out)
+
+			testCommitRandom(t, s, work, "large", 64<<10)
+
+			out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+			assert.Error(t, err, out)
+			assert.Contains(t, out, "Push rejected: pushes to test may be at most 16 KiB.")
+
+			if assert.NotEmpty(t, events) {
+				e := events[len(events)-1]
+				assert.Equal(t, EventQuotaExceeded, e.Type)
+				assert.Equal(t, "pack", e.Data["kind"])
+			}
+
+			// The branch must not have moved
+			out, err = testGit(t, s, work, "ls-remote", testRemote(s, "test.git"), "main")
+			assert.NoError(t, err, out)
+
+			head, _ := testGit(t, s, work, "rev-parse", "HEAD~1")
+			assert.True(t, strings.HasPrefix(out, strings.TrimSpace(head)), out)
+		})
+	}
+}
+
+func TestSSH_MaxRepoSize(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, MaxRepoSize: 256 << 10}, nil)
+
+	work := testWorkTree(t, s)
+	testCommitRandom(t, s, work, "first", 200<<10)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	// The repository has room left, but not enough for this push
+	testCommitRandom(t, s, work, "second", 200<<10)
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "Push rejected: test has used")
+	assert.Contains(t, out, "of its 256 KiB quota")
+}
+
+func TestSSH_MaxRepoSize_Full(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, MaxRepoSize: 1}, nil)
+	assert.NoError(t, initRepo(filepath.Join(s.config.Dir, "test"), s.config))
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "Push rejected: test has used")
+}
+
+func Test_repoSize(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "a"), make([]byte, 100), 0644)
+	os.Mkdir(filepath.Join(dir, "objects"), 0755)
+	os.WriteFile(filepath.Join(dir, "objects", "b"), make([]byte, 50), 0644)
+
+	size, err := repoSize(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(150), size)
+}
+
+func TestSSH_QuotaWarning(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		warnings []Event
+		payloads []WebhookPayload
+	)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	s := startTestSSH(t, Config{
+		AutoCreate:   true,
+		MaxRepoSize:  1 << 20,
+		QuotaWarning: 0.9,
+		Routes:       []Route{{Pattern: "small", QuotaWarning: 0.25}},
+		Webhooks:     []Webhook{{URL: hook.URL}},
+	}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			if e.Type == EventQuotaWarning {
+				mu.Lock()
+				warnings = append(warnings, e)
+				mu.Unlock()
+			}
+		}
+	})
+
+	work := testWorkTree(t, s)
+	testCommitRandom(t, s, work, "first", 128<<10)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "small.git"), "main")
+	assert.NoError(t, err, out)
+	assert.NotContains(t, out, "Warning:")
+
+	testCommitRandom(t, s, work, "second", 256<<10)
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "small.git"), "main")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "Warning: small is using")
+	assert.Contains(t, out, "of its 1 MiB quota")
+
+	testCommitRandom(t, s, work, "third", 1<<10)
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "small.git"), "main")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "Warning: small is using")
+
+	// Other repositories use the server wide threshold
+	out, err = testGit(t, s, work, "push", testRemote(s, "large.git"), "main")
+	assert.NoError(t, err, out)
+	assert.NotContains(t, out, "Warning:")
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, p := range payloads {
+			if p.Event == EventQuotaWarning {
+				return p.Repo == "small" && p.Quota != nil && p.Quota.Limit == 1<<20
+			}
+		}
+
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Len(t, warnings, 1)
+}
@@ -1,6 +1,8 @@
 package gitkit
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -9,6 +11,8 @@ import (
 	"strings"
 
 	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const ZeroSHA = "0000000000000000000000000000000000000000"
@@ -18,6 +22,16 @@ type Receiver struct {
 	MasterOnly  bool
 	TmpDir      string
 	HandlerFunc func(*HookInfo, string) error
+
+	// ValidateCommitFunc, when set, is called with each commit the push
+	// adds, oldest first, across every ref pushed, before HandlerFunc. repo
+	// is the repository's path. Returning an error rejects the push, for
+	// instance one adding secrets, oversized files or malformed messages.
+	ValidateCommitFunc func(ctx context.Context, repo string, commit *Commit) error
+
+	// TracerProvider records a span for each hook run, as part of the trace
+	// of the push which ran it. The global TracerProvider is used when nil.
+	TracerProvider trace.TracerProvider
 }
 
 func ReadCommitMessage(sha string) (string, error) {
@@ -45,16 +59,38 @@ func IsForcePush(hook *HookInfo) (bool, error) {
 	return base != hook.OldRev, nil
 }
 
-func (r *Receiver) Handle(reader io.Reader) error {
-	hook, err := ReadHookInput(reader)
+func (r *Receiver) Handle(reader io.Reader) (err error) {
+	ctx, span := tracer(r.TracerProvider).Start(HookContext(context.Background()), "gitkit.hook")
+	defer func() { endSpan(span, err) }()
+
+	// pre-receive is given every ref pushed, which commits are validated
+	// across
+	input, err := io.ReadAll(reader)
 	if err != nil {
 		return err
 	}
 
+	hook, err := ReadHookInput(bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(
+		attribute.String("gitkit.ref", hook.Ref),
+		attribute.String("gitkit.old_rev", hook.OldRev),
+		attribute.String("gitkit.new_rev", hook.NewRev),
+	)
+
 	if r.MasterOnly && hook.Ref != "refs/heads/master" {
 		return fmt.Errorf("cant push to non-master branch")
 	}
 
+	if r.ValidateCommitFunc != nil {
+		if err := r.validateCommits(ctx, hook.RepoPath, input); err != nil {
+			return err
+		}
+	}
+
 	id, err := uuid.NewV4()
 	if err != nil {
 		return fmt.Errorf("error generating new uuid: %v", err)
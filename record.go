@@ -0,0 +1,191 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// DefaultRecordMaxBytes caps how much of a session is recorded when
+// Config.RecordMaxBytes is zero
+const DefaultRecordMaxBytes = 1 << 20
+
+// Directions of recorded data
+const (
+	RecordFromClient = "client"
+	RecordToClient   = "server"
+	RecordStderr     = "stderr"
+)
+
+// RecordChunk is a single read or write within a recorded session, at
+// Offset from the start of the session
+type RecordChunk struct {
+	Direction string        `json:"direction"`
+	Offset    time.Duration `json:"offset"`
+	Data      []byte        `json:"data"`
+}
+
+// Transcript is a recording of the pack protocol streams of a session, for
+// debugging broken pushes and fetches. Once MaxBytes of data has been
+// recorded, later chunks are counted but their data dropped.
+type Transcript struct {
+	ID        string        `json:"id"`
+	Repo      string        `json:"repo"`
+	Command   string        `json:"command"`
+	PublicKey PublicKey     `json:"public_key"`
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"duration"`
+	Chunks    []RecordChunk `json:"chunks"`
+	Bytes     int64         `json:"bytes"`
+	Truncated bool          `json:"truncated"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// RecordSink receives transcripts once sessions finish
+type RecordSink interface {
+	Record(t *Transcript) error
+}
+
+// FileRecordSink writes each transcript as JSON to <Dir>/<id>.json
+type FileRecordSink struct {
+	Dir string
+}
+
+// NewFileRecordSink returns a FileRecordSink writing to dir, creating it
+// if need be
+func NewFileRecordSink(dir string) (*FileRecordSink, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileRecordSink{Dir: dir}, nil
+}
+
+func (f *FileRecordSink) Record(t *Transcript) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(f.Dir, t.ID+".json"), data, 0600)
+}
+
+type recorderContextKey struct{}
+
+// recorder collects a transcript from the streams it tees
+type recorder struct {
+	mu   sync.Mutex
+	max  int64
+	t    Transcript
+	done bool
+}
+
+// startRecording returns a context carrying a recorder for the session,
+// when RecordSink is set and RecordFunc, if set, chooses to record it
+func (s SSH) startRecording(ctx context.Context, gitcmd *GitCommand) (context.Context, *recorder) {
+	if s.RecordSink == nil || (s.RecordFunc != nil && !s.RecordFunc(ctx, gitcmd)) {
+		return ctx, nil
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		logError("record", err)
+		return ctx, nil
+	}
+
+	max := s.config.RecordMaxBytes
+	if max == 0 {
+		max = DefaultRecordMaxBytes
+	}
+
+	rec := &recorder{max: max, t: Transcript{
+		ID:      id.String(),
+		Repo:    gitcmd.Repo,
+		Command: gitcmd.SubCommand(),
+		Started: time.Now(),
+	}}
+	rec.t.PublicKey, _ = ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+	return context.WithValue(ctx, recorderContextKey{}, rec), rec
+}
+
+// finishRecording passes the transcript to RecordSink
+func (s SSH) finishRecording(rec *recorder, err error) {
+	if rec == nil {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.done = true
+	rec.t.Duration = time.Since(rec.t.Started)
+	if err != nil {
+		rec.t.Error = err.Error()
+	}
+
+	if err := s.RecordSink.Record(&rec.t); err != nil {
+		logError("record", err)
+	}
+}
+
+func (r *recorder) add(direction string, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Client input may still be copied after git exits
+	if r.done {
+		return
+	}
+
+	r.t.Bytes += int64(len(p))
+	if r.t.Bytes > r.max {
+		r.t.Truncated = true
+		return
+	}
+
+	r.t.Chunks = append(r.t.Chunks, RecordChunk{
+		Direction: direction,
+		Offset:    time.Since(r.t.Started),
+		Data:      append([]byte{}, p...),
+	})
+}
+
+// recordReader tees what is read from r into the session's recording, if
+// there is one
+func recordReader(ctx context.Context, direction string, r io.Reader) io.Reader {
+	rec, ok := ctx.Value(recorderContextKey{}).(*recorder)
+	if !ok {
+		return r
+	}
+
+	return io.TeeReader(r, recordTee{rec, direction})
+}
+
+// recordWriter tees what is written to w into the session's recording, if
+// there is one
+func recordWriter(ctx context.Context, direction string, w io.Writer) io.Writer {
+	rec, ok := ctx.Value(recorderContextKey{}).(*recorder)
+	if !ok {
+		return w
+	}
+
+	return io.MultiWriter(w, recordTee{rec, direction})
+}
+
+type recordTee struct {
+	rec       *recorder
+	direction string
+}
+
+func (w recordTee) Write(p []byte) (int, error) {
+	w.rec.add(w.direction, p)
+
+	return len(p), nil
+}
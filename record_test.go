@@ -0,0 +1,103 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRecordSink struct {
+	mu          sync.Mutex
+	transcripts []*Transcript
+}
+
+func (s *testRecordSink) Record(t *Transcript) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transcripts = append(s.transcripts, t)
+
+	return nil
+}
+
+func (s *testRecordSink) recorded() []*Transcript {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Transcript{}, s.transcripts...)
+}
+
+func TestSSH_RecordSink(t *testing.T) {
+	sink := new(testRecordSink)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.RecordSink = sink
+		s.RecordFunc = func(_ context.Context, cmd *GitCommand) bool {
+			return cmd.Repo == "recorded"
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	for _, repo := range []string{"recorded.git", "other.git"} {
+		if out, err := testGit(t, s, work, "push", testRemote(s, repo), "main"); err != nil {
+			t.Fatalf("unexpected error: %v\n%s", err, out)
+		}
+	}
+
+	var transcripts []*Transcript
+	for i := 0; i < 100 && len(transcripts) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		transcripts = sink.recorded()
+	}
+
+	if len(transcripts) != 1 {
+		t.Fatalf("expected a single transcript, received %d", len(transcripts))
+	}
+
+	tr := transcripts[0]
+	if tr.Repo != "recorded" || tr.Command != "receive-pack" || tr.Truncated {
+		t.Errorf("unexpected transcript %#v", tr)
+	}
+
+	seen := map[string]bool{}
+	for _, c := range tr.Chunks {
+		seen[c.Direction] = true
+	}
+
+	if !seen[RecordFromClient] || !seen[RecordToClient] {
+		t.Errorf("expected both directions recorded, received %v", seen)
+	}
+}
+
+func TestRecorder_MaxBytes(t *testing.T) {
+	rec := &recorder{max: 8}
+
+	rec.add(RecordFromClient, []byte("0000"))
+	rec.add(RecordToClient, []byte("0000"))
+	rec.add(RecordToClient, []byte("dropped"))
+
+	if len(rec.t.Chunks) != 2 || !rec.t.Truncated || rec.t.Bytes != 15 {
+		t.Errorf("unexpected transcript %#v", rec.t)
+	}
+}
+
+func TestFileRecordSink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "transcripts")
+
+	sink, err := NewFileRecordSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Record(&Transcript{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "abc.json")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,118 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrRefPolicy is returned when a push breaks a RefPolicy
+var ErrRefPolicy = errors.New("refused by ref policy")
+
+// RefPolicy protects refs from pushes without hook scripts. Patterns are
+// globs as understood by path.Match, where a trailing "/**" matches any
+// depth. Those starting refs/ match full ref names; others match branch
+// names, so that "main" and "release/*" protect refs/heads/main and
+// refs/heads/release/1.0.
+type RefPolicy struct {
+	Protected       []string // Refs which may be neither deleted nor rewound
+	FastForwardOnly []string // Refs which may not be rewound
+	DenyForcePush   bool     // No ref may be rewound
+	DenyTagDeletion bool     // Tags may not be deleted
+	DenyDeletes     bool     // No ref may be deleted, as with receive.denyDeletes
+}
+
+func (p RefPolicy) empty() bool {
+	return len(p.Protected) == 0 && len(p.FastForwardOnly) == 0 && !p.DenyForcePush && !p.DenyTagDeletion && !p.DenyDeletes
+}
+
+// checkRefPolicyInMemory refuses ref policies where repositories are
+// served in memory, whose pushes go-git applies without them being checked
+func (c *Config) checkRefPolicyInMemory() error {
+	if !c.InMemory {
+		return nil
+	}
+
+	set := !c.RefPolicy.empty()
+	for _, r := range c.Routes {
+		set = set || (r.RefPolicy != nil && !r.RefPolicy.empty())
+	}
+
+	if set {
+		return fmt.Errorf("ref policy: %w in memory", ErrOperationDisabled)
+	}
+
+	return nil
+}
+
+// validate checks each pattern is one path.Match accepts
+func (p RefPolicy) validate() error {
+	for _, pattern := range append(append([]string{}, p.Protected...), p.FastForwardOnly...) {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("ref policy %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// check applies p to push. Deletions are refused outright, while rewinds
+// refers to the objects the push sent to tell whether an update rewinds
+// its ref, and so is only asked about refs p stops rewinding.
+func (p RefPolicy) check(push *PushRequest, rewinds func(RefUpdate) bool) error {
+	for _, u := range push.Updates {
+		switch action := u.Action(); {
+		case u.NewRev == ZeroSHA && p.DenyDeletes:
+			return fmt.Errorf("%w: %s may not be deleted", ErrRefPolicy, u.Ref)
+
+		case action == TagDeleteAction && p.DenyTagDeletion:
+			return fmt.Errorf("%w: tag %s may not be deleted", ErrRefPolicy, strings.TrimPrefix(u.Ref, "refs/tags/"))
+
+		case u.NewRev == ZeroSHA && refsMatch(p.Protected, u.Ref):
+			return fmt.Errorf("%w: %s is protected and may not be deleted", ErrRefPolicy, u.Ref)
+
+		case u.NewRev == ZeroSHA || u.OldRev == ZeroSHA:
+			// Neither deleting nor creating a ref rewinds it
+
+		case p.denyRewind(u.Ref) && rewinds(u):
+			return fmt.Errorf("%w: %s may not be rewound", ErrRefPolicy, u.Ref)
+		}
+	}
+
+	return nil
+}
+
+// denyRewind reports whether p stops ref being rewound
+func (p RefPolicy) denyRewind(ref string) bool {
+	return p.DenyForcePush || refsMatch(p.Protected, ref) || refsMatch(p.FastForwardOnly, ref)
+}
+
+// refsMatch reports whether ref matches any of patterns
+func refsMatch(patterns []string, ref string) bool {
+	name := ref
+	if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		name = branch
+	}
+
+	for _, pattern := range patterns {
+		subject := name
+		if strings.HasPrefix(pattern, "refs/") {
+			subject = ref
+		}
+
+		if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+			if strings.HasPrefix(subject, prefix+"/") {
+				return true
+			}
+
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,151 @@
+package gitkit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_refsMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		ref     string
+		expect  bool
+	}{
+		{"main", "refs/heads/main", true},
+		{"main", "refs/heads/maintenance", false},
+		{"release/*", "refs/heads/release/1.0", true},
+		{"release/*", "refs/heads/release/1.0/hotfix", false},
+		{"release/**", "refs/heads/release/1.0/hotfix", true},
+		{"refs/tags/v*", "refs/tags/v1.0", true},
+		{"v*", "refs/tags/v1.0", false},
+		{"refs/heads/**", "refs/heads/feature/x", true},
+	} {
+		assert.Equal(t, test.expect, refsMatch([]string{test.pattern}, test.ref), "%s %s", test.pattern, test.ref)
+	}
+}
+
+func TestRefPolicy_check(t *testing.T) {
+	sha := "1111111111111111111111111111111111111111"
+	other := "2222222222222222222222222222222222222222"
+
+	for _, test := range []struct {
+		name      string
+		policy    RefPolicy
+		update    RefUpdate
+		rewinds   bool
+		expectErr bool
+	}{
+		{"protected delete", RefPolicy{Protected: []string{"main"}}, RefUpdate{OldRev: sha, NewRev: ZeroSHA, Ref: "refs/heads/main"}, false, true},
+		{"protected fast forward", RefPolicy{Protected: []string{"main"}}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/heads/main"}, false, false},
+		{"protected rewind", RefPolicy{Protected: []string{"main"}}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/heads/main"}, true, true},
+		{"protected create", RefPolicy{Protected: []string{"main"}}, RefUpdate{OldRev: ZeroSHA, NewRev: sha, Ref: "refs/heads/main"}, true, false},
+		{"unprotected rewind", RefPolicy{Protected: []string{"main"}}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/heads/dev"}, true, false},
+		{"fast-forward only delete", RefPolicy{FastForwardOnly: []string{"dev"}}, RefUpdate{OldRev: sha, NewRev: ZeroSHA, Ref: "refs/heads/dev"}, false, false},
+		{"fast-forward only rewind", RefPolicy{FastForwardOnly: []string{"dev"}}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/heads/dev"}, true, true},
+		{"protected tag rewind", RefPolicy{Protected: []string{"refs/tags/**"}}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/tags/v1.0"}, true, true},
+		{"deny force push", RefPolicy{DenyForcePush: true}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/meta/config"}, true, true},
+		{"deny force push fast forward", RefPolicy{DenyForcePush: true}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/heads/dev"}, false, false},
+		{"tag delete", RefPolicy{DenyTagDeletion: true}, RefUpdate{OldRev: sha, NewRev: ZeroSHA, Ref: "refs/tags/v1.0"}, false, true},
+		{"branch delete", RefPolicy{DenyTagDeletion: true}, RefUpdate{OldRev: sha, NewRev: ZeroSHA, Ref: "refs/heads/dev"}, false, false},
+		{"deny deletes", RefPolicy{DenyDeletes: true}, RefUpdate{OldRev: sha, NewRev: ZeroSHA, Ref: "refs/heads/dev"}, false, true},
+		{"deny deletes rewind", RefPolicy{DenyDeletes: true}, RefUpdate{OldRev: sha, NewRev: other, Ref: "refs/heads/dev"}, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			push := &PushRequest{Updates: []RefUpdate{test.update}}
+
+			err := test.policy.check(push, func(RefUpdate) bool { return test.rewinds })
+			if test.expectErr {
+				assert.ErrorIs(t, err, ErrRefPolicy)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Empty(t, push.GitConfig)
+		})
+	}
+}
+
+func TestRefPolicy_validate(t *testing.T) {
+	assert.NoError(t, RefPolicy{Protected: []string{"main", "release/**"}}.validate())
+	assert.Error(t, RefPolicy{FastForwardOnly: []string{"["}}.validate())
+	assert.Error(t, new(RouteTable).Set([]Route{{Pattern: "*", RefPolicy: &RefPolicy{Protected: []string{"["}}}}))
+}
+
+func TestSSH_RefPolicy(t *testing.T) {
+	s := startTestSSH(t, Config{
+		AutoCreate: true,
+		RefPolicy:  RefPolicy{Protected: []string{"main", "refs/tags/**"}, DenyTagDeletion: true},
+		Routes:     []Route{{Pattern: "open/**", RefPolicy: &RefPolicy{}}},
+	}, nil)
+
+	work := testWorkTree(t, s)
+
+	for _, remote := range []string{testRemote(s, "test.git"), testRemote(s, "open/test.git")} {
+		for _, args := range [][]string{
+			{"tag", "-f", "v1"},
+			{"push", remote, "main", "v1", "main:dev"},
+		} {
+			if out, err := testGit(t, s, work, args...); err != nil {
+				t.Fatalf("git %v: %v\n%s", args, err, out)
+			}
+		}
+	}
+
+	if out, err := testGit(t, s, work, "commit", "-q", "--amend", "--allow-empty", "-m", "amended"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	remote := testRemote(s, "test.git")
+
+	out, err := testGit(t, s, work, "push", remote, ":main")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "protected")
+
+	out, err = testGit(t, s, work, "push", remote, ":v1")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "v1 may not be deleted")
+
+	out, err = testGit(t, s, work, "push", "--force", remote, "main")
+	assert.Error(t, err, out)
+
+	// Unprotected branches may still be rewound and deleted
+	out, err = testGit(t, s, work, "push", "--force", remote, "main:dev")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, s, work, "push", remote, ":dev")
+	assert.NoError(t, err, out)
+
+	// Rewinds are refused ref by ref, so one push may fast forward a
+	// protected branch while rewinding another
+	for _, args := range [][]string{
+		{"reset", "-q", "--hard", "HEAD@{1}"},
+		{"commit", "-q", "--allow-empty", "-m", "third"},
+		{"push", remote, "main:dev"},
+		{"push", "--force", remote, "main", "main~1:dev"},
+		{"tag", "v2"},
+		{"push", remote, "v2"},
+		{"tag", "-f", "v2", "main~1"},
+	} {
+		out, err = testGit(t, s, work, args...)
+		require.NoError(t, err, "git %v\n%s", args, out)
+	}
+
+	out, err = testGit(t, s, work, "push", "--force", remote, "v2")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "refs/tags/v2 may not be rewound")
+
+	quarantines, _ := filepath.Glob(filepath.Join(s.config.Dir, "test.git", "objects", "incoming-*"))
+	assert.Empty(t, quarantines)
+
+	// The route's own policy replaces the server's
+	open := testRemote(s, "open/test.git")
+
+	out, err = testGit(t, s, work, "push", "--force", open, "main")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, s, work, "push", open, ":v1")
+	assert.NoError(t, err, out)
+}
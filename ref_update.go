@@ -0,0 +1,47 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+)
+
+// Operations passed to AuthoriseRefUpdateFunc
+const (
+	RefCreate      = "create"
+	RefDelete      = "delete"
+	RefFastForward = "fast-forward"
+	RefForceUpdate = "force-update" // The update rewinds the ref
+)
+
+// authoriseRefUpdates asks AuthoriseRefUpdateFunc about each ref push
+// updates, once each, with rewinds telling fast forwards from rewinds by
+// the objects the push sent
+func (s SSH) authoriseRefUpdates(ctx context.Context, gitcmd *GitCommand, push *PushRequest, rewinds func(RefUpdate) bool) error {
+	if s.AuthoriseRefUpdateFunc == nil {
+		return nil
+	}
+
+	for _, u := range push.Updates {
+		var op string
+
+		switch {
+		case u.OldRev == ZeroSHA:
+			op = RefCreate
+
+		case u.NewRev == ZeroSHA:
+			op = RefDelete
+
+		case rewinds(u):
+			op = RefForceUpdate
+
+		default:
+			op = RefFastForward
+		}
+
+		if err := s.AuthoriseRefUpdateFunc(ctx, gitcmd, u, op); err != nil {
+			return fmt.Errorf("%s %s: %w", op, u.Ref, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSH_AuthoriseRefUpdateFunc(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ops []string
+	)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthoriseRefUpdateFunc = func(_ context.Context, _ *GitCommand, u RefUpdate, op string) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			ops = append(ops, op)
+
+			if (op == RefDelete || op == RefForceUpdate) && u.Ref != "refs/heads/scratch" {
+				return NewClientError(errors.New(op+" refused"), "Only maintainers may delete or rewind "+u.Ref)
+			}
+
+			return nil
+		}
+	})
+
+	takeOps := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		taken := ops
+		ops = nil
+
+		return taken
+	}
+
+	work := testWorkTree(t, s)
+	remote := testRemote(s, "test.git")
+
+	commit := func(msg string) {
+		out, err := testGit(t, s, work, "commit", "-q", "--allow-empty", "-m", msg)
+		require.NoError(t, err, out)
+	}
+
+	out, err := testGit(t, s, work, "push", remote, "main", "main:other")
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{RefCreate, RefCreate}, takeOps())
+
+	// The new commit is not on the server yet, but is known to fast forward
+	// main once the push's objects arrive
+	commit("second")
+
+	out, err = testGit(t, s, work, "push", remote, "main")
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{RefFastForward}, takeOps())
+
+	out, err = testGit(t, s, work, "push", remote, "main:other")
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{RefFastForward}, takeOps())
+
+	out, err = testGit(t, s, work, "push", "-f", remote, "main~1:main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Only maintainers may delete or rewind refs/heads/main")
+	assert.Equal(t, []string{RefForceUpdate}, takeOps())
+
+	out, err = testGit(t, s, work, "push", remote, ":other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Only maintainers may delete or rewind refs/heads/other")
+	assert.Equal(t, []string{RefDelete}, takeOps())
+
+	// Rewinds with new commits are told apart too, and refused before
+	// receive-pack is run
+	out, err = testGit(t, s, work, "reset", "-q", "--hard", "main~1")
+	require.NoError(t, err, out)
+	commit("diverged")
+
+	out, err = testGit(t, s, work, "push", "-f", remote, "main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Only maintainers may delete or rewind refs/heads/main")
+	assert.Equal(t, []string{RefForceUpdate}, takeOps())
+
+	// Rewinds the func allows are applied alongside other refs' updates
+	out, err = testGit(t, s, work, "push", remote, "main@{2}:refs/heads/scratch")
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{RefCreate}, takeOps())
+
+	out, err = testGit(t, s, work, "push", "-f", remote, "main:scratch", "main:feature")
+	require.NoError(t, err, out)
+	assert.Equal(t, []string{RefForceUpdate, RefCreate}, takeOps())
+}
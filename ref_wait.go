@@ -0,0 +1,87 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultRefPollInterval is how often WaitForRef looks at a ref
+const DefaultRefPollInterval = 100 * time.Millisecond
+
+// ErrRefWaitTimeout is returned by WaitForRef when a ref does not reach the
+// expected value in time
+var ErrRefWaitTimeout = errors.New("timed out waiting for ref")
+
+// WaitForRef blocks until ref in repo points at sha, so that systems acting
+// on a push webhook can wait for this server, which may be a replica or sit
+// behind a cache, to have the push before fetching. Passing ZeroSHA waits
+// for the ref to be deleted. ErrRefWaitTimeout is returned should timeout
+// pass first, and ctx's error if it is cancelled.
+func (s *SSH) WaitForRef(ctx context.Context, repo, ref, sha string, timeout time.Duration) error {
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+
+	loc, err := s.current().resolveRepo(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	poll := time.NewTicker(DefaultRefPollInterval)
+	defer poll.Stop()
+
+	var current string
+
+	for {
+		current, err = resolveRef(ctx, s.config.GitPath, loc.Path, ref)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if current == sha {
+			return nil
+		}
+
+		select {
+		case <-poll.C:
+
+		case <-deadline.C:
+			return fmt.Errorf("%w: %s %s is at %s, waiting for %s", ErrRefWaitTimeout, repo, ref, current, sha)
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// resolveRef returns the object ref points at in the repository at path,
+// or ZeroSHA when the ref, or the repository, does not exist
+func resolveRef(ctx context.Context, gitPath, path, ref string) (string, error) {
+	if !repoExists(path) {
+		return ZeroSHA, nil
+	}
+
+	out, err := exec.CommandContext(ctx, gitPath, "-C", path, "rev-parse", "--verify", "--quiet", ref).Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return ZeroSHA, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %s: %w", ref, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,54 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_WaitForRef(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testWorkTree(t, s)
+	head, _ := testGit(t, s, work, "rev-parse", "HEAD")
+	head = strings.TrimSpace(head)
+
+	t.Run("Timeout", func(t *testing.T) {
+		err := s.WaitForRef(context.Background(), "test", "refs/heads/main", head, 250*time.Millisecond)
+		assert.True(t, errors.Is(err, ErrRefWaitTimeout), err)
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+		}()
+
+		assert.NoError(t, s.WaitForRef(context.Background(), "test", "refs/heads/main", head, 10*time.Second))
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			testGit(t, s, work, "push", testRemote(s, "test.git"), ":main")
+		}()
+
+		assert.NoError(t, s.WaitForRef(context.Background(), "test", "refs/heads/main", ZeroSHA, 10*time.Second))
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := s.WaitForRef(ctx, "test", "refs/heads/main", head, 10*time.Second)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Invalid ref", func(t *testing.T) {
+		assert.Error(t, s.WaitForRef(context.Background(), "test", "--output=x", head, time.Second))
+	})
+}
@@ -0,0 +1,196 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+)
+
+// EventConfigReloaded is emitted once ReloadConfig has swapped in a new
+// configuration
+const EventConfigReloaded = "config.reloaded"
+
+// reloadedConfig is the configuration given to ReloadConfig, along with
+// the webhook dispatcher, routing table and push certificate seed built
+// from it
+type reloadedConfig struct {
+	config       *Config
+	webhooks     *WebhookDispatcher
+	routes       *RouteTable
+	pushCertSeed string
+}
+
+// liveConfig holds the latest reloaded configuration. It is held by
+// pointer so the SSH type may continue to be copied by its value receivers.
+type liveConfig struct {
+	mu      sync.Mutex // Serialises reloads
+	current atomic.Pointer[reloadedConfig]
+}
+
+// current returns s as it should serve a new connection: with the
+// configuration last given to ReloadConfig, if any. Each connection keeps
+// the configuration it started with, so never sees a reload half applied.
+func (s *SSH) current() *SSH {
+	reloaded := s.live.current.Load()
+	if reloaded == nil {
+		return s
+	}
+
+	c := *s
+	c.config, c.webhooks = reloaded.config, reloaded.webhooks
+	c.routes, c.pushCertSeed = reloaded.routes, reloaded.pushCertSeed
+
+	return &c
+}
+
+// ReloadConfig replaces the server's configuration without a restart, such
+// as to change banners, messages, hooks, routes, webhooks or limits.
+// Connections made after it returns are served with config, while those
+// already open finish with the configuration they started with.
+//
+// config is checked before anything changes, so that a mistake leaves the
+// running configuration in place. KeyDir, HostKeys, Dir, Auth, GitUser,
+// ServerVersion, ServerVersionBuild and SSHCrypto are fixed once the server
+// is listening, so keep their current values. An empty PushCertSeed keeps
+// the seed in use, so that nonces already handed out stay valid.
+//
+// Routes are swapped for a new table, so connections already open keep
+// routing as they did; Routes returns the new one. The pack cache is shared
+// by every connection, and takes on the new PackCacheMaxBytes,
+// PackCacheMaxPack and TmpDir at once, evicting kept packs which no longer
+// fit.
+func (s *SSH) ReloadConfig(config Config) error {
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+
+	old := s.current().config
+
+	config.KeyDir, config.HostKeys, config.Dir = old.KeyDir, old.HostKeys, old.Dir
+	config.Auth, config.GitUser, config.ServerVersion = old.Auth, old.GitUser, old.ServerVersion
+	config.ServerVersionBuild, config.SSHCrypto = old.ServerVersionBuild, old.SSHCrypto
+
+	if config.GitPath == "" {
+		config.GitPath = "git"
+	}
+
+	if err := checkReload(&config); err != nil {
+		return err
+	}
+
+	routes := new(RouteTable)
+	if err := routes.Set(config.Routes); err != nil {
+		return err
+	}
+
+	reloaded := &reloadedConfig{config: &config, routes: routes, pushCertSeed: config.PushCertSeed}
+	if reloaded.pushCertSeed == "" {
+		reloaded.pushCertSeed = s.current().pushCertSeed
+	}
+
+	if len(config.Webhooks) > 0 {
+		reloaded.webhooks = &WebhookDispatcher{Hooks: config.Webhooks, Store: s.Store}
+	}
+
+	s.live.current.Store(reloaded)
+	s.packCache.setLimits(config.PackCacheMaxBytes, config.PackCacheMaxPack, config.TmpDir)
+
+	if config.AutoHooks && !config.ReadOnly {
+		if err := config.setupHooks(); err != nil {
+			return fmt.Errorf("configuration reloaded, but hooks could not be installed: %w", err)
+		}
+	}
+
+	s.emit(context.Background(), Event{Type: EventConfigReloaded})
+
+	return nil
+}
+
+// checkReload reports anything in config which would fail once served, such
+// as templates which do not parse
+func checkReload(config *Config) error {
+	for _, root := range config.Roots {
+		if _, err := os.Stat(root.Path); err != nil {
+			return fmt.Errorf("repository root is not accessible: %w", err)
+		}
+	}
+
+	if err := new(RouteTable).Set(config.Routes); err != nil {
+		return err
+	}
+
+	if err := config.checkTrustedProxies(); err != nil {
+		return err
+	}
+
+	if err := config.checkCIDRs(); err != nil {
+		return err
+	}
+
+	if err := config.AuthFailures.check(); err != nil {
+		return err
+	}
+
+	if err := config.RefPolicy.validate(); err != nil {
+		return err
+	}
+
+	if err := config.checkRefPolicyInMemory(); err != nil {
+		return err
+	}
+
+	funcs := template.FuncMap{"cloneURLs": config.CloneURLs}
+
+	if _, err := template.New("banner").Funcs(BannerFuncs).Funcs(funcs).Parse(config.BannerTemplate); err != nil {
+		return fmt.Errorf("banner template: %w", err)
+	}
+
+	for locale, messages := range config.Messages {
+		for id, msg := range messages {
+			t := template.New(id).Funcs(BannerFuncs)
+			if id == MsgBanner {
+				t = t.Funcs(funcs)
+			}
+
+			if _, err := t.Parse(msg); err != nil {
+				return fmt.Errorf("message %s for %s: %w", id, locale, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReloadOnHangup calls ReloadConfig with the result of load each time the
+// process receives SIGHUP, until ctx is cancelled. Failed reloads are
+// logged, and the running configuration kept.
+func (s *SSH) ReloadOnHangup(ctx context.Context, load func() (Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			config, err := load()
+			if err == nil {
+				err = s.ReloadConfig(config)
+			}
+
+			if err != nil {
+				log.Printf("ssh: config reload failed: %v", err)
+				continue
+			}
+
+			log.Print("ssh: config reloaded")
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testShell returns the banner a shell request on client is greeted with
+func testShell(t *testing.T, client *ssh.Client) string {
+	t.Helper()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server writes its banner without replying to shell requests
+	if _, err := sess.SendRequest("shell", false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestSSH_ReloadConfig(t *testing.T) {
+	var mu sync.Mutex
+	events := []Event{}
+
+	s := startTestSSH(t, Config{BannerTemplate: "before"}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			events = append(events, e)
+		}
+	})
+
+	dir := s.config.Dir
+
+	open := testSSHClient(t, s)
+	assert.Equal(t, "before", testShell(t, open))
+
+	assert.NoError(t, s.ReloadConfig(Config{BannerTemplate: "after", Dir: t.TempDir(), AutoCreate: true}))
+
+	assert.Equal(t, "after", testShell(t, testSSHClient(t, s)))
+	assert.Equal(t, "before", testShell(t, open), "connections open before the reload keep their configuration")
+
+	current := s.current().config
+	assert.Equal(t, dir, current.Dir, "Dir is fixed once listening")
+	assert.Equal(t, "git", current.GitPath)
+	assert.True(t, current.AutoCreate)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventConfigReloaded, events[0].Type)
+	}
+}
+
+func TestSSH_ReloadConfig_Invalid(t *testing.T) {
+	s := startTestSSH(t, Config{BannerTemplate: "before"}, nil)
+
+	for name, config := range map[string]Config{
+		"banner":  {BannerTemplate: "{{ .Nope"},
+		"message": {Messages: MessageCatalog{"en": {MsgAccessDenied: "{{ cloneURLs .Repo }}"}}},
+		"route":   {Routes: []Route{{Pattern: "^team/(.*"}}},
+		"root":    {Roots: []RepoRoot{{Path: "/does/not/exist"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, s.ReloadConfig(config))
+			assert.Equal(t, "before", testShell(t, testSSHClient(t, s)))
+		})
+	}
+}
+
+func TestSSH_ReloadConfig_Routes(t *testing.T) {
+	s := startTestSSH(t, Config{Routes: []Route{{Pattern: "alias/*", TrimPrefix: "alias/"}}}, nil)
+
+	before := s.current()
+	assert.NoError(t, s.ReloadConfig(Config{PushCertSeed: "reloaded"}))
+
+	// Connections which started before the reload keep routing as they did
+	loc, err := before.resolveRepo(context.Background(), "alias/test")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(s.config.Dir, "test"), loc.Path)
+
+	loc, err = s.current().resolveRepo(context.Background(), "alias/test")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(s.config.Dir, "alias/test"), loc.Path)
+
+	_, ok := s.Routes().Match("alias/test")
+	assert.False(t, ok)
+	assert.Equal(t, "reloaded", s.current().pushCertSeed)
+
+	// Seeds are kept when none is given, so nonces handed out stay valid
+	assert.NoError(t, s.ReloadConfig(Config{}))
+	assert.Equal(t, "reloaded", s.current().pushCertSeed)
+}
+
+func TestSSH_ReloadConfig_PackCache(t *testing.T) {
+	s := startTestSSH(t, Config{PackCache: true, PackCacheMaxBytes: 1 << 20}, nil)
+
+	for _, key := range []string{"small", "large"} {
+		f := &packFlight{size: 1 << 10, readers: 1, done: true}
+		if key == "large" {
+			f.size = 1 << 19
+		}
+
+		f.cond = sync.NewCond(&f.mu)
+
+		s.packCache.mu.Lock()
+		s.packCache.keep(key, []string{"want"}, f)
+		s.packCache.mu.Unlock()
+	}
+
+	tmp := t.TempDir()
+	assert.NoError(t, s.ReloadConfig(Config{PackCache: true, PackCacheMaxBytes: 1 << 18, TmpDir: tmp}))
+
+	s.packCache.mu.Lock()
+	defer s.packCache.mu.Unlock()
+
+	assert.Equal(t, int64(1<<18), s.packCache.maxBytes)
+	assert.Equal(t, tmp, s.packCache.tmpDir)
+	assert.Contains(t, s.packCache.kept, "small")
+	assert.NotContains(t, s.packCache.kept, "large", "packs which no longer fit are evicted")
+}
+
+func TestSSH_ReloadConfig_Webhooks(t *testing.T) {
+	s := startTestSSH(t, Config{}, nil)
+
+	assert.Nil(t, s.current().webhooks)
+
+	assert.NoError(t, s.ReloadConfig(Config{Webhooks: []Webhook{{URL: "http://127.0.0.1:0/hook"}}}))
+
+	if webhooks := s.current().webhooks; assert.NotNil(t, webhooks) {
+		assert.Len(t, webhooks.Hooks, 1)
+	}
+}
+
+func TestSSH_ReloadOnHangup(t *testing.T) {
+	// Catch SIGHUP throughout, so that the test process survives signals
+	// sent before ReloadOnHangup is listening
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, syscall.SIGHUP)
+	defer signal.Stop(caught)
+
+	s := startTestSSH(t, Config{BannerTemplate: "before"}, nil)
+
+	loaded := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.ReloadOnHangup(ctx, func() (Config, error) {
+		select {
+		case loaded <- struct{}{}:
+		default:
+		}
+
+		return Config{BannerTemplate: "after"}, nil
+	})
+
+	assert.Eventually(t, func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+		select {
+		case <-loaded:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return s.current().config.BannerTemplate == "after"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,165 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrRepoLocked is returned for pushes to repositories locked with
+// RepoManager.Lock, or by another process holding the lock file
+var ErrRepoLocked = errors.New("repository is locked")
+
+var errFlockUnsupported = errors.New("repository locks are only supported on unix")
+
+// repoLockFile is the file, within a repository, which is flocked: shared
+// by the server for each write it serves and while Check reads it, and
+// exclusively by maintenance, such as GC, Prewarm, PurgeDeleted and
+// ImportBundle. Tools outside gitkit may take it too, such as with flock(1).
+const repoLockFile = "gitkit.lock"
+
+// repoLockPoll is how often Lock retries while writes are in flight
+const repoLockPoll = 50 * time.Millisecond
+
+// repoLocks holds the lock files of repositories locked with
+// RepoManager.Lock, by repository path
+type repoLocks struct {
+	mu   sync.Mutex
+	held map[string]*os.File
+}
+
+// holds reports whether the repository at path is locked with
+// RepoManager.Lock by this server
+func (l *repoLocks) holds(path string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.held[path] != nil
+}
+
+// openRepoLock opens the lock file of the repository at path
+func openRepoLock(path string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(path, repoLockFile), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// lockForWrite takes a shared lock on the repository at path for a write,
+// or for reading it whole, failing with ErrRepoLocked when it is locked for
+// maintenance. The returned func releases it.
+func lockForWrite(path string) (func(), error) {
+	f, err := openRepoLock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch err := flockFile(f, false); {
+	case errors.Is(err, errFlockUnsupported):
+		// Locks cannot be taken here, so neither can Lock have been
+
+	case err != nil:
+		f.Close()
+		return nil, err
+	}
+
+	return func() { f.Close() }, nil
+}
+
+// lockForMaintenance takes the exclusive lock on the repository at path,
+// failing with ErrRepoLocked while writes are in flight or it is locked
+// already. The returned func releases it.
+func lockForMaintenance(path string) (func(), error) {
+	f, err := openRepoLock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch err := flockFile(f, true); {
+	case errors.Is(err, errFlockUnsupported):
+
+	case err != nil:
+		f.Close()
+		return nil, err
+	}
+
+	return func() { f.Close() }, nil
+}
+
+// Lock takes the repository name offline for writes, such as for a
+// migration or fsck, waiting for pushes in flight to finish. Pushes made
+// while it is held are refused with ErrRepoLocked; fetches are still
+// served. The lock is advisory, an flock of the gitkit.lock file in the
+// repository, which is respected by every server sharing the repository.
+func (m *RepoManager) Lock(ctx context.Context, name string) error {
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	locks := m.s.locks
+
+	// Waiting on a lock this server holds would never end
+	if locks.holds(path) {
+		return fmt.Errorf("%w: %s is already locked", ErrRepoLocked, name)
+	}
+
+	f, err := openRepoLock(path)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := flockFile(f, true)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, ErrRepoLocked) {
+			f.Close()
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return ctx.Err()
+
+		case <-time.After(repoLockPoll):
+		}
+	}
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+
+	if locks.held == nil {
+		locks.held = make(map[string]*os.File)
+	}
+
+	locks.held[path] = f
+
+	return nil
+}
+
+// Unlock releases a lock taken with Lock, allowing pushes to name again
+func (m *RepoManager) Unlock(ctx context.Context, name string) error {
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	locks := m.s.locks
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+
+	f := locks.held[path]
+	if f == nil {
+		return fmt.Errorf("%s is not locked", name)
+	}
+
+	delete(locks.held, path)
+
+	return f.Close()
+}
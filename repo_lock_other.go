@@ -0,0 +1,9 @@
+//go:build !unix
+
+package gitkit
+
+import "os"
+
+func flockFile(_ *os.File, _ bool) error {
+	return errFlockUnsupported
+}
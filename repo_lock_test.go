@@ -0,0 +1,104 @@
+//go:build unix
+
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lockForWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	// Writes share the lock
+	first, err := lockForWrite(dir)
+	require.NoError(t, err)
+
+	second, err := lockForWrite(dir)
+	require.NoError(t, err)
+
+	f, err := openRepoLock(dir)
+	require.NoError(t, err)
+	defer f.Close()
+
+	assert.ErrorIs(t, flockFile(f, true), ErrRepoLocked)
+
+	first()
+	second()
+
+	assert.NoError(t, flockFile(f, true))
+
+	_, err = lockForWrite(dir)
+	assert.ErrorIs(t, err, ErrRepoLocked)
+}
+
+func TestRepoManager_Lock(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testWorkTree(t, s)
+	remote := testRemote(s, "test.git")
+
+	out, err := testGit(t, s, work, "push", remote, "main")
+	require.NoError(t, err, out)
+
+	ctx := context.Background()
+	repos := s.Repos()
+
+	assert.ErrorIs(t, repos.Lock(ctx, "missing"), ErrRepoNotFound)
+	assert.Error(t, repos.Unlock(ctx, "test"))
+
+	// Lock waits for writes in flight
+	release, err := lockForWrite(filepath.Join(s.config.Dir, "test"))
+	require.NoError(t, err)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, repos.Lock(waitCtx, "test"), context.DeadlineExceeded)
+	release()
+
+	require.NoError(t, repos.Lock(ctx, "test"))
+	assert.ErrorIs(t, repos.Lock(ctx, "test"), ErrRepoLocked)
+
+	out, err = testGit(t, s, work, "push", remote, "main:other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "test is locked for maintenance")
+
+	// Fetches are still served
+	out, err = testGit(t, s, t.TempDir(), "clone", remote, "clone")
+	assert.NoError(t, err, out)
+
+	// As are checks, while maintenance and other writes are not
+	_, err = repos.Check(ctx, "test")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, s.GC(ctx, "test"), ErrRepoLocked)
+	assert.ErrorIs(t, s.Prewarm(ctx, "test"), ErrRepoLocked)
+	assert.ErrorIs(t, repos.SetDefaultBranch(ctx, "test", "other"), ErrRepoLocked)
+
+	require.NoError(t, repos.Unlock(ctx, "test"))
+
+	out, err = testGit(t, s, work, "push", remote, "main:other")
+	assert.NoError(t, err, out)
+}
+
+func TestServer_RepoLock(t *testing.T) {
+	var dir string
+
+	srv := startTestHTTP(t, Config{}, func(s *Server) { dir = s.config.Dir })
+
+	f, err := openRepoLock(filepath.Join(dir, "team", "test.git"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, flockFile(f, true))
+
+	assert.Equal(t, http.StatusOK, testHTTPRefs(t, srv, "git-upload-pack", nil).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, testHTTPRefs(t, srv, "git-receive-pack", nil).StatusCode)
+}
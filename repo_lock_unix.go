@@ -0,0 +1,25 @@
+//go:build unix
+
+package gitkit
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flockFile locks f without blocking, exclusively or shared, returning
+// ErrRepoLocked when a conflicting lock is held
+func flockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrRepoLocked
+	}
+
+	return err
+}
@@ -0,0 +1,283 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRepoListLimit is how many repositories RepoManager.List returns
+// when RepoListOptions.Limit is zero
+const DefaultRepoListLimit = 100
+
+// ErrRepoNotFound is returned when a repository does not exist
+var ErrRepoNotFound = errors.New("repository not found")
+
+// RepoManager reports on the repositories a server holds, such as for
+// dashboards, as returned by SSH.Repos
+type RepoManager struct {
+	s *SSH
+}
+
+// RepoStat describes a repository, as returned by RepoManager.Stat
+type RepoStat struct {
+	Name          string
+	Path          string
+	Size          int64     // Bytes used on disk
+	Refs          int       // Branches, tags and any other refs
+	DefaultBranch string    // Branch HEAD points at; empty when HEAD is detached
+	Description   string    // From the description file; empty when git's placeholder was never replaced
+	LastPush      time.Time // From push history when Config.PushHistory is set, otherwise when refs last changed. Zero for repositories never pushed to.
+	ReadOnly      bool
+	Visibility    string
+	State         RepoState
+}
+
+// RepoListOptions selects a page of repositories. Names are listed in
+// order, so the Next of one page is the After of the following one.
+type RepoListOptions struct {
+	Prefix string // Only names starting with Prefix, such as a namespace like "team/"
+	After  string // Only names after this one
+	Limit  int    // Most names returned. Defaults to DefaultRepoListLimit.
+}
+
+// RepoPage is a page of repository names. Next is empty on the last page.
+type RepoPage struct {
+	Repos []string
+	Next  string
+}
+
+// Repos returns a RepoManager for the server's repositories
+func (s *SSH) Repos() *RepoManager {
+	return &RepoManager{s: s}
+}
+
+// List returns a page of the repositories under Config.Dir, Config.Roots
+// and the roots of Config.Routes, whatever their visibility
+func (m *RepoManager) List(opts RepoListOptions) (RepoPage, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultRepoListLimit
+	}
+
+	repos, err := m.s.current().listAllRepos()
+	if err != nil {
+		return RepoPage{}, err
+	}
+
+	start := sort.SearchStrings(repos, opts.After)
+	if start < len(repos) && repos[start] == opts.After {
+		start++
+	}
+
+	page := RepoPage{Repos: []string{}}
+	for _, repo := range repos[start:] {
+		if !strings.HasPrefix(repo, opts.Prefix) {
+			continue
+		}
+
+		if len(page.Repos) == limit {
+			page.Next = page.Repos[limit-1]
+			break
+		}
+
+		page.Repos = append(page.Repos, repo)
+	}
+
+	return page, nil
+}
+
+// Stat describes the repository name
+func (m *RepoManager) Stat(ctx context.Context, name string) (RepoStat, error) {
+	s := m.s.current()
+
+	if err := validateRepoPath(name); err != nil {
+		return RepoStat{}, err
+	}
+
+	loc, err := s.resolveRepo(ctx, name)
+	if err != nil {
+		return RepoStat{}, err
+	}
+
+	if !repoExists(loc.Path) {
+		return RepoStat{}, fmt.Errorf("%w: %s", ErrRepoNotFound, name)
+	}
+
+	stat := RepoStat{
+		Name:       name,
+		Path:       loc.Path,
+		ReadOnly:   loc.ReadOnly,
+		Visibility: loc.Visibility,
+	}
+
+	status, err := readRepoState(loc.Path)
+	if err != nil {
+		return stat, err
+	}
+
+	stat.State = status.State
+
+	if stat.Size, err = repoSize(loc.Path); err != nil {
+		return stat, err
+	}
+
+	refs, err := exec.CommandContext(ctx, s.config.GitPath, "-C", loc.Path, "for-each-ref", "--format=%(refname)").Output()
+	if err != nil {
+		return stat, fmt.Errorf("unable to list refs: %w", err)
+	}
+
+	stat.Refs = bytes.Count(refs, []byte("\n"))
+
+	// symbolic-ref fails when HEAD is detached, which leaves no default
+	if head, err := exec.CommandContext(ctx, s.config.GitPath, "-C", loc.Path, "symbolic-ref", "--quiet", "--short", "HEAD").Output(); err == nil {
+		stat.DefaultBranch = strings.TrimSpace(string(head))
+	}
+
+	if desc, err := os.ReadFile(filepath.Join(loc.Path, "description")); err == nil && !bytes.HasPrefix(desc, []byte("Unnamed repository;")) {
+		stat.Description = strings.TrimSpace(string(desc))
+	}
+
+	if stat.LastPush, err = s.lastPush(name, loc.Path); err != nil {
+		return stat, err
+	}
+
+	return stat, nil
+}
+
+// unnamedDescription is the description git init writes, which Stat
+// reports as no description
+const unnamedDescription = "Unnamed repository; edit this file 'description' to name the repository.\n"
+
+// SetDescription replaces the description of the repository name, as
+// shown by gitweb and RepoStat. An empty text clears it.
+func (m *RepoManager) SetDescription(ctx context.Context, name, text string) error {
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	desc := unnamedDescription
+	if text = strings.TrimSpace(text); text != "" {
+		desc = text + "\n"
+	}
+
+	file := filepath.Join(path, "description")
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(desc), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// SetDefaultBranch points HEAD of the repository name at branch, such as
+// main, which is what clones check out. The branch need not exist yet.
+func (m *RepoManager) SetDefaultBranch(ctx context.Context, name, branch string) error {
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	release, err := lockForWrite(path)
+	if err != nil {
+		return fmt.Errorf("default branch %q: %w", branch, err)
+	}
+	defer release()
+
+	ref := "refs/heads/" + strings.TrimPrefix(branch, "refs/heads/")
+
+	out, err := exec.CommandContext(ctx, m.s.current().config.GitPath, "-C", path, "symbolic-ref", "HEAD", ref).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("default branch %q: %w: %s", branch, err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// lastPush returns when repo was last pushed to, from its push history or,
+// failing that, from when its refs were last written
+func (s SSH) lastPush(repo, path string) (time.Time, error) {
+	if s.Store != nil {
+		prefix := pushHistoryPrefix(repo)
+
+		keys, err := s.Store.List(prefix)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if len(keys) > 0 {
+			return time.Unix(0, pushKeyTime(prefix, keys[len(keys)-1])), nil
+		}
+	}
+
+	var last time.Time
+
+	err := filepath.WalkDir(filepath.Join(path, "refs"), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+
+		return err
+	})
+
+	if info, perr := os.Stat(filepath.Join(path, "packed-refs")); perr == nil && info.ModTime().After(last) {
+		last = info.ModTime()
+	}
+
+	return last, err
+}
+
+// listAllRepos lists the repositories under Config.Dir, Config.Roots and
+// the roots of Config.Routes in order, those in more than one listed once
+func (s SSH) listAllRepos() ([]string, error) {
+	if s.config.InMemory {
+		return s.Repositories.List()
+	}
+
+	repos, err := listRepos(s.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range s.config.Roots {
+		more, err := listRepos(root.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		repos = append(repos, more...)
+	}
+
+	routed, err := s.listRouteRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	repos = append(repos, routed...)
+
+	sort.Strings(repos)
+
+	unique := repos[:0]
+	for i, repo := range repos {
+		if i == 0 || repo != repos[i-1] {
+			unique = append(unique, repo)
+		}
+	}
+
+	return unique, nil
+}
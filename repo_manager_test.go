@@ -0,0 +1,168 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoManager_List(t *testing.T) {
+	root := t.TempDir()
+	cfg := Config{Dir: t.TempDir(), GitPath: "git", Roots: []RepoRoot{{Path: root}}}
+
+	for _, repo := range []string{
+		filepath.Join(cfg.Dir, "a.git"),
+		filepath.Join(cfg.Dir, "team", "b.git"),
+		filepath.Join(cfg.Dir, "team", "c.git"),
+		filepath.Join(root, "team", "c.git"),
+		filepath.Join(root, "z.git"),
+	} {
+		if err := initRepo(repo, &cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos := NewSSH(cfg).Repos()
+
+	page, err := repos.List(RepoListOptions{Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, RepoPage{Repos: []string{"a.git", "team/b.git"}, Next: "team/b.git"}, page)
+
+	page, err = repos.List(RepoListOptions{Limit: 2, After: page.Next})
+	assert.NoError(t, err)
+	assert.Equal(t, RepoPage{Repos: []string{"team/c.git", "z.git"}}, page)
+
+	page, err = repos.List(RepoListOptions{Prefix: "team/"})
+	assert.NoError(t, err)
+	assert.Equal(t, RepoPage{Repos: []string{"team/b.git", "team/c.git"}}, page)
+
+	page, err = repos.List(RepoListOptions{After: "z.git"})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Repos)
+}
+
+func TestRepoManager_Stat(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, PushHistory: true}, nil)
+
+	work := testWorkTree(t, s)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main", "main:refs/tags/v1"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	path := filepath.Join(s.config.Dir, "test")
+	if err := os.WriteFile(filepath.Join(path, "description"), []byte("The test repository\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pushes to new repositories leave HEAD on git's own default
+	if out, err := testGit(t, s, path, "symbolic-ref", "HEAD", "refs/heads/main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	stat, err := s.Repos().Stat(context.Background(), "test")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "test", stat.Name)
+	assert.Equal(t, path, stat.Path)
+	assert.Equal(t, 2, stat.Refs)
+	assert.Equal(t, "main", stat.DefaultBranch)
+	assert.Equal(t, "The test repository", stat.Description)
+	assert.Equal(t, VisibilityPublic, stat.Visibility)
+	assert.Greater(t, stat.Size, int64(0))
+	assert.WithinDuration(t, time.Now(), stat.LastPush, time.Minute)
+
+	pushes, err := s.Pushes(PushQuery{Repo: "test"})
+	if assert.NoError(t, err) && assert.Len(t, pushes, 1) {
+		assert.Equal(t, pushes[0].Time.UnixNano(), stat.LastPush.UnixNano())
+	}
+
+	_, err = s.Repos().Stat(context.Background(), "missing.git")
+	assert.True(t, errors.Is(err, ErrRepoNotFound))
+
+	_, err = s.Repos().Stat(context.Background(), "../escape.git")
+	assert.Error(t, err)
+}
+
+func TestRepoManager_Stat_Empty(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), GitPath: "git"}
+	if err := initRepo(filepath.Join(cfg.Dir, "empty.git"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := NewSSH(cfg).Repos().Stat(context.Background(), "empty.git")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 0, stat.Refs)
+	assert.Empty(t, stat.Description)
+	assert.True(t, stat.LastPush.IsZero())
+}
+
+func TestRepoManager_SetDescription(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), GitPath: "git"}
+	if err := initRepo(filepath.Join(cfg.Dir, "test.git"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	repos := NewSSH(cfg).Repos()
+
+	assert.NoError(t, repos.SetDescription(ctx, "test.git", "  The test repository\n"))
+
+	stat, err := repos.Stat(ctx, "test.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "The test repository", stat.Description)
+
+	assert.NoError(t, repos.SetDescription(ctx, "test.git", ""))
+
+	stat, err = repos.Stat(ctx, "test.git")
+	assert.NoError(t, err)
+	assert.Empty(t, stat.Description)
+
+	assert.True(t, errors.Is(repos.SetDescription(ctx, "missing.git", "x"), ErrRepoNotFound))
+}
+
+func TestRepoManager_SetDefaultBranch(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	work := testWorkTree(t, s)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main", "main:develop"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	ctx := context.Background()
+
+	assert.NoError(t, s.Repos().SetDefaultBranch(ctx, "test", "develop"))
+
+	stat, err := s.Repos().Stat(ctx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "develop", stat.DefaultBranch)
+
+	// Clones check out the new default
+	clone := filepath.Join(t.TempDir(), "clone")
+	if out, err := testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), clone); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	out, err := testGit(t, s, clone, "symbolic-ref", "--short", "HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, "develop\n", out)
+
+	// Branches may be named before they are pushed
+	assert.NoError(t, s.Repos().SetDefaultBranch(ctx, "test", "refs/heads/trunk"))
+
+	stat, err = s.Repos().Stat(ctx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "trunk", stat.DefaultBranch)
+
+	assert.Error(t, s.Repos().SetDefaultBranch(ctx, "test", "bad..name"))
+	assert.True(t, errors.Is(s.Repos().SetDefaultBranch(ctx, "missing", "main"), ErrRepoNotFound))
+}
@@ -0,0 +1,71 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidRepoName is returned for repository names which are malformed,
+// or which are rejected by a RepoNamePolicy
+var ErrInvalidRepoName = errors.New("invalid repository name")
+
+// DefaultRepoNameChars is the character set each part of a repository name
+// must match when RepoNamePolicy.AllowedChars is not set
+var DefaultRepoNameChars = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// RepoNamePolicy controls which repository names clients may use
+type RepoNamePolicy struct {
+	AllowedChars *regexp.Regexp // Pattern every slash separated part must match; DefaultRepoNameChars when nil
+	MaxDepth     int            // Maximum number of parts, such as 2 for org/repo. Zero means unlimited.
+}
+
+// Validate checks name against the policy, after checking that it is
+// structurally sound
+func (p RepoNamePolicy) Validate(name string) error {
+	if err := validateRepoPath(name); err != nil {
+		return err
+	}
+
+	parts := strings.Split(name, "/")
+	if p.MaxDepth > 0 && len(parts) > p.MaxDepth {
+		return fmt.Errorf("%w: %q is nested deeper than %d", ErrInvalidRepoName, name, p.MaxDepth)
+	}
+
+	allowed := p.AllowedChars
+	if allowed == nil {
+		allowed = DefaultRepoNameChars
+	}
+
+	for _, part := range parts {
+		if !allowed.MatchString(part) {
+			return fmt.Errorf("%w: %q contains disallowed characters", ErrInvalidRepoName, name)
+		}
+	}
+
+	return nil
+}
+
+// validateRepoPath rejects names which could never be safe regardless of
+// policy, such as those which are absolute or contain ".." parts
+func validateRepoPath(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidRepoName)
+	}
+
+	if strings.HasPrefix(name, "/") {
+		return fmt.Errorf("%w: %q is absolute", ErrInvalidRepoName, name)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "":
+			return fmt.Errorf("%w: %q contains an empty path component", ErrInvalidRepoName, name)
+		case ".", "..":
+			return fmt.Errorf("%w: %q contains a relative path component", ErrInvalidRepoName, name)
+		}
+	}
+
+	return nil
+}
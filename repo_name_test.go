@@ -0,0 +1,38 @@
+package gitkit
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRepoNamePolicy_Validate(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		policy      RepoNamePolicy
+		repo        string
+		expectError bool
+	}{
+		{"Simple name", RepoNamePolicy{}, "hello", false},
+		{"Nested name", RepoNamePolicy{}, "org/team/hello", false},
+		{"Name with punctuation", RepoNamePolicy{}, "hello-world_v1.2", false},
+		{"Empty name", RepoNamePolicy{}, "", true},
+		{"Absolute name", RepoNamePolicy{}, "/etc/passwd", true},
+		{"Parent traversal", RepoNamePolicy{}, "../hello", true},
+		{"Nested traversal", RepoNamePolicy{}, "org/../../hello", true},
+		{"Empty component", RepoNamePolicy{}, "org//hello", true},
+		{"Hidden component", RepoNamePolicy{}, "org/.ssh", true},
+		{"Disallowed characters", RepoNamePolicy{}, "hello world", true},
+		{"Too deep", RepoNamePolicy{MaxDepth: 2}, "a/b/c", true},
+		{"Within depth", RepoNamePolicy{MaxDepth: 2}, "a/b", false},
+		{"Custom characters", RepoNamePolicy{AllowedChars: regexp.MustCompile(`^[a-z]+$`)}, "Hello", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate(test.repo)
+			if err != nil && !test.expectError {
+				t.Errorf("unexpected error: %v", err)
+			} else if err == nil && test.expectError {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DefaultUserHomesDir is where RepoPathOptions.UserHomes places user homes
+// within Config.Dir when HomesDir is not set
+const DefaultUserHomesDir = "users"
+
+// RepoPathOptions adds the path syntaxes other git servers accept to plain
+// repository names. Either way, the path is mapped onto an ordinary
+// repository name, which is then validated, routed and authorised as any
+// other.
+type RepoPathOptions struct {
+	UserHomes    bool   // Accept ~user/repo, naming the repository HomesDir/user/repo
+	HomesDir     string // Directory of user homes within Config.Dir. Defaults to DefaultUserHomesDir.
+	AbsoluteRoot string // Accept absolute paths beneath this directory, naming repositories by their path within it, and refuse all others. Empty takes absolute paths as relative to Config.Dir.
+}
+
+func (o RepoPathOptions) homesDir() string {
+	if o.HomesDir == "" {
+		return DefaultUserHomesDir
+	}
+
+	return o.HomesDir
+}
+
+// mapRepoPath sets gitcmd.Repo from a ~user or absolute gitcmd.Path, as
+// RepoPathOptions, UserRepoFunc and AbsolutePathFunc allow. Paths in
+// neither syntax are left alone.
+func (s SSH) mapRepoPath(ctx context.Context, gitcmd *GitCommand) (err error) {
+	name := gitcmd.Repo
+
+	switch {
+	case strings.HasPrefix(gitcmd.Path, "~"):
+		if s.UserRepoFunc == nil && !s.config.RepoPaths.UserHomes {
+			return nil
+		}
+
+		user, repo, ok := strings.Cut(strings.TrimPrefix(gitcmd.Path, "~"), "/")
+		if !ok || user == "" {
+			return fmt.Errorf("%w: %q names no user repository", ErrInvalidRepoName, gitcmd.Path)
+		}
+
+		repo = parseRepoName(repo)
+
+		// Each part is checked alone, as joining them would clean away
+		// components such as ~../repo
+		for _, part := range []string{user, repo} {
+			if err = validateRepoPath(part); err != nil {
+				return err
+			}
+		}
+
+		if s.UserRepoFunc != nil {
+			name, err = s.UserRepoFunc(ctx, user, repo)
+		} else {
+			name = path.Join(s.config.RepoPaths.homesDir(), user, repo)
+		}
+
+	case strings.HasPrefix(gitcmd.Path, "/"):
+		if s.AbsolutePathFunc != nil {
+			name, err = s.AbsolutePathFunc(ctx, gitcmd.Path)
+
+			break
+		}
+
+		root := s.config.RepoPaths.AbsoluteRoot
+		if root == "" {
+			return nil
+		}
+
+		p := path.Clean(gitcmd.Path)
+		if p == path.Clean(root) || !withinDir(root, p) {
+			return fmt.Errorf("%w: %q is outside %s", ErrPathTraversal, gitcmd.Path, root)
+		}
+
+		name = parseRepoName(strings.TrimPrefix(p, path.Clean(root)))
+
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("ssh: mapping %q: %w", gitcmd.Path, err)
+	}
+
+	if err = validateRepoPath(name); err != nil {
+		return err
+	}
+
+	gitcmd.Repo = name
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_mapRepoPath(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		paths  RepoPathOptions
+		path   string
+		expect string
+		err    error
+	}{
+		{name: "plain names are untouched", paths: RepoPathOptions{UserHomes: true, AbsoluteRoot: "/srv/git"}, path: "team/project.git", expect: "team/project"},
+		{name: "user homes off", path: "~alice/project.git", expect: "~alice/project"},
+		{name: "user home", paths: RepoPathOptions{UserHomes: true}, path: "~alice/project.git", expect: "users/alice/project"},
+		{name: "homes dir", paths: RepoPathOptions{UserHomes: true, HomesDir: "home"}, path: "~alice/team/project", expect: "home/alice/team/project"},
+		{name: "no user", paths: RepoPathOptions{UserHomes: true}, path: "~/project.git", err: ErrInvalidRepoName},
+		{name: "no repo", paths: RepoPathOptions{UserHomes: true}, path: "~alice", err: ErrInvalidRepoName},
+		{name: "relative user", paths: RepoPathOptions{UserHomes: true}, path: "~../project.git", err: ErrInvalidRepoName},
+		{name: "relative user repo", paths: RepoPathOptions{UserHomes: true}, path: "~alice/../bob/project.git", err: ErrInvalidRepoName},
+		{name: "absolute paths relative to dir", path: "/team/project.git", expect: "team/project"},
+		{name: "absolute path", paths: RepoPathOptions{AbsoluteRoot: "/srv/git"}, path: "/srv/git/team/project.git", expect: "team/project"},
+		{name: "absolute root with trailing slash", paths: RepoPathOptions{AbsoluteRoot: "/srv/git/"}, path: "/srv/git/project.git", expect: "project"},
+		{name: "outside absolute root", paths: RepoPathOptions{AbsoluteRoot: "/srv/git"}, path: "/srv/gitolite/project.git", err: ErrPathTraversal},
+		{name: "absolute root itself", paths: RepoPathOptions{AbsoluteRoot: "/srv/git"}, path: "/srv/git", err: ErrPathTraversal},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := SSH{config: &Config{RepoPaths: test.paths}}
+			gitcmd := &GitCommand{Path: test.path, Repo: parseRepoName(test.path)}
+
+			err := s.mapRepoPath(context.Background(), gitcmd)
+			if test.err != nil {
+				assert.True(t, errors.Is(err, test.err), "expected %v, received %v", test.err, err)
+
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expect, gitcmd.Repo)
+			}
+		})
+	}
+}
+
+func TestSSH_mapRepoPath_Funcs(t *testing.T) {
+	denied := errors.New("no such user")
+
+	s := SSH{
+		config: &Config{RepoPaths: RepoPathOptions{AbsoluteRoot: "/unused"}},
+		UserRepoFunc: func(_ context.Context, user, repo string) (string, error) {
+			if user != "alice" {
+				return "", denied
+			}
+
+			return "people/" + user + "-" + repo, nil
+		},
+		AbsolutePathFunc: func(_ context.Context, path string) (string, error) {
+			return "../" + filepath.Base(path), nil
+		},
+	}
+
+	gitcmd := &GitCommand{Path: "~alice/project.git"}
+	if assert.NoError(t, s.mapRepoPath(context.Background(), gitcmd)) {
+		assert.Equal(t, "people/alice-project", gitcmd.Repo)
+	}
+
+	err := s.mapRepoPath(context.Background(), &GitCommand{Path: "~bob/project.git"})
+	assert.True(t, errors.Is(err, denied))
+
+	// Nor is UserRepoFunc asked about users which are not names
+	err = s.mapRepoPath(context.Background(), &GitCommand{Path: "~./project.git"})
+	assert.True(t, errors.Is(err, ErrInvalidRepoName))
+
+	// Whatever the callback gives is still checked
+	err = s.mapRepoPath(context.Background(), &GitCommand{Path: "/srv/git/project.git"})
+	assert.True(t, errors.Is(err, ErrInvalidRepoName))
+}
+
+func TestSSH_RepoPaths(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, RepoPaths: RepoPathOptions{UserHomes: true, AbsoluteRoot: "/srv/git"}}, nil)
+
+	work := testWorkTree(t, s)
+
+	for _, remote := range []string{"~alice/project.git", "srv/git/team/project.git"} {
+		if out, err := testGit(t, s, work, "push", testRemote(s, remote), "main"); err != nil {
+			t.Fatalf("%s: %v\n%s", remote, err, out)
+		}
+	}
+
+	assert.True(t, repoExists(filepath.Join(s.config.Dir, "users", "alice", "project")))
+	assert.True(t, repoExists(filepath.Join(s.config.Dir, "team", "project")))
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "elsewhere/project.git"), "main")
+	assert.Error(t, err, out)
+	assert.True(t, errors.Is(s.Report().LastError, ErrPathTraversal))
+}
@@ -0,0 +1,273 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RepoState is where a repository is in its lifecycle
+type RepoState string
+
+const (
+	RepoActive        RepoState = "active"          // Served as usual
+	RepoArchived      RepoState = "archived"        // Fetches are served; pushes are refused
+	RepoDeletePending RepoState = "deleted-pending" // Refused as though missing, until removed by PurgeDeleted
+)
+
+// DefaultDeleteRetention is how long deleted repositories are kept before
+// PurgeDeleted removes them, when Config.DeleteRetention is zero
+const DefaultDeleteRetention = 7 * 24 * time.Hour
+
+// EventRepoPurged is emitted when PurgeDeleted removes a repository
+const EventRepoPurged = "repo.purged"
+
+// ErrRepoArchived is returned for pushes to archived repositories
+var ErrRepoArchived = errors.New("repository is archived")
+
+// repoStateFile is the marker file, within a repository, holding its state
+const repoStateFile = "gitkit-state"
+
+// RepoStatus is a repository's state and when it entered it
+type RepoStatus struct {
+	State   RepoState `json:"state"`
+	Since   time.Time `json:"since"`
+	Message string    `json:"message,omitempty"` // Shown to clients refused for the state, in place of the catalog's message
+}
+
+// readRepoState returns the state recorded in the repository at path.
+// Repositories without a marker file are active.
+func readRepoState(path string) (RepoStatus, error) {
+	data, err := os.ReadFile(filepath.Join(path, repoStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return RepoStatus{State: RepoActive}, nil
+	}
+
+	if err != nil {
+		return RepoStatus{}, err
+	}
+
+	var status RepoStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return RepoStatus{}, fmt.Errorf("%s: %w", repoStateFile, err)
+	}
+
+	return status, nil
+}
+
+// writeRepoState records status in the repository at path, removing the
+// marker file for active repositories
+func writeRepoState(path string, status RepoStatus) error {
+	marker := filepath.Join(path, repoStateFile)
+
+	if status.State == RepoActive {
+		err := os.Remove(marker)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	tmp := marker + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, marker)
+}
+
+// RepoArchivedNotice is passed to the MsgRepoArchived template
+type RepoArchivedNotice struct {
+	Repo  string
+	Since time.Time
+}
+
+// refuseForState returns an error when the repository at path is pending
+// deletion, or is archived and gitcmd is a push, along with the message the
+// client should be shown
+func (c Config) refuseForState(locale, path string, gitcmd *GitCommand) (string, error) {
+	status, err := readRepoState(path)
+	if err != nil {
+		return c.Message(locale, MsgRepoNotFound, nil), err
+	}
+
+	switch {
+	case status.State == RepoDeletePending:
+		return c.Message(locale, MsgRepoNotFound, nil), fmt.Errorf("%w: %s is pending deletion", ErrRepoNotFound, gitcmd.Repo)
+
+	case status.State == RepoArchived && gitcmd.IsWrite():
+		msg := status.Message + "\r\n"
+		if status.Message == "" {
+			msg = c.Message(locale, MsgRepoArchived, RepoArchivedNotice{Repo: gitcmd.Repo, Since: status.Since})
+		}
+
+		return msg, fmt.Errorf("%w: %s", ErrRepoArchived, gitcmd.Repo)
+	}
+
+	return "", nil
+}
+
+// State returns the lifecycle state of the repository name
+func (m *RepoManager) State(ctx context.Context, name string) (RepoStatus, error) {
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return RepoStatus{}, err
+	}
+
+	return readRepoState(path)
+}
+
+// SetState moves the repository name into state, recording message to be
+// shown to clients it refuses, such as where an archived project moved to
+func (m *RepoManager) SetState(ctx context.Context, name string, state RepoState, message string) error {
+	switch state {
+	case RepoActive, RepoArchived, RepoDeletePending:
+
+	default:
+		return fmt.Errorf("unknown repository state %q", state)
+	}
+
+	path, err := m.repoPath(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return writeRepoState(path, RepoStatus{State: state, Since: time.Now().UTC(), Message: message})
+}
+
+// repoPath resolves the repository name, which must exist on disk
+func (m *RepoManager) repoPath(ctx context.Context, name string) (string, error) {
+	s := m.s.current()
+
+	if s.config.InMemory {
+		return "", fmt.Errorf("repository states: %w in memory", ErrOperationDisabled)
+	}
+
+	if err := validateRepoPath(name); err != nil {
+		return "", err
+	}
+
+	loc, err := s.resolveRepo(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if !repoExists(loc.Path) {
+		return "", fmt.Errorf("%w: %s", ErrRepoNotFound, name)
+	}
+
+	return loc.Path, nil
+}
+
+// PurgeDeleted removes repositories which have been pending deletion for
+// longer than Config.DeleteRetention, returning their names. Forks of a
+// purged repository are first given their own copies of the objects they
+// borrow from it. Repositories under maintenance, or being written to, are
+// left for a later run.
+func (m *RepoManager) PurgeDeleted(ctx context.Context) ([]string, error) {
+	s := m.s.current()
+
+	retention := s.config.DeleteRetention
+	if retention <= 0 {
+		retention = DefaultDeleteRetention
+	}
+
+	repos, err := s.listAllRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	purged := []string{}
+	for _, repo := range repos {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+
+		loc, err := s.resolveRepo(ctx, repo)
+		if err != nil {
+			return purged, err
+		}
+
+		status, err := readRepoState(loc.Path)
+		if err != nil {
+			return purged, err
+		}
+
+		if status.State != RepoDeletePending || time.Since(status.Since) < retention {
+			continue
+		}
+
+		removed, err := s.purgeRepo(ctx, repo, loc.Path)
+		if err != nil {
+			return purged, err
+		}
+
+		if removed {
+			s.emit(ctx, Event{Type: EventRepoPurged, Repo: repo})
+			purged = append(purged, repo)
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeRepo removes the repository repo at path, holding its maintenance
+// lock and lock file, once its forks no longer borrow its objects. It
+// reports false when the repository, or one of its forks, is busy.
+func (s *SSH) purgeRepo(ctx context.Context, repo, path string) (bool, error) {
+	if !s.maintenance.acquire(path) {
+		return false, nil
+	}
+	defer s.maintenance.release(path)
+
+	unlock, err := lockForMaintenance(path)
+	if errors.Is(err, ErrRepoLocked) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	switch err = s.dissociateForks(ctx, repo); {
+	case errors.Is(err, ErrRepoLocked) || errors.Is(err, ErrMaintenanceRunning):
+		return false, nil
+
+	case err != nil:
+		return false, fmt.Errorf("purge %s: %w", repo, err)
+	}
+
+	return true, os.RemoveAll(path)
+}
+
+// RunPurgeDeleted calls PurgeDeleted every interval until ctx is
+// cancelled. Failures are logged, and retried at the next run.
+func (m *RepoManager) RunPurgeDeleted(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.PurgeDeleted(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("purge: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_repoState(t *testing.T) {
+	dir := t.TempDir()
+
+	status, err := readRepoState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, RepoActive, status.State)
+
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, writeRepoState(dir, RepoStatus{State: RepoArchived, Since: since, Message: "Moved to example.com/new"}))
+
+	status, err = readRepoState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, RepoStatus{State: RepoArchived, Since: since, Message: "Moved to example.com/new"}, status)
+
+	// Active repositories have no marker file
+	assert.NoError(t, writeRepoState(dir, RepoStatus{State: RepoActive}))
+	assert.NoFileExists(t, filepath.Join(dir, repoStateFile))
+	assert.NoError(t, writeRepoState(dir, RepoStatus{State: RepoActive}))
+}
+
+func TestSSH_RepoStates(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthoriseAdminFunc = func(context.Context, []string) error { return nil }
+	})
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	if !assert.NoError(t, err, out) {
+		return
+	}
+
+	ctx := context.Background()
+	repos := s.Repos()
+
+	assert.Error(t, repos.SetState(ctx, "test", "frozen", ""))
+	assert.ErrorIs(t, repos.SetState(ctx, "missing", RepoArchived, ""), ErrRepoNotFound)
+
+	// Archived repositories serve fetches, but refuse pushes
+	assert.NoError(t, repos.SetState(ctx, "test", RepoArchived, ""))
+
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), "clone")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main:other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "test is archived and no longer accepts pushes")
+
+	assert.NoError(t, repos.SetState(ctx, "test", RepoArchived, "Moved to example.com/new"))
+
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main:other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Moved to example.com/new")
+
+	stat, err := repos.Stat(ctx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, RepoArchived, stat.State)
+
+	// Deleted repositories are refused as though missing
+	out, err = testSSHRun(t, s, "gitkit delete test.git")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Repository not found")
+
+	// and kept until the retention window passes
+	purged, err := repos.PurgeDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, purged)
+
+	out, err = testSSHRun(t, s, "gitkit restore test.git")
+	assert.NoError(t, err, out)
+
+	status, err := repos.State(ctx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, RepoActive, status.State)
+}
+
+func TestRepoManager_PurgeDeleted(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, DeleteRetention: time.Nanosecond}, nil)
+
+	work := testWorkTree(t, s)
+	for _, repo := range []string{"kept.git", "deleted.git"} {
+		out, err := testGit(t, s, work, "push", testRemote(s, repo), "main")
+		if !assert.NoError(t, err, out) {
+			return
+		}
+	}
+
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	ctx := context.Background()
+	assert.NoError(t, s.Repos().SetState(ctx, "deleted", RepoDeletePending, ""))
+
+	purged, err := s.Repos().PurgeDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deleted"}, purged)
+
+	assert.NoDirExists(t, filepath.Join(s.config.Dir, "deleted"))
+	assert.DirExists(t, filepath.Join(s.config.Dir, "kept"))
+	purgedEvents := testEvents(t, events, EventRepoPurged)
+	assert.Equal(t, "deleted", purgedEvents[len(purgedEvents)-1].Repo)
+}
+
+func TestServer_RepoStates(t *testing.T) {
+	var dir string
+
+	srv := startTestHTTP(t, Config{}, func(s *Server) { dir = s.config.Dir })
+	path := filepath.Join(dir, "team", "test.git")
+
+	assert.NoError(t, writeRepoState(path, RepoStatus{State: RepoArchived}))
+	assert.Equal(t, http.StatusOK, testHTTPRefs(t, srv, "git-upload-pack", nil).StatusCode)
+	assert.Equal(t, http.StatusForbidden, testHTTPRefs(t, srv, "git-receive-pack", nil).StatusCode)
+
+	assert.NoError(t, writeRepoState(path, RepoStatus{State: RepoDeletePending}))
+	assert.Equal(t, http.StatusNotFound, testHTTPRefs(t, srv, "git-upload-pack", nil).StatusCode)
+}
+
+func TestRepoManager_PurgeDeleted_Forked(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, DeleteRetention: time.Nanosecond}, nil)
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "deleted.git"), "main")
+	require.NoError(t, err, out)
+
+	ctx := context.Background()
+	require.NoError(t, s.Fork(ctx, "deleted", "fork"))
+	require.NoError(t, s.Repos().SetState(ctx, "deleted", RepoDeletePending, ""))
+
+	// Repositories locked for maintenance wait for the next run
+	require.NoError(t, s.Repos().Lock(ctx, "deleted"))
+
+	purged, err := s.Repos().PurgeDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, purged)
+	assert.DirExists(t, filepath.Join(s.config.Dir, "deleted"))
+
+	require.NoError(t, s.Repos().Unlock(ctx, "deleted"))
+
+	purged, err = s.Repos().PurgeDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deleted"}, purged)
+
+	// The fork keeps the objects it borrowed
+	assert.NoFileExists(t, filepath.Join(s.config.Dir, "fork", "objects", "info", "alternates"))
+
+	forks, err := s.Forks("deleted")
+	assert.NoError(t, err)
+	assert.Empty(t, forks)
+
+	out, err = testGit(t, s, t.TempDir(), "clone", "-q", "-b", "main", testRemote(s, "fork.git"), ".")
+	assert.NoError(t, err, out)
+}
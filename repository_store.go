@@ -0,0 +1,96 @@
+package gitkit
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// RepositoryStore holds the repositories served when Config.InMemory is
+// set, in place of Config.Dir
+type RepositoryStore interface {
+	// Open returns the storage of the repository called name, or
+	// ErrRepoNotFound when there is none
+	Open(name string) (storage.Storer, error)
+
+	// Create initialises an empty repository called name
+	Create(name string) (storage.Storer, error)
+
+	// List returns the names of every repository
+	List() ([]string, error)
+}
+
+// MemoryRepositoryStore is a RepositoryStore keeping each repository in
+// its own in-memory filesystem, so that nothing touches disk
+type MemoryRepositoryStore struct {
+	mu    sync.Mutex
+	repos map[string]billy.Filesystem
+}
+
+func NewMemoryRepositoryStore() *MemoryRepositoryStore {
+	return &MemoryRepositoryStore{repos: make(map[string]billy.Filesystem)}
+}
+
+func (m *MemoryRepositoryStore) Open(name string) (storage.Storer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fs, ok := m.repos[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRepoNotFound, name)
+	}
+
+	return filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil
+}
+
+func (m *MemoryRepositoryStore) Create(name string) (storage.Storer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fs, ok := m.repos[name]
+	if ok {
+		return filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil
+	}
+
+	fs = memfs.New()
+	st := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+
+	if _, err := git.Init(st, nil); err != nil {
+		return nil, err
+	}
+
+	m.repos[name] = fs
+
+	return st, nil
+}
+
+func (m *MemoryRepositoryStore) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.repos))
+	for name := range m.repos {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Repository opens the repository called name, for tests to inspect
+func (m *MemoryRepositoryStore) Repository(name string) (*git.Repository, error) {
+	st, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return git.Open(st, nil)
+}
@@ -0,0 +1,107 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// EventKeyRejected is emitted when a key is refused for having expired or
+// been revoked
+const EventKeyRejected = "key.rejected"
+
+var (
+	ErrKeyExpired = errors.New("key has expired")
+	ErrKeyRevoked = errors.New("key has been revoked")
+)
+
+// RevocationChecker reports whether a key has been revoked, such as by
+// consulting a revocation list. It is asked on every authentication, and
+// again before each command a connection runs, so that keys revoked while
+// a client is connected stop working. Clients refused while authenticating
+// are only told permission was denied, as ssh carries no message then;
+// MsgKeyRevoked and MsgKeyExpired are shown to those already connected.
+type RevocationChecker interface {
+	Revoked(ctx context.Context, pk PublicKey) (bool, error)
+}
+
+// checkKey refuses pk if it has expired or been revoked. Keys are refused
+// too when RevocationChecker fails, rather than letting a revoked key
+// through.
+func (s SSH) checkKey(ctx context.Context, pk PublicKey) error {
+	if !pk.ExpiresAt.IsZero() && time.Now().After(pk.ExpiresAt) {
+		return fmt.Errorf("%w: %s expired %s", ErrKeyExpired, pk.Fingerprint, pk.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if s.RevocationChecker == nil {
+		return nil
+	}
+
+	revoked, err := s.RevocationChecker.Revoked(ctx, pk)
+	if err != nil {
+		return fmt.Errorf("%w: %s could not be checked: %w", ErrKeyRevoked, pk.Fingerprint, err)
+	}
+
+	if revoked {
+		return fmt.Errorf("%w: %s", ErrKeyRevoked, pk.Fingerprint)
+	}
+
+	return nil
+}
+
+// rejectKey emits EventKeyRejected for pk, refused with err
+func (s SSH) rejectKey(ctx context.Context, pk PublicKey, err error) {
+	reason := "revoked"
+	if errors.Is(err, ErrKeyExpired) {
+		reason = "expired"
+	}
+
+	s.emit(context.WithValue(ctx, PublicKeyContextKey{}, pk), Event{Type: EventKeyRejected, Data: map[string]string{
+		"reason": reason,
+		"error":  err.Error(),
+	}})
+}
+
+// checkSessionKey repeats checkKey for the key a connection authenticated
+// with, as it may have expired or been revoked since
+func (s SSH) checkSessionKey(ctx context.Context) error {
+	if !s.config.Auth {
+		return nil
+	}
+
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+	err := s.checkKey(ctx, pk)
+	if err != nil {
+		s.rejectKey(ctx, pk, err)
+	}
+
+	return err
+}
+
+// reportRejectedKey tells the client why checkSessionKey refused their key
+func (s SSH) reportRejectedKey(ctx context.Context, sess *session, ch ssh.Channel, err error) {
+	id := MsgKeyRevoked
+	if errors.Is(err, ErrKeyExpired) {
+		id = MsgKeyExpired
+	}
+
+	ch.Stderr().Write([]byte(s.message(ctx, sess, id)))
+	sendExitStatus(ch, 1)
+}
+
+// DisconnectKey closes every connection authenticated with the key whose
+// Id is id, such as once it has been revoked, returning how many were
+// closed
+func (s *SSH) DisconnectKey(id string) int {
+	if id == "" {
+		return 0
+	}
+
+	return s.state.disconnect(func(info SessionInfo) bool {
+		return info.PublicKey.Id == id
+	})
+}
@@ -0,0 +1,239 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type testRevocations struct {
+	mu      sync.Mutex
+	revoked map[string]bool
+	err     error
+}
+
+func (r *testRevocations) Revoked(_ context.Context, pk PublicKey) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.revoked[pk.Id], r.err
+}
+
+func (r *testRevocations) revoke(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revoked[id] = true
+}
+
+func testClientSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// startTestKeySSH serves keys named by the ids keys maps their
+// fingerprints to, each expiring at its time
+func startTestKeySSH(t *testing.T, keys map[string]PublicKey, setup func(*SSH)) *SSH {
+	t.Helper()
+
+	return startTestSSH(t, Config{Auth: true}, func(s *SSH) {
+		s.PublicKeyLookupFunc = func(_ context.Context, key PublicKeyLookup) (*PublicKey, error) {
+			pk, ok := keys[key.Fingerprint]
+			if !ok {
+				return nil, errors.New("unknown key")
+			}
+
+			return &pk, nil
+		}
+
+		s.Commands = map[string]CommandFunc{
+			"whoami": func(ctx context.Context, ch ssh.Channel, _ []string) error {
+				_, err := ch.Write([]byte(ctx.Value(PublicKeyContextKey{}).(PublicKey).Id))
+
+				return err
+			},
+		}
+
+		if setup != nil {
+			setup(s)
+		}
+	})
+}
+
+func testKeyDial(s *SSH, signer ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+func testClientRun(t *testing.T, client *ssh.Client, cmd string) (string, error) {
+	t.Helper()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	out, err := sess.CombinedOutput(cmd)
+
+	return string(out), err
+}
+
+func TestSSH_KeyExpiry(t *testing.T) {
+	current, expired := testClientSigner(t), testClientSigner(t)
+
+	var mu sync.Mutex
+	events := []Event{}
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(current.PublicKey()): {Id: "current", Name: "current", ExpiresAt: time.Now().Add(time.Hour)},
+		ssh.FingerprintSHA256(expired.PublicKey()): {Id: "expired", Name: "expired", ExpiresAt: time.Now().Add(-time.Hour)},
+	}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			events = append(events, e)
+		}
+	})
+
+	client, err := testKeyDial(s, current)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+
+	_, err = testKeyDial(s, expired)
+	assert.Error(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventKeyRejected, events[0].Type)
+		assert.Equal(t, "expired", events[0].PublicKey.Id)
+		assert.Equal(t, "expired", events[0].Data["reason"])
+	}
+}
+
+func TestSSH_RevocationChecker(t *testing.T) {
+	alice, bob := testClientSigner(t), testClientSigner(t)
+	revocations := &testRevocations{revoked: map[string]bool{"bob": true}}
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(alice.PublicKey()): {Id: "alice", Name: "alice"},
+		ssh.FingerprintSHA256(bob.PublicKey()):   {Id: "bob", Name: "bob"},
+	}, func(s *SSH) {
+		s.RevocationChecker = revocations
+		s.config.Messages = MessageCatalog{DefaultLocale: {MsgKeyRevoked: "{{ .PublicKey.Name }} is no longer welcome\r\n"}}
+	})
+
+	_, err := testKeyDial(s, bob)
+	assert.Error(t, err)
+
+	client, err := testKeyDial(s, alice)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	out, err := testClientRun(t, client, "whoami")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", out)
+
+	t.Run("revoked while connected", func(t *testing.T) {
+		revocations.revoke("alice")
+
+		out, err := testClientRun(t, client, "whoami")
+		assert.Error(t, err)
+		assert.Equal(t, "alice is no longer welcome\r\n", out)
+
+		_, err = testKeyDial(s, alice)
+		assert.Error(t, err)
+	})
+}
+
+func TestSSH_RevocationChecker_Fails(t *testing.T) {
+	alice := testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(alice.PublicKey()): {Id: "alice"},
+	}, func(s *SSH) {
+		s.RevocationChecker = &testRevocations{err: errors.New("revocation list unavailable")}
+	})
+
+	_, err := testKeyDial(s, alice)
+	assert.Error(t, err)
+}
+
+func TestSSH_DisconnectKey(t *testing.T) {
+	alice, bob := testClientSigner(t), testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(alice.PublicKey()): {Id: "alice"},
+		ssh.FingerprintSHA256(bob.PublicKey()):   {Id: "bob"},
+	}, nil)
+
+	var clients []*ssh.Client
+	for _, signer := range []ssh.Signer{alice, alice, bob} {
+		client, err := testKeyDial(s, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		clients = append(clients, client)
+	}
+
+	// Sessions pick up their key once the server finishes the handshake
+	assert.Eventually(t, func() bool {
+		for _, info := range s.Sessions() {
+			if info.PublicKey.Id == "" {
+				return false
+			}
+		}
+
+		return len(s.Sessions()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 2, s.DisconnectKey("alice"))
+	assert.Equal(t, 0, s.DisconnectKey(""))
+
+	for _, client := range clients[:2] {
+		done := make(chan struct{})
+		go func(client *ssh.Client) {
+			client.Wait()
+			close(done)
+		}(client)
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("expected alice's connection to be closed")
+		}
+	}
+
+	out, err := testClientRun(t, clients[2], "whoami")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", out)
+}
@@ -0,0 +1,319 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Repository visibility, which controls whether a repository is listed
+// to clients (such as in banners)
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+	VisibilityHidden  = "hidden"
+)
+
+// Route.AutoCreate settings, replacing Config.AutoCreate for the
+// repositories a route matches
+const (
+	AutoCreateOn  = "on"
+	AutoCreateOff = "off"
+)
+
+// Route maps repository names matching Pattern onto a storage root and
+// policy. Patterns are globs as understood by path.Match, where a trailing
+// "/**" matches any depth, or regular expressions when they start with "^".
+type Route struct {
+	Pattern    string
+	Root       string // Directory holding matching repositories; Config.Dir when empty
+	TrimPrefix string // Prefix removed from the repository name before joining with Root
+	ReadOnly   bool   // Reject pushes to matching repositories
+	Visibility string // One of the Visibility constants; VisibilityPublic when empty
+
+	// QuotaWarning replaces Config.QuotaWarning for matching repositories
+	QuotaWarning float64
+
+	// UploadPack, when set, replaces Config.UploadPack for matching
+	// repositories
+	UploadPack *UploadPackOptions
+
+	// RefPolicy, when set, replaces Config.RefPolicy for matching
+	// repositories
+	RefPolicy *RefPolicy
+
+	// AutoCreate is one of the AutoCreate constants, or empty to follow
+	// Config.AutoCreate. Config.ReadOnly and ReadOnly still prevent creation.
+	AutoCreate string
+
+	// Readers and Writers, when either is set, name the keys, by
+	// PublicKey.Name, which may fetch from and push to matching
+	// repositories. Writers may fetch too. Requires Config.Auth.
+	Readers []string
+	Writers []string
+}
+
+type compiledRoute struct {
+	Route
+	re *regexp.Regexp
+}
+
+func (r compiledRoute) match(name string) bool {
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+
+	if prefix, ok := strings.CutSuffix(r.Pattern, "/**"); ok {
+		return strings.HasPrefix(name, prefix+"/")
+	}
+
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// RouteTable holds an ordered set of routes, the first match winning. It
+// is safe to replace routes while the server is running.
+type RouteTable struct {
+	mu     sync.RWMutex
+	routes []compiledRoute
+}
+
+// Set validates and replaces all routes in the table
+func (t *RouteTable) Set(routes []Route) error {
+	compiled := make([]compiledRoute, len(routes))
+
+	for i, r := range routes {
+		compiled[i] = compiledRoute{Route: r}
+
+		if r.AutoCreate != "" && r.AutoCreate != AutoCreateOn && r.AutoCreate != AutoCreateOff {
+			return fmt.Errorf("route %q: unknown AutoCreate setting %q", r.Pattern, r.AutoCreate)
+		}
+
+		if r.RefPolicy != nil {
+			if err := r.RefPolicy.validate(); err != nil {
+				return fmt.Errorf("route %q: %w", r.Pattern, err)
+			}
+		}
+
+		if strings.HasPrefix(r.Pattern, "^") {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return fmt.Errorf("route %q: %w", r.Pattern, err)
+			}
+
+			compiled[i].re = re
+		} else if _, err := path.Match(strings.TrimSuffix(r.Pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("route %q: %w", r.Pattern, err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.routes = compiled
+
+	return nil
+}
+
+// Match returns the first route matching the repository name
+func (t *RouteTable) Match(name string) (Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, r := range t.routes {
+		if r.match(name) {
+			return r.Route, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// rooted returns the routes which give their own Root
+func (t *RouteTable) rooted() []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	routes := []Route{}
+	for _, r := range t.routes {
+		if r.Root != "" {
+			routes = append(routes, r.Route)
+		}
+	}
+
+	return routes
+}
+
+// RepoRoot is a directory of repositories searched, after Config.Dir, for
+// repositories which do not exist there, so that existing layouts such as
+// mirrors or archives can be served alongside new repositories. New
+// repositories are always created in Config.Dir.
+type RepoRoot struct {
+	Path     string
+	ReadOnly bool // Reject pushes to repositories found in this root
+}
+
+// repoLocation is the outcome of resolving a repository name
+type repoLocation struct {
+	Name         string
+	Path         string
+	ReadOnly     bool
+	AutoCreate   bool
+	Visibility   string
+	QuotaWarning float64
+	Readers      []string
+	Writers      []string
+	UploadPack   UploadPackOptions
+	HideRefs     []string
+	RefPolicy    RefPolicy
+}
+
+// permits reports whether the key named name may fetch from, or when write
+// is set push to, the repository
+func (l repoLocation) permits(name string, write bool) bool {
+	if len(l.Readers) == 0 && len(l.Writers) == 0 {
+		return true
+	}
+
+	for _, w := range l.Writers {
+		if w == name {
+			return true
+		}
+	}
+
+	if write {
+		return false
+	}
+
+	for _, r := range l.Readers {
+		if r == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveRepo determines where a repository lives. The routing table is
+// consulted first, then ResolveRepoFunc, and finally the repository name is
+// joined to Config.Dir, or to the first of Config.Roots holding it
+func (s *SSH) resolveRepo(ctx context.Context, name string) (loc repoLocation, err error) {
+	loc = repoLocation{
+		Name:         name,
+		Path:         filepath.Join(s.config.Dir, name),
+		AutoCreate:   s.config.autoCreate(),
+		Visibility:   VisibilityPublic,
+		QuotaWarning: s.config.QuotaWarning,
+		UploadPack:   s.config.UploadPack,
+		RefPolicy:    s.config.RefPolicy,
+	}
+
+	if route, ok := s.routes.Match(name); ok {
+		root := route.Root
+		if root == "" {
+			root = s.config.Dir
+		}
+
+		loc.Path = filepath.Join(root, strings.TrimPrefix(name, route.TrimPrefix))
+		loc.ReadOnly = route.ReadOnly
+
+		if route.Visibility != "" {
+			loc.Visibility = route.Visibility
+		}
+
+		if route.QuotaWarning > 0 {
+			loc.QuotaWarning = route.QuotaWarning
+		}
+
+		if route.UploadPack != nil {
+			loc.UploadPack = *route.UploadPack
+		}
+
+		if route.RefPolicy != nil {
+			loc.RefPolicy = *route.RefPolicy
+		}
+
+		switch route.AutoCreate {
+		case AutoCreateOn:
+			loc.AutoCreate = !s.config.ReadOnly
+		case AutoCreateOff:
+			loc.AutoCreate = false
+		}
+
+		loc.Readers, loc.Writers = route.Readers, route.Writers
+
+		if !withinDir(root, loc.Path) {
+			err = ErrPathTraversal
+		}
+
+		return
+	}
+
+	// Paths returned by ResolveRepoFunc are trusted, since the embedding
+	// application is free to place repositories wherever it likes
+	if s.ResolveRepoFunc != nil {
+		loc.Path, err = s.ResolveRepoFunc(ctx, name)
+
+		return
+	}
+
+	if !withinDir(s.config.Dir, loc.Path) {
+		err = ErrPathTraversal
+
+		return
+	}
+
+	if repoExists(loc.Path) {
+		return
+	}
+
+	for _, root := range s.config.Roots {
+		p := filepath.Join(root.Path, name)
+		if !withinDir(root.Path, p) {
+			return loc, ErrPathTraversal
+		}
+
+		if repoExists(p) {
+			loc.Path = p
+			loc.ReadOnly = root.ReadOnly
+
+			return
+		}
+	}
+
+	return
+}
+
+// listRouteRepos lists the repositories under the roots routes give, by
+// the names clients use for them. Roots not yet created hold none.
+func (s SSH) listRouteRepos() ([]string, error) {
+	repos := []string{}
+
+	for _, route := range s.routes.rooted() {
+		found, err := listRepos(route.Root)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range found {
+			name := route.TrimPrefix + filepath.ToSlash(repo)
+
+			// Only names which route back to this root are its own
+			if match, ok := s.routes.Match(name); ok && match.Root == route.Root {
+				repos = append(repos, name)
+			}
+		}
+	}
+
+	return repos, nil
+}
@@ -0,0 +1,225 @@
+package gitkit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRouteTable_Match(t *testing.T) {
+	table := new(RouteTable)
+	assert.NoError(t, table.Set([]Route{
+		{Pattern: "mirrors/*", Root: "/srv/mirrors", TrimPrefix: "mirrors/", ReadOnly: true},
+		{Pattern: "archive/**", Root: "/srv/archive", Visibility: VisibilityHidden},
+		{Pattern: `^team-[a-z]+/`, Root: "/srv/teams"},
+	}))
+
+	for name, expect := range map[string]string{
+		"mirrors/linux":     "/srv/mirrors",
+		"mirrors/a/b":       "",
+		"archive/2019/old":  "/srv/archive",
+		"team-infra/deploy": "/srv/teams",
+		"team-42/deploy":    "",
+		"plain":             "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			route, ok := table.Match(name)
+
+			assert.Equal(t, expect != "", ok)
+			assert.Equal(t, expect, route.Root)
+		})
+	}
+}
+
+func TestRouteTable_Set_Invalid(t *testing.T) {
+	table := new(RouteTable)
+
+	assert.Error(t, table.Set([]Route{{Pattern: "^(unclosed"}}))
+	assert.Error(t, table.Set([]Route{{Pattern: "[unclosed"}}))
+	assert.Error(t, table.Set([]Route{{Pattern: "public/*", AutoCreate: "sometimes"}}))
+}
+
+func TestSSH_resolveRepo(t *testing.T) {
+	s := NewSSH(Config{
+		Dir:    "/srv/git",
+		Routes: []Route{{Pattern: "mirrors/*", Root: "/srv/mirrors", TrimPrefix: "mirrors/", ReadOnly: true}},
+	})
+	s.ResolveRepoFunc = func(_ context.Context, repo string) (string, error) {
+		return "/srv/custom/" + repo, nil
+	}
+
+	loc, err := s.resolveRepo(context.Background(), "mirrors/linux")
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/mirrors/linux", loc.Path)
+	assert.True(t, loc.ReadOnly)
+
+	loc, err = s.resolveRepo(context.Background(), "project")
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/custom/project", loc.Path)
+	assert.False(t, loc.ReadOnly)
+
+	s.ResolveRepoFunc = nil
+	loc, err = s.resolveRepo(context.Background(), "project")
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/git/project", loc.Path)
+}
+
+func TestSSH_resolveRepo_Traversal(t *testing.T) {
+	s := NewSSH(Config{
+		Dir:    "/srv/git",
+		Routes: []Route{{Pattern: "mirrors/**", Root: "/srv/mirrors", TrimPrefix: "mirrors/"}},
+	})
+
+	for _, name := range []string{"../etc", "org/../../etc", "mirrors/../../etc"} {
+		_, err := s.resolveRepo(context.Background(), name)
+		assert.ErrorIs(t, err, ErrPathTraversal, name)
+	}
+}
+
+func TestSSH_resolveRepo_Roots(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), GitPath: "git"}
+	mirrors, archive := t.TempDir(), t.TempDir()
+
+	cfg.Roots = []RepoRoot{{Path: mirrors, ReadOnly: true}, {Path: archive}}
+
+	for _, p := range []string{
+		filepath.Join(cfg.Dir, "project"),
+		filepath.Join(mirrors, "project"),
+		filepath.Join(mirrors, "linux"),
+		filepath.Join(archive, "linux"),
+		filepath.Join(archive, "old"),
+	} {
+		assert.NoError(t, initRepo(p, &cfg))
+	}
+
+	s := NewSSH(cfg)
+
+	for name, expect := range map[string]repoLocation{
+		"project": {Path: filepath.Join(cfg.Dir, "project")},
+		"linux":   {Path: filepath.Join(mirrors, "linux"), ReadOnly: true},
+		"old":     {Path: filepath.Join(archive, "old")},
+		"new":     {Path: filepath.Join(cfg.Dir, "new")},
+	} {
+		loc, err := s.resolveRepo(context.Background(), name)
+		assert.NoError(t, err)
+		assert.Equal(t, expect.Path, loc.Path, name)
+		assert.Equal(t, expect.ReadOnly, loc.ReadOnly, name)
+	}
+
+	repos, err := s.listVisibleRepos(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux", "old", "project"}, repos)
+}
+
+func TestSSH_resolveRepo_AutoCreate(t *testing.T) {
+	routes := []Route{
+		{Pattern: "public/*", Root: "/srv/public", TrimPrefix: "public/", AutoCreate: AutoCreateOn},
+		{Pattern: "private/*", Root: "/srv/private", TrimPrefix: "private/", AutoCreate: AutoCreateOff},
+		{Pattern: "shared/*", Root: "/srv/shared", TrimPrefix: "shared/"},
+	}
+
+	for _, test := range []struct {
+		cfg    Config
+		expect map[string]bool
+	}{
+		{Config{Dir: "/srv/git", Routes: routes}, map[string]bool{"public/a": true, "private/a": false, "shared/a": false, "a": false}},
+		{Config{Dir: "/srv/git", Routes: routes, AutoCreate: true}, map[string]bool{"public/a": true, "private/a": false, "shared/a": true, "a": true}},
+		{Config{Dir: "/srv/git", Routes: routes, AutoCreate: true, ReadOnly: true}, map[string]bool{"public/a": false, "private/a": false, "shared/a": false, "a": false}},
+	} {
+		s := NewSSH(test.cfg)
+
+		for name, expect := range test.expect {
+			loc, err := s.resolveRepo(context.Background(), name)
+			assert.NoError(t, err)
+			assert.Equal(t, expect, loc.AutoCreate, "%s with AutoCreate %v, ReadOnly %v", name, test.cfg.AutoCreate, test.cfg.ReadOnly)
+		}
+	}
+}
+
+func TestRepoLocation_permits(t *testing.T) {
+	assert.True(t, repoLocation{}.permits("", true))
+
+	loc := repoLocation{Readers: []string{"bob"}, Writers: []string{"alice"}}
+	assert.True(t, loc.permits("alice", true))
+	assert.True(t, loc.permits("alice", false))
+	assert.True(t, loc.permits("bob", false))
+	assert.False(t, loc.permits("bob", true))
+	assert.False(t, loc.permits("carol", false))
+	assert.False(t, loc.permits("", false))
+}
+
+func TestSSH_Routes_Roots(t *testing.T) {
+	public, private := filepath.Join(t.TempDir(), "public"), t.TempDir()
+
+	s := startTestSSH(t, Config{Routes: []Route{
+		{Pattern: "public/*", Root: public, TrimPrefix: "public/", AutoCreate: AutoCreateOn},
+		{Pattern: "private/*", Root: private, TrimPrefix: "private/"},
+	}}, nil)
+
+	work := testWorkTree(t, s)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "public/test.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	assert.True(t, repoExists(filepath.Join(public, "test")))
+
+	// Config.AutoCreate is not set, and the route does not turn it on
+	_, err := testGit(t, s, work, "push", testRemote(s, "private/test.git"), "main")
+	assert.Error(t, err)
+	assert.False(t, repoExists(filepath.Join(private, "test")))
+
+	page, err := s.Repos().List(RepoListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"public/test"}, page.Repos)
+}
+
+func TestSSH_Routes_Access(t *testing.T) {
+	alice, bob, carol := testClientSigner(t), testClientSigner(t), testClientSigner(t)
+	private := t.TempDir()
+
+	if err := initRepo(filepath.Join(private, "repo"), &Config{GitPath: "git"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(alice.PublicKey()): {Id: "1", Name: "alice"},
+		ssh.FingerprintSHA256(bob.PublicKey()):   {Id: "2", Name: "bob"},
+		ssh.FingerprintSHA256(carol.PublicKey()): {Id: "3", Name: "carol"},
+	}, func(s *SSH) {
+		err := s.routes.Set([]Route{{
+			Pattern:    "private/*",
+			Root:       private,
+			TrimPrefix: "private/",
+			Readers:    []string{"bob"},
+			Writers:    []string{"alice"},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, test := range []struct {
+		signer ssh.Signer
+		cmd    string
+		denied bool
+	}{
+		{alice, "git-receive-pack 'private/repo.git'", false},
+		{bob, "git-upload-pack 'private/repo.git'", false},
+		{bob, "git-receive-pack 'private/repo.git'", true},
+		{carol, "git-upload-pack 'private/repo.git'", true},
+	} {
+		client, err := testKeyDial(s, test.signer)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		// Denied commands are refused before git advertises any refs
+		out, _ := testClientRun(t, client, test.cmd)
+		client.Close()
+
+		assert.Equal(t, test.denied, out == "", "%s: %q", test.cmd, out)
+	}
+}
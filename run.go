@@ -0,0 +1,362 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionNotFound is returned by KillSession for sessions which are not
+// connected
+var ErrSessionNotFound = errors.New("session not found")
+
+// DefaultShutdownTimeout is how long Run waits for in-flight connections
+// to finish once its context is cancelled, when Config.ShutdownTimeout is
+// not set
+const DefaultShutdownTimeout = 30 * time.Second
+
+// RunReport summarises a server's lifetime, as returned by Run
+type RunReport struct {
+	Started     time.Time
+	Uptime      time.Duration
+	Connections int64 // Connections accepted
+	Commands    int64 // Git commands executed
+	Errors      int64 // Failed handshakes and commands
+	LastError   error
+}
+
+// serverState tracks live connections and counters. It is held by pointer
+// so the SSH type may continue to be copied by its value receivers.
+type serverState struct {
+	listenerMu sync.RWMutex
+	listeners  []net.Listener // Kept here, as copies of SSH made while serving would race with Stop
+
+	mu      sync.Mutex
+	conns   map[net.Conn]*trackedConn
+	wg      sync.WaitGroup
+	started time.Time
+	lastErr error
+
+	finalisers []func(ctx context.Context) error // Called by RunUntilSignal once connections drain
+
+	connections atomic.Int64
+	commands    atomic.Int64
+	errors      atomic.Int64
+}
+
+func newServerState() *serverState {
+	return &serverState{conns: make(map[net.Conn]*trackedConn)}
+}
+
+func (st *serverState) markStarted() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.started = time.Now()
+}
+
+func (st *serverState) track(conn net.Conn) *trackedConn {
+	id := st.connections.Add(1)
+	st.wg.Add(1)
+
+	tc := &trackedConn{info: SessionInfo{
+		ID:         strconv.FormatInt(id, 10),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Started:    time.Now(),
+	}}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.conns[conn] = tc
+
+	return tc
+}
+
+func (st *serverState) untrack(conn net.Conn) {
+	st.mu.Lock()
+	delete(st.conns, conn)
+	st.mu.Unlock()
+
+	st.wg.Done()
+}
+
+func (st *serverState) recordError(err error) {
+	if err == nil {
+		return
+	}
+
+	st.errors.Add(1)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.lastErr = err
+}
+
+func (st *serverState) closeAll() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for conn := range st.conns {
+		conn.Close()
+	}
+}
+
+// disconnect closes the connections whose SessionInfo match, returning how
+// many were closed
+func (st *serverState) disconnect(match func(SessionInfo) bool) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	closed := 0
+	for conn, tc := range st.conns {
+		if match(tc.snapshot()) {
+			conn.Close()
+			closed++
+		}
+	}
+
+	return closed
+}
+
+// claimKey counts tc as a connection authenticated with the key with
+// fingerprint, unless max connections already are
+func (st *serverState) claimKey(tc *trackedConn, fingerprint string, max int) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n := 0
+	for _, other := range st.conns {
+		if other != tc && other.claimedKey() == fingerprint {
+			n++
+		}
+	}
+
+	if n >= max {
+		return false
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.claimed = fingerprint
+
+	return true
+}
+
+// sessions returns the connected clients, oldest first
+func (st *serverState) sessions() []SessionInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(st.conns))
+	for _, tc := range st.conns {
+		sessions = append(sessions, tc.snapshot())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+
+	return sessions
+}
+
+func (st *serverState) report() RunReport {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	r := RunReport{
+		Started:     st.started,
+		Connections: st.connections.Load(),
+		Commands:    st.commands.Load(),
+		Errors:      st.errors.Load(),
+		LastError:   st.lastErr,
+	}
+
+	if !st.started.IsZero() {
+		r.Uptime = time.Since(st.started)
+	}
+
+	return r
+}
+
+// Shutdown stops accepting new connections and waits for existing ones to
+// finish. Should ctx expire first, remaining connections are closed and the
+// context's error returned.
+func (s *SSH) Shutdown(ctx context.Context) error {
+	if err := s.Stop(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.state.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		s.state.closeAll()
+		return ctx.Err()
+	}
+}
+
+// Run listens on binds and serves until ctx is cancelled, then shuts down
+// gracefully, allowing Config.ShutdownTimeout for connections to drain. The
+// returned error is nil when the server stopped because ctx was cancelled.
+func (s *SSH) Run(ctx context.Context, binds ...string) (*RunReport, error) {
+	if err := s.Listen(binds...); err != nil {
+		return nil, err
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+		s.state.recordError(err)
+
+	case <-ctx.Done():
+		timeout := s.config.ShutdownTimeout
+		if timeout == 0 {
+			timeout = DefaultShutdownTimeout
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err = s.Shutdown(shutdownCtx)
+
+		// Serve always fails once its listener is closed
+		if serveErr := <-served; !errors.Is(serveErr, net.ErrClosed) && err == nil {
+			err = serveErr
+		}
+	}
+
+	report := s.Report()
+
+	return &report, err
+}
+
+// SessionInfo describes a connected client, as returned by Sessions
+type SessionInfo struct {
+	ID         string
+	RemoteAddr string
+	User       string
+	PublicKey  PublicKey
+	Started    time.Time
+	Command    string // Most recent command run on the connection
+	Repo       string // Repository of the most recent git command
+	Operation  string // Git operation of the most recent git command, such as upload-pack
+}
+
+type trackedConnContextKey struct{}
+
+// trackedConn holds the SessionInfo of a live connection, along with the
+// keys PublicKeyLookupFunc accepted while it was authenticating
+type trackedConn struct {
+	mu       sync.Mutex
+	info     SessionInfo
+	accepted map[string]PublicKey
+	claimed  string // Fingerprint of the key counted against Config.MaxSessionsPerKey
+}
+
+// accept records a key PublicKeyLookupFunc allowed. Clients may be offered
+// several before one is used, so keys are held by fingerprint.
+func (tc *trackedConn) accept(pk PublicKey) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.accepted == nil {
+		tc.accepted = make(map[string]PublicKey)
+	}
+
+	tc.accepted[pk.Fingerprint] = pk
+}
+
+// authenticated returns the accepted key with fingerprint, the one the
+// client authenticated with, discarding the rest
+func (tc *trackedConn) authenticated(fingerprint string) (PublicKey, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	pk, ok := tc.accepted[fingerprint]
+	tc.accepted = nil
+
+	return pk, ok
+}
+
+func (tc *trackedConn) claimedKey() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return tc.claimed
+}
+
+func (tc *trackedConn) update(f func(*SessionInfo)) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	f(&tc.info)
+}
+
+func (tc *trackedConn) snapshot() SessionInfo {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return tc.info
+}
+
+// setSessionCommand records cmd against the connection in ctx
+func setSessionCommand(ctx context.Context, cmd string) {
+	if tc, ok := ctx.Value(trackedConnContextKey{}).(*trackedConn); ok {
+		tc.update(func(info *SessionInfo) { info.Command = cmd })
+	}
+}
+
+// setSessionGitCommand records the git command, and the repository and
+// operation it is for, against the connection in ctx
+func setSessionGitCommand(ctx context.Context, gitcmd *GitCommand) {
+	if tc, ok := ctx.Value(trackedConnContextKey{}).(*trackedConn); ok {
+		tc.update(func(info *SessionInfo) {
+			info.Command, info.Repo, info.Operation = gitcmd.Original, gitcmd.Repo, gitcmd.SubCommand()
+		})
+	}
+}
+
+// Sessions returns the clients currently connected, oldest first
+func (s *SSH) Sessions() []SessionInfo {
+	return s.state.sessions()
+}
+
+// KillSession closes the connection of the session with id, as listed by
+// Sessions
+func (s *SSH) KillSession(id string) error {
+	closed := s.state.disconnect(func(info SessionInfo) bool {
+		return info.ID == id
+	})
+
+	if closed == 0 {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+
+	return nil
+}
+
+// Report returns the server's current counters
+func (s *SSH) Report() RunReport {
+	return s.state.report()
+}
@@ -0,0 +1,290 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_Run(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), AutoCreate: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	type result struct {
+		report *RunReport
+		err    error
+	}
+
+	done := make(chan result)
+	go func() {
+		report, err := s.Run(ctx, "127.0.0.1:0")
+		done <- result{report, err}
+	}()
+
+	for s.Address() == "" {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if out, err := testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git")); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	cancel()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("unexpected error: %v", r.err)
+		}
+
+		if r.report.Connections != 1 || r.report.Commands != 1 {
+			t.Errorf("expected 1 connection and command, received %#v", r.report)
+		}
+
+		if r.report.Uptime <= 0 {
+			t.Errorf("expected positive uptime, received %v", r.report.Uptime)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
+
+func TestSSH_Listen_Multiple(t *testing.T) {
+	sock := testSocketPath(t)
+
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), AutoCreate: true})
+	if err := s.Listen("127.0.0.1:0", "127.0.0.1:0", "unix:"+sock); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	addrs := s.Addresses()
+	if len(addrs) != 3 || addrs[0] != s.Address() || addrs[2] != sock {
+		t.Fatalf("unexpected addresses %q", addrs)
+	}
+
+	config := &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	for i, network := range []string{"tcp", "tcp", "unix"} {
+		client, err := ssh.Dial(network, addrs[i], config)
+		if err != nil {
+			t.Fatalf("%s: %v", addrs[i], err)
+		}
+
+		client.Close()
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected %v, received %v", net.ErrClosed, err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Stop")
+	}
+
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed, received %v", err)
+	}
+
+	if len(s.Addresses()) != 0 {
+		t.Errorf("expected no addresses, received %q", s.Addresses())
+	}
+}
+
+func TestSSH_Serve_ListenerFailure(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+	if err := s.Listen("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := s.currentListeners()
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	listeners[0].Close()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after a listener failed")
+	}
+
+	if _, err := net.Dial("tcp", listeners[1].Addr().String()); err == nil {
+		t.Error("expected the other listener to be closed")
+	}
+
+	if s.Address() != "" {
+		t.Errorf("expected no listeners, received %s", s.Address())
+	}
+}
+
+func TestSSH_Listen_Error(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir()})
+
+	if err := s.Listen(); !errors.Is(err, ErrNoListener) {
+		t.Errorf("expected %v, received %v", ErrNoListener, err)
+	}
+
+	if err := s.Listen("127.0.0.1:0", "256.0.0.1:0"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if s.Address() != "" {
+		t.Errorf("expected no listeners, received %s", s.Address())
+	}
+}
+
+func TestSSH_Sessions(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+	client := testSSHClient(t, s)
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// upload-pack waits for the client once it has advertised its refs
+	stdin, _ := sess.StdinPipe()
+	defer stdin.Close()
+
+	if err := sess.Start("git-upload-pack 'test.git'"); err != nil {
+		t.Fatal(err)
+	}
+
+	var info SessionInfo
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if sessions := s.Sessions(); len(sessions) == 1 && sessions[0].Operation != "" {
+			info = sessions[0]
+			break
+		}
+	}
+
+	if info.Repo != "test" || info.Operation != "upload-pack" || info.Command != "git-upload-pack 'test.git'" {
+		t.Fatalf("unexpected session %+v", info)
+	}
+
+	if info.RemoteAddr != client.LocalAddr().String() {
+		t.Errorf("expected session from %s, received %s", client.LocalAddr(), info.RemoteAddr)
+	}
+
+	if err := s.KillSession("no-such-session"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, received %v", err)
+	}
+
+	if err := s.KillSession(info.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the session's connection to be closed")
+	}
+}
+
+// querySigner offers a key it cannot sign with, as a client holding only
+// someone else's public key would, staying in authentication until release
+// is closed
+type querySigner struct {
+	ssh.Signer
+	release chan struct{}
+}
+
+func (q querySigner) Sign(io.Reader, []byte) (*ssh.Signature, error) {
+	<-q.release
+
+	return nil, errors.New("no private key")
+}
+
+func TestSSH_MaxSessionsPerKey(t *testing.T) {
+	alice, bob := testClientSigner(t), testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(alice.PublicKey()): {Id: "alice"},
+		ssh.FingerprintSHA256(bob.PublicKey()):   {Id: "bob"},
+	}, func(s *SSH) {
+		s.config.MaxSessionsPerKey = 1
+	})
+
+	// Connections over the limit complete the handshake, then are closed
+	// before any session opens
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		client, err := testKeyDial(s, signer)
+		if err != nil {
+			return nil, err
+		}
+
+		sess, err := client.NewSession()
+		if err != nil {
+			client.Close()
+
+			return nil, err
+		}
+
+		sess.Close()
+
+		return client, nil
+	}
+
+	// Offering alice's key without signing holds no slot, however long
+	// the connection stays in authentication
+	release := make(chan struct{})
+	defer close(release)
+
+	go testKeyDial(s, querySigner{alice, release})
+
+	time.Sleep(100 * time.Millisecond)
+
+	first, err := dial(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dial(alice); err == nil {
+		t.Error("expected a second session for the same key to be refused")
+	}
+
+	other, err := dial(bob)
+	if err != nil {
+		t.Fatalf("expected other keys to connect: %v", err)
+	}
+	other.Close()
+
+	first.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		client, err := dial(alice)
+		if err == nil {
+			client.Close()
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the key to connect once its session closed: %v", err)
+		}
+	}
+}
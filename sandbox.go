@@ -0,0 +1,59 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// CommandSandbox confines the git processes run for clients' commands,
+// and so the hooks git runs, such as to keep a compromised hook from
+// reading the rest of the host. Sandbox is called with each command once
+// it is built, and before it is started; it may change the command's
+// SysProcAttr, or its Path and Args to run git through a wrapper.
+type CommandSandbox interface {
+	Sandbox(ctx context.Context, cmd *exec.Cmd) error
+}
+
+// ProcessSandbox is a CommandSandbox using the kernel's own isolation:
+// switching user, changing root directory and, on Linux, starting git in
+// new namespaces
+type ProcessSandbox struct {
+	// User is the account git runs as, in place of any given by
+	// Config.SystemUsers. Requires the server to run as root.
+	User string
+
+	// Chroot is the directory git sees as its root. git, everything it
+	// loads, and the repositories must be found within it at the paths the
+	// server uses, such as by bind mounting them. Requires the server to
+	// run as root, or Unshare to hold syscall.CLONE_NEWUSER.
+	Chroot string
+
+	// Unshare holds the syscall.CLONE_NEW* namespaces, such as
+	// CLONE_NEWNS, CLONE_NEWPID and CLONE_NEWNET, git starts in. With
+	// CLONE_NEWUSER and no User, the server's own uid and gid are mapped
+	// into the new user namespace. Only supported on Linux.
+	Unshare uintptr
+}
+
+func (p *ProcessSandbox) Sandbox(_ context.Context, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	if p.User != "" {
+		cred, err := lookupCredential(p.User)
+		if err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	if p.Chroot != "" {
+		cmd.SysProcAttr.Chroot = p.Chroot
+	}
+
+	return p.unshare(cmd.SysProcAttr)
+}
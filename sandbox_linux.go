@@ -0,0 +1,21 @@
+package gitkit
+
+import (
+	"os"
+	"syscall"
+)
+
+func (p *ProcessSandbox) unshare(attr *syscall.SysProcAttr) error {
+	if p.Unshare == 0 {
+		return nil
+	}
+
+	attr.Cloneflags |= p.Unshare
+
+	if p.Unshare&syscall.CLONE_NEWUSER != 0 && attr.Credential == nil && len(attr.UidMappings) == 0 {
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessSandbox_Unshare(t *testing.T) {
+	cmd := exec.Command("git")
+	assert.NoError(t, (&ProcessSandbox{Unshare: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS}).Sandbox(context.Background(), cmd))
+
+	assert.Equal(t, uintptr(syscall.CLONE_NEWUSER|syscall.CLONE_NEWNS), cmd.SysProcAttr.Cloneflags)
+	assert.Equal(t, []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}, cmd.SysProcAttr.UidMappings)
+}
+
+func TestSSH_Sandbox_Hooks(t *testing.T) {
+	sandbox := &ProcessSandbox{Unshare: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID}
+
+	probe := exec.Command("true")
+	if err := sandbox.Sandbox(context.Background(), probe); err != nil || probe.Run() != nil {
+		t.Skip("namespaces are not available")
+	}
+
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.Sandbox = sandbox
+	})
+
+	repo := filepath.Join(s.config.Dir, "test")
+	if err := initRepo(repo, s.config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook records the user namespace git ran it in
+	nsFile := filepath.Join(t.TempDir(), "ns")
+	hook := "#!/bin/sh\ncat >/dev/null\nreadlink /proc/self/ns/user > " + nsFile + "\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	host, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hookNS, err := os.ReadFile(nsFile)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, host, strings.TrimSpace(string(hookNS)))
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package gitkit
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (p *ProcessSandbox) unshare(_ *syscall.SysProcAttr) error {
+	if p.Unshare != 0 {
+		return errors.New("sandbox: namespaces are only supported on Linux")
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSandbox struct {
+	err error
+}
+
+// Sandbox runs git through env, as wrappers such as bwrap or firejail are
+func (s testSandbox) Sandbox(_ context.Context, cmd *exec.Cmd) error {
+	cmd.Path = "/usr/bin/env"
+	cmd.Args = append([]string{"env", "-u", "SECRET"}, cmd.Args...)
+
+	return s.err
+}
+
+func TestSSH_gitCommand_Sandbox(t *testing.T) {
+	ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "alice"})
+
+	s := testSystemUserSSH(SystemUsersOff)
+	s.Sandbox = testSandbox{}
+
+	cmd, err := s.gitCommand(ctx, []string{"GITKIT_KEY=alice"}, "upload-pack", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"env", "-u", "SECRET", "git", "upload-pack", "repo"}, cmd.Args)
+	assert.Contains(t, cmd.Env, "GITKIT_KEY=alice")
+
+	s.Sandbox = testSandbox{err: errors.New("no sandbox for you")}
+
+	_, err = s.gitCommand(ctx, nil, "upload-pack", "repo")
+	assert.Error(t, err)
+}
+
+func TestProcessSandbox(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	cmd := exec.Command("git", "upload-pack", "repo")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	assert.NoError(t, (&ProcessSandbox{User: "nobody", Chroot: "/srv/jail"}).Sandbox(context.Background(), cmd))
+
+	// Attributes set before the sandbox are kept
+	assert.True(t, cmd.SysProcAttr.Setpgid)
+	assert.Equal(t, "/srv/jail", cmd.SysProcAttr.Chroot)
+
+	if assert.NotNil(t, cmd.SysProcAttr.Credential) {
+		assert.Equal(t, nobody.Uid, strconv.Itoa(int(cmd.SysProcAttr.Credential.Uid)))
+	}
+
+	assert.Error(t, (&ProcessSandbox{User: "no-such-user-here"}).Sandbox(context.Background(), exec.Command("git")))
+}
@@ -0,0 +1,61 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RegisterFinaliser adds f to the funcs RunUntilSignal calls once
+// connections have drained, such as to flush a Store or close a database.
+// Finalisers run in the reverse of the order they were registered, as
+// deferred calls do.
+func (s *SSH) RegisterFinaliser(f func(ctx context.Context) error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	s.state.finalisers = append(s.state.finalisers, f)
+}
+
+// RunUntilSignal is Run, stopping on SIGINT or SIGTERM as well as when ctx
+// is cancelled, and then calling the registered finalisers. A second signal
+// while connections drain is left to its default behaviour, so that an
+// operator may still kill the process.
+func (s *SSH) RunUntilSignal(ctx context.Context, binds ...string) (*RunReport, error) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	report, err := s.Run(ctx, binds...)
+
+	return report, errors.Join(err, s.finalise())
+}
+
+// finalise calls the registered finalisers, allowing them
+// Config.ShutdownTimeout between them
+func (s *SSH) finalise() error {
+	s.state.mu.Lock()
+	finalisers := s.state.finalisers
+	s.state.mu.Unlock()
+
+	timeout := s.config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := []error{}
+	for i := len(finalisers) - 1; i >= 0; i-- {
+		errs = append(errs, finalisers[i](ctx))
+	}
+
+	return errors.Join(errs...)
+}
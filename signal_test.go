@@ -0,0 +1,65 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSSH_RunUntilSignal(t *testing.T) {
+	s := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), AutoCreate: true})
+
+	finalised := []string{}
+	s.RegisterFinaliser(func(context.Context) error {
+		finalised = append(finalised, "first")
+		return nil
+	})
+	s.RegisterFinaliser(func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected finalisers to be given a deadline")
+		}
+
+		finalised = append(finalised, "second")
+		return errors.New("flush failed")
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := s.RunUntilSignal(context.Background(), "127.0.0.1:0")
+		done <- err
+	}()
+
+	for s.Address() == "" {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if out, err := testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git")); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Skipf("unable to signal self: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "flush failed" {
+			t.Errorf("expected the finaliser's error, received %v", err)
+		}
+
+		if len(finalised) != 2 || finalised[0] != "second" || finalised[1] != "first" {
+			t.Errorf("expected finalisers to run in reverse order, received %q", finalised)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunUntilSignal did not return after SIGTERM")
+	}
+}
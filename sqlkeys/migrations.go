@@ -0,0 +1,83 @@
+package sqlkeys
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrations create and evolve the schema, in order. Each is applied once,
+// within a transaction, and never edited after release; change the schema
+// by appending another.
+var migrations = []string{
+	`CREATE TABLE users (
+		name          TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL DEFAULT '',
+		created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE keys (
+		fingerprint TEXT PRIMARY KEY,
+		user_name   TEXT NOT NULL REFERENCES users (name),
+		payload     TEXT NOT NULL,
+		expires_at  TIMESTAMP NULL,
+		created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX keys_user_name ON keys (user_name);
+
+	CREATE TABLE repos (
+		name       TEXT PRIMARY KEY,
+		public     BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE permissions (
+		user_name TEXT NOT NULL REFERENCES users (name),
+		repo_name TEXT NOT NULL REFERENCES repos (name),
+		access    TEXT NOT NULL CHECK (access IN ('read', 'write')),
+		PRIMARY KEY (user_name, repo_name)
+	);`,
+
+	`ALTER TABLE keys ADD COLUMN last_used_at TIMESTAMP NULL;
+	ALTER TABLE keys ADD COLUMN last_used_ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE keys ADD COLUMN use_count INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// Migrate applies any migrations the database has not yet seen
+func (s *Store) Migrate(ctx context.Context) error {
+	if err := s.exec(ctx, "CREATE TABLE IF NOT EXISTS gitkit_schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("sqlkeys: migrate: %w", err)
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM gitkit_schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("sqlkeys: migrate: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		if err := s.migrate(ctx, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("sqlkeys: migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// migrate applies a single migration, recording it as version
+func (s *Store) migrate(ctx context.Context, version int, migration string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, s.rebind("INSERT INTO gitkit_schema_migrations (version) VALUES (?)"), version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,315 @@
+// Package sqlkeys keeps gitkit users, their keys and their repository
+// permissions in a SQLite or Postgres database, for servers which want
+// persistence without writing a backend of their own:
+//
+//	db, err := sql.Open("sqlite", "/var/lib/git/users.db")
+//	if err != nil {
+//		return err
+//	}
+//
+//	store := sqlkeys.New(db, sqlkeys.SQLite)
+//	if err := store.Migrate(ctx); err != nil {
+//		return err
+//	}
+//
+//	store.Wire(server)
+//
+// No driver is imported; the caller links whichever it prefers, such as
+// modernc.org/sqlite or github.com/lib/pq. Migrate creates the users, keys,
+// repos and permissions tables, recording applied migrations in
+// gitkit_schema_migrations so that it is safe to call on every start.
+//
+// Users are named by their users row, which becomes the gitkit.PublicKey's
+// Id and Name. Repositories are readable by users granted Read or Write on
+// them, or by anyone when marked public, and writable by users granted
+// Write. Repositories with no repos row are refused.
+//
+// Each use of a key is recorded against it, as gitkit.KeyUsageRecorder, so
+// that StaleKeys can find keys nobody has used in a while.
+package sqlkeys
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jspc/gitkit"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrUnknownKey   = errors.New("sqlkeys: unknown key")
+	ErrBadPassword  = errors.New("sqlkeys: unknown user or wrong password")
+	ErrAccessDenied = errors.New("sqlkeys: access denied")
+	ErrBadAccess    = errors.New("sqlkeys: access must be read or write")
+)
+
+// Dialect is the flavour of SQL a database speaks
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// Access is a user's level of access to a repository
+type Access string
+
+const (
+	Read  Access = "read"
+	Write Access = "write"
+)
+
+// Store is a database of users, keys and permissions
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// New returns a Store using db, which speaks dialect
+func New(db *sql.DB, dialect Dialect) *Store {
+	return &Store{db: db, dialect: dialect}
+}
+
+// Wire installs the store's callbacks on server
+func (s *Store) Wire(server *gitkit.SSH) {
+	server.PublicKeyLookupFunc = s.PublicKeyLookup
+	server.AuthoriseOperationFunc = s.AuthoriseOperation
+	server.KeyUsageRecorder = s
+}
+
+// rebind rewrites query's ? placeholders for the store's dialect
+func (s *Store) rebind(query string) string {
+	if s.dialect != Postgres {
+		return query
+	}
+
+	var (
+		out strings.Builder
+		n   int
+	)
+
+	for _, r := range query {
+		if r != '?' {
+			out.WriteRune(r)
+			continue
+		}
+
+		n++
+		out.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return out.String()
+}
+
+func (s *Store) exec(ctx context.Context, query string, args ...any) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+
+	return err
+}
+
+// AddUser creates a user. password may be empty for users who only
+// authenticate with keys; otherwise its bcrypt hash is stored for
+// BasicAuth.
+func (s *Store) AddUser(ctx context.Context, name, password string) error {
+	var hash []byte
+
+	if password != "" {
+		var err error
+
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.exec(ctx, "INSERT INTO users (name, password_hash) VALUES (?, ?)", name, string(hash))
+}
+
+// RemoveUser deletes a user along with their keys and permissions
+func (s *Store) RemoveUser(ctx context.Context, name string) error {
+	for _, query := range []string{
+		"DELETE FROM permissions WHERE user_name = ?",
+		"DELETE FROM keys WHERE user_name = ?",
+		"DELETE FROM users WHERE name = ?",
+	} {
+		if err := s.exec(ctx, query, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddKey allows user to authenticate with key until expires, or forever
+// when expires is zero
+func (s *Store) AddKey(ctx context.Context, user string, key ssh.PublicKey, expires time.Time) error {
+	var expiresAt sql.NullTime
+	if !expires.IsZero() {
+		expiresAt = sql.NullTime{Time: expires, Valid: true}
+	}
+
+	return s.exec(ctx, "INSERT INTO keys (fingerprint, user_name, payload, expires_at) VALUES (?, ?, ?, ?)",
+		ssh.FingerprintSHA256(key), user, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), expiresAt)
+}
+
+// RemoveKey deletes the key with the given SHA256 fingerprint
+func (s *Store) RemoveKey(ctx context.Context, fingerprint string) error {
+	return s.exec(ctx, "DELETE FROM keys WHERE fingerprint = ?", fingerprint)
+}
+
+// AddRepo records a repository, readable by anyone when public
+func (s *Store) AddRepo(ctx context.Context, name string, public bool) error {
+	return s.exec(ctx, "INSERT INTO repos (name, public) VALUES (?, ?)", name, public)
+}
+
+// Grant gives user access to repo, replacing any they had
+func (s *Store) Grant(ctx context.Context, user, repo string, access Access) error {
+	if access != Read && access != Write {
+		return ErrBadAccess
+	}
+
+	if err := s.Revoke(ctx, user, repo); err != nil {
+		return err
+	}
+
+	return s.exec(ctx, "INSERT INTO permissions (user_name, repo_name, access) VALUES (?, ?, ?)", user, repo, string(access))
+}
+
+// Revoke removes user's access to repo
+func (s *Store) Revoke(ctx context.Context, user, repo string) error {
+	return s.exec(ctx, "DELETE FROM permissions WHERE user_name = ? AND repo_name = ?", user, repo)
+}
+
+// PublicKeyLookup identifies the user owning key
+func (s *Store) PublicKeyLookup(ctx context.Context, key gitkit.PublicKeyLookup) (*gitkit.PublicKey, error) {
+	var (
+		user      string
+		payload   string
+		expiresAt sql.NullTime
+	)
+
+	err := s.db.QueryRowContext(ctx, s.rebind("SELECT user_name, payload, expires_at FROM keys WHERE fingerprint = ?"), key.Fingerprint).
+		Scan(&user, &payload, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownKey
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("sqlkeys: key lookup: %w", err)
+	}
+
+	return &gitkit.PublicKey{
+		Id:          user,
+		Name:        user,
+		Fingerprint: key.Fingerprint,
+		Content:     payload,
+		ExpiresAt:   expiresAt.Time,
+	}, nil
+}
+
+// RecordKeyUsage notes when and from where a key was last used, and counts
+// its uses
+func (s *Store) RecordKeyUsage(ctx context.Context, usage gitkit.KeyUsage) error {
+	return s.exec(ctx, "UPDATE keys SET last_used_at = ?, last_used_ip = ?, use_count = use_count + 1 WHERE fingerprint = ?",
+		usage.Time, usage.RemoteIP, usage.PublicKey.Fingerprint)
+}
+
+// KeyUsage describes when a key was last used
+type KeyUsage struct {
+	Fingerprint string
+	User        string
+	LastUsedAt  time.Time // Zero for keys never used
+	LastUsedIP  string
+	UseCount    int
+}
+
+// StaleKeys lists keys unused since before, including those never used
+// and added before it, so that they may be removed
+func (s *Store) StaleKeys(ctx context.Context, before time.Time) ([]KeyUsage, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT fingerprint, user_name, last_used_at, last_used_ip, use_count
+		FROM keys
+		WHERE (last_used_at IS NULL AND created_at < ?) OR last_used_at < ?
+		ORDER BY fingerprint`), before, before)
+	if err != nil {
+		return nil, fmt.Errorf("sqlkeys: stale keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []KeyUsage
+
+	for rows.Next() {
+		var (
+			k        KeyUsage
+			lastUsed sql.NullTime
+		)
+
+		if err := rows.Scan(&k.Fingerprint, &k.User, &lastUsed, &k.LastUsedIP, &k.UseCount); err != nil {
+			return nil, fmt.Errorf("sqlkeys: stale keys: %w", err)
+		}
+
+		k.LastUsedAt = lastUsed.Time
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// BasicAuth checks an HTTP user's password, for use as a gitkit.Server's
+// BasicAuthFunc
+func (s *Store) BasicAuth(ctx context.Context, user, pass string) (*gitkit.PublicKey, error) {
+	var hash string
+
+	err := s.db.QueryRowContext(ctx, s.rebind("SELECT password_hash FROM users WHERE name = ?"), user).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBadPassword
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("sqlkeys: user lookup: %w", err)
+	}
+
+	if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return nil, ErrBadPassword
+	}
+
+	return &gitkit.PublicKey{Id: user, Name: user}, nil
+}
+
+// AuthoriseOperation allows reads of public repositories and of those the
+// user has been granted access to, and pushes by users granted Write
+func (s *Store) AuthoriseOperation(ctx context.Context, cmd *gitkit.GitCommand) error {
+	pk, _ := ctx.Value(gitkit.PublicKeyContextKey{}).(gitkit.PublicKey)
+
+	var (
+		public bool
+		access string
+	)
+
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT r.public, COALESCE(p.access, '')
+		FROM repos r LEFT JOIN permissions p ON p.repo_name = r.name AND p.user_name = ?
+		WHERE r.name = ?`), pk.Name, cmd.Repo).Scan(&public, &access)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAccessDenied
+	}
+
+	if err != nil {
+		return fmt.Errorf("sqlkeys: permission lookup: %w", err)
+	}
+
+	allowed := public || access != ""
+	if cmd.IsWrite() {
+		allowed = Access(access) == Write
+	}
+
+	if !allowed {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package sqlkeys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jspc/gitkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// testDriver is a database/sql driver which records the statements it is
+// given and answers queries with whatever rows returns
+type testDriver struct {
+	mu    sync.Mutex
+	execs []string
+	args  [][]driver.Value
+	rows  func(query string, args []driver.Value) [][]driver.Value
+}
+
+func (d *testDriver) Open(string) (driver.Conn, error) { return testConn{d}, nil }
+
+type testConn struct{ d *testDriver }
+
+func (c testConn) Prepare(query string) (driver.Stmt, error) { return testStmt{c.d, query}, nil }
+func (c testConn) Close() error                              { return nil }
+func (c testConn) Begin() (driver.Tx, error)                 { return testTx{}, nil }
+
+type testTx struct{}
+
+func (testTx) Commit() error   { return nil }
+func (testTx) Rollback() error { return nil }
+
+type testStmt struct {
+	d     *testDriver
+	query string
+}
+
+func (s testStmt) Close() error  { return nil }
+func (s testStmt) NumInput() int { return -1 }
+
+func (s testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	s.d.execs = append(s.d.execs, s.query)
+	s.d.args = append(s.d.args, args)
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	var rows [][]driver.Value
+	if s.d.rows != nil {
+		rows = s.d.rows(s.query, args)
+	}
+
+	return &testRows{rows: rows}, nil
+}
+
+type testRows struct{ rows [][]driver.Value }
+
+func (r *testRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"a", "b", "c"}
+	}
+
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *testRows) Close() error { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+
+	return nil
+}
+
+var testDriverN int
+
+func testStore(t *testing.T, dialect Dialect, rows func(string, []driver.Value) [][]driver.Value) (*Store, *testDriver) {
+	t.Helper()
+
+	d := &testDriver{rows: rows}
+
+	testDriverN++
+	name := "sqlkeys-test-" + strconv.Itoa(testDriverN)
+	sql.Register(name, d)
+
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return New(db, dialect), d
+}
+
+func testKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func userContext(name string) context.Context {
+	return context.WithValue(context.Background(), gitkit.PublicKeyContextKey{}, gitkit.PublicKey{Name: name})
+}
+
+func TestStore_rebind(t *testing.T) {
+	query := "SELECT a FROM b WHERE c = ? AND d = ?"
+
+	assert.Equal(t, query, New(nil, SQLite).rebind(query))
+	assert.Equal(t, "SELECT a FROM b WHERE c = $1 AND d = $2", New(nil, Postgres).rebind(query))
+}
+
+func TestStore_Migrate(t *testing.T) {
+	version := int64(0)
+
+	s, d := testStore(t, SQLite, func(query string, _ []driver.Value) [][]driver.Value {
+		if strings.Contains(query, "MAX(version)") {
+			return [][]driver.Value{{version}}
+		}
+
+		return nil
+	})
+
+	ctx := context.Background()
+	if !assert.NoError(t, s.Migrate(ctx)) {
+		return
+	}
+
+	// Each migration is applied and then recorded
+	if assert.Len(t, d.execs, 1+2*len(migrations)) {
+		assert.Contains(t, d.execs[0], "gitkit_schema_migrations")
+		assert.Contains(t, d.execs[1], "CREATE TABLE users")
+		assert.Equal(t, []driver.Value{int64(len(migrations))}, d.args[len(d.args)-1])
+	}
+
+	// Applied migrations are not run again
+	version = int64(len(migrations))
+	d.execs = nil
+
+	assert.NoError(t, s.Migrate(ctx))
+	assert.Len(t, d.execs, 1)
+}
+
+func TestStore_PublicKeyLookup(t *testing.T) {
+	key := testKey(t)
+	fingerprint := ssh.FingerprintSHA256(key)
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, _ := testStore(t, Postgres, func(query string, args []driver.Value) [][]driver.Value {
+		if strings.Contains(query, "$1") && args[0] == fingerprint {
+			return [][]driver.Value{{"alice", "ssh-ed25519 AAAA", expires}}
+		}
+
+		return nil
+	})
+
+	pk, err := s.PublicKeyLookup(context.Background(), gitkit.PublicKeyLookup{Fingerprint: fingerprint})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", pk.Id)
+		assert.Equal(t, "alice", pk.Name)
+		assert.Equal(t, fingerprint, pk.Fingerprint)
+		assert.Equal(t, "ssh-ed25519 AAAA", pk.Content)
+		assert.Equal(t, expires, pk.ExpiresAt)
+	}
+
+	_, err = s.PublicKeyLookup(context.Background(), gitkit.PublicKeyLookup{Fingerprint: ssh.FingerprintSHA256(testKey(t))})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestStore_BasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := testStore(t, SQLite, func(_ string, args []driver.Value) [][]driver.Value {
+		switch args[0] {
+		case "alice":
+			return [][]driver.Value{{string(hash)}}
+
+		case "keys-only":
+			return [][]driver.Value{{""}}
+		}
+
+		return nil
+	})
+
+	ctx := context.Background()
+
+	pk, err := s.BasicAuth(ctx, "alice", "secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", pk.Name)
+	}
+
+	for _, user := range []string{"alice", "keys-only", "mallory"} {
+		_, err = s.BasicAuth(ctx, user, "wrong")
+		assert.ErrorIs(t, err, ErrBadPassword, user)
+	}
+}
+
+func TestStore_AuthoriseOperation(t *testing.T) {
+	grants := map[string]string{"alice": "write", "bob": "read"}
+
+	s, _ := testStore(t, SQLite, func(_ string, args []driver.Value) [][]driver.Value {
+		switch args[1] {
+		case "private":
+			return [][]driver.Value{{false, grants[args[0].(string)]}}
+
+		case "public":
+			return [][]driver.Value{{true, grants[args[0].(string)]}}
+		}
+
+		return nil
+	})
+
+	fetch := func(repo string) *gitkit.GitCommand {
+		return &gitkit.GitCommand{Command: "git-upload-pack", Repo: repo}
+	}
+	push := func(repo string) *gitkit.GitCommand {
+		return &gitkit.GitCommand{Command: "git-receive-pack", Repo: repo}
+	}
+
+	for _, c := range []struct {
+		user    string
+		cmd     *gitkit.GitCommand
+		allowed bool
+	}{
+		{"alice", fetch("private"), true},
+		{"alice", push("private"), true},
+		{"bob", fetch("private"), true},
+		{"bob", push("private"), false},
+		{"carol", fetch("private"), false},
+		{"carol", fetch("public"), true},
+		{"carol", push("public"), false},
+		{"", fetch("public"), true},
+		{"alice", fetch("unknown"), false},
+	} {
+		err := s.AuthoriseOperation(userContext(c.user), c.cmd)
+		if c.allowed {
+			assert.NoError(t, err, "%s %s %s", c.user, c.cmd.Command, c.cmd.Repo)
+		} else {
+			assert.ErrorIs(t, err, ErrAccessDenied, "%s %s %s", c.user, c.cmd.Command, c.cmd.Repo)
+		}
+	}
+}
+
+func TestStore_Writes(t *testing.T) {
+	s, d := testStore(t, SQLite, nil)
+	ctx := context.Background()
+	key := testKey(t)
+
+	assert.NoError(t, s.AddUser(ctx, "alice", "secret"))
+	assert.NoError(t, s.AddKey(ctx, "alice", key, time.Time{}))
+	assert.NoError(t, s.AddRepo(ctx, "project", false))
+	assert.NoError(t, s.Grant(ctx, "alice", "project", Write))
+	assert.ErrorIs(t, s.Grant(ctx, "alice", "project", "admin"), ErrBadAccess)
+
+	if !assert.Len(t, d.args, 5) {
+		return
+	}
+
+	// Passwords are stored hashed
+	assert.Equal(t, "alice", d.args[0][0])
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(d.args[0][1].(string)), []byte("secret")))
+
+	assert.Equal(t, ssh.FingerprintSHA256(key), d.args[1][0])
+	assert.Nil(t, d.args[1][3])
+
+	// Grants replace existing access
+	assert.Contains(t, d.execs[3], "DELETE FROM permissions")
+	assert.Equal(t, []driver.Value{"alice", "project", "write"}, d.args[4])
+}
+
+func TestStore_RecordKeyUsage(t *testing.T) {
+	s, d := testStore(t, Postgres, nil)
+	now := time.Now()
+
+	assert.NoError(t, s.RecordKeyUsage(context.Background(), gitkit.KeyUsage{
+		PublicKey: gitkit.PublicKey{Fingerprint: "SHA256:alice"},
+		Time:      now,
+		RemoteIP:  "192.0.2.1",
+	}))
+
+	if assert.Len(t, d.execs, 1) {
+		assert.Contains(t, d.execs[0], "use_count = use_count + 1 WHERE fingerprint = $3")
+		assert.Equal(t, []driver.Value{now, "192.0.2.1", "SHA256:alice"}, d.args[0])
+	}
+}
+
+func TestStore_StaleKeys(t *testing.T) {
+	used := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, _ := testStore(t, SQLite, func(string, []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{"SHA256:alice", "alice", used, "192.0.2.1", int64(3)},
+			{"SHA256:bob", "bob", nil, "", int64(0)},
+		}
+	})
+
+	keys, err := s.StaleKeys(context.Background(), time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []KeyUsage{
+			{Fingerprint: "SHA256:alice", User: "alice", LastUsedAt: used, LastUsedIP: "192.0.2.1", UseCount: 3},
+			{Fingerprint: "SHA256:bob", User: "bob"},
+		}, keys)
+	}
+}
@@ -13,10 +13,14 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -24,6 +28,7 @@ var (
 	ErrAlreadyStarted = errors.New("server has already been started")
 	ErrNoListener     = errors.New("cannot call Serve() before Listen()")
 	ErrIncorrectUser  = errors.New("unrecognised/ invalid user")
+	ErrReadOnly       = errors.New("server is in read-only mode")
 )
 
 type PublicKey struct {
@@ -31,35 +36,330 @@ type PublicKey struct {
 	Name        string
 	Fingerprint string
 	Content     string
+	Locale      string    // Preferred locale for messages, used when the client sends no LANG
+	ExpiresAt   time.Time // When the key stops being accepted; zero keys never expire
+
+	// Metadata holds whatever PublicKeyLookupFunc attaches to the key, such
+	// as roles or an organisation ID, and is passed on to later callbacks
+	// untouched
+	Metadata any
+}
+
+// PublicKeyLookup describes the key a client is attempting to authenticate
+// with, as passed to PublicKeyLookupFunc
+type PublicKeyLookup struct {
+	Payload     string        // Key in authorized_keys format
+	Fingerprint string        // SHA256 fingerprint, in the form produced by ssh-keygen -l
+	Type        string        // Key algorithm, such as ssh-ed25519
+	Key         ssh.PublicKey // Parsed key
+}
+
+func newPublicKeyLookup(key ssh.PublicKey) PublicKeyLookup {
+	return PublicKeyLookup{
+		Payload:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Type:        key.Type(),
+		Key:         key,
+	}
 }
 
 type PublicKeyContextKey struct{}
 type UserContextKey struct{}
+type RemoteAddrContextKey struct{}
 
 const (
-	keyID   = "key-id"
-	keyName = "key-name"
-	sshUser = "ssh-user"
+	keyID          = "key-id"
+	keyName        = "key-name"
+	keyFingerprint = "key-fingerprint"
+	keyLocale      = "key-locale"
+	sshUser        = "ssh-user"
 )
 
 type SSH struct {
-	listener net.Listener
-
-	sshconfig *ssh.ServerConfig
-	config    *Config
-
-	PublicKeyLookupFunc    func(ctx context.Context, publicKeyPayload string) (*PublicKey, error)
+	sshconfig    *ssh.ServerConfig
+	config       *Config
+	hostSigners  []ssh.Signer
+	routes       *RouteTable
+	packCache    *packCache
+	hostKeys     *hostKeyRing
+	live         *liveConfig
+	routesErr    error
+	state        *serverState
+	events       *eventBus
+	maintenance  *maintenanceLocks
+	locks        *repoLocks
+	mirrors      *mirrors
+	failures     *authFailures
+	webhooks     *WebhookDispatcher
+	keyAuth      bool // sshconfig authenticates with PublicKeyLookupFunc
+	tokenAuth    bool // sshconfig authenticates with UsernameTokenFunc
+	pushCertSeed string
+
+	PublicKeyLookupFunc    func(ctx context.Context, key PublicKeyLookup) (*PublicKey, error)
 	PreLoginFunc           func(ctx context.Context, metadata ssh.ConnMetadata) error
 	AuthoriseOperationFunc func(ctx context.Context, cmd *GitCommand) error
+	ListReposFunc          func(ctx context.Context) ([]string, error)
+	ResolveRepoFunc        func(ctx context.Context, repo string) (path string, err error)
+	EventFunc              func(ctx context.Context, e Event)
+
+	// Store persists operational state shared by server subsystems. It
+	// defaults to a MemoryStore.
+	Store Store
+
+	// TracerProvider records spans for each connection's handshake, key
+	// lookup and commands, and for the git processes they run. The global
+	// TracerProvider is used when nil.
+	TracerProvider trace.TracerProvider
+
+	// SubsystemHandlers serve ssh subsystem requests, keyed by subsystem
+	// name, so that (for instance) sftp can share the git port. Requests for
+	// subsystems without a handler are refused.
+	SubsystemHandlers map[string]func(ctx context.Context, ch ssh.Channel, req *ssh.Request)
+
+	// AuthorisePushFunc is called for pushes once the client has said which
+	// refs it is updating, and with which push options, but before any
+	// objects are received. Returning an error rejects the whole push, a
+	// ClientError choosing the reason the client is given. Not supported
+	// with Config.InMemory.
+	AuthorisePushFunc func(ctx context.Context, cmd *GitCommand, push *PushRequest) error
+
+	// AuthoriseRefUpdateFunc is called for each ref a push updates, before
+	// AuthorisePushFunc, with whether the update creates, deletes, fast
+	// forwards or rewinds the ref, so that keys can be given different
+	// rights to destructive changes. An error rejects the whole push.
+	// Updates are told apart once the push's objects have been received,
+	// into a quarantine they only leave if the push is allowed. Not
+	// supported with Config.InMemory.
+	AuthoriseRefUpdateFunc func(ctx context.Context, cmd *GitCommand, u RefUpdate, op string) error
+
+	// ValidateRepoNameFunc replaces the checks made by Config.RepoNames.
+	// Names are always rejected if they are absolute or contain "..".
+	ValidateRepoNameFunc func(ctx context.Context, name string) error
+
+	// AutoCreateAuthoriseFunc, when set, is called before AutoCreate
+	// initialises a missing repository. Returning an error prevents creation.
+	AutoCreateAuthoriseFunc func(ctx context.Context, cmd *GitCommand) error
+
+	// TemplateFunc chooses the template AutoCreate seeds a repository
+	// from, in place of Config.RepoTemplate. Returning nil creates an empty
+	// repository.
+	TemplateFunc func(ctx context.Context, cmd *GitCommand) (*RepoTemplate, error)
+
+	// RepoCreatedFunc, when set, is called once AutoCreate has initialised
+	// a repository, before the push creating it is served, with the key of
+	// the client pushing, so that inventory systems learn of it at once.
+	// EventRepoCreated is emitted alongside it.
+	RepoCreatedFunc func(ctx context.Context, repo string, pk PublicKey)
+
+	// BandwidthFunc returns the transfer rate limits for connections
+	// authenticated with a key, in place of Config.Bandwidth
+	BandwidthFunc func(ctx context.Context, pk PublicKey) BandwidthLimits
+
+	// BlobLimitFunc returns the largest blob clients authenticated with pk
+	// may fetch, in place of UploadPackOptions.MaxBlobSize, such as to lift
+	// the limit for trusted keys by returning zero. pk is empty for clients
+	// which did not authenticate.
+	BlobLimitFunc func(ctx context.Context, pk PublicKey) int64
+
+	// RecordSink, when set, receives transcripts of git sessions; see
+	// Transcript. RecordFunc chooses which sessions to record, such as
+	// those for a single repository or key, and when nil all are.
+	RecordSink RecordSink
+	RecordFunc func(ctx context.Context, cmd *GitCommand) bool
+
+	// VerifyPushCertificateFunc, when set, advertises support for signed
+	// pushes (git push --signed) and is called for every push with its
+	// certificate, or nil when the push is unsigned, before any objects are
+	// received. Returning an error rejects the push, so signing may be
+	// enforced. Checking the signature is left to the callback. Not
+	// supported with Config.InMemory.
+	VerifyPushCertificateFunc func(ctx context.Context, cmd *GitCommand, cert *PushCertificate) error
+
+	// SystemUserFunc maps an authenticated key to the system account git
+	// runs as, when Config.SystemUsers is set, so that repository ownership
+	// can follow filesystem permissions. Returning "" runs git as the
+	// server's own user.
+	SystemUserFunc func(ctx context.Context, pk PublicKey) (string, error)
+
+	// HookEnvFunc adds to the environment git, and so its hooks, run with
+	// for a command, alongside GITKIT_KEY and the other HookEnv variables,
+	// so that hook scripts can enforce policy. It cannot replace those.
+	HookEnvFunc func(ctx context.Context, cmd *GitCommand) map[string]string
+
+	// Sandbox confines the git processes run for clients' commands, and
+	// the hooks they run, such as with a ProcessSandbox
+	Sandbox CommandSandbox
+
+	// Commands serve exec requests for commands other than git, keyed by
+	// command name, so that operators and applications can add their own
+	Commands map[string]CommandFunc
+
+	// AuthoriseAdminFunc enables the built-in admin commands, run as
+	// gitkit <command>, and is called with the command and its arguments
+	// each time one is used. Returning an error refuses the command. When
+	// nil, admin commands are not available.
+	AuthoriseAdminFunc func(ctx context.Context, args []string) error
+
+	// WhoamiFunc, when set, answers interactive shells, and WhoamiCommand,
+	// with a report of who the client authenticated as, like GitHub's
+	// "Hi username!", in place of the banner. The repositories listed are
+	// those it returns, or when their Access is nil, those route Readers
+	// and Writers allow.
+	WhoamiFunc func(ctx context.Context, pk PublicKey) (*Whoami, error)
+
+	// RevocationChecker, when set, is asked whether each key is revoked as
+	// it authenticates and before every command. Revoked keys are refused,
+	// as are keys past their ExpiresAt.
+	RevocationChecker RevocationChecker
+
+	// UsernameTokenFunc authenticates clients by the username they connect
+	// as, so that CI systems can clone from token-<opaque>@host with a
+	// short-lived token in place of a key. It returns the identity the
+	// token stands for, or an error for usernames which are not tokens, in
+	// which case clients go on to offer keys to PublicKeyLookupFunc.
+	// Identities without a Fingerprint are given one from their Id. Once
+	// authenticated, such clients are recorded with TokenUser as their
+	// user, so that the token is kept out of hooks, sessions and events.
+	UsernameTokenFunc func(ctx context.Context, username string) (*PublicKey, error)
+
+	// Repositories holds repositories when Config.InMemory is set. It
+	// defaults to a MemoryRepositoryStore.
+	Repositories RepositoryStore
+
+	// RewriteCommandFunc is called with each git command once it is
+	// parsed, and may return a changed copy: one for another repository,
+	// with extra Args such as --strict, or running a custom Binary. The
+	// rewritten command is the one authorised and run.
+	RewriteCommandFunc func(ctx context.Context, cmd *GitCommand) (*GitCommand, error)
+
+	// UserRepoFunc, when set, maps ~user/repo paths onto repository names,
+	// in place of Config.RepoPaths.HomesDir
+	UserRepoFunc func(ctx context.Context, user, repo string) (string, error)
+
+	// AbsolutePathFunc, when set, maps absolute repository paths onto
+	// repository names, in place of Config.RepoPaths.AbsoluteRoot. It
+	// should refuse paths outside the store.
+	AbsolutePathFunc func(ctx context.Context, path string) (string, error)
+
+	// HideRefsFunc returns refs to hide from the client running cmd, such
+	// as refs/pull/ or refs/keep-around/, which are passed to upload-pack
+	// and receive-pack as uploadpack.hideRefs and receive.hideRefs. Hidden
+	// refs are not advertised, so cannot be fetched by name, nor may they
+	// be pushed to. Their objects are not secret: clients which know an
+	// object's id may still fetch it, as git allows over protocol v2, and
+	// over any protocol with UploadPackOptions.AllowAnySHA1InWant.
+	HideRefsFunc func(ctx context.Context, cmd *GitCommand) []string
+
+	// NamespaceFunc returns the namespace, such as "project-42", cmd runs
+	// in. git sees only the refs under refs/namespaces/<namespace>/, as
+	// GIT_NAMESPACE gives it, so that repositories such as forks can share
+	// one object store while appearing separate. Returning "" serves the
+	// whole repository. Not supported with Config.InMemory.
+	NamespaceFunc func(ctx context.Context, cmd *GitCommand) (string, error)
+
+	// AllowConnFunc is called with the address of each connection, after
+	// Config.DenyCIDRs and Config.AllowCIDRs and before the handshake.
+	// Returning an error closes the connection.
+	AllowConnFunc func(ctx context.Context, addr net.Addr) error
+
+	// BannerCallback returns text, such as a legal notice, shown to each
+	// client before it authenticates. Returning an empty string shows
+	// nothing.
+	BannerCallback func(ctx context.Context, conn ssh.ConnMetadata) string
+
+	// AuthoriseRequestFunc is called after AuthoriseOperationFunc with the
+	// command and the session it was asked for in, such as the client's
+	// key, address and protocol version. Returning an error refuses the
+	// command.
+	AuthoriseRequestFunc func(ctx context.Context, req *OperationRequest) error
+
+	// DirectTCPIPFunc enables direct-tcpip channels, as opened by ssh -L,
+	// so that auxiliary services can be tunnelled over the git port. It is
+	// called with each forward a client asks for; returning an error
+	// refuses it, as are all forwards when it is nil. Allowed forwards are
+	// connected to by the server.
+	DirectTCPIPFunc func(ctx context.Context, fwd DirectTCPIP) error
+
+	// ProgressFunc, when set, is called every Config.ProgressInterval while
+	// git runs for a client, with the bytes sent each way so far, and once
+	// more when git exits, so that in-flight clones and pushes can be
+	// watched. It is called from the transfer's goroutine, so should not
+	// block.
+	ProgressFunc func(ctx context.Context, cmd *GitCommand, stats TransferStats)
+
+	// OperationOutputFunc, when set, is called once for each command a
+	// client runs, before git starts. Output for the client from git and
+	// its hooks, such as progress and messages from pre-receive, is copied
+	// to the writer it returns as it is sent, which is closed once the
+	// command finishes if it is an io.Closer. A nil writer leaves the
+	// command uncaptured.
+	OperationOutputFunc func(ctx context.Context, cmd *GitCommand) io.Writer
+
+	// KeyUsageRecorder, when set, is told each time a key is used to run a
+	// command, with when, from where and what for
+	KeyUsageRecorder KeyUsageRecorder
+
+	// OnAcceptError is called with each error accepting connections, other
+	// than the listener closing on Stop. Serve retries temporary errors,
+	// such as running out of file descriptors, after a backoff of up to
+	// Config.AcceptBackoffMax, and returns on any other.
+	OnAcceptError func(err error)
+
+	// ReloadFunc is called by Reload, and so gitkit reload, to have the
+	// embedding application re-read its configuration, such as routes,
+	// which it may then apply with ReloadConfig
+	ReloadFunc func(ctx context.Context) error
+
+	// UpstreamFunc, when set, makes the server a gateway: commands it
+	// returns an Upstream for are passed on to that server once the client
+	// has been authenticated and authorised, with the Upstream's
+	// credentials, rather than run against a local repository. RefPolicy,
+	// AuthorisePushFunc and other checks of the pushed refs are left to
+	// the upstream. A nil Upstream serves the command locally.
+	UpstreamFunc func(ctx context.Context, cmd *GitCommand) (*Upstream, error)
+
+	// MirrorFunc, when set, makes repositories it returns a Mirror for
+	// read-through caches of their upstreams: the first fetch clones the
+	// upstream, and later ones fetch from it once the Mirror's TTL has
+	// passed, before clients are served locally. Pushes to mirrors are
+	// refused. A nil Mirror serves the repository as usual.
+	MirrorFunc func(ctx context.Context, cmd *GitCommand) (*Mirror, error)
+
+	// Cluster, when set, joins the server to a cluster of nodes sharing a
+	// ClusterRouter, with commands for repositories held elsewhere proxied
+	// to the node holding them
+	Cluster *Cluster
 }
 
 func NewSSH(config Config) *SSH {
-	s := &SSH{config: &config}
+	s := &SSH{
+		config:      &config,
+		routes:      new(RouteTable),
+		state:       newServerState(),
+		events:      new(eventBus),
+		maintenance: new(maintenanceLocks),
+		locks:       new(repoLocks),
+		mirrors:     new(mirrors),
+		failures:    new(authFailures),
+		hostKeys:    new(hostKeyRing),
+		live:        new(liveConfig),
+		Store:       NewMemoryStore(),
+	}
+
+	s.pushCertSeed = config.PushCertSeed
+	if s.pushCertSeed == "" {
+		s.pushCertSeed = newPushCertSeed()
+	}
 
 	// Use PATH if full path is not specified
 	if s.config.GitPath == "" {
 		s.config.GitPath = "git"
 	}
+
+	s.routesErr = s.routes.Set(config.Routes)
+	s.packCache = newPackCache(s, s.config.GitPath)
+	s.packCache.setLimits(config.PackCacheMaxBytes, config.PackCacheMaxPack, config.TmpDir)
+
 	return s
 }
 
@@ -76,20 +376,64 @@ func cleanCommand(cmd string) string {
 	return cmd[i:]
 }
 
-func execCommandBytes(cmdname string, args ...string) ([]byte, []byte, error) {
-	bufOut := new(bytes.Buffer)
-	bufErr := new(bytes.Buffer)
+// session holds state for a single ssh session channel
+type session struct {
+	locale string
+	env    map[string]string // Accepted env requests, passed on to git
+	client *clusterClient    // Set when another node proxies the session's command
+}
+
+// environ returns the session's environment in the form used by exec.Cmd
+func (sess *session) environ() []string {
+	if sess == nil {
+		return nil
+	}
+
+	env := make([]string, 0, len(sess.env))
+	for k, v := range sess.env {
+		env = append(env, k+"="+v)
+	}
+
+	sort.Strings(env)
+
+	return env
+}
+
+// message renders a localised client facing message for the session
+func (s SSH) message(ctx context.Context, sess *session, id string) string {
+	return s.config.Message(s.sessionLocale(ctx, sess), id, s.bannerData(ctx))
+}
+
+// sessionLocale prefers the locale the client sent via LANG, falling back
+// to the preference attached to the authenticated key
+func (s SSH) sessionLocale(ctx context.Context, sess *session) string {
+	if sess != nil && sess.locale != "" {
+		return sess.locale
+	}
 
-	cmd := exec.Command(cmdname, args...)
-	cmd.Stdout = bufOut
-	cmd.Stderr = bufErr
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
 
-	err := cmd.Run()
-	return bufOut.Bytes(), bufErr.Bytes(), err
+	return pk.Locale
 }
 
 func (s *SSH) handleConnection(ctx context.Context, chans <-chan ssh.NewChannel) {
+	// Forwards still connecting are waited for, so that none is accepted
+	// once the connection is done with
+	var forwards sync.WaitGroup
+	defer forwards.Wait()
+
 	for newChan := range chans {
+		if newChan.ChannelType() == "direct-tcpip" {
+			forwards.Add(1)
+			go func(newChan ssh.NewChannel) {
+				defer forwards.Done()
+
+				s.handleDirectTCPIP(ctx, newChan)
+			}(newChan)
+
+			continue
+		}
+
 		if newChan.ChannelType() != "session" {
 			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
@@ -104,22 +448,37 @@ func (s *SSH) handleConnection(ctx context.Context, chans <-chan ssh.NewChannel)
 		go func(in <-chan *ssh.Request) {
 			defer ch.Close()
 
+			sess := new(session)
 			for req := range in {
-				s.handleRequest(ctx, ch, req)
+				s.handleRequest(ctx, sess, ch, req)
 			}
 
 		}(reqs)
 	}
 }
 
-func (s SSH) handleRequest(ctx context.Context, ch ssh.Channel, req *ssh.Request) {
+func (s SSH) handleRequest(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request) {
+	if err := s.checkRequestPayload(ctx, req); err != nil {
+		log.Print(err)
+		req.Reply(false, nil)
+
+		return
+	}
+
 	payload := cleanCommand(string(req.Payload))
 
+	if sess.client != nil {
+		ctx = s.clientContext(ctx, sess.client)
+	}
+
 	switch req.Type {
-	case "env":
-		log.Printf("ssh: incoming env request: %s\n", payload)
+	case clusterClientRequest:
+		if err := s.handleClusterClient(ctx, sess, req); err != nil {
+			log.Print(err)
+		}
 
-		err := s.handleEnvRequest(payload)
+	case "env":
+		err := s.handleEnvRequest(sess, req)
 		if err != nil {
 			log.Print(err)
 		}
@@ -127,17 +486,36 @@ func (s SSH) handleRequest(ctx context.Context, ch ssh.Channel, req *ssh.Request
 	case "exec":
 		log.Printf("ssh: incoming exec request: %s\n", payload)
 
-		err := s.handleExecRequest(ctx, ch, req, payload)
+		s.state.commands.Add(1)
+
+		err := s.handleExecRequest(ctx, sess, ch, req, payload)
 		if err != nil {
 			log.Print(err)
+			s.state.recordError(err)
 		}
 
 		ch.Close()
 
 	case "shell":
-		pk := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+		if s.WhoamiFunc != nil {
+			report, err := s.whoami(ctx, s.sessionLocale(ctx, sess))
+			if err != nil {
+				log.Print(err)
+				s.state.recordError(err)
+				report = s.message(ctx, sess, MsgAccessDenied)
+			}
+
+			ch.Write([]byte(report))
+			ch.Close()
+
+			break
+		}
+
+		data := s.bannerData(ctx)
+		data.Locale = s.sessionLocale(ctx, sess)
+		data.Repos = s.bannerRepos(ctx)
 
-		banner, err := s.config.CompileBanner(pk)
+		banner, err := s.config.CompileBanner(data)
 		if err != nil {
 			log.Print(err)
 		}
@@ -145,316 +523,1380 @@ func (s SSH) handleRequest(ctx context.Context, ch ssh.Channel, req *ssh.Request
 		ch.Write(banner)
 		ch.Close()
 
+	case "subsystem":
+		s.handleSubsystemRequest(ctx, ch, req)
+
 	default:
 		log.Printf("ssh: ignoring %s request", req.Type)
 	}
 }
 
-func (s SSH) handleEnvRequest(payload string) error {
-	args := strings.Split(strings.Replace(payload, "\x00", "", -1), "\v")
-	if len(args) != 2 {
-		return fmt.Errorf("env: invalid env arguments: '%#v'", args)
+// handleSubsystemRequest hands the channel to the SubsystemHandlers entry
+// for the requested subsystem, such as sftp. The channel is closed once the
+// handler returns.
+func (s SSH) handleSubsystemRequest(ctx context.Context, ch ssh.Channel, req *ssh.Request) {
+	var payload struct{ Name string }
+
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		log.Printf("ssh: invalid subsystem request: %v", err)
+		req.Reply(false, nil)
+
+		return
 	}
 
-	args[0] = strings.TrimLeft(args[0], "\x04")
-	if len(args[0]) == 0 {
-		return fmt.Errorf("env: invalid key from payload: %s", payload)
+	handler, ok := s.SubsystemHandlers[payload.Name]
+	if !ok {
+		log.Printf("ssh: ignoring unknown subsystem %q", payload.Name)
+		req.Reply(false, nil)
+
+		return
 	}
 
-	_, _, err := execCommandBytes("env", args[0]+"="+args[1])
-	if err != nil {
-		log.Printf("env: %v", err)
+	if err := s.checkSessionKey(ctx); err != nil {
+		log.Print(err)
+		req.Reply(false, nil)
+
+		return
 	}
 
-	return err
+	log.Printf("ssh: incoming subsystem request: %s", payload.Name)
+
+	req.Reply(true, nil)
+	handler(ctx, ch, req)
+	ch.Close()
 }
 
-func (s SSH) handleExecRequest(ctx context.Context, ch ssh.Channel, req *ssh.Request, payload string) (err error) {
-	cmdName := strings.TrimLeft(payload, "'()")
-	log.Printf("ssh: payload '%v'", cmdName)
+// bannerData collects what banner and message templates are given for the
+// current connection, less Repos, which only the banner lists
+func (s SSH) bannerData(ctx context.Context) BannerData {
+	data := BannerData{
+		PublicKey: ctx.Value(PublicKeyContextKey{}).(PublicKey),
+	}
 
-	if strings.HasPrefix(cmdName, "\x00") {
-		cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
+	data.User, _ = ctx.Value(UserContextKey{}).(string)
+	data.RemoteAddr, _ = ctx.Value(RemoteAddrContextKey{}).(string)
+
+	if s.sshconfig != nil {
+		data.ServerVersion = s.sshconfig.ServerVersion
 	}
 
-	gitcmd, err := ParseGitCommand(cmdName)
-	if err != nil {
-		ch.Write([]byte("Invalid command.\r\n"))
+	return data
+}
 
-		return err
+// bannerRepos lists the repositories the banner shows the current
+// connection
+func (s SSH) bannerRepos(ctx context.Context) []string {
+	var (
+		repos []string
+		err   error
+	)
+
+	if s.ListReposFunc != nil {
+		repos, err = s.ListReposFunc(ctx)
+	} else {
+		repos, err = s.listVisibleRepos(ctx)
 	}
 
-	if s.AuthoriseOperationFunc != nil {
-		err = s.AuthoriseOperationFunc(ctx, gitcmd)
-		if err != nil {
-			return
-		}
+	if err != nil {
+		log.Printf("ssh: unable to list repos for banner: %v", err)
 	}
 
-	if !repoExists(filepath.Join(s.config.Dir, gitcmd.Repo)) && s.config.AutoCreate {
-		err = initRepo(gitcmd.Repo, s.config)
-		if err != nil {
-			return
+	return repos
+}
+
+// listVisibleRepos lists repositories under Config.Dir and Config.Roots,
+// skipping any routed as hidden or private
+func (s SSH) listVisibleRepos(ctx context.Context) ([]string, error) {
+	repos, err := s.listAllRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		loc, err := s.resolveRepo(ctx, repo)
+		if err != nil || loc.Visibility != VisibilityPublic {
+			continue
 		}
+
+		visible = append(visible, repo)
 	}
 
-	keyID := ctx.Value(PublicKeyContextKey{}).(PublicKey).Id
+	return visible, nil
+}
 
-	cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
-	cmd.Dir = s.config.Dir
-	cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
+// handleEnvRequest records variables the client sets, such as
+// GIT_PROTOCOL, for the git command the session goes on to run. Only
+// variables in Config.AllowedEnv are accepted.
+func (s SSH) handleEnvRequest(sess *session, req *ssh.Request) error {
+	var env struct{ Name, Value string }
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("ssh: cant open stdout pipe: %w", err)
+	if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+		req.Reply(false, nil)
+
+		return fmt.Errorf("env: invalid env request: %w", err)
 	}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("ssh: cant open stderr pipe: %w", err)
+	log.Printf("ssh: incoming env request: %s=%s", env.Name, env.Value)
+
+	if !s.config.envAllowed(env.Name) {
+		req.Reply(false, nil)
+
+		return fmt.Errorf("env: %s is not allowed", env.Name)
 	}
 
-	input, err := cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("ssh: cant open stdin pipe: %w", err)
+	if env.Name == "LANG" || env.Name == "LC_ALL" {
+		if locale := localeFromEnv(env.Value); locale != "" {
+			sess.locale = locale
+		}
 	}
 
-	if err = cmd.Start(); err != nil {
-		return fmt.Errorf("ssh: start error: %w", err)
+	if sess.env == nil {
+		sess.env = make(map[string]string)
 	}
 
-	req.Reply(true, nil)
+	sess.env[env.Name] = env.Value
 
-	go io.Copy(input, ch)
-	io.Copy(ch, stdout)
-	io.Copy(ch.Stderr(), stderr)
+	return req.Reply(true, nil)
+}
 
-	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("ssh: command failed: %w", err)
-	}
+func (s SSH) handleExecRequest(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, payload string) (err error) {
+	// Nodes only run commands for the clients they proxy
+	if fromClusterNode(ctx) && sess.client == nil {
+		ch.Write([]byte(s.message(ctx, sess, MsgAccessDenied)))
 
-	_, err = ch.SendRequest("exit-status", true, []byte{0, 0, 0, 0})
+		return fmt.Errorf("%w: cluster node sent no client", ErrAccessDenied)
+	}
 
-	return
-}
+	if err = s.checkSessionKey(ctx); err != nil {
+		req.Reply(true, nil)
+		s.reportRejectedKey(ctx, sess, ch, err)
 
-func (s *SSH) createServerKey() error {
-	if err := os.MkdirAll(s.config.KeyDir, os.ModePerm); err != nil {
 		return err
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if handler, args, ok := s.lookupCommand(req); ok {
+		setSessionCommand(ctx, strings.Join(args, " "))
+
+		return s.runCommand(ctx, ch, req, handler, args)
+	}
+
+	cmdName := strings.TrimLeft(payload, "'()")
+	log.Printf("ssh: payload '%v'", cmdName)
+
+	if strings.HasPrefix(cmdName, "\x00") {
+		cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
+	}
+
+	gitcmd, err := ParseGitCommand(cmdName)
 	if err != nil {
+		ch.Write([]byte(s.message(ctx, sess, MsgInvalidCommand)))
+
 		return err
 	}
 
-	privateKeyFile, err := os.Create(s.config.KeyPath())
-	if err != nil {
+	if err = s.mapRepoPath(ctx, gitcmd); err != nil {
+		ch.Write([]byte(s.message(ctx, sess, MsgInvalidCommand)))
+
 		return err
 	}
 
-	if err := os.Chmod(s.config.KeyPath(), 0600); err != nil {
+	if gitcmd, err = s.rewriteCommand(ctx, gitcmd); err != nil {
+		ch.Write([]byte(clientLine(err, s.message(ctx, sess, MsgInvalidCommand))))
+
 		return err
 	}
-	defer privateKeyFile.Close()
-	if err != nil {
+
+	setSessionGitCommand(ctx, gitcmd)
+
+	ctx, span := s.startSpan(ctx, "gitkit.command", commandAttributes(gitcmd)...)
+	defer func() { endSpan(span, err) }()
+
+	if proxied, err := s.proxyToOwner(ctx, sess, ch, req, gitcmd, cmdName); proxied {
 		return err
 	}
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
+
+	if !s.config.operationAllowed(gitcmd.SubCommand()) {
+		ch.Write([]byte(s.message(ctx, sess, MsgOperationDisabled)))
+
+		return fmt.Errorf("%w: %s", ErrOperationDisabled, gitcmd.SubCommand())
+	}
+
+	if err = s.validateRepoName(ctx, gitcmd.Repo); err != nil {
+		ch.Write([]byte(s.message(ctx, sess, MsgInvalidCommand)))
+
 		return err
 	}
 
-	pubKeyPath := s.config.KeyPath() + ".pub"
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	loc, err := s.resolveRepo(ctx, gitcmd.Repo)
 	if err != nil {
+		ch.Write([]byte(s.message(ctx, sess, MsgInvalidCommand)))
+
 		return err
 	}
-	return os.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
-}
 
-func (s SSH) defaultPreLoginFunc(ctx context.Context, metadata ssh.ConnMetadata) error {
-	u := metadata.User()
+	if s.HideRefsFunc != nil {
+		loc.HideRefs = s.HideRefsFunc(ctx, gitcmd)
+	}
 
-	if s.config.Auth && s.config.GitUser != "" && u != s.config.GitUser {
-		return ErrIncorrectUser
+	if err = s.resolveNamespace(ctx, gitcmd); err != nil {
+		ch.Stderr().Write([]byte(clientLine(err, s.message(ctx, sess, MsgInvalidCommand))))
+
+		return err
 	}
 
-	return nil
-}
+	if held, qerr := quarantined(s.Store, loc.Path); held || qerr != nil {
+		ch.Stderr().Write([]byte(s.message(ctx, sess, MsgQuarantined)))
 
-func (s *SSH) setup() error {
-	if s.sshconfig != nil {
-		return nil
+		if qerr != nil {
+			return qerr
+		}
+
+		return ErrQuarantined
 	}
 
-	config := &ssh.ServerConfig{
-		ServerVersion: fmt.Sprintf("SSH-2.0-gitkit %s", Version),
+	if (s.config.ReadOnly || loc.ReadOnly) && gitcmd.IsWrite() {
+		ch.Write([]byte(s.message(ctx, sess, MsgReadOnly)))
+
+		return ErrReadOnly
 	}
 
-	if s.config.KeyDir == "" {
-		return fmt.Errorf("key directory is not provided")
+	if err = s.authoriseCommand(ctx, sess, ch, gitcmd, loc); err != nil {
+		return err
 	}
 
-	if !s.config.Auth {
-		config.NoClientAuth = true
-	} else {
-		if s.PublicKeyLookupFunc == nil {
-			return fmt.Errorf("public key lookup func is not provided")
-		}
+	s.recordKeyUsage(ctx, gitcmd)
 
-		if s.PreLoginFunc == nil {
-			s.PreLoginFunc = s.defaultPreLoginFunc
+	if proxied, err := s.proxyUpstream(ctx, sess, ch, req, gitcmd); proxied {
+		return err
+	}
+
+	if s.config.InMemory {
+		return s.serveInMemory(ctx, sess, ch, req, gitcmd, loc)
+	}
+
+	if err = s.refreshMirror(ctx, sess, ch, gitcmd, loc); err != nil {
+		return err
+	}
+
+	if !repoExists(loc.Path) && loc.AutoCreate && !loc.ReadOnly {
+		if err = s.authoriseAutoCreate(ctx, sess, ch, gitcmd); err != nil {
+			return err
 		}
 
-		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			ctx := context.WithValue(context.Background(), UserContextKey{}, conn.User())
-			err := s.PreLoginFunc(ctx, conn)
-			if err != nil {
-				return nil, err
+		tmpl := s.config.RepoTemplate
+		if s.TemplateFunc != nil {
+			if tmpl, err = s.TemplateFunc(ctx, gitcmd); err != nil {
+				return
 			}
+		}
 
-			log.Print(err)
+		err = initRepoFromTemplate(loc.Path, s.config, tmpl)
+		if err != nil {
+			return
+		}
 
-			pkey, err := s.PublicKeyLookupFunc(ctx, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
-			if err != nil {
-				return nil, err
-			}
+		s.repoCreated(ctx, gitcmd.Repo)
+	}
 
-			if pkey == nil {
-				return nil, fmt.Errorf("auth handler did not return a key")
-			}
+	if !repoExists(loc.Path) {
+		ch.Write([]byte(s.message(ctx, sess, MsgRepoNotFound)))
+
+		return fmt.Errorf("%w: %s", ErrRepoNotFound, gitcmd.Repo)
+	}
+
+	if msg, err := s.config.refuseForState(s.sessionLocale(ctx, sess), loc.Path, gitcmd); err != nil {
+		ch.Stderr().Write([]byte(msg))
+
+		return err
+	}
+
+	if gitcmd.IsWrite() && !s.config.InMemory {
+		release, err := lockForWrite(loc.Path)
+		if err != nil {
+			ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgRepoLocked, gitcmd)))
 
-			return &ssh.Permissions{Extensions: map[string]string{keyID: pkey.Id, keyName: pkey.Name, sshUser: conn.User()}}, nil
+			return fmt.Errorf("ssh: %w", err)
 		}
+		defer release()
 	}
 
-	keypath := s.config.KeyPath()
-	if !fileExists(keypath) {
-		if err := s.createServerKey(); err != nil {
-			return err
+	ctx, cancel := s.operationTimeout(ctx, gitcmd)
+	defer cancel()
+
+	defer func() {
+		if errors.Is(err, ErrOperationTimeout) {
+			s.reportTimeout(ctx, sess, ch, gitcmd)
+		}
+	}()
+
+	ctx, rec := s.startRecording(ctx, gitcmd)
+	defer func() { s.finishRecording(rec, err) }()
+
+	ctx, pushRec := s.startPushRecord(ctx, gitcmd)
+	defer func() { s.finishPushRecord(pushRec, loc, gitcmd.Namespace, err) }()
+
+	in := pushRec.count(s.guardInput(ctx, recordReader(ctx, RecordFromClient, ch)))
+	s.applyBlobLimit(ctx, gitcmd, &loc)
+	in = s.guardFetch(ctx, sess, ch, gitcmd, loc, in)
+
+	var quota *pushQuota
+	if gitcmd.IsWrite() {
+		if quota, err = s.startPushQuota(loc); err != nil {
+			return
+		}
+
+		if quota.full() {
+			req.Reply(true, nil)
+
+			return s.rejectQuota(ctx, sess, ch, gitcmd, quota)
 		}
+
+		in = quota.limit(in)
 	}
 
-	privateBytes, err := os.ReadFile(keypath)
-	if err != nil {
-		return err
+	in = s.cacheFetches(ctx, sess, gitcmd, loc, in, ch)
+
+	// Pushes may run git more than once, but are captured as one command
+	out := s.operationOutput(ctx, gitcmd)
+	if out != nil {
+		defer out.Close()
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return err
+	if gitcmd.IsWrite() && s.interceptPushes(loc) {
+		return s.execAuthorisedPush(ctx, sess, ch, in, req, gitcmd, loc, quota, out)
 	}
 
-	config.AddHostKey(private)
-	s.sshconfig = config
-	return nil
+	conflictRef, err := s.runGit(ctx, sess, ch, req, gitcmd, s.gitArgs(gitcmd, loc), in, out)
+	if qerr := s.checkQuota(ctx, sess, ch, gitcmd, quota, err); qerr != nil {
+		return qerr
+	}
+
+	return s.finishGit(ctx, sess, ch, gitcmd, conflictRef, err)
 }
 
-func (s *SSH) Listen(bind string) error {
-	if s.listener != nil {
-		return ErrAlreadyStarted
-	}
+// interceptPushes reports whether pushes to loc need to be read before
+// receive-pack applies them
+func (s SSH) interceptPushes(loc repoLocation) bool {
+	return !loc.RefPolicy.empty() || s.AuthoriseRefUpdateFunc != nil || s.AuthorisePushFunc != nil || s.VerifyPushCertificateFunc != nil || s.webhooks != nil || s.config.PushHistory || s.config.AtomicPushes || s.events.subscribed()
+}
 
-	if err := s.setup(); err != nil {
+// execAuthorisedPush serves a push in two steps, in the same way as the
+// smart HTTP protocol: refs are advertised, then the client's ref updates
+// are read and checked against the repository's RefPolicy, then passed to
+// AuthoriseRefUpdateFunc, VerifyPushCertificateFunc and AuthorisePushFunc,
+// and only then is receive-pack started, with any per-push configuration
+// the callbacks asked for. Where telling fast forwards from rewinds needs
+// the pushed objects, they are first quarantined and checked. Pushes are
+// also served this way when webhooks need to know which refs changed, the
+// push is to be kept in the push history, subscribers are waiting on
+// EventPushCompleted, or Config.AtomicPushes is set.
+func (s SSH) execAuthorisedPush(ctx context.Context, sess *session, ch ssh.Channel, in io.Reader, req *ssh.Request, gitcmd *GitCommand, loc repoLocation, quota *pushQuota, out *outputWriter) error {
+	if _, err := s.runGit(ctx, sess, ch, req, gitcmd, s.gitArgs(gitcmd, loc, "--stateless-rpc", "--advertise-refs"), nil, out); err != nil {
 		return err
 	}
 
-	if err := s.config.Setup(); err != nil {
-		return err
+	push, raw, err := readPushRequest(in)
+	if quota.exceeded() {
+		return s.rejectQuota(ctx, sess, ch, gitcmd, quota)
 	}
 
-	var err error
-	s.listener, err = net.Listen("tcp", bind)
 	if err != nil {
-		return err
+		return fmt.Errorf("ssh: unable to read push request: %w", err)
 	}
 
-	return nil
-}
+	push.RepoPath = loc.Path
+	recordPushRequest(ctx, push)
 
-func (s *SSH) Serve() error {
-	if s.listener == nil {
-		return ErrNoListener
-	}
+	// The pack follows the commands read, and is only needed here to tell
+	// fast forwards from rewinds
+	var quarantine *pushQuarantine
+	if s.quarantines(loc, push) {
+		quarantine, err = s.quarantinePush(ctx, loc.Path, push, in)
+		if quota.exceeded() {
+			return s.rejectQuota(ctx, sess, ch, gitcmd, quota)
+		}
 
-	for {
-		// wait for connection or Stop()
-		conn, err := s.listener.Accept()
 		if err != nil {
-			return err
+			return fmt.Errorf("ssh: unable to receive pack: %w", err)
 		}
+		defer quarantine.remove()
+	}
 
-		go func() {
-			log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+	authCtx, span := s.startSpan(ctx, "gitkit.authorise_push", append(commandAttributes(gitcmd), attribute.Int("gitkit.push.updates", len(push.Updates)))...)
 
-			sConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshconfig)
-			if err != nil {
-				if err == io.EOF {
-					log.Printf("ssh: handshaking was terminated: %v", err)
-				} else {
-					log.Printf("ssh: error on handshaking: %v", err)
-				}
-				return
-			}
+	err = loc.RefPolicy.check(push, quarantine.pushRewinds)
+	if err == nil {
+		err = s.authoriseRefUpdates(authCtx, gitcmd, push, quarantine.pushRewinds)
+	}
 
-			log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+	if err == nil {
+		err = s.verifyPushCertificate(authCtx, gitcmd, push)
+	}
 
-			var (
-				pk      PublicKey
-				gitUser string
-			)
+	if err == nil && s.AuthorisePushFunc != nil {
+		err = s.AuthorisePushFunc(authCtx, gitcmd, push)
+	}
 
-			if sConn.Permissions != nil {
-				pk.Name = sConn.Permissions.Extensions[keyName]
-				pk.Id = sConn.Permissions.Extensions[keyID]
-				gitUser = sConn.Permissions.Extensions[sshUser]
-			}
+	endSpan(span, err)
 
-			ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, pk)
-			ctx = context.WithValue(ctx, UserContextKey{}, gitUser)
+	if err != nil {
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgPushRejected, PushRejection{
+			Repo:   gitcmd.Repo,
+			Reason: clientMessage(err, err.Error()),
+		})))
+		sendExitStatus(ch, 1)
 
-			go ssh.DiscardRequests(reqs)
-			go s.handleConnection(ctx, chans)
-		}()
+		return fmt.Errorf("ssh: %w: %v", ErrPushRejected, err)
 	}
-}
 
-func (s *SSH) ListenAndServe(bind string) error {
-	if err := s.Listen(bind); err != nil {
-		return err
+	// Nothing to update, so there is no need to run receive-pack again
+	if len(push.Updates) == 0 {
+		return sendExitStatus(ch, 0)
 	}
-	return s.Serve()
-}
 
-// Stop stops the server if it has been started, otherwise it is a no-op.
-func (s *SSH) Stop() error {
-	if s.listener == nil {
-		return nil
+	if raw, err = s.config.makeAtomic(push, raw); err != nil {
+		return fmt.Errorf("ssh: unable to make push atomic: %w", err)
 	}
-	defer func() {
-		s.listener = nil
+
+	args := []string{}
+	for _, c := range push.GitConfig {
+		args = append(args, "-c", c)
+	}
+
+	args = append(args, s.gitArgs(gitcmd, loc, "--stateless-rpc")...)
+
+	// Quarantined objects are kept, so receive-pack is sent an empty pack
+	pack := in
+	if quarantine != nil {
+		if err = quarantine.keep(); err != nil {
+			return fmt.Errorf("ssh: unable to keep pushed objects: %w", err)
+		}
+
+		pack = bytes.NewReader(emptyPack(len(push.Updates[0].OldRev)))
+	}
+
+	conflictRef, err := s.runGit(ctx, sess, ch, nil, gitcmd, args, io.MultiReader(bytes.NewReader(raw), pack), out)
+	if qerr := s.checkQuota(ctx, sess, ch, gitcmd, quota, err); qerr != nil {
+		return qerr
+	}
+
+	if err = s.finishGit(ctx, sess, ch, gitcmd, conflictRef, err); err != nil {
+		return err
+	}
+
+	s.pushCompleted(ctx, gitcmd, loc, push)
+
+	return nil
+}
+
+// authoriseCommand checks the client may run gitcmd against loc, by the
+// route's Readers and Writers, then AuthoriseOperationFunc and
+// AuthoriseRequestFunc, telling clients which may not
+func (s SSH) authoriseCommand(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand, loc repoLocation) (err error) {
+	ctx, span := s.startSpan(ctx, "gitkit.authorise", commandAttributes(gitcmd)...)
+	defer func() { endSpan(span, err) }()
+
+	if pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey); !loc.permits(pk.Name, gitcmd.IsWrite()) {
+		ch.Write([]byte(s.message(ctx, sess, MsgAccessDenied)))
+
+		return ErrAccessDenied
+	}
+
+	if s.AuthoriseOperationFunc != nil {
+		if err = s.AuthoriseOperationFunc(ctx, gitcmd); err != nil {
+			ch.Write([]byte(clientLine(err, s.message(ctx, sess, MsgAccessDenied))))
+
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+
+	if s.AuthoriseRequestFunc != nil {
+		var env map[string]string
+		if sess != nil {
+			env = sess.env
+		}
+
+		if err = s.AuthoriseRequestFunc(ctx, newOperationRequest(ctx, gitcmd, env)); err != nil {
+			ch.Write([]byte(clientLine(err, s.message(ctx, sess, MsgAccessDenied))))
+
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+
+	return nil
+}
+
+// authoriseAutoCreate checks AutoCreateAuthoriseFunc, if set, allows
+// gitcmd's repository to be created, telling clients when it does not
+func (s SSH) authoriseAutoCreate(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand) error {
+	if s.AutoCreateAuthoriseFunc == nil {
+		return nil
+	}
+
+	if err := s.AutoCreateAuthoriseFunc(ctx, gitcmd); err != nil {
+		ch.Write([]byte(clientLine(err, s.message(ctx, sess, MsgAccessDenied))))
+
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	}
+
+	return nil
+}
+
+// repoCreated reports that AutoCreate made repo, with the event and
+// RepoCreatedFunc
+func (s SSH) repoCreated(ctx context.Context, repo string) {
+	s.emit(ctx, Event{Type: EventRepoCreated, Repo: repo, Data: map[string]string{"source": "autocreate"}})
+
+	if s.RepoCreatedFunc != nil {
+		pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+		s.RepoCreatedFunc(ctx, repo, pk)
+	}
+}
+
+// runGit runs git with args for gitcmd, streaming its output to the
+// channel, and copying it to out when set. When req is set it is replied
+// to once git has started. The ref of any lock conflict seen in git's
+// output is returned.
+func (s SSH) runGit(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, args []string, stdin io.Reader, out *outputWriter) (conflictRef string, err error) {
+	ctx, span := s.startSpan(ctx, "gitkit.exec", attribute.StringSlice("gitkit.args", args))
+	defer func() { endSpan(span, err) }()
+
+	// The client's variables go first, so that those it is allowed to set
+	// cannot replace gitkit's own
+	env := append(sess.environ(), s.hookEnv(ctx, gitcmd)...)
+	if gitcmd.Namespace != "" {
+		env = append(env, "GIT_NAMESPACE="+gitcmd.Namespace)
+	}
+
+	program, args, env := s.gitProgram(gitcmd, args, env)
+	cmd, err := s.programCommand(ctx, program, append(env, traceEnv(ctx)...), args...)
+	if err != nil {
+		return "", err
+	}
+
+	cmd.Dir = s.config.Dir
+
+	// Timeouts kill git's whole process group, so that children such as
+	// pack-objects stop with it
+	if _, ok := ctx.Deadline(); ok {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+
+		cmd.SysProcAttr.Setpgid = true
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("ssh: cant open stdout pipe: %w", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", fmt.Errorf("ssh: cant open stderr pipe: %w", err)
+	}
+
+	var input io.WriteCloser
+	if stdin != nil {
+		input, err = cmd.StdinPipe()
+		if err != nil {
+			return "", fmt.Errorf("ssh: cant open stdin pipe: %w", err)
+		}
+	}
+
+	if err = cmd.Start(); err != nil {
+		return "", fmt.Errorf("ssh: start error: %w", err)
+	}
+
+	stop := killOnTimeout(ctx, cmd)
+	defer stop()
+
+	if req != nil {
+		req.Reply(true, nil)
+	}
+
+	progress := s.startProgress(ctx, gitcmd)
+	defer progress.stop()
+
+	stdin = progress.reader(stdin)
+
+	stdoutWatch := &conflictWatcher{w: ch}
+	stderrWatch := &conflictWatcher{w: ch.Stderr(), rewrite: true}
+
+	var toClient, toStderr io.Writer = stdoutWatch, recordWriter(ctx, RecordStderr, stderrWatch)
+	if out != nil {
+		toClient = &sidebandTee{w: stdoutWatch, out: out}
+		toStderr = io.MultiWriter(toStderr, out)
+	}
+
+	// Closing stdin when the client stops sending, or is cut off by a
+	// quota, lets git see the end of its input rather than wait for more.
+	// This copy is not waited for: clients may hold their side open after
+	// git exits, and once it has, writes to git fail and end the copy.
+	if stdin != nil {
+		go func() {
+			copyBuffer(input, throttleReader(ctx, stdin))
+			input.Close()
+		}()
+	}
+
+	// stdout and stderr are drained together, since git blocks once either
+	// pipe is full; a chatty stderr would otherwise stall the pack on
+	// stdout. Both must be drained before cmd.Wait closes them.
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		copyBuffer(throttleWriter(ctx, recordWriter(ctx, RecordToClient, progress.writer(toClient))), stdout)
 	}()
 
-	return s.listener.Close()
+	go func() {
+		defer wg.Done()
+		copyBuffer(toStderr, stderr)
+	}()
+
+	wg.Wait()
+	stderrWatch.Flush()
+
+	conflictRef = stdoutWatch.ref
+	if conflictRef == "" {
+		conflictRef = stderrWatch.ref
+	}
+
+	if err = cmd.Wait(); err != nil {
+		return conflictRef, timedOut(ctx, fmt.Errorf("ssh: command failed: %w", err))
+	}
+
+	return conflictRef, nil
+}
+
+// finishGit reports the outcome of a git command to the client
+func (s SSH) finishGit(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand, conflictRef string, err error) error {
+	conflict := gitcmd.IsWrite() && conflictRef != ""
+	if conflict {
+		s.reportPushConflict(ctx, sess, ch, gitcmd, conflictRef)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = sendExitStatus(ch, 0); err != nil {
+		return err
+	}
+
+	if conflict {
+		return fmt.Errorf("ssh: %w on %s", ErrPushConflict, conflictRef)
+	}
+
+	return nil
+}
+
+// sendExitStatus reports how a command ended. No reply is asked for, as
+// clients built on golang.org/x/crypto/ssh, such as gateways proxying to
+// this server, never send one.
+func sendExitStatus(ch ssh.Channel, code uint32) error {
+	_, err := ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{code}))
+
+	return err
+}
+
+// gitArgs builds the arguments used to run git for a command, with flags
+// placed between the subcommand and repository path
+func (s SSH) gitArgs(gitcmd *GitCommand, loc repoLocation, flags ...string) []string {
+	args := []string{}
+
+	if gitcmd.IsWrite() {
+		// Push options are only sent by clients when advertised
+		args = append(args, "-c", "receive.advertisePushOptions=true")
+		args = append(args, s.pushCertGitConfig()...)
+	} else if gitcmd.SubCommand() == OperationUploadPack {
+		args = append(args, loc.UploadPack.gitConfig()...)
+	}
+
+	args = append(args, hideRefsConfig(gitcmd, loc.HideRefs)...)
+
+	args = append(args, gitcmd.SubCommand())
+	args = append(args, flags...)
+	args = append(args, gitcmd.Args...)
+
+	return append(args, loc.Path)
+}
+
+func (s SSH) validateRepoName(ctx context.Context, name string) error {
+	if s.ValidateRepoNameFunc != nil {
+		return s.ValidateRepoNameFunc(ctx, name)
+	}
+
+	return s.config.RepoNames.Validate(name)
+}
+
+// reportPushConflict tells the client their push lost a race for a ref lock
+func (s SSH) reportPushConflict(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand, ref string) {
+	conflict := PushConflict{Repo: gitcmd.Repo, Ref: ref}
+
+	ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgPushConflict, conflict)))
+
+	s.emit(ctx, Event{
+		Type: EventPushConflict,
+		Repo: gitcmd.Repo,
+		Data: map[string]string{"ref": ref},
+	})
+}
+
+func (s *SSH) createServerKey() error {
+	if err := os.MkdirAll(s.config.KeyDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	privateKeyFile, err := os.Create(s.config.KeyPath())
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(s.config.KeyPath(), 0600); err != nil {
+		return err
+	}
+	defer privateKeyFile.Close()
+	if err != nil {
+		return err
+	}
+	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
+		return err
+	}
+
+	pubKeyPath := s.config.KeyPath() + ".pub"
+	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
+}
+
+func (s SSH) defaultPreLoginFunc(ctx context.Context, metadata ssh.ConnMetadata) error {
+	u := metadata.User()
+
+	if s.config.Auth && s.config.GitUser != "" && u != s.config.GitUser {
+		return ErrIncorrectUser
+	}
+
+	return nil
+}
+
+// publicKeyCallback authenticates keys with PreLoginFunc and
+// PublicKeyLookupFunc, passing them ctx so that lookups can be abandoned
+// when the client goes away
+func (s *SSH) publicKeyCallback(parent context.Context) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (perms *ssh.Permissions, err error) {
+		attrs := []attribute.KeyValue{attribute.String("gitkit.key.fingerprint", ssh.FingerprintSHA256(key))}
+
+		// Clients whose token was refused go on to offer keys with it as
+		// their username, which is then kept out of the span
+		if s.UsernameTokenFunc == nil {
+			attrs = append(attrs, attribute.String("gitkit.user", conn.User()))
+		}
+
+		ctx, span := s.startSpan(parent, "gitkit.auth", attrs...)
+		defer func() { endSpan(span, err) }()
+
+		if s.Cluster.isNode(key) {
+			return nodePermissions(conn, key), nil
+		}
+
+		// Refusals of the key itself count against it, from this address,
+		// unless it was refused for having failed already
+		id := keyFailureID(ssh.FingerprintSHA256(key), conn.RemoteAddr())
+		counted := false
+		defer func() {
+			if counted && err != nil && !errors.Is(err, ErrAuthBlocked) {
+				s.authFailed(ctx, id, map[string]string{
+					"fingerprint": ssh.FingerprintSHA256(key),
+					"remote_addr": conn.RemoteAddr().String(),
+				})
+			}
+		}()
+
+		if err = s.throttleAuth(ctx, id); err != nil {
+			return nil, err
+		}
+
+		ctx = context.WithValue(ctx, UserContextKey{}, conn.User())
+		err = s.PreLoginFunc(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		counted = true
+		lookup := newPublicKeyLookup(key)
+
+		pkey, err := s.PublicKeyLookupFunc(ctx, lookup)
+		if err != nil {
+			return nil, err
+		}
+
+		if pkey == nil {
+			return nil, fmt.Errorf("auth handler did not return a key")
+		}
+
+		if pkey.Fingerprint == "" {
+			pkey.Fingerprint = lookup.Fingerprint
+		}
+
+		span.SetAttributes(attribute.String("gitkit.key.id", pkey.Id))
+
+		return s.acceptKey(parent, ctx, conn.User(), *pkey)
+	}
+}
+
+// acceptKey admits the client, logged in as user, as pkey, once it has
+// passed expiry and revocation checks. Session limits are applied once the
+// handshake completes, since clients may offer keys they cannot sign with.
+func (s *SSH) acceptKey(parent, ctx context.Context, user string, pkey PublicKey) (*ssh.Permissions, error) {
+	if err := s.checkKey(ctx, pkey); err != nil {
+		s.rejectKey(ctx, pkey, err)
+
+		return nil, err
+	}
+
+	// Permissions only carry strings, so the key itself is kept against
+	// the connection until the handshake completes
+	if tc, ok := parent.Value(trackedConnContextKey{}).(*trackedConn); ok {
+		tc.accept(pkey)
+	}
+
+	return &ssh.Permissions{Extensions: map[string]string{
+		keyID:          pkey.Id,
+		keyName:        pkey.Name,
+		keyFingerprint: pkey.Fingerprint,
+		keyLocale:      pkey.Locale,
+		sshUser:        user,
+	}}, nil
+}
+
+func (s *SSH) setup() error {
+	if s.sshconfig != nil {
+		return nil
+	}
+
+	if s.routesErr != nil {
+		return s.routesErr
+	}
+
+	if err := s.config.checkTrustedProxies(); err != nil {
+		return err
+	}
+
+	if err := s.config.checkCIDRs(); err != nil {
+		return err
+	}
+
+	if err := s.config.AuthFailures.check(); err != nil {
+		return err
+	}
+
+	if err := s.config.RefPolicy.validate(); err != nil {
+		return err
+	}
+
+	if len(s.config.Webhooks) > 0 {
+		s.webhooks = &WebhookDispatcher{Hooks: s.config.Webhooks, Store: s.Store}
+	}
+
+	if err := s.checkInMemory(); err != nil {
+		return err
+	}
+
+	if s.config.InMemory && s.Repositories == nil {
+		s.Repositories = NewMemoryRepositoryStore()
+	}
+
+	config := &ssh.ServerConfig{
+		ServerVersion: BuildInfo().serverVersion(s.config.ServerVersionBuild),
+	}
+
+	if v := s.config.ServerVersion; v != "" {
+		// Clients only talk to servers identifying as RFC 4253 says
+		if !strings.HasPrefix(v, "SSH-2.0-") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("server version %q must be one line beginning SSH-2.0-", v)
+		}
+
+		config.ServerVersion = v
+	}
+
+	if err := s.config.SSHCrypto.apply(&config.Config); err != nil {
+		return err
+	}
+
+	if !s.config.Auth {
+		config.NoClientAuth = true
+	} else {
+		if s.PublicKeyLookupFunc == nil && s.UsernameTokenFunc == nil {
+			return fmt.Errorf("public key lookup func is not provided")
+		}
+
+		if s.PreLoginFunc == nil {
+			s.PreLoginFunc = s.defaultPreLoginFunc
+		}
+
+		if s.PublicKeyLookupFunc != nil {
+			config.PublicKeyCallback = s.publicKeyCallback(context.Background())
+			s.keyAuth = true
+		}
+
+		if s.UsernameTokenFunc != nil {
+			config.NoClientAuth = true
+			config.NoClientAuthCallback = s.usernameTokenCallback(context.Background())
+			s.tokenAuth = true
+		}
+	}
+
+	if s.Cluster != nil {
+		if err := s.Cluster.validate(s.config, s.keyAuth); err != nil {
+			return err
+		}
+	}
+
+	signers, err := s.loadHostSigners()
+	if err != nil {
+		return err
+	}
+
+	base := *config
+	s.hostKeys.base, s.hostKeys.signers = &base, signers
+
+	for _, signer := range signers {
+		config.AddHostKey(signer)
+	}
+
+	if s.keysFromDir() {
+		if err := s.loadNextHostKey(); err != nil {
+			return err
+		}
+	}
+
+	s.sshconfig = config
+	return nil
+}
+
+// loadHostSigners returns the host keys to serve: signers added with
+// AddHostSigner, then any Config.HostKeys. Only when neither is set is a
+// key read from (or generated into) KeyDir
+func (s *SSH) loadHostSigners() ([]ssh.Signer, error) {
+	signers := append([]ssh.Signer{}, s.hostSigners...)
+
+	for i, pemBytes := range s.config.HostKeys {
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("host key %d: %w", i, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		return signers, nil
+	}
+
+	if s.config.KeyDir == "" {
+		return nil, fmt.Errorf("key directory is not provided")
+	}
+
+	keypath := s.config.KeyPath()
+	if !fileExists(keypath) {
+		if err := s.createServerKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	privateBytes, err := os.ReadFile(keypath)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ssh.Signer{private}, nil
+}
+
+// Listen binds each of binds, such as ":22" and "[::1]:2222", for Serve to
+// accept connections on together. Binds beginning unix: are unix socket
+// paths, such as unix:/run/gitkit.sock.
+func (s *SSH) Listen(binds ...string) error {
+	if len(binds) == 0 {
+		return fmt.Errorf("%w: no address to listen on", ErrNoListener)
+	}
+
+	return s.listenWith(func() ([]net.Listener, error) {
+		return listenAll(binds)
+	})
+}
+
+// listenWith sets the server up and serves the listeners open returns
+func (s *SSH) listenWith(open func() ([]net.Listener, error)) error {
+	if s.currentListener() != nil {
+		return ErrAlreadyStarted
+	}
+
+	if err := s.setup(); err != nil {
+		return err
+	}
+
+	if err := s.config.Setup(); err != nil {
+		return err
+	}
+
+	listeners, err := open()
+	if err != nil {
+		return err
+	}
+
+	s.setListeners(listeners)
+
+	return nil
+}
+
+// Serve accepts connections on every listener until one fails, such as
+// when Stop closes them, at which point the rest are closed too and the
+// error is returned
+func (s *SSH) Serve() error {
+	listeners := s.currentListeners()
+	if len(listeners) == 0 {
+		return ErrNoListener
+	}
+
+	s.state.markStarted()
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- s.accept(listener)
+		}(listener)
+	}
+
+	err := <-errs
+
+	// Listeners are served together, so one failing takes the rest with it
+	closeListeners(s.setListeners(nil))
+
+	for range listeners[1:] {
+		<-errs
+	}
+
+	return err
 }
 
-// Address returns the network address of the listener. This is in
+// accept serves each connection listener accepts, until it fails with an
+// error other than a temporary one
+func (s *SSH) accept(listener net.Listener) error {
+	backoff := acceptBackoff{max: s.config.acceptBackoffMax()}
+
+	for {
+		// wait for connection or Stop()
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.OnAcceptError != nil && !errors.Is(err, net.ErrClosed) {
+				s.OnAcceptError(err)
+			}
+
+			if !temporaryAcceptError(err) {
+				return err
+			}
+
+			delay := backoff.next()
+			log.Printf("ssh: accept error: %v; retrying in %v", err, delay)
+			s.state.recordError(err)
+
+			time.Sleep(delay)
+
+			continue
+		}
+
+		backoff.reset()
+
+		go s.serveConn(conn, s.state.track(conn))
+	}
+}
+
+// serveConn handshakes with conn and serves its channels
+func (s *SSH) serveConn(conn net.Conn, tc *trackedConn) {
+	defer s.state.untrack(conn)
+
+	// The connection is served start to finish with the
+	// configuration current as it arrived
+	srv := s.current()
+
+	proxied, err := srv.proxyConn(conn)
+	if err != nil {
+		log.Printf("ssh: error reading proxy header from %s: %v", conn.RemoteAddr(), err)
+		s.state.recordError(err)
+		conn.Close()
+
+		return
+	}
+
+	conn = proxied
+
+	tc.update(func(info *SessionInfo) {
+		info.RemoteAddr = conn.RemoteAddr().String()
+	})
+
+	ctx, span := srv.startSpan(context.Background(), "gitkit.connection", attribute.String("client.address", conn.RemoteAddr().String()))
+	defer span.End()
+
+	// Unwanted networks, and addresses failing to authenticate too often,
+	// are turned away before any key exchange
+	err = srv.allowConn(ctx, conn)
+	if err == nil {
+		err = srv.throttleAuth(ctx, addrFailureID(conn.RemoteAddr()))
+	}
+
+	if err != nil {
+		log.Printf("ssh: closing connection from %s: %v", conn.RemoteAddr(), err)
+		endSpan(span, err)
+		conn.Close()
+
+		srv.emit(ctx, Event{Type: EventConnectionDenied, Data: map[string]string{
+			"remote_addr": conn.RemoteAddr().String(),
+			"error":       err.Error(),
+		}})
+
+		return
+	}
+
+	log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+
+	// Tie the connection's context, including that of key lookups, to
+	// the client staying connected
+	conn, ctx = watchConn(ctx, conn)
+	ctx = context.WithValue(ctx, trackedConnContextKey{}, tc)
+	ctx = context.WithValue(ctx, RemoteAddrContextKey{}, conn.RemoteAddr().String())
+
+	hsCtx, hsSpan := srv.startSpan(ctx, "gitkit.handshake")
+
+	config := s.sshconfig
+	if rotated := s.hostKeys.serverConfig(); rotated != nil {
+		config = rotated
+	}
+
+	if s.keyAuth || s.tokenAuth || srv.BannerCallback != nil {
+		perConn := *config
+		if s.keyAuth {
+			perConn.PublicKeyCallback = srv.publicKeyCallback(hsCtx)
+		}
+		if s.tokenAuth {
+			perConn.NoClientAuthCallback = srv.usernameTokenCallback(hsCtx)
+		}
+		if srv.BannerCallback != nil {
+			perConn.BannerCallback = func(conn ssh.ConnMetadata) string { return srv.BannerCallback(hsCtx, conn) }
+		}
+		config = &perConn
+	}
+
+	sConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	endSpan(hsSpan, err)
+
+	if err != nil {
+		if err == io.EOF {
+			log.Printf("ssh: handshaking was terminated: %v", err)
+		} else {
+			log.Printf("ssh: error on handshaking: %v", err)
+			s.state.recordError(err)
+		}
+
+		var authErr *ssh.ServerAuthError
+		if errors.As(err, &authErr) {
+			srv.emit(ctx, Event{Type: EventAuthFailed, Data: map[string]string{
+				"remote_addr": conn.RemoteAddr().String(),
+				"error":       err.Error(),
+			}})
+
+			srv.authFailed(ctx, addrFailureID(conn.RemoteAddr()), map[string]string{"remote_addr": conn.RemoteAddr().String()})
+		}
+
+		return
+	}
+
+	log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+
+	var (
+		pk      PublicKey
+		gitUser string
+	)
+
+	if sConn.Permissions != nil {
+		ext := sConn.Permissions.Extensions
+
+		if accepted, ok := tc.authenticated(ext[keyFingerprint]); ok {
+			pk = accepted
+		} else {
+			// Set by a PublicKeyCallback given with SetSSHConfig
+			pk.Name = ext[keyName]
+			pk.Id = ext[keyID]
+			pk.Fingerprint = ext[keyFingerprint]
+			pk.Locale = ext[keyLocale]
+		}
+
+		gitUser = ext[sshUser]
+
+		if ext[clusterNode] != "" {
+			ctx = context.WithValue(ctx, clusterNodeContextKey{}, true)
+		}
+	}
+
+	tc.update(func(info *SessionInfo) {
+		info.User = gitUser
+		info.PublicKey = pk
+	})
+
+	// Only keys the client signed with count against its session limit.
+	// The slot is released as the connection is untracked.
+	if pk.Fingerprint != "" && !fromClusterNode(ctx) {
+		if err := srv.claimSession(ctx, pk); err != nil {
+			log.Printf("ssh: closing connection from %s: %v", sConn.RemoteAddr(), err)
+			sConn.Close()
+
+			return
+		}
+	}
+
+	ctx = context.WithValue(ctx, PublicKeyContextKey{}, pk)
+	ctx = context.WithValue(ctx, UserContextKey{}, gitUser)
+	ctx = context.WithValue(ctx, connContextKey{}, sConn)
+	ctx = srv.withBandwidth(ctx, pk)
+
+	// Each event has its own data, as subscribers may keep or change it
+	connData := func() map[string]string {
+		return map[string]string{
+			"remote_addr":    sConn.RemoteAddr().String(),
+			"client_version": string(sConn.ClientVersion()),
+			"user":           gitUser,
+		}
+	}
+	srv.emit(ctx, Event{Type: EventConnectionOpened, Data: connData()})
+	defer func() { srv.emit(ctx, Event{Type: EventConnectionClosed, Data: connData()}) }()
+
+	go ssh.DiscardRequests(reqs)
+	go srv.keepalive(ctx, sConn)
+	srv.handleConnection(ctx, chans)
+}
+
+func (s *SSH) ListenAndServe(binds ...string) error {
+	if err := s.Listen(binds...); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Stop stops the server if it has been started, otherwise it is a no-op.
+func (s *SSH) Stop() error {
+	errs := []error{}
+	for _, listener := range s.setListeners(nil) {
+		errs = append(errs, listener.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Address returns the network address of the first listener. This is in
 // particular useful when binding to :0 to get a free port assigned by
 // the OS.
 func (s *SSH) Address() string {
-	if s.listener != nil {
-		return s.listener.Addr().String()
+	if listener := s.currentListener(); listener != nil {
+		return listener.Addr().String()
 	}
 	return ""
 }
 
+// Addresses returns the network address of every listener, in the order
+// they were bound
+func (s *SSH) Addresses() []string {
+	addrs := []string{}
+	for _, listener := range s.currentListeners() {
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	return addrs
+}
+
 // SetSSHConfig can be used to set custom SSH Server settings.
 func (s *SSH) SetSSHConfig(cfg *ssh.ServerConfig) {
 	s.sshconfig = cfg
 }
 
-// SetListener can be used to set custom Listener.
+// AddHostSigner adds a host key to the server, such as one held in Vault
+// or a KMS. A crypto.Signer, including one backed by an HSM, can be adapted
+// with ssh.NewSignerFromSigner. Keys added this way take the place of the
+// key otherwise read from KeyDir.
+func (s *SSH) AddHostSigner(signer ssh.Signer) {
+	s.hostSigners = append(s.hostSigners, signer)
+
+	if s.sshconfig != nil {
+		s.sshconfig.AddHostKey(signer)
+		s.hostKeys.add(signer)
+	}
+}
+
+// Routes returns the server's routing table, which may be updated with
+// Set at any time
+func (s *SSH) Routes() *RouteTable {
+	return s.current().routes
+}
+
+// SetListener can be used to set custom Listener, in place of any others.
 func (s *SSH) SetListener(l net.Listener) {
-	s.listener = l
+	if l == nil {
+		s.setListeners(nil)
+
+		return
+	}
+
+	s.setListeners([]net.Listener{l})
+}
+
+// AddListener adds a custom Listener, which Serve accepts connections on
+// alongside any others. It must be added before Serve is called.
+func (s *SSH) AddListener(l net.Listener) {
+	s.state.listenerMu.Lock()
+	defer s.state.listenerMu.Unlock()
+
+	// Copied, so that slices already handed out by currentListeners are
+	// left alone
+	s.state.listeners = append(s.state.listeners[:len(s.state.listeners):len(s.state.listeners)], l)
+}
+
+func (s *SSH) currentListener() net.Listener {
+	if listeners := s.currentListeners(); len(listeners) > 0 {
+		return listeners[0]
+	}
+
+	return nil
+}
+
+func (s *SSH) currentListeners() []net.Listener {
+	s.state.listenerMu.RLock()
+	defer s.state.listenerMu.RUnlock()
+
+	return s.state.listeners
+}
+
+// setListeners replaces the listeners, returning the previous ones
+func (s *SSH) setListeners(l []net.Listener) (previous []net.Listener) {
+	s.state.listenerMu.Lock()
+	defer s.state.listenerMu.Unlock()
+
+	previous, s.state.listeners = s.state.listeners, l
+
+	return
 }
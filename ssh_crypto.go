@@ -0,0 +1,77 @@
+package gitkit
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHCrypto restricts the algorithms the SSH server negotiates, such as to
+// turn off legacy key exchanges and ciphers. Each list is in order of
+// preference; empty lists keep golang.org/x/crypto/ssh's defaults.
+type SSHCrypto struct {
+	KeyExchanges []string // Such as "curve25519-sha256"
+	Ciphers      []string // Such as "aes256-gcm@openssh.com"
+	MACs         []string // Such as "hmac-sha2-256-etm@openssh.com"
+}
+
+// apply sets c's algorithms on config, refusing any the ssh package does
+// not implement, which it would otherwise drop without saying
+func (c SSHCrypto) apply(config *ssh.Config) error {
+	check := ssh.Config{KeyExchanges: c.KeyExchanges, Ciphers: c.Ciphers, MACs: c.MACs}
+	check.SetDefaults()
+
+	// Group exchange is only implemented for clients
+	kexs := check.KeyExchanges[:0]
+	for _, kex := range check.KeyExchanges {
+		if !strings.HasPrefix(kex, "diffie-hellman-group-exchange-") {
+			kexs = append(kexs, kex)
+		}
+	}
+
+	check.KeyExchanges = kexs
+
+	for _, algos := range []struct {
+		name      string
+		set, kept []string
+	}{
+		{"key exchange", c.KeyExchanges, check.KeyExchanges},
+		{"cipher", c.Ciphers, check.Ciphers},
+		{"MAC", c.MACs, check.MACs},
+	} {
+		if unsupported := missing(algos.set, algos.kept); len(unsupported) > 0 {
+			return fmt.Errorf("ssh crypto: unsupported %s algorithms: %s", algos.name, strings.Join(unsupported, ", "))
+		}
+	}
+
+	if len(c.KeyExchanges) > 0 {
+		config.KeyExchanges = c.KeyExchanges
+	}
+
+	if len(c.Ciphers) > 0 {
+		config.Ciphers = c.Ciphers
+	}
+
+	if len(c.MACs) > 0 {
+		config.MACs = c.MACs
+	}
+
+	return nil
+}
+
+// missing returns the strings of a which are not in b
+func missing(a, b []string) (out []string) {
+	found := make(map[string]bool, len(b))
+	for _, s := range b {
+		found[s] = true
+	}
+
+	for _, s := range a {
+		if !found[s] {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,70 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHCrypto_apply(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		crypto      SSHCrypto
+		expect      ssh.Config
+		expectError bool
+	}{
+		{"Defaults are kept", SSHCrypto{}, ssh.Config{}, false},
+		{"Algorithms are set", SSHCrypto{
+			KeyExchanges: []string{"curve25519-sha256"},
+			Ciphers:      []string{"aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"},
+			MACs:         []string{"hmac-sha2-512-etm@openssh.com"},
+		}, ssh.Config{
+			KeyExchanges: []string{"curve25519-sha256"},
+			Ciphers:      []string{"aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"},
+			MACs:         []string{"hmac-sha2-512-etm@openssh.com"},
+		}, false},
+		{"Unknown ciphers are refused", SSHCrypto{Ciphers: []string{"aes256-gcm@openssh.com", "blowfish-cbc"}}, ssh.Config{}, true},
+		{"Unknown MACs are refused", SSHCrypto{MACs: []string{"hmac-md5"}}, ssh.Config{}, true},
+		{"Client only key exchanges are refused", SSHCrypto{KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}}, ssh.Config{}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var config ssh.Config
+
+			err := test.crypto.apply(&config)
+			if test.expectError {
+				assert.Error(t, err)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, config)
+		})
+	}
+}
+
+func TestSSH_SSHCrypto(t *testing.T) {
+	s := startTestSSH(t, Config{SSHCrypto: SSHCrypto{Ciphers: []string{"aes256-ctr"}, MACs: []string{"hmac-sha2-512"}}}, nil)
+
+	dial := func(ciphers ...string) error {
+		client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Config:          ssh.Config{Ciphers: ciphers},
+		})
+		if err == nil {
+			client.Close()
+		}
+
+		return err
+	}
+
+	assert.NoError(t, dial("aes256-ctr"))
+	assert.Error(t, dial("aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com"))
+
+	bad := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), SSHCrypto: SSHCrypto{Ciphers: []string{"arcfour512"}}})
+	if err := bad.Listen("127.0.0.1:0"); !assert.Error(t, err) {
+		bad.Stop()
+	}
+}
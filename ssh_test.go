@@ -0,0 +1,589 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testHostKeyPEM(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestSSH_loadHostSigners(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edSigner, err := ssh.NewSignerFromSigner(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		config      Config
+		signers     []ssh.Signer
+		expectKeys  int
+		expectError bool
+	}{
+		{"No keys configured", Config{}, nil, 0, true},
+		{"Keys from bytes", Config{HostKeys: [][]byte{testHostKeyPEM(t)}}, nil, 1, false},
+		{"Invalid key bytes", Config{HostKeys: [][]byte{[]byte("nope")}}, nil, 0, true},
+		{"Keys from signer", Config{}, []ssh.Signer{edSigner}, 1, false},
+		{"Keys from both", Config{HostKeys: [][]byte{testHostKeyPEM(t)}}, []ssh.Signer{edSigner}, 2, false},
+		{"Keys from KeyDir", Config{KeyDir: t.TempDir()}, nil, 1, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSSH(test.config)
+			for _, signer := range test.signers {
+				s.AddHostSigner(signer)
+			}
+
+			signers, err := s.loadHostSigners()
+			if err != nil && !test.expectError {
+				t.Errorf("unexpected error: %v", err)
+			} else if err == nil && test.expectError {
+				t.Error("expected error")
+			}
+
+			if len(signers) != test.expectKeys {
+				t.Errorf("expected %d keys, received %d", test.expectKeys, len(signers))
+			}
+		})
+	}
+}
+
+func Test_newPublicKeyLookup(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := newPublicKeyLookup(key)
+
+	if lookup.Type != ssh.KeyAlgoED25519 {
+		t.Errorf("expected %q, received %q", ssh.KeyAlgoED25519, lookup.Type)
+	}
+
+	if expect := ssh.FingerprintSHA256(key); lookup.Fingerprint != expect {
+		t.Errorf("expected %q, received %q", expect, lookup.Fingerprint)
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(lookup.Payload))
+	if err != nil {
+		t.Fatalf("payload is not in authorized_keys format: %v", err)
+	}
+
+	if ssh.FingerprintSHA256(parsed) != lookup.Fingerprint {
+		t.Error("payload does not round trip")
+	}
+}
+
+// startTestSSH runs an SSH server on a random local port for the duration
+// of the test, configuring it with setup before it starts listening
+func startTestSSH(t *testing.T, cfg Config, setup func(*SSH)) *SSH {
+	t.Helper()
+
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+
+	if cfg.KeyDir == "" && len(cfg.HostKeys) == 0 {
+		cfg.KeyDir = t.TempDir()
+	}
+
+	s := NewSSH(cfg)
+	if setup != nil {
+		setup(s)
+	}
+
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve()
+	t.Cleanup(func() { s.Stop() })
+
+	return s
+}
+
+// testGit runs git in dir, talking to s via the system ssh client
+func testGit(t *testing.T, s *SSH, dir string, args ...string) (string, error) {
+	t.Helper()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR -p "+port,
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	return string(out), err
+}
+
+// testWorkTree creates a local repository with a single commit on main
+func testWorkTree(t *testing.T, s *SSH) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		if out, err := testGit(t, s, dir, args...); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	return dir
+}
+
+func testRemote(s *SSH, repo string) string {
+	return "ssh://git@" + s.Address() + "/" + repo
+}
+
+func TestSSH_AuthorisePushFunc(t *testing.T) {
+	var received *PushRequest
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthorisePushFunc = func(_ context.Context, _ *GitCommand, push *PushRequest) error {
+			received = push
+
+			for _, opt := range push.Options {
+				if opt == "deny" {
+					return fmt.Errorf("denied by push option")
+				}
+			}
+
+			return nil
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", "-o", "deny", testRemote(s, "test.git"), "main")
+	if err == nil {
+		t.Fatalf("expected push to be rejected\n%s", out)
+	}
+
+	if !strings.Contains(out, "Push rejected: denied by push option") {
+		t.Errorf("expected rejection message, received\n%s", out)
+	}
+
+	out, err = testGit(t, s, work, "push", "-o", "ticket=123", testRemote(s, "test.git"), "main")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	if received == nil || len(received.Updates) != 1 {
+		t.Fatalf("expected a single ref update, received %#v", received)
+	}
+
+	if received.Updates[0].Ref != "refs/heads/main" || received.Updates[0].Action() != BranchCreateAction {
+		t.Errorf("unexpected update %#v", received.Updates[0])
+	}
+
+	if len(received.Options) != 1 || received.Options[0] != "ticket=123" {
+		t.Errorf("unexpected push options %#v", received.Options)
+	}
+}
+
+// testSSHClient connects to s using the go ssh client, for tests which need
+// to drive the protocol more directly than git does
+func testSSHClient(t *testing.T, s *SSH) *ssh.Client {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestSSH_SubsystemHandlers(t *testing.T) {
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.SubsystemHandlers = map[string]func(context.Context, ssh.Channel, *ssh.Request){
+			"echo": func(_ context.Context, ch ssh.Channel, _ *ssh.Request) {
+				io.Copy(ch, io.LimitReader(ch, 5))
+			},
+		}
+	})
+
+	client := testSSHClient(t, s)
+
+	t.Run("Known subsystem", func(t *testing.T) {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		stdin, _ := sess.StdinPipe()
+		stdout, _ := sess.StdoutPipe()
+
+		if err := sess.RequestSubsystem("echo"); err != nil {
+			t.Fatal(err)
+		}
+
+		stdin.Write([]byte("hello"))
+
+		out, err := io.ReadAll(stdout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(out) != "hello" {
+			t.Errorf("expected %q, received %q", "hello", out)
+		}
+	})
+
+	t.Run("Unknown subsystem", func(t *testing.T) {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		if err := sess.RequestSubsystem("sftp"); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestSSH_AuthorisePushFunc_GitConfig(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.AuthorisePushFunc = func(_ context.Context, _ *GitCommand, push *PushRequest) error {
+			push.GitConfig = append(push.GitConfig, "receive.denyNonFastForwards=true")
+			return nil
+		}
+	})
+
+	work := testWorkTree(t, s)
+
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	if out, err := testGit(t, s, work, "commit", "-q", "--amend", "--allow-empty", "-m", "rewritten"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	out, err := testGit(t, s, work, "push", "--force", testRemote(s, "test.git"), "main")
+	if err == nil {
+		t.Fatalf("expected force push to be refused\n%s", out)
+	}
+
+	if !strings.Contains(out, "non-fast-forward") {
+		t.Errorf("expected non-fast-forward rejection, received\n%s", out)
+	}
+}
+
+func TestSSH_PublicKeyLookupFunc_Disconnect(t *testing.T) {
+	called := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	s := startTestSSH(t, Config{Auth: true}, func(s *SSH) {
+		s.PublicKeyLookupFunc = func(ctx context.Context, _ PublicKeyLookup) (*PublicKey, error) {
+			close(called)
+
+			select {
+			case <-ctx.Done():
+				close(cancelled)
+			case <-time.After(10 * time.Second):
+			}
+
+			return nil, fmt.Errorf("lookup abandoned")
+		}
+	})
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ssh.NewClientConn(conn, s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup not called")
+	}
+
+	conn.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected lookup context to be cancelled on disconnect")
+	}
+}
+
+func TestSSH_EnvRequests(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true}, nil)
+	client := testSSHClient(t, s)
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	if err := sess.Setenv("LD_PRELOAD", "/tmp/evil.so"); err == nil {
+		t.Error("expected LD_PRELOAD to be refused")
+	}
+
+	if err := sess.Setenv("GIT_PROTOCOL", "version=2"); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, _ := sess.StdoutPipe()
+	stdin, _ := sess.StdinPipe()
+
+	if err := sess.Start("git-upload-pack 'test.git'"); err != nil {
+		t.Fatal(err)
+	}
+
+	line, _, err := readPktLine(stdout)
+	stdin.Write([]byte("0000"))
+	stdin.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(line)) != "version 2" {
+		t.Errorf("expected protocol v2 advertisement, received %q", line)
+	}
+}
+
+func TestSSH_PublicKeyLookupFunc_Metadata(t *testing.T) {
+	type account struct {
+		Org   string
+		Roles []string
+	}
+
+	var signers []ssh.Signer
+	for i := 0; i < 2; i++ {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	rejected := ssh.FingerprintSHA256(signers[0].PublicKey())
+
+	s := startTestSSH(t, Config{Auth: true}, func(s *SSH) {
+		s.PublicKeyLookupFunc = func(_ context.Context, key PublicKeyLookup) (*PublicKey, error) {
+			if key.Fingerprint == rejected {
+				return nil, fmt.Errorf("unknown key")
+			}
+
+			return &PublicKey{
+				Id:       "2",
+				Content:  key.Payload,
+				Metadata: &account{Org: "acme", Roles: []string{"admin"}},
+			}, nil
+		}
+
+		s.Commands = map[string]CommandFunc{
+			"whoami": func(ctx context.Context, ch ssh.Channel, _ []string) error {
+				pk := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+				acct, ok := pk.Metadata.(*account)
+				if !ok {
+					return fmt.Errorf("unexpected metadata %#v", pk.Metadata)
+				}
+
+				fmt.Fprintf(ch, "%s %s %s %v", pk.Id, acct.Org, acct.Roles[0], pk.Content != "")
+
+				return nil
+			},
+		}
+	})
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	out, err := sess.CombinedOutput("whoami")
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	if string(out) != "2 acme admin true" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 || sessions[0].PublicKey.Metadata == nil {
+		t.Errorf("expected the session registry to hold the key, received %#v", sessions)
+	}
+}
+
+func TestSSH_ChattyStderr(t *testing.T) {
+	// Far more stderr than a pipe holds, written before any of the pack
+	git := filepath.Join(t.TempDir(), "git")
+	script := "#!/bin/sh\n[ \"$1\" = upload-pack ] && head -c 1048576 /dev/zero | tr '\\0' x >&2\nexec git \"$@\"\n"
+	if err := os.WriteFile(git, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestSSH(t, Config{AutoCreate: true, GitPath: git, UploadPackTimeout: time.Minute}, nil)
+
+	work := testWorkTree(t, s)
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	out, err := testGit(t, s, t.TempDir(), "clone", "-q", testRemote(s, "test.git"), ".")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := strings.Count(out, "x"); n < 1<<20 {
+		t.Errorf("expected %d bytes of stderr, received %d", 1<<20, n)
+	}
+}
+
+func TestSSH_ServerVersion(t *testing.T) {
+	s := startTestSSH(t, Config{ServerVersion: "SSH-2.0-OpenSSH_9.6"}, func(s *SSH) {
+		s.BannerCallback = func(_ context.Context, conn ssh.ConnMetadata) string {
+			return "Authorised use only, " + conn.User() + "\n"
+		}
+	})
+
+	var banner string
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(msg string) error {
+			banner = msg
+
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if v := string(client.ServerVersion()); v != "SSH-2.0-OpenSSH_9.6" {
+		t.Errorf("unexpected server version %q", v)
+	}
+
+	if banner != "Authorised use only, git\n" {
+		t.Errorf("unexpected banner %q", banner)
+	}
+
+	for _, version := range []string{"gitkit", "SSH-2.0-gitkit\r\nextra"} {
+		bad := NewSSH(Config{Dir: t.TempDir(), KeyDir: t.TempDir(), ServerVersion: version})
+		if err := bad.Listen("127.0.0.1:0"); err == nil {
+			bad.Stop()
+			t.Errorf("expected server version %q to be refused", version)
+		}
+	}
+}
+
+func TestSSH_TmpDir(t *testing.T) {
+	tmp := t.TempDir()
+
+	s := startTestSSH(t, Config{AutoCreate: true, TmpDir: tmp}, nil)
+	work := testWorkTree(t, s)
+
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	// Hooks run by receive-pack inherit its environment
+	seen := filepath.Join(t.TempDir(), "tmpdir")
+	hook := filepath.Join(s.config.Dir, "test", "hooks", "pre-receive")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\necho \"$TMPDIR\" > "+seen+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main:other"); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	got, err := os.ReadFile(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(got)) != tmp {
+		t.Errorf("expected git to be given TMPDIR %q, received %q", tmp, got)
+	}
+}
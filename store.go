@@ -0,0 +1,216 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrStoreKeyNotFound is returned by Store.Get for keys which do not exist
+var ErrStoreKeyNotFound = errors.New("store: key not found")
+
+// Store persists server operational state, such as quotas and key usage.
+// Keys are slash separated paths, such as "usage/keys/1234", which allows
+// related values to be listed by prefix.
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+}
+
+func validStoreKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("store: invalid key %q", key)
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("store: invalid key %q", key)
+		}
+	}
+
+	return nil
+}
+
+// MemoryStore is a Store which holds everything in memory, and so loses
+// state on restart. It is the default for new servers.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (m *MemoryStore) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	v, ok := m.data[key]
+	if !ok {
+		return nil, ErrStoreKeyNotFound
+	}
+
+	return append([]byte{}, v...), nil
+}
+
+func (m *MemoryStore) Put(key string, value []byte) error {
+	if err := validStoreKey(key); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, key)
+
+	return nil
+}
+
+func (m *MemoryStore) List(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []string{}
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// FileStore is a Store which keeps each key in its own file beneath Dir
+type FileStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{Dir: dir}, nil
+}
+
+func (f *FileStore) path(key string) (string, error) {
+	if err := validStoreKey(key); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(f.Dir, filepath.FromSlash(key)), nil
+}
+
+func (f *FileStore) Get(key string) ([]byte, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrStoreKeyNotFound
+	}
+
+	return data, err
+}
+
+// Put writes value to a temporary file and renames it into place, so
+// readers never see a partially written value
+func (f *FileStore) Put(key string, value []byte) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *FileStore) Delete(key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (f *FileStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+
+	err := filepath.WalkDir(f.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.Dir, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	sort.Strings(keys)
+
+	return keys, err
+}
@@ -0,0 +1,47 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, s Store) {
+	_, err := s.Get("missing")
+	assert.ErrorIs(t, err, ErrStoreKeyNotFound)
+
+	assert.NoError(t, s.Put("usage/keys/1", []byte("one")))
+	assert.NoError(t, s.Put("usage/keys/2", []byte("two")))
+	assert.NoError(t, s.Put("quotas/repo", []byte("100")))
+	assert.NoError(t, s.Put("usage/keys/1", []byte("uno")))
+
+	v, err := s.Get("usage/keys/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "uno", string(v))
+
+	keys, err := s.List("usage/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"usage/keys/1", "usage/keys/2"}, keys)
+
+	assert.NoError(t, s.Delete("usage/keys/1"))
+	assert.NoError(t, s.Delete("usage/keys/1"))
+
+	keys, err = s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"quotas/repo", "usage/keys/2"}, keys)
+
+	for _, key := range []string{"", "/abs", "../escape", "a//b", "a/./b"} {
+		assert.Error(t, s.Put(key, nil), key)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+
+	testStore(t, s)
+}
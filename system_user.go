@@ -0,0 +1,140 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Ways of running git as a system account, for Config.SystemUsers
+const (
+	// SystemUsersOff runs git as the server's own user
+	SystemUsersOff = ""
+
+	// SystemUsersSudo runs git through sudo -n -u <user>. The server's
+	// user needs a sudoers rule allowing it to run git as each account
+	// without a password, with SETENV so that the HookEnv variables and
+	// the client's allowed env reach git.
+	SystemUsersSudo = "sudo"
+
+	// SystemUsersSetuid starts git with the account's uid, gid and
+	// supplementary groups, which requires the server to run as root
+	SystemUsersSetuid = "setuid"
+)
+
+// systemUser returns the account git should run as for the connection, or
+// "" for the server's own user
+func (s SSH) systemUser(ctx context.Context) (string, error) {
+	if s.config.SystemUsers == SystemUsersOff || s.SystemUserFunc == nil {
+		return "", nil
+	}
+
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+	return s.SystemUserFunc(ctx, pk)
+}
+
+// gitCommand builds the command running git with args for the connection,
+// as the system user it maps to when Config.SystemUsers is set, confined by
+// Sandbox when one is given
+func (s SSH) gitCommand(ctx context.Context, env []string, args ...string) (*exec.Cmd, error) {
+	return s.programCommand(ctx, s.config.GitPath, env, args...)
+}
+
+// programCommand is gitCommand for program, which is git unless a
+// RewriteCommandFunc chose another binary
+func (s SSH) programCommand(ctx context.Context, program string, env []string, args ...string) (*exec.Cmd, error) {
+	cmd, err := s.systemCommand(ctx, program, append(env, s.config.tmpEnv()...), args...)
+	if err != nil || s.Sandbox == nil {
+		return cmd, err
+	}
+
+	if err := s.Sandbox.Sandbox(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+func (s SSH) systemCommand(ctx context.Context, program string, env []string, args ...string) (*exec.Cmd, error) {
+	name, err := s.systemUser(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: unable to map system user: %w", err)
+	}
+
+	if name == "" {
+		cmd := exec.Command(program, args...)
+		cmd.Env = append(os.Environ(), env...)
+
+		return cmd, nil
+	}
+
+	switch s.config.SystemUsers {
+	case SystemUsersSudo:
+		keep := make([]string, 0, len(env))
+		for _, kv := range env {
+			keep = append(keep, strings.SplitN(kv, "=", 2)[0])
+		}
+
+		sudoArgs := []string{"-n", "-u", name}
+		if len(keep) > 0 {
+			sudoArgs = append(sudoArgs, "--preserve-env="+strings.Join(keep, ","))
+		}
+
+		cmd := exec.Command("sudo", append(append(sudoArgs, "--", program), args...)...)
+		cmd.Env = append(os.Environ(), env...)
+
+		return cmd, nil
+
+	case SystemUsersSetuid:
+		cred, err := lookupCredential(name)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd := exec.Command(program, args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+
+		return cmd, nil
+	}
+
+	return nil, fmt.Errorf("ssh: unknown system users mode %q", s.config.SystemUsers)
+}
+
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid uid %q", name, u.Uid)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid gid %q", name, u.Gid)
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+
+	return cred, nil
+}
@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"context"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSystemUserSSH(mode string) *SSH {
+	s := NewSSH(Config{SystemUsers: mode})
+	s.SystemUserFunc = func(_ context.Context, pk PublicKey) (string, error) {
+		if pk.Id == "server" {
+			return "", nil
+		}
+
+		return "nobody", nil
+	}
+
+	return s
+}
+
+func TestSSH_gitCommand_Off(t *testing.T) {
+	ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "alice"})
+
+	cmd, err := testSystemUserSSH(SystemUsersOff).gitCommand(ctx, nil, "upload-pack", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git", "upload-pack", "repo"}, cmd.Args)
+	assert.Nil(t, cmd.SysProcAttr)
+}
+
+func TestSSH_gitCommand_Sudo(t *testing.T) {
+	s := testSystemUserSSH(SystemUsersSudo)
+
+	ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "alice"})
+
+	cmd, err := s.gitCommand(ctx, []string{"GITKIT_KEY=alice", "GIT_PROTOCOL=version=2"}, "upload-pack", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sudo", "-n", "-u", "nobody", "--preserve-env=GITKIT_KEY,GIT_PROTOCOL", "--", "git", "upload-pack", "repo"}, cmd.Args)
+
+	// Keys mapped to no account run as the server
+	ctx = context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "server"})
+
+	cmd, err = s.gitCommand(ctx, nil, "upload-pack", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "git", cmd.Args[0])
+}
+
+func TestSSH_gitCommand_Setuid(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "alice"})
+
+	cmd, err := testSystemUserSSH(SystemUsersSetuid).gitCommand(ctx, nil, "upload-pack", "repo")
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, cmd.SysProcAttr) && assert.NotNil(t, cmd.SysProcAttr.Credential) {
+		assert.Equal(t, nobody.Uid, strconv.Itoa(int(cmd.SysProcAttr.Credential.Uid)))
+	}
+}
+
+func TestSSH_gitCommand_Unknown(t *testing.T) {
+	ctx := context.WithValue(context.Background(), PublicKeyContextKey{}, PublicKey{Id: "alice"})
+
+	_, err := testSystemUserSSH("su").gitCommand(ctx, nil, "upload-pack", "repo")
+	assert.Error(t, err)
+}
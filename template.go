@@ -0,0 +1,126 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Defaults for the initial commit made from RepoTemplate.Dir
+const (
+	DefaultTemplateMessage     = "Initial commit"
+	DefaultTemplateAuthorName  = "gitkit"
+	DefaultTemplateAuthorEmail = "gitkit@localhost"
+)
+
+// RepoTemplate seeds repositories as AutoCreate initialises them
+type RepoTemplate struct {
+	DefaultBranch string            // Branch HEAD points at, such as main. git's default when empty.
+	Dir           string            // Files, such as README and LICENSE, committed to the default branch as the first commit
+	Config        map[string]string // git config values set in the new repository, such as receive.denyNonFastForwards
+	Message       string            // Message of the first commit. Defaults to DefaultTemplateMessage.
+	AuthorName    string            // Author of the first commit. Defaults to DefaultTemplateAuthorName.
+	AuthorEmail   string            // Defaults to DefaultTemplateAuthorEmail
+}
+
+// apply seeds the bare repository at path from the template
+func (t *RepoTemplate) apply(gitPath, tmpDir, path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	git := func(env []string, stdin []byte, args ...string) (string, error) {
+		cmd := exec.Command(gitPath, append([]string{"--git-dir", path}, args...)...)
+		cmd.Env = append(os.Environ(), env...)
+		if tmpDir != "" {
+			cmd.Env = append(cmd.Env, "TMPDIR="+tmpDir)
+		}
+		cmd.Stdin = bytes.NewReader(stdin)
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("template: git %s: %w", strings.Join(args, " "), err)
+		}
+
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if t.DefaultBranch != "" {
+		if _, err := git(nil, nil, "symbolic-ref", "HEAD", "refs/heads/"+t.DefaultBranch); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(t.Config))
+	for k := range t.Config {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if _, err := git(nil, nil, "config", k, t.Config[k]); err != nil {
+			return err
+		}
+	}
+
+	if t.Dir == "" {
+		return nil
+	}
+
+	return t.commit(tmpDir, git)
+}
+
+// commit records the files in Dir as the first commit on HEAD, using a
+// throwaway index since bare repositories have no work tree
+func (t *RepoTemplate) commit(tmpDir string, git func(env []string, stdin []byte, args ...string) (string, error)) error {
+	index, err := os.CreateTemp(tmpDir, "gitkit-template-index")
+	if err != nil {
+		return err
+	}
+
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+
+	dir, err := filepath.Abs(t.Dir)
+	if err != nil {
+		return err
+	}
+
+	env := []string{
+		"GIT_INDEX_FILE=" + index.Name(),
+		"GIT_AUTHOR_NAME=" + defaultValue(DefaultTemplateAuthorName, t.AuthorName),
+		"GIT_AUTHOR_EMAIL=" + defaultValue(DefaultTemplateAuthorEmail, t.AuthorEmail),
+		"GIT_COMMITTER_NAME=" + defaultValue(DefaultTemplateAuthorName, t.AuthorName),
+		"GIT_COMMITTER_EMAIL=" + defaultValue(DefaultTemplateAuthorEmail, t.AuthorEmail),
+	}
+
+	if _, err := git(env, nil, "-C", dir, "--work-tree", dir, "add", "--all", "."); err != nil {
+		return err
+	}
+
+	tree, err := git(env, nil, "write-tree")
+	if err != nil {
+		return err
+	}
+
+	commit, err := git(env, []byte(defaultValue(DefaultTemplateMessage, t.Message)), "commit-tree", tree)
+	if err != nil {
+		return err
+	}
+
+	branch, err := git(nil, nil, "symbolic-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	_, err = git(nil, nil, "update-ref", branch, commit, ZeroSHA)
+
+	return err
+}
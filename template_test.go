@@ -0,0 +1,80 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTemplateDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("# New project\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "LICENSE"), []byte("MIT\n"), 0644)
+
+	return dir
+}
+
+func TestRepoTemplate_apply(t *testing.T) {
+	cfg := Config{
+		GitPath: "git",
+		RepoTemplate: &RepoTemplate{
+			DefaultBranch: "trunk",
+			Dir:           testTemplateDir(t),
+			Config:        map[string]string{"receive.denyNonFastForwards": "true"},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "test")
+	assert.NoError(t, initRepo(path, &cfg))
+
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", path}, args...)...).Output()
+		assert.NoError(t, err, args)
+
+		return strings.TrimSpace(string(out))
+	}
+
+	assert.Equal(t, "refs/heads/trunk", git("symbolic-ref", "HEAD"))
+	assert.Equal(t, "true", git("config", "receive.denyNonFastForwards"))
+	assert.Equal(t, "LICENSE\nREADME.md", git("ls-tree", "--name-only", "trunk"))
+	assert.Equal(t, "Initial commit", git("log", "-1", "--format=%s", "trunk"))
+	assert.Equal(t, DefaultTemplateAuthorName, git("log", "-1", "--format=%an", "trunk"))
+}
+
+func TestSSH_TemplateFunc(t *testing.T) {
+	templates := testTemplateDir(t)
+
+	s := startTestSSH(t, Config{AutoCreate: true}, func(s *SSH) {
+		s.TemplateFunc = func(_ context.Context, cmd *GitCommand) (*RepoTemplate, error) {
+			if cmd.Repo == "empty" {
+				return nil, nil
+			}
+
+			return &RepoTemplate{DefaultBranch: "main", Dir: templates, Message: "Seed " + cmd.Repo}, nil
+		}
+	})
+
+	clone := t.TempDir()
+
+	out, err := testGit(t, s, clone, "clone", testRemote(s, "seeded.git"), ".")
+	assert.NoError(t, err, out)
+
+	readme, err := os.ReadFile(filepath.Join(clone, "README.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# New project\n", string(readme))
+
+	out, _ = testGit(t, s, clone, "log", "--format=%s")
+	assert.Equal(t, "Seed seeded", strings.TrimSpace(out))
+
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "empty.git"), ".")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "empty repository")
+}
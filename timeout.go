@@ -0,0 +1,82 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// EventOperationTimeout is emitted when git is killed for running longer
+// than Config.UploadPackTimeout or Config.ReceivePackTimeout
+const EventOperationTimeout = "operation.timeout"
+
+// ErrOperationTimeout is returned when git runs longer than
+// Config.UploadPackTimeout or Config.ReceivePackTimeout allow
+var ErrOperationTimeout = errors.New("operation timed out")
+
+// OperationTimeout is passed to the MsgOperationTimeout template
+type OperationTimeout struct {
+	Repo      string
+	Operation string // "fetch" or "push"
+	Timeout   time.Duration
+}
+
+// operationTimeout returns a context which expires once gitcmd has run for
+// as long as its timeout allows, or ctx itself when it has none
+func (s SSH) operationTimeout(ctx context.Context, gitcmd *GitCommand) (context.Context, context.CancelFunc) {
+	timeout := s.config.UploadPackTimeout
+	if gitcmd.IsWrite() {
+		timeout = s.config.ReceivePackTimeout
+	}
+
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// killOnTimeout kills cmd, which must have been started in its own process
+// group, and anything it has started, such as pack-objects, once ctx's
+// deadline passes. The returned function stops the watch.
+func killOnTimeout(ctx context.Context, cmd *exec.Cmd) func() bool {
+	if _, ok := ctx.Deadline(); !ok {
+		return func() bool { return true }
+	}
+
+	return context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	})
+}
+
+// timedOut wraps err in ErrOperationTimeout when ctx's deadline has passed
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrOperationTimeout, err)
+	}
+
+	return err
+}
+
+// reportTimeout tells the client their fetch or push took too long
+func (s SSH) reportTimeout(ctx context.Context, sess *session, ch ssh.Channel, gitcmd *GitCommand) {
+	info := OperationTimeout{Repo: gitcmd.Repo, Operation: "fetch", Timeout: s.config.UploadPackTimeout}
+	if gitcmd.IsWrite() {
+		info.Operation, info.Timeout = "push", s.config.ReceivePackTimeout
+	}
+
+	ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgOperationTimeout, info)))
+	sendExitStatus(ch, 1)
+
+	s.emit(ctx, Event{Type: EventOperationTimeout, Repo: gitcmd.Repo, Data: map[string]string{
+		"operation": info.Operation,
+		"timeout":   info.Timeout.String(),
+	}})
+}
@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_ReceivePackTimeout(t *testing.T) {
+	var mu sync.Mutex
+	events := []Event{}
+
+	s := startTestSSH(t, Config{AutoCreate: true, ReceivePackTimeout: 500 * time.Millisecond}, func(s *SSH) {
+		s.EventFunc = func(_ context.Context, e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if e.Type == EventOperationTimeout {
+				events = append(events, e)
+			}
+		}
+	})
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	hook := filepath.Join(s.config.Dir, "test", "hooks", "pre-receive")
+	assert.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\nsleep 30\n"), 0755))
+
+	testCommitRandom(t, s, work, "slow", 16)
+
+	start := time.Now()
+	out, err = testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Your push of test was stopped after 500ms")
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "push", events[0].Data["operation"])
+	}
+}
+
+func TestSSH_UploadPackTimeout(t *testing.T) {
+	git := filepath.Join(t.TempDir(), "git")
+	assert.NoError(t, os.WriteFile(git, []byte("#!/bin/sh\n[ \"$1\" = upload-pack ] && sleep 30\nexec git \"$@\"\n"), 0755))
+
+	s := startTestSSH(t, Config{AutoCreate: true, GitPath: git, UploadPackTimeout: 500 * time.Millisecond}, nil)
+
+	work := testWorkTree(t, s)
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	assert.NoError(t, err, out)
+
+	start := time.Now()
+	out, err = testGit(t, s, t.TempDir(), "clone", testRemote(s, "test.git"), ".")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Your fetch of test was stopped after 500ms")
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func Test_timedOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+
+	<-ctx.Done()
+
+	assert.ErrorIs(t, timedOut(ctx, assert.AnError), ErrOperationTimeout)
+	assert.NoError(t, timedOut(ctx, nil))
+	assert.NotErrorIs(t, timedOut(context.Background(), assert.AnError), ErrOperationTimeout)
+}
@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+)
+
+// TokenUser is the user clients authenticated by UsernameTokenFunc are
+// given in place of the username they connected with, which is their token
+const TokenUser = "token"
+
+// tokenFingerprintPrefix marks the fingerprints given to identities from
+// UsernameTokenFunc, which have no key of their own
+const tokenFingerprintPrefix = "token:"
+
+// usernameTokenCallback authenticates the ssh "none" method clients try
+// first with UsernameTokenFunc, so that the username alone is the
+// credential. PreLoginFunc is not called, since token usernames are never
+// Config.GitUser.
+func (s *SSH) usernameTokenCallback(parent context.Context) func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata) (perms *ssh.Permissions, err error) {
+		// The username is a credential, so is kept out of the span
+		ctx, span := s.startSpan(parent, "gitkit.auth", attribute.String("gitkit.auth.method", "username-token"))
+		defer func() { endSpan(span, err) }()
+
+		ctx = context.WithValue(ctx, UserContextKey{}, TokenUser)
+
+		pkey, err := s.UsernameTokenFunc(ctx, conn.User())
+		if err != nil {
+			return nil, err
+		}
+
+		if pkey == nil {
+			return nil, fmt.Errorf("token handler did not return a key")
+		}
+
+		if pkey.Fingerprint == "" {
+			pkey.Fingerprint = tokenFingerprintPrefix + pkey.Id
+		}
+
+		span.SetAttributes(attribute.String("gitkit.key.id", pkey.Id))
+
+		return s.acceptKey(parent, ctx, TokenUser, *pkey)
+	}
+}
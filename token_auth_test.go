@@ -0,0 +1,88 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func testTokenDial(s *SSH, user string, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+func testUsernameTokens(_ context.Context, username string) (*PublicKey, error) {
+	switch strings.TrimPrefix(username, "token-") {
+	case "ci":
+		return &PublicKey{Id: "ci", Name: "ci"}, nil
+	case "stale":
+		return &PublicKey{Id: "stale", ExpiresAt: time.Now().Add(-time.Minute)}, nil
+	}
+
+	return nil, errors.New("not a token")
+}
+
+func TestSSH_UsernameTokenFunc(t *testing.T) {
+	signer := testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(signer.PublicKey()): {Id: "alice"},
+	}, func(s *SSH) {
+		s.UsernameTokenFunc = testUsernameTokens
+	})
+
+	client, err := testTokenDial(s, "token-ci")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	out, err := testClientRun(t, client, "whoami")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", out)
+
+	// The token is not kept as the user
+	sessions := s.Sessions()
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, TokenUser, sessions[0].User)
+	}
+
+	for _, user := range []string{"token-unknown", "token-stale"} {
+		_, err := testTokenDial(s, user)
+		assert.Error(t, err, user)
+	}
+
+	// Usernames which are not tokens fall back to keys
+	keyed, err := testTokenDial(s, "git", ssh.PublicKeys(signer))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer keyed.Close()
+
+	out, err = testClientRun(t, keyed, "whoami")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", out)
+}
+
+func TestSSH_UsernameTokenFunc_WithoutKeys(t *testing.T) {
+	s := startTestSSH(t, Config{Auth: true}, func(s *SSH) {
+		s.UsernameTokenFunc = testUsernameTokens
+	})
+
+	client, err := testTokenDial(s, "token-ci")
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.Close()
+
+	_, err = testTokenDial(s, "git", ssh.PublicKeys(testClientSigner(t)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name gitkit's spans are recorded under
+const TracerName = "github.com/jspc/gitkit"
+
+// Environment variables carrying the trace context of a command to git,
+// and so to its hooks
+const (
+	TraceParentEnv = "TRACEPARENT"
+	TraceStateEnv  = "TRACESTATE"
+)
+
+// tracer returns the tracer spans are recorded with, from tp or, when nil,
+// the global TracerProvider
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return tp.Tracer(TracerName, trace.WithInstrumentationVersion(Version))
+}
+
+func (s SSH) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer(s.TracerProvider).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, against span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// commandAttributes describe a git command on its spans
+func commandAttributes(gitcmd *GitCommand) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gitkit.repo", gitcmd.Repo),
+		attribute.String("gitkit.operation", gitcmd.SubCommand()),
+	}
+}
+
+// envCarrier adapts environment variables, such as TRACEPARENT, to a
+// propagation.TextMapCarrier
+type envCarrier map[string]string
+
+func (c envCarrier) Get(key string) string {
+	return c[strings.ToUpper(key)]
+}
+
+func (c envCarrier) Set(key, value string) {
+	c[strings.ToUpper(key)] = value
+}
+
+func (c envCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// traceEnv returns the environment passing the span in ctx on to git
+func traceEnv(ctx context.Context) []string {
+	carrier := envCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	env := []string{}
+	for k, v := range carrier {
+		env = append(env, k+"="+v)
+	}
+
+	return env
+}
+
+// HookContext returns ctx carrying the trace gitkit passed to git in
+// TraceParentEnv, so that hooks run by git, such as a Receiver, can record
+// their spans as part of the push that ran them
+func HookContext(ctx context.Context) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, envCarrier{
+		TraceParentEnv: os.Getenv(TraceParentEnv),
+		TraceStateEnv:  os.Getenv(TraceStateEnv),
+	})
+}
@@ -0,0 +1,169 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+func testTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	return tp, recorder
+}
+
+// testEndedSpans waits for a span named last to end, returning the ended
+// spans by name
+func testEndedSpans(t *testing.T, recorder *tracetest.SpanRecorder, last string) map[string][]sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		spans := map[string][]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = append(spans[span.Name()], span)
+		}
+
+		if len(spans[last]) > 0 {
+			return spans
+		}
+	}
+
+	t.Fatalf("span %s never ended", last)
+
+	return nil
+}
+
+func TestSSH_TracerProvider(t *testing.T) {
+	tp, recorder := testTracerProvider(t)
+
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.TracerProvider = tp
+		s.AuthoriseOperationFunc = func(context.Context, *GitCommand) error { return nil }
+		s.AuthorisePushFunc = func(context.Context, *GitCommand, *PushRequest) error { return nil }
+	})
+
+	repo := filepath.Join(s.config.Dir, "test")
+	if err := initRepo(repo, s.config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook records the trace context git was run with
+	traceFile := filepath.Join(t.TempDir(), "traceparent")
+	hook := "#!/bin/sh\ncat >/dev/null\necho \"$TRACEPARENT\" > " + traceFile + "\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := testGit(t, s, testWorkTree(t, s), "push", testRemote(s, "test.git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	spans := testEndedSpans(t, recorder, "gitkit.connection")
+
+	for _, name := range []string{"gitkit.connection", "gitkit.handshake", "gitkit.command", "gitkit.authorise", "gitkit.authorise_push", "gitkit.exec"} {
+		if !assert.NotEmpty(t, spans[name], name) {
+			return
+		}
+	}
+
+	conn := spans["gitkit.connection"][0].SpanContext()
+	command := spans["gitkit.command"][0]
+
+	assert.Equal(t, conn.SpanID(), spans["gitkit.handshake"][0].Parent().SpanID())
+	assert.Equal(t, conn.SpanID(), command.Parent().SpanID())
+	assert.Equal(t, command.SpanContext().SpanID(), spans["gitkit.authorise"][0].Parent().SpanID())
+	assert.Equal(t, command.SpanContext().SpanID(), spans["gitkit.authorise_push"][0].Parent().SpanID())
+
+	// receive-pack is run once to advertise refs and again to apply the push
+	assert.Len(t, spans["gitkit.exec"], 2)
+	for _, exec := range spans["gitkit.exec"] {
+		assert.Equal(t, conn.TraceID(), exec.SpanContext().TraceID())
+	}
+
+	traceparent, err := os.ReadFile(traceFile)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(traceparent), conn.TraceID().String())
+	}
+}
+
+func TestSSH_TracerProvider_Auth(t *testing.T) {
+	tp, recorder := testTracerProvider(t)
+	known, unknown := testClientSigner(t), testClientSigner(t)
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		ssh.FingerprintSHA256(known.PublicKey()): {Id: "known", Name: "known"},
+	}, func(s *SSH) {
+		s.TracerProvider = tp
+	})
+
+	client, err := testKeyDial(s, known)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.Close()
+
+	_, err = testKeyDial(s, unknown)
+	assert.Error(t, err)
+
+	spans := testEndedSpans(t, recorder, "gitkit.connection")
+	for deadline := time.Now().Add(5 * time.Second); len(spans["gitkit.connection"]) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		spans = testEndedSpans(t, recorder, "gitkit.connection")
+	}
+
+	if !assert.Len(t, spans["gitkit.auth"], 2) {
+		return
+	}
+
+	outcomes := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans["gitkit.auth"] {
+		outcomes[span.Status().Code.String()] = span
+	}
+
+	if accepted, ok := outcomes["Unset"]; assert.True(t, ok) {
+		handshakes := map[trace.SpanID]bool{}
+		for _, hs := range spans["gitkit.handshake"] {
+			handshakes[hs.SpanContext().SpanID()] = true
+		}
+
+		assert.True(t, handshakes[accepted.Parent().SpanID()])
+	}
+
+	assert.Contains(t, outcomes, "Error")
+}
+
+func TestHookContext(t *testing.T) {
+	tp, recorder := testTracerProvider(t)
+
+	ctx, span := tracer(tp).Start(context.Background(), "push")
+	span.End()
+
+	for _, kv := range traceEnv(ctx) {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+
+	assert.Equal(t, span.SpanContext().TraceID(), trace.SpanContextFromContext(HookContext(context.Background())).TraceID())
+
+	// Receivers record their hook in the same trace, failures included
+	r := Receiver{TracerProvider: tp}
+	assert.Error(t, r.Handle(strings.NewReader("invalid\n")))
+
+	spans := testEndedSpans(t, recorder, "gitkit.hook")
+	hook := spans["gitkit.hook"][0]
+
+	assert.Equal(t, span.SpanContext().SpanID(), hook.Parent().SpanID())
+	assert.Equal(t, "Error", hook.Status().Code.String())
+}
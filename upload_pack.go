@@ -0,0 +1,352 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrDepthExceeded is returned when a shallow fetch asks for more history
+// than UploadPackOptions.MaxDepth allows
+var ErrDepthExceeded = errors.New("shallow fetch exceeds depth limit")
+
+// ErrFilterRequired is returned when a fetch does not filter out the blobs
+// UploadPackOptions.MaxBlobSize, or SSH.BlobLimitFunc, forbids
+var ErrFilterRequired = errors.New("fetch must filter out large blobs")
+
+// ErrBlobTooLarge is returned when a fetch asks for a blob by id, as
+// partial clones do lazily, which is over UploadPackOptions.MaxBlobSize
+var ErrBlobTooLarge = errors.New("blob exceeds size limit")
+
+// UploadPackOptions enable fetch features for repositories without their
+// own git config having to, by passing upload-pack -c options
+type UploadPackOptions struct {
+	AllowFilter        bool // Set uploadpack.allowFilter, serving partial clones such as --filter=blob:none
+	AllowAnySHA1InWant bool // Set uploadpack.allowAnySHA1InWant, serving fetches of any object by id rather than only those refs point to
+
+	// MaxDepth is the most commits a shallow fetch may ask for. Fetches
+	// deepening by date or by excluding refs are refused, since their depth
+	// cannot be told in advance. Zero is unlimited.
+	MaxDepth int
+
+	// MaxBlobSize is the largest blob served. Fetches must ask for a
+	// partial clone leaving out larger ones, such as with
+	// --filter=blob:limit=1m or --filter=blob:none, and are refused
+	// otherwise, as are fetches of larger blobs by id. Setting it allows
+	// filters, as AllowFilter does. Zero is unlimited.
+	MaxBlobSize int64
+}
+
+// DepthLimit is passed to the MsgDepthExceeded template
+type DepthLimit struct {
+	Repo  string
+	Limit int
+}
+
+// BlobLimit is passed to the MsgFilterRequired template
+type BlobLimit struct {
+	Repo  string
+	Limit int64
+}
+
+// gitConfig returns the -c options setting o for upload-pack
+func (o UploadPackOptions) gitConfig() []string {
+	args := []string{}
+
+	if o.AllowFilter || o.MaxBlobSize > 0 {
+		args = append(args, "-c", "uploadpack.allowFilter=true")
+	}
+
+	if o.AllowAnySHA1InWant {
+		args = append(args, "-c", "uploadpack.allowAnySHA1InWant=true")
+	}
+
+	return args
+}
+
+// applyBlobLimit replaces loc's MaxBlobSize with the one BlobLimitFunc
+// gives the client's key, when set
+func (s SSH) applyBlobLimit(ctx context.Context, gitcmd *GitCommand, loc *repoLocation) {
+	if s.BlobLimitFunc == nil || gitcmd.SubCommand() != OperationUploadPack {
+		return
+	}
+
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+	loc.UploadPack.MaxBlobSize = s.BlobLimitFunc(ctx, pk)
+}
+
+// guardFetch wraps what a client sends upload-pack so that shallow fetches
+// deeper than loc allows, and fetches not filtering out the blobs it
+// forbids, are refused, with the client told why in an ERR pkt-line
+func (s SSH) guardFetch(ctx context.Context, sess *session, w io.Writer, gitcmd *GitCommand, loc repoLocation, in io.Reader) io.Reader {
+	opts := loc.UploadPack
+	if (opts.MaxDepth <= 0 && opts.MaxBlobSize <= 0) || gitcmd.SubCommand() != OperationUploadPack {
+		return in
+	}
+
+	g := &fetchGuard{r: in, maxDepth: opts.MaxDepth, maxBlob: opts.MaxBlobSize, refuse: func(err error) {
+		log.Printf("ssh: %v", err)
+
+		locale := s.sessionLocale(ctx, sess)
+		limit := BlobLimit{Repo: gitcmd.Repo, Limit: opts.MaxBlobSize}
+
+		// Blob sizes which could not be checked are refused as too large
+		var msg string
+		switch {
+		case errors.Is(err, ErrDepthExceeded):
+			msg = s.config.Message(locale, MsgDepthExceeded, DepthLimit{Repo: gitcmd.Repo, Limit: opts.MaxDepth})
+
+		case errors.Is(err, ErrFilterRequired):
+			msg = s.config.Message(locale, MsgFilterRequired, limit)
+
+		default:
+			msg = s.config.Message(locale, MsgBlobTooLarge, limit)
+		}
+
+		packLine(w, "ERR "+strings.TrimRight(msg, "\r\n"))
+
+		// Clients may still be writing the rest of their request, and fail
+		// on the closed connection without reading why, so upload-pack is
+		// only stopped once they have read the error and hung up
+		io.Copy(io.Discard, in)
+	}}
+
+	if opts.MaxBlobSize > 0 {
+		g.checkWants = func(oids []string) error {
+			return checkBlobSizes(ctx, s.config.GitPath, loc.Path, oids, opts.MaxBlobSize)
+		}
+	}
+
+	return g
+}
+
+// checkBlobSizes returns ErrBlobTooLarge when any of oids names a blob over
+// max bytes in the repository at path
+func checkBlobSizes(ctx context.Context, gitPath, path string, oids []string, max int64) error {
+	cmd := exec.CommandContext(ctx, gitPath, "-C", path, "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	cmd.Stdin = strings.NewReader(strings.Join(oids, "\n") + "\n")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("blob sizes: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		// Objects git does not have are reported as "<oid> missing"
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+
+		if size, err := strconv.ParseInt(fields[2], 10, 64); err == nil && size > max {
+			return fmt.Errorf("%w: blob %s is %d bytes, limit %d", ErrBlobTooLarge, fields[0], size, max)
+		}
+	}
+
+	return nil
+}
+
+// fetchGuard passes pkt-lines through one at a time, checking the depth
+// each deepen line asks for, and that sections with wants carry a filter
+// line within maxBlob, before git sees them. upload-pack is only ever sent
+// pkt-lines, so anything else is passed straight through for git to
+// judge.
+type fetchGuard struct {
+	r        io.Reader
+	maxDepth int
+	maxBlob  int64
+	refuse   func(err error)
+	pending  []byte
+	raw      bool
+	err      error
+
+	// checkWants, when set, vets the objects each section wants
+	checkWants func(oids []string) error
+
+	// Whether the current section, up to the next flush, has wants and
+	// an acceptable filter, and the object ids it wants
+	wanted, filtered bool
+	wants            []string
+}
+
+func (g *fetchGuard) Read(p []byte) (int, error) {
+	for len(g.pending) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+
+		if g.raw {
+			return g.r.Read(p)
+		}
+
+		g.readLine()
+	}
+
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+
+	return n, nil
+}
+
+func (g *fetchGuard) readLine() {
+	line := make([]byte, 4)
+
+	n, err := io.ReadFull(g.r, line)
+	if err != nil {
+		g.pending, g.err = line[:n], err
+		return
+	}
+
+	l, err := strconv.ParseUint(string(line), 16, 16)
+	if err != nil || l == 3 || l > maxPktLen {
+		g.pending, g.raw = line, true
+		return
+	}
+
+	switch {
+	case l > 4:
+		line = append(line, make([]byte, l-4)...)
+
+		if n, err := io.ReadFull(g.r, line[4:]); err != nil {
+			g.pending, g.err = line[:4+n], err
+			return
+		}
+
+		err = g.check(strings.TrimSuffix(string(line[4:]), "\n"))
+
+	case l == 0:
+		err = g.endSection()
+	}
+
+	if err != nil {
+		g.err = err
+		g.refuse(err)
+
+		return
+	}
+
+	g.pending = line
+}
+
+// check refuses deepen lines going beyond g.maxDepth, and filter lines
+// letting through blobs over g.maxBlob
+func (g *fetchGuard) check(line string) error {
+	switch {
+	case strings.HasPrefix(line, "want "):
+		g.wanted = true
+
+		if fields := strings.Fields(line); len(fields) > 1 {
+			g.wants = append(g.wants, fields[1])
+		}
+
+	case strings.HasPrefix(line, "want-ref "):
+		g.wanted = true
+
+	case strings.HasPrefix(line, "filter ") && g.maxBlob > 0:
+		spec := strings.TrimPrefix(line, "filter ")
+		if !filterWithin(spec, g.maxBlob) {
+			return fmt.Errorf("%w: %s, limit %d bytes", ErrFilterRequired, line, g.maxBlob)
+		}
+
+		g.filtered = true
+	}
+
+	if g.maxDepth <= 0 {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "deepen-since ") || strings.HasPrefix(line, "deepen-not ") {
+		return fmt.Errorf("%w: %s", ErrDepthExceeded, line)
+	}
+
+	depth, ok := strings.CutPrefix(line, "deepen ")
+	if !ok {
+		return nil
+	}
+
+	if d, err := strconv.Atoi(depth); err != nil || d > g.maxDepth {
+		return fmt.Errorf("%w: %s, limit %d", ErrDepthExceeded, line, g.maxDepth)
+	}
+
+	return nil
+}
+
+// endSection refuses a section, ended by a flush, which wanted objects
+// without filtering out the blobs g.maxBlob forbids
+func (g *fetchGuard) endSection() error {
+	wanted, filtered, wants := g.wanted, g.filtered, g.wants
+	g.wanted, g.filtered, g.wants = false, false, nil
+
+	if g.maxBlob > 0 && wanted && !filtered {
+		return fmt.Errorf("%w: no filter, limit %d bytes", ErrFilterRequired, g.maxBlob)
+	}
+
+	if g.checkWants != nil && len(wants) > 0 {
+		return g.checkWants(wants)
+	}
+
+	return nil
+}
+
+// filterWithin reports whether the object filter spec leaves out every
+// blob over max bytes, as blob:none, tree:0 and blob:limit up to max do,
+// alone or combined with other filters
+func filterWithin(spec string, max int64) bool {
+	if filters, ok := strings.CutPrefix(spec, "combine:"); ok {
+		for _, f := range strings.Split(filters, "+") {
+			if f, err := url.PathUnescape(f); err == nil && filterWithin(f, max) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if spec == "blob:none" || spec == "tree:0" {
+		return true
+	}
+
+	limit, ok := strings.CutPrefix(spec, "blob:limit=")
+	if !ok {
+		return false
+	}
+
+	n, err := parseFilterSize(limit)
+
+	return err == nil && n <= max
+}
+
+// parseFilterSize parses a blob:limit size, which git allows a k, m or g
+// suffix on
+func parseFilterSize(s string) (int64, error) {
+	unit := int64(1)
+
+	if s != "" {
+		switch strings.ToLower(s[len(s)-1:]) {
+		case "k":
+			unit = 1 << 10
+		case "m":
+			unit = 1 << 20
+		case "g":
+			unit = 1 << 30
+		}
+	}
+
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid filter size %q", s)
+	}
+
+	return n * unit, nil
+}
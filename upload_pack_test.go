@@ -0,0 +1,234 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testHistory pushes a repository of three commits, with a README in each,
+// returning the work tree it was pushed from
+func testHistory(t *testing.T, s *SSH, repo string) string {
+	t.Helper()
+
+	work := testWorkTree(t, s)
+	for i, content := range []string{"one", "two"} {
+		if err := os.WriteFile(filepath.Join(work, "README"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, args := range [][]string{{"add", "README"}, {"commit", "-q", "-m", content}} {
+			if out, err := testGit(t, s, work, args...); err != nil {
+				t.Fatalf("commit %d: %v\n%s", i, err, out)
+			}
+		}
+	}
+
+	if out, err := testGit(t, s, work, "push", testRemote(s, repo+".git"), "main"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	return work
+}
+
+func TestUploadPackOptions_gitConfig(t *testing.T) {
+	assert.Empty(t, UploadPackOptions{MaxDepth: 1}.gitConfig())
+	assert.Equal(t, []string{
+		"-c", "uploadpack.allowFilter=true",
+		"-c", "uploadpack.allowAnySHA1InWant=true",
+	}, UploadPackOptions{AllowFilter: true, AllowAnySHA1InWant: true}.gitConfig())
+}
+
+func TestSSH_UploadPack_AllowFilter(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, Routes: []Route{
+		{Pattern: "partial/**", UploadPack: &UploadPackOptions{AllowFilter: true}},
+	}}, nil)
+
+	testHistory(t, s, "full")
+	testHistory(t, s, "partial/repo")
+
+	out, err := testGit(t, s, t.TempDir(), "clone", "-b", "main", "--filter=blob:none", testRemote(s, "full.git"), ".")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "filtering not recognized by server")
+
+	out, err = testGit(t, s, t.TempDir(), "clone", "-b", "main", "--filter=blob:none", testRemote(s, "partial/repo.git"), ".")
+	assert.NoError(t, err, out)
+	assert.NotContains(t, out, "filtering not recognized by server")
+}
+
+func TestSSH_UploadPack_AllowAnySHA1InWant(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, UploadPack: UploadPackOptions{AllowAnySHA1InWant: true}}, nil)
+	work := testHistory(t, s, "test")
+
+	// Drop the ref, leaving the commit reachable from nowhere
+	testGit(t, s, work, "branch", "old", "main~1")
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "old"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	old, _ := testGit(t, s, work, "rev-parse", "old")
+	if out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), ":old"); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	clone := t.TempDir()
+	testGit(t, s, clone, "init", "-q")
+
+	out, err := testGit(t, s, clone, "-c", "protocol.version=0", "fetch", testRemote(s, "test.git"), strings.TrimSpace(old))
+	assert.NoError(t, err, out)
+}
+
+func TestSSH_UploadPack_MaxDepth(t *testing.T) {
+	s := startTestSSH(t, Config{AutoCreate: true, UploadPack: UploadPackOptions{MaxDepth: 2}}, nil)
+	testHistory(t, s, "test")
+
+	for _, protocol := range []string{"protocol.version=0", "protocol.version=2"} {
+		t.Run(protocol, func(t *testing.T) {
+			out, err := testGit(t, s, t.TempDir(), "-c", protocol, "clone", "-q", "-b", "main", "--depth", "2", testRemote(s, "test.git"), ".")
+			assert.NoError(t, err, out)
+
+			for _, flag := range []string{"--depth=3", "--shallow-since=2000-01-01"} {
+				out, err = testGit(t, s, t.TempDir(), "-c", protocol, "clone", "-q", "-b", "main", flag, testRemote(s, "test.git"), ".")
+				assert.Error(t, err, flag)
+				assert.Contains(t, out, "Shallow fetches of test may be at most 2 commits deep.", flag)
+			}
+		})
+	}
+}
+
+func Test_fetchGuard(t *testing.T) {
+	req := new(bytes.Buffer)
+	packLine(req, "want e285100b636ac67fa28d85685072158edaa01685\n")
+	packLine(req, "deepen 5\n")
+	packFlush(req)
+
+	out, err := io.ReadAll(&fetchGuard{r: bytes.NewReader(req.Bytes()), maxDepth: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, req.Bytes(), out)
+
+	var refused error
+	g := &fetchGuard{r: bytes.NewReader(req.Bytes()), maxDepth: 4, refuse: func(err error) { refused = err }}
+
+	out, err = io.ReadAll(g)
+	assert.True(t, errors.Is(err, ErrDepthExceeded))
+	assert.True(t, errors.Is(refused, ErrDepthExceeded))
+	assert.Equal(t, "0032want e285100b636ac67fa28d85685072158edaa01685\n", string(out))
+}
+
+func TestSSH_UploadPack_MaxBlobSize(t *testing.T) {
+	trusted := false
+
+	s := startTestSSH(t, Config{AutoCreate: true, UploadPack: UploadPackOptions{MaxBlobSize: 1024}}, func(s *SSH) {
+		s.BlobLimitFunc = func(_ context.Context, pk PublicKey) int64 {
+			if trusted {
+				return 0
+			}
+
+			return 1024
+		}
+	})
+	work := testHistory(t, s, "test")
+
+	for _, protocol := range []string{"protocol.version=0", "protocol.version=2"} {
+		t.Run(protocol, func(t *testing.T) {
+			// Checking out blob:none would fetch the missing blobs by id,
+			// which protocol v0 only serves with AllowAnySHA1InWant
+			for _, filter := range []string{"--filter=blob:limit=1k", "--filter=blob:none"} {
+				out, err := testGit(t, s, t.TempDir(), "-c", protocol, "clone", "-q", "--no-checkout", "-b", "main", filter, testRemote(s, "test.git"), ".")
+				assert.NoError(t, err, filter, out)
+			}
+
+			for _, args := range [][]string{{}, {"--filter=blob:limit=2k"}} {
+				out, err := testGit(t, s, t.TempDir(), append([]string{"-c", protocol, "clone", "-q", "-b", "main"}, append(args, testRemote(s, "test.git"), ".")...)...)
+				assert.Error(t, err, args)
+				assert.Contains(t, out, "Fetches of test must leave out blobs over 1 KiB, such as with --filter=blob:limit=1024.", args)
+			}
+		})
+	}
+
+	// Partial clones fetch the blobs they left out by id, which are
+	// served only within the limit
+	if err := os.WriteFile(filepath.Join(work, "large"), bytes.Repeat([]byte("large\n"), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"add", "large"}, {"commit", "-q", "-m", "large"}, {"push", testRemote(s, "test.git"), "main"}} {
+		if out, err := testGit(t, s, work, args...); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+	}
+
+	clone := t.TempDir()
+	out, err := testGit(t, s, clone, "clone", "-q", "--no-checkout", "-b", "main", "--filter=blob:limit=1k", testRemote(s, "test.git"), ".")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, s, clone, "checkout", "main")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "test serves blobs of at most 1 KiB.")
+
+	trusted = true
+
+	out, err = testGit(t, s, t.TempDir(), "clone", "-q", "-b", "main", testRemote(s, "test.git"), ".")
+	assert.NoError(t, err, out)
+}
+
+func Test_filterWithin(t *testing.T) {
+	for spec, expect := range map[string]bool{
+		"blob:none":                            true,
+		"tree:0":                               true,
+		"tree:1":                               false,
+		"blob:limit=1024":                      true,
+		"blob:limit=1k":                        true,
+		"blob:limit=1025":                      false,
+		"blob:limit=1m":                        false,
+		"blob:limit=lots":                      false,
+		"sparse:oid=main:.sparse":              false,
+		"combine:tree%3A2+blob%3Alimit%3D512":  true,
+		"combine:tree%3A2+blob%3Alimit%3D2048": false,
+	} {
+		assert.Equal(t, expect, filterWithin(spec, 1024), spec)
+	}
+}
+
+func Test_fetchGuard_MaxBlob(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		filter string
+		err    bool
+	}{
+		{"filtered", "filter blob:limit=100\n", false},
+		{"unfiltered", "", true},
+		{"too large", "filter blob:limit=1g\n", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(bytes.Buffer)
+			packLine(req, "want e285100b636ac67fa28d85685072158edaa01685\n")
+			if test.filter != "" {
+				packLine(req, test.filter)
+			}
+			packFlush(req)
+
+			// Rounds of haves carry no wants, and so need no filter
+			packLine(req, "have e285100b636ac67fa28d85685072158edaa01685\n")
+			packFlush(req)
+
+			var refused error
+			out, err := io.ReadAll(&fetchGuard{r: bytes.NewReader(req.Bytes()), maxBlob: 100, refuse: func(err error) { refused = err }})
+
+			if test.err {
+				assert.ErrorIs(t, err, ErrFilterRequired)
+				assert.ErrorIs(t, refused, ErrFilterRequired)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, req.Bytes(), out)
+			}
+		})
+	}
+}
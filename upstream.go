@@ -0,0 +1,447 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUpstreamUnavailable is returned when the upstream a command is for
+// cannot be reached, or does not accept the gateway's credentials
+var ErrUpstreamUnavailable = errors.New("upstream unavailable")
+
+// ErrProtocolV2Required is returned for fetches from http upstreams by
+// clients speaking protocol version 0 or 1, whose conversations cannot be
+// carried by stateless http requests
+var ErrProtocolV2Required = errors.New("git protocol version 2 required")
+
+// Upstream is a git server commands are passed on to, with the gateway's
+// own credentials, in place of running git locally
+type Upstream struct {
+	// URL of the repository upstream, such as
+	// ssh://git@github.com/org/project.git or
+	// https://git.example.com/org/project.git
+	URL string
+
+	// Signer and HostKeyCallback authenticate ssh upstreams, and the
+	// gateway to them
+	Signer          ssh.Signer
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Username and Password are sent to http upstreams with basic auth,
+	// when set
+	Username string
+	Password string
+
+	// Client sends requests to http upstreams. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// DialTimeout bounds connecting to ssh upstreams. Defaults to 10s.
+	DialTimeout time.Duration
+}
+
+// proxyUpstream hands gitcmd to the upstream UpstreamFunc gives for it,
+// reporting whether there was one
+func (s SSH) proxyUpstream(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand) (bool, error) {
+	if s.UpstreamFunc == nil {
+		return false, nil
+	}
+
+	up, err := s.UpstreamFunc(ctx, gitcmd)
+	if err != nil {
+		ch.Stderr().Write([]byte(clientLine(err, s.config.Message(s.sessionLocale(ctx, sess), MsgUpstreamUnavailable, gitcmd))))
+
+		return true, fmt.Errorf("upstream: %w: %w", ErrUpstreamUnavailable, err)
+	}
+
+	if up == nil {
+		return false, nil
+	}
+
+	ctx, span := s.startSpan(ctx, "gitkit.upstream", commandAttributes(gitcmd)...)
+
+	err = s.proxyTo(ctx, sess, ch, req, gitcmd, up)
+	endSpan(span, err)
+
+	switch {
+	case errors.Is(err, ErrUpstreamUnavailable):
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgUpstreamUnavailable, gitcmd)))
+
+	case errors.Is(err, ErrProtocolV2Required):
+		ch.Stderr().Write([]byte(s.config.Message(s.sessionLocale(ctx, sess), MsgProtocolV2Required, gitcmd)))
+
+	case errors.Is(err, ErrOperationDisabled):
+		ch.Write([]byte(s.message(ctx, sess, MsgOperationDisabled)))
+	}
+
+	return true, err
+}
+
+func (s SSH) proxyTo(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, up *Upstream) error {
+	u, err := url.Parse(up.URL)
+	if err != nil {
+		return fmt.Errorf("upstream: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ssh":
+		return up.proxySSH(ctx, sess, ch, req, gitcmd, u)
+
+	case "http", "https":
+		return up.proxyHTTP(ctx, sess, ch, req, gitcmd, u)
+	}
+
+	return fmt.Errorf("upstream: unsupported scheme %q", u.Scheme)
+}
+
+// proxySSH runs gitcmd against the repository at u
+func (up *Upstream) proxySSH(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, u *url.URL) error {
+	user := "git"
+	if u.User != nil {
+		user = u.User.Username()
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	auth := []ssh.AuthMethod{}
+	if up.Signer != nil {
+		auth = append(auth, ssh.PublicKeys(up.Signer))
+	}
+
+	client, err := dialSSH(ctx, addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: up.HostKeyCallback,
+	}, up.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("upstream: %w: %s: %w", ErrUpstreamUnavailable, u.Host, err)
+	}
+	defer client.Close()
+
+	command := "git-" + gitcmd.SubCommand() + " '" + strings.ReplaceAll(u.Path, "'", `'\''`) + "'"
+
+	err = runRemote(ctx, client, sess, ch, req, command, nil)
+
+	var unavailable remoteUnavailable
+	if errors.As(err, &unavailable) {
+		return fmt.Errorf("upstream: %w: %s: %w", ErrUpstreamUnavailable, u.Host, unavailable.err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("upstream: %s: %w", u.Host, err)
+	}
+
+	return nil
+}
+
+// proxyHTTP carries gitcmd's conversation over the smart http protocol to
+// the repository at u. Pushes take two requests, as over http: the refs,
+// then everything the client sends. Fetches take one request for the
+// capabilities then one for each command the client sends, which only
+// protocol version 2 makes stateless.
+func (up *Upstream) proxyHTTP(ctx context.Context, sess *session, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, u *url.URL) error {
+	service := "git-" + gitcmd.SubCommand()
+
+	protocol := ""
+	if sess != nil {
+		protocol = sess.env["GIT_PROTOCOL"]
+	}
+
+	switch gitcmd.SubCommand() {
+	case OperationUploadPack:
+		if !strings.Contains(protocol, "version=2") {
+			return fmt.Errorf("upstream: %w", ErrProtocolV2Required)
+		}
+
+	case OperationReceivePack:
+
+	default:
+		return fmt.Errorf("upstream: %w: %s over http", ErrOperationDisabled, gitcmd.SubCommand())
+	}
+
+	refs, err := up.request(ctx, http.MethodGet, u.JoinPath("info", "refs").String()+"?service="+service, service, protocol, nil)
+	if err != nil {
+		return err
+	}
+	defer refs.Body.Close()
+
+	req.Reply(true, nil)
+
+	if err = copyAdvertisement(ch, bufio.NewReader(refs.Body)); err != nil {
+		return fmt.Errorf("upstream: %s: %w", u.Host, err)
+	}
+
+	in := bufio.NewReader(ch)
+
+	for {
+		var body io.Reader
+
+		if service == "git-receive-pack" {
+			push, raw, err := readPushRequest(in)
+			if err != nil {
+				return fmt.Errorf("upstream: unable to read push request: %w", err)
+			}
+
+			// Nothing to push
+			if len(push.Updates) == 0 {
+				return sendExitStatus(ch, 0)
+			}
+
+			// Deletions send no pack, and clients wait on the status
+			// report without closing their side
+			body = bytes.NewReader(raw)
+			for _, update := range push.Updates {
+				if update.NewRev != ZeroSHA {
+					body = io.MultiReader(body, in)
+
+					break
+				}
+			}
+		} else {
+			request, err := readV2Request(in)
+			if errors.Is(err, io.EOF) && len(request) == 0 {
+				return sendExitStatus(ch, 0)
+			}
+
+			if err != nil {
+				return fmt.Errorf("upstream: unable to read request: %w", err)
+			}
+
+			// A lone flush ends the conversation
+			if len(request) == 4 {
+				return sendExitStatus(ch, 0)
+			}
+
+			body = bytes.NewReader(request)
+		}
+
+		resp, err := up.request(ctx, http.MethodPost, u.JoinPath(service).String(), service, protocol, body)
+		if err != nil {
+			return err
+		}
+
+		_, err = copyBuffer(ch, resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			return fmt.Errorf("upstream: %s: %w", u.Host, err)
+		}
+
+		if service == "git-receive-pack" {
+			return sendExitStatus(ch, 0)
+		}
+	}
+}
+
+// request sends a smart http request for service to the upstream,
+// returning the response when it succeeded
+func (up *Upstream) request(ctx context.Context, method, target, service, protocol string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+
+	if up.Username != "" || up.Password != "" {
+		req.SetBasicAuth(up.Username, up.Password)
+	}
+
+	if protocol != "" {
+		req.Header.Set("Git-Protocol", protocol)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-"+service+"-request")
+		req.Header.Set("Accept", "application/x-"+service+"-result")
+	}
+
+	client := up.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w: %w", ErrUpstreamUnavailable, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		return nil, fmt.Errorf("upstream: %w: %s %s: %s", ErrUpstreamUnavailable, method, req.URL.Redacted(), resp.Status)
+	}
+
+	return resp, nil
+}
+
+// copyAdvertisement copies a smart http ref or capability advertisement
+// to w as it would be sent over ssh, without the "# service=" header
+// versions before 2 begin with
+func copyAdvertisement(w io.Writer, r *bufio.Reader) error {
+	head, err := r.Peek(4 + len("# service="))
+	if err == nil && string(head[4:]) == "# service=" {
+		for {
+			_, flush, err := readPktLine(r)
+			if err != nil {
+				return fmt.Errorf("invalid advertisement: %w", err)
+			}
+
+			if flush {
+				break
+			}
+		}
+	}
+
+	_, err = copyBuffer(w, r)
+
+	return err
+}
+
+// readV2Request reads one protocol version 2 command from r, up to and
+// including the flush packet which ends it
+func readV2Request(r io.Reader) ([]byte, error) {
+	var request []byte
+
+	for {
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return request, err
+		}
+
+		n, err := strconv.ParseUint(string(head), 16, 16)
+		if err != nil || n == 3 || n > maxPktLen {
+			return request, fmt.Errorf("invalid pkt-line length %q", head)
+		}
+
+		request = append(request, head...)
+
+		switch {
+		case n == 0:
+			return request, nil
+
+		case n > 4:
+			line := make([]byte, n-4)
+			if _, err := io.ReadFull(r, line); err != nil {
+				return request, err
+			}
+
+			request = append(request, line...)
+		}
+	}
+}
+
+// remoteUnavailable wraps errors which stopped runRemote starting the
+// command at all
+type remoteUnavailable struct{ err error }
+
+func (e remoteUnavailable) Error() string { return e.err.Error() }
+
+func (e remoteUnavailable) Unwrap() error { return e.err }
+
+// runRemote runs command in a session on client, after prepare, passing
+// the channel's input, output and exit status between them, and the
+// session's environment on
+func runRemote(ctx context.Context, client *ssh.Client, sess *session, ch ssh.Channel, req *ssh.Request, command string, prepare func(*ssh.Session) error) error {
+	// Closing the connection ends the session should the client go away
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	remote, err := client.NewSession()
+	if err != nil {
+		return remoteUnavailable{err}
+	}
+	defer remote.Close()
+
+	if prepare != nil {
+		if err = prepare(remote); err != nil {
+			return remoteUnavailable{err}
+		}
+	}
+
+	// Variables the remote does not allow are refused there, as they
+	// would have been here
+	if sess != nil {
+		for k, v := range sess.env {
+			remote.Setenv(k, v)
+		}
+	}
+
+	stdin, err := remote.StdinPipe()
+	if err != nil {
+		return remoteUnavailable{err}
+	}
+
+	remote.Stdout = ch
+	remote.Stderr = ch.Stderr()
+
+	if err = remote.Start(command); err != nil {
+		return remoteUnavailable{err}
+	}
+
+	req.Reply(true, nil)
+
+	// As in runGit, this copy is not waited for, since clients may keep
+	// their side open after the command exits
+	go func() {
+		copyBuffer(stdin, ch)
+		stdin.Close()
+	}()
+
+	var exitErr *ssh.ExitError
+	switch err = remote.Wait(); {
+	case err == nil:
+		return sendExitStatus(ch, 0)
+
+	case errors.As(err, &exitErr):
+		sendExitStatus(ch, uint32(exitErr.ExitStatus()))
+
+		return fmt.Errorf("command failed: %w", err)
+	}
+
+	return remoteUnavailable{err}
+}
+
+// dialSSH connects to addr as config says, bounding the connection and
+// handshake by timeout, or 10s when it is not set
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
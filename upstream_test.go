@@ -0,0 +1,166 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_copyAdvertisement(t *testing.T) {
+	var out bytes.Buffer
+
+	require.NoError(t, copyAdvertisement(&out, bufio.NewReader(strings.NewReader("001f# service=git-receive-pack\n0000000bfirst\n0000"))))
+	assert.Equal(t, "000bfirst\n0000", out.String())
+
+	// Version 2 capabilities have no header
+	out.Reset()
+
+	require.NoError(t, copyAdvertisement(&out, bufio.NewReader(strings.NewReader("000eversion 2\n0000"))))
+	assert.Equal(t, "000eversion 2\n0000", out.String())
+}
+
+func Test_readV2Request(t *testing.T) {
+	r := strings.NewReader("0014command=ls-refs\n00010009peel\n0000" + "0000")
+
+	request, err := readV2Request(r)
+	require.NoError(t, err)
+	assert.Equal(t, "0014command=ls-refs\n00010009peel\n0000", string(request))
+
+	request, err = readV2Request(r)
+	require.NoError(t, err)
+	assert.Equal(t, "0000", string(request))
+
+	_, err = readV2Request(strings.NewReader("zzzz"))
+	assert.Error(t, err)
+}
+
+func TestSSH_UpstreamFunc_SSH(t *testing.T) {
+	upstream := startTestSSH(t, Config{AutoCreate: true}, nil)
+
+	gateway := startTestSSH(t, Config{}, func(s *SSH) {
+		s.UpstreamFunc = func(_ context.Context, cmd *GitCommand) (*Upstream, error) {
+			if cmd.Repo == "local" {
+				return nil, nil
+			}
+
+			return &Upstream{
+				URL:             "ssh://git@" + upstream.Address() + "/mirrored/" + cmd.Repo + ".git",
+				Signer:          testClientSigner(t),
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}, nil
+		}
+	})
+
+	work := testWorkTree(t, gateway)
+	remote := testRemote(gateway, "test.git")
+
+	out, err := testGit(t, gateway, work, "push", remote, "main")
+	require.NoError(t, err, out)
+	assert.DirExists(t, filepath.Join(upstream.config.Dir, "mirrored", "test"))
+
+	out, err = testGit(t, gateway, t.TempDir(), "clone", remote, "clone")
+	assert.NoError(t, err, out)
+
+	// Commands without an upstream are served locally, where there is no
+	// such repository
+	out, err = testGit(t, gateway, t.TempDir(), "clone", testRemote(gateway, "local.git"), "clone")
+	assert.Error(t, err, out)
+	assert.NoDirExists(t, filepath.Join(gateway.config.Dir, "mirrored"))
+}
+
+func TestSSH_UpstreamFunc_HTTP(t *testing.T) {
+	backend, err := exec.Command("git", "--exec-path").Output()
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "test.git")
+
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", "-b", "main", repo},
+		{"--git-dir", repo, "config", "http.receivepack", "true"},
+	} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	cgiHandler := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(backend)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "gateway" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		// CGI needs a length, where git sends chunked pushes
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		r.Header.Del("Transfer-Encoding")
+		r.TransferEncoding = nil
+
+		cgiHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var password atomic.Value
+	password.Store("secret")
+
+	gateway := startTestSSH(t, Config{}, func(s *SSH) {
+		s.UpstreamFunc = func(context.Context, *GitCommand) (*Upstream, error) {
+			return &Upstream{URL: srv.URL + "/test.git", Username: "gateway", Password: password.Load().(string)}, nil
+		}
+	})
+
+	work := testWorkTree(t, gateway)
+	remote := testRemote(gateway, "test.git")
+
+	out, err := testGit(t, gateway, work, "push", remote, "main", "main:other")
+	require.NoError(t, err, out)
+
+	head, err := exec.Command("git", "--git-dir", repo, "rev-parse", "main").Output()
+	require.NoError(t, err)
+
+	local, err := exec.Command("git", "-C", work, "rev-parse", "main").Output()
+	require.NoError(t, err)
+	assert.Equal(t, string(local), string(head))
+
+	// Deletions send no pack
+	out, err = testGit(t, gateway, work, "push", remote, ":other")
+	require.NoError(t, err, out)
+	assert.Error(t, exec.Command("git", "--git-dir", repo, "rev-parse", "--verify", "-q", "other").Run())
+
+	out, err = testGit(t, gateway, t.TempDir(), "-c", "protocol.version=2", "clone", remote, "clone")
+	assert.NoError(t, err, out)
+
+	out, err = testGit(t, gateway, t.TempDir(), "-c", "protocol.version=0", "clone", remote, "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "can only be fetched with git protocol version 2")
+
+	password.Store("wrong")
+
+	out, err = testGit(t, gateway, t.TempDir(), "-c", "protocol.version=2", "clone", remote, "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "test is unavailable at the moment")
+}
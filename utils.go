@@ -1,18 +1,26 @@
 package gitkit
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 )
 
 var reSlashDedup = regexp.MustCompile(`\/{2,}`)
 
+// ErrPathTraversal is returned when a repository name would resolve to a
+// path outside of the directory it should be served from
+var ErrPathTraversal = errors.New("repository path escapes its root directory")
+
 func fail500(w http.ResponseWriter, context string, err error) {
 	http.Error(w, "Internal server error", 500)
 	logError(context, err)
@@ -49,6 +57,35 @@ func packFlush(w io.Writer) error {
 	return err
 }
 
+// maxPktLen is the largest pkt-line git will send, including its length
+const maxPktLen = 65520
+
+// readPktLine reads a single pkt-line from r, returning its payload. Flush
+// packets are reported with a nil payload and flush set.
+func readPktLine(r io.Reader) (payload []byte, flush bool, err error) {
+	var head [4]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+
+	n, err := strconv.ParseUint(string(head[:]), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid pkt-line length %q", head)
+	}
+
+	switch {
+	case n == 0:
+		return nil, true, nil
+	case n < 4 || n > maxPktLen:
+		return nil, false, fmt.Errorf("invalid pkt-line length %d", n)
+	}
+
+	payload = make([]byte, n-4)
+	_, err = io.ReadFull(r, payload)
+
+	return
+}
+
 func subCommand(rpc string) string {
 	return strings.TrimPrefix(rpc, "git-")
 }
@@ -80,3 +117,73 @@ func getNamespaceAndRepo(input string) (string, string) {
 
 	return strings.Join(blocks[0:num-1], "/"), blocks[num-1]
 }
+
+// titleCase upper-cases the first letter of each space separated word
+func titleCase(s string) string {
+	words := strings.Split(s, " ")
+	for i, w := range words {
+		if w != "" {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// defaultValue returns def when value is empty, for use in templates
+// as {{ .Name | default "anonymous" }}
+func defaultValue(def string, value string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
+
+// withinDir reports whether p is root, or a path beneath it
+func withinDir(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, "../") && !filepath.IsAbs(rel)
+}
+
+// formatBytes renders a size such as 1536 as "1.5 KiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	value := strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64)
+
+	return strings.TrimSuffix(value, ".0") + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+// copyBuffers holds the buffers used to stream git's input and output, so
+// that busy servers do not allocate fresh ones for every stream
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32<<10)
+		return &buf
+	},
+}
+
+// copyBuffer copies src to dst through a pooled buffer. Both are wrapped so
+// that io.CopyBuffer cannot bypass the buffer with WriterTo or ReaderFrom,
+// which would allocate their own.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
@@ -2,6 +2,10 @@ package gitkit
 
 import (
 	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -75,3 +79,107 @@ func Test_getNamespaceAndRepo(t *testing.T) {
 		assert.Equal(t, expected[1], repo)
 	}
 }
+
+func Test_titleCase(t *testing.T) {
+	cases := map[string]string{
+		"":            "",
+		"hello":       "Hello",
+		"hello world": "Hello World",
+		"a  b":        "A  B",
+	}
+
+	for example, expected := range cases {
+		assert.Equal(t, expected, titleCase(example))
+	}
+}
+
+func Test_listRepos(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"a/objects", "org/b/objects", "org/b/nested/objects", "empty"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, p), 0755))
+	}
+
+	repos, err := listRepos(dir)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "org/b"}, repos)
+}
+
+func Test_withinDir(t *testing.T) {
+	cases := map[string]bool{
+		"/srv/git":               true,
+		"/srv/git/repo":          true,
+		"/srv/git/org/repo":      true,
+		"/srv/git/../etc/passwd": false,
+		"/srv/gitother":          false,
+		"/etc":                   false,
+	}
+
+	for example, expected := range cases {
+		assert.Equal(t, expected, withinDir("/srv/git", filepath.Clean(example)), example)
+	}
+}
+
+func Test_initRepo_nested(t *testing.T) {
+	c := Config{Dir: t.TempDir(), GitPath: "git"}
+	p := filepath.Join(c.Dir, "team", "sub", "project")
+
+	assert.NoError(t, initRepo(p, &c))
+	assert.True(t, repoExists(p))
+}
+
+func Test_initRepo_defaultBranch(t *testing.T) {
+	head := func(p string) string {
+		out, err := exec.Command("git", "--git-dir", p, "symbolic-ref", "HEAD").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	c := Config{Dir: t.TempDir(), GitPath: "git", DefaultBranch: "trunk"}
+
+	p := filepath.Join(c.Dir, "project")
+	assert.NoError(t, initRepo(p, &c))
+	assert.Equal(t, "refs/heads/trunk", head(p))
+
+	c.RepoTemplate = &RepoTemplate{DefaultBranch: "main"}
+
+	p = filepath.Join(c.Dir, "templated")
+	assert.NoError(t, initRepo(p, &c))
+	assert.Equal(t, "refs/heads/main", head(p))
+
+	c.RepoTemplate, c.DefaultBranch = nil, "bad name"
+	assert.Error(t, initRepo(filepath.Join(c.Dir, "invalid"), &c))
+}
+
+func Test_formatBytes(t *testing.T) {
+	for n, expect := range map[int64]string{
+		0:         "0 B",
+		1023:      "1023 B",
+		1024:      "1 KiB",
+		1536:      "1.5 KiB",
+		8 << 20:   "8 MiB",
+		5 << 30:   "5 GiB",
+		1<<40 + 1: "1 TiB",
+	} {
+		if rcvd := formatBytes(n); rcvd != expect {
+			t.Errorf("%d: expected %q, received %q", n, expect, rcvd)
+		}
+	}
+}
+
+func Test_copyBuffer(t *testing.T) {
+	data := bytes.Repeat([]byte("gitkit"), 100<<10)
+	out := new(bytes.Buffer)
+
+	n, err := copyBuffer(out, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("expected %d bytes to be copied, received %d", len(data), n)
+	}
+}
@@ -0,0 +1,183 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commit describes a commit being pushed, as passed to
+// Receiver.ValidateCommitFunc
+type Commit struct {
+	Hash      string
+	Parents   []string
+	Author    Signature
+	Committer Signature
+	Message   string
+
+	// Files added or changed since the first parent, or every file of a
+	// root commit. Deleted files and submodules are left out.
+	Files []CommitFile
+}
+
+// Signature is the author or committer of a Commit
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// CommitFile is a file written by a Commit
+type CommitFile struct {
+	Path string
+	Hash string // The blob's id
+	Size int64
+}
+
+// validateCommits passes each commit which the updates in input, as given
+// to pre-receive, would add to the repository at dir to ValidateCommitFunc,
+// oldest first, stopping at the first it refuses
+func (r *Receiver) validateCommits(ctx context.Context, dir string, input []byte) error {
+	args := []string{"rev-list", "--reverse"}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(input)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("Invalid hook input")
+		}
+
+		if fields[1] != ZeroSHA {
+			args = append(args, fields[1])
+		}
+	}
+
+	// Deletions add no commits
+	if len(args) == 2 {
+		return nil
+	}
+
+	// In pre-receive no ref points to the pushed commits yet, so whatever
+	// refs do not reach is new
+	out, err := repoGit(dir, append(args, "--not", "--all")...)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range strings.Fields(out) {
+		commit, err := readCommit(dir, hash)
+		if err != nil {
+			return err
+		}
+
+		if err := r.ValidateCommitFunc(ctx, dir, commit); err != nil {
+			return fmt.Errorf("commit %s: %w", hash, err)
+		}
+	}
+
+	return nil
+}
+
+// readCommit reads the commit hash from the repository at dir
+func readCommit(dir, hash string) (*Commit, error) {
+	out, err := repoGit(dir, "show", "-s", "--format=%P%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%B", hash)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.SplitN(out, "\x00", 8)
+	if len(fields) != 8 {
+		return nil, fmt.Errorf("unable to read commit %s", hash)
+	}
+
+	commit := &Commit{
+		Hash:      hash,
+		Parents:   strings.Fields(fields[0]),
+		Author:    signature(fields[1], fields[2], fields[3]),
+		Committer: signature(fields[4], fields[5], fields[6]),
+		Message:   strings.TrimRight(fields[7], "\n"),
+	}
+
+	commit.Files, err = commitFiles(dir, commit)
+
+	return commit, err
+}
+
+func signature(name, email, when string) Signature {
+	unix, _ := strconv.ParseInt(when, 10, 64)
+
+	return Signature{Name: name, Email: email, When: time.Unix(unix, 0)}
+}
+
+// commitFiles lists the files commit writes, with their sizes
+func commitFiles(dir string, commit *Commit) ([]CommitFile, error) {
+	args := []string{"diff-tree", "-r", "-z", "--no-commit-id"}
+	if len(commit.Parents) == 0 {
+		args = append(args, "--root", commit.Hash)
+	} else {
+		args = append(args, commit.Parents[0], commit.Hash)
+	}
+
+	out, err := repoGit(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each change is ":<old mode> <new mode> <old id> <new id> <status>"
+	// then the path, each ending in NUL
+	files := []CommitFile{}
+	entries := strings.Split(out, "\x00")
+	for i := 0; i+1 < len(entries); i += 2 {
+		fields := strings.Fields(entries[i])
+		if len(fields) != 5 || fields[4] == "D" || fields[1] == "160000" {
+			continue
+		}
+
+		files = append(files, CommitFile{Path: entries[i+1], Hash: fields[3]})
+	}
+
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	ids := []string{}
+	for _, f := range files {
+		ids = append(ids, f.Hash)
+	}
+
+	cmd := exec.Command("git", "cat-file", "--batch-check=%(objectsize)")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+
+	sizes, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file sizes: %w", err)
+	}
+
+	for i, size := range strings.Split(strings.TrimSpace(string(sizes)), "\n") {
+		if i < len(files) {
+			files[i].Size, _ = strconv.ParseInt(size, 10, 64)
+		}
+	}
+
+	return files, nil
+}
+
+// repoGit runs git in the repository at dir, returning what it prints
+func repoGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,114 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPushedCommits makes a repository whose main branch holds one commit,
+// with two more commits after it which no ref points to, as in pre-receive.
+// It returns the repository and the commits.
+func testPushedCommits(t *testing.T) (string, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=author", "GIT_AUTHOR_EMAIL=author@example.com",
+			"GIT_COMMITTER_NAME=committer", "GIT_COMMITTER_EMAIL=committer@example.com",
+		)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	base := git("rev-parse", "HEAD")
+
+	if err := os.WriteFile(filepath.Join(dir, "large.bin"), make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	git("add", "large.bin")
+	git("commit", "-q", "-m", "add large file\n\nwith a body")
+	added := git("rev-parse", "HEAD")
+
+	git("rm", "-q", "large.bin")
+	git("commit", "-q", "-m", "remove large file")
+	removed := git("rev-parse", "HEAD")
+
+	git("update-ref", "refs/heads/main", base)
+
+	return dir, []string{base, added, removed}
+}
+
+func TestReceiver_validateCommits(t *testing.T) {
+	dir, commits := testPushedCommits(t)
+	input := []byte(commits[0] + " " + commits[2] + " refs/heads/main\n" + commits[0] + " " + ZeroSHA + " refs/heads/old\n")
+
+	seen := []*Commit{}
+	r := Receiver{ValidateCommitFunc: func(_ context.Context, repo string, commit *Commit) error {
+		assert.Equal(t, dir, repo)
+		seen = append(seen, commit)
+
+		return nil
+	}}
+
+	if !assert.NoError(t, r.validateCommits(context.Background(), dir, input)) || !assert.Len(t, seen, 2) {
+		return
+	}
+
+	added := seen[0]
+	assert.Equal(t, commits[1], added.Hash)
+	assert.Equal(t, []string{commits[0]}, added.Parents)
+	assert.Equal(t, "author@example.com", added.Author.Email)
+	assert.Equal(t, "committer", added.Committer.Name)
+	assert.False(t, added.Committer.When.IsZero())
+	assert.Equal(t, "add large file\n\nwith a body", added.Message)
+
+	if assert.Len(t, added.Files, 1) {
+		assert.Equal(t, "large.bin", added.Files[0].Path)
+		assert.Equal(t, int64(2048), added.Files[0].Size)
+	}
+
+	assert.Equal(t, commits[2], seen[1].Hash)
+	assert.Empty(t, seen[1].Files)
+}
+
+func TestReceiver_validateCommits_Reject(t *testing.T) {
+	dir, commits := testPushedCommits(t)
+	errTooLarge := errors.New("file too large")
+
+	r := Receiver{ValidateCommitFunc: func(_ context.Context, _ string, commit *Commit) error {
+		for _, f := range commit.Files {
+			if f.Size > 1024 {
+				return errTooLarge
+			}
+		}
+
+		return nil
+	}}
+
+	err := r.validateCommits(context.Background(), dir, []byte(commits[0]+" "+commits[2]+" refs/heads/main\n"))
+	assert.ErrorIs(t, err, errTooLarge)
+	assert.ErrorContains(t, err, commits[1])
+
+	// Deletions add no commits to check
+	assert.NoError(t, r.validateCommits(context.Background(), dir, []byte(commits[0]+" "+ZeroSHA+" refs/heads/main\n")))
+
+	assert.Error(t, r.validateCommits(context.Background(), dir, []byte("invalid\n")))
+}
@@ -1,3 +1,146 @@
 package gitkit
 
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
 const Version = "0.4.0"
+
+const (
+	modulePath = "github.com/jspc/gitkit"
+	cryptoPath = "golang.org/x/crypto"
+)
+
+// pseudoVersion matches the commit at the end of a Go module pseudo-version,
+// such as v0.4.1-0.20240101120000-abcdef123456
+var pseudoVersion = regexp.MustCompile(`[.-]\d{14}-([0-9a-f]{12})(\+incompatible)?$`)
+
+// VersionInfo describes the gitkit build a program is running, as
+// BuildInfo reports it
+type VersionInfo struct {
+	Version       string // gitkit's Version
+	Module        string // Module version gitkit was built at, such as v0.4.0, or (devel) for a local checkout. Empty when unknown.
+	Commit        string // Commit gitkit was built from, when known
+	Modified      bool   // Whether the checkout built had uncommitted changes
+	GoVersion     string // Go toolchain the program was built with
+	CryptoVersion string // Version of golang.org/x/crypto, which gitkit's ssh comes from. Empty when unknown.
+}
+
+// BuildInfo reports the gitkit build the running program includes, from
+// the build information Go embeds in binaries, so that operators can say
+// exactly what they run
+func BuildInfo() VersionInfo {
+	info, _ := debug.ReadBuildInfo()
+
+	return buildInfo(info)
+}
+
+func buildInfo(info *debug.BuildInfo) VersionInfo {
+	v := VersionInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+	}
+
+	if info == nil {
+		return v
+	}
+
+	if info.GoVersion != "" {
+		v.GoVersion = info.GoVersion
+	}
+
+	if info.Main.Path == modulePath {
+		// Built from a gitkit checkout, such as gitkitd, which go build
+		// stamps with the commit
+		v.Module = info.Main.Version
+
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				v.Commit = setting.Value
+
+			case "vcs.modified":
+				v.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+
+		switch dep.Path {
+		case modulePath:
+			v.Module = dep.Version
+
+		case cryptoPath:
+			v.CryptoVersion = dep.Version
+		}
+	}
+
+	if m := pseudoVersion.FindStringSubmatch(v.Module); v.Commit == "" && m != nil {
+		v.Commit = m[1]
+	}
+
+	return v
+}
+
+// String returns v on one line, such as
+// "gitkit 0.4.0 (v0.4.0, abcdef123456) go1.22.1 golang.org/x/crypto v0.21.0"
+func (v VersionInfo) String() string {
+	var build []string
+	if v.Module != "" && v.Module != "(devel)" {
+		build = append(build, v.Module)
+	}
+
+	if v.Commit != "" {
+		commit := v.shortCommit()
+		if v.Modified {
+			commit += "-modified"
+		}
+
+		build = append(build, commit)
+	}
+
+	s := "gitkit " + v.Version
+	if len(build) > 0 {
+		s += fmt.Sprintf(" (%s)", strings.Join(build, ", "))
+	}
+
+	s += " " + v.GoVersion
+
+	if v.CryptoVersion != "" {
+		s += " " + cryptoPath + " " + v.CryptoVersion
+	}
+
+	return s
+}
+
+// serverVersion is the SSH identification string naming v, adding the
+// commit and Go version when withBuild is set
+func (v VersionInfo) serverVersion(withBuild bool) string {
+	s := fmt.Sprintf("SSH-2.0-gitkit %s", v.Version)
+	if !withBuild {
+		return s
+	}
+
+	// Everything after the first space is a comment, which may name anything
+	if v.Commit != "" {
+		s += " " + v.shortCommit()
+	}
+
+	return s + " " + v.GoVersion
+}
+
+func (v VersionInfo) shortCommit() string {
+	if len(v.Commit) > 12 {
+		return v.Commit[:12]
+	}
+
+	return v.Commit
+}
@@ -0,0 +1,106 @@
+package gitkit
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_buildInfo(t *testing.T) {
+	crypto := &debug.Module{Path: cryptoPath, Version: "v0.21.0"}
+
+	for _, test := range []struct {
+		name   string
+		info   *debug.BuildInfo
+		expect VersionInfo
+		str    string
+	}{
+		{"No build information", nil, VersionInfo{Version: Version, GoVersion: runtime.Version()}, "gitkit " + Version + " " + runtime.Version()},
+		{"Built from a gitkit checkout", &debug.BuildInfo{
+			GoVersion: "go1.22.1",
+			Main:      debug.Module{Path: modulePath, Version: "(devel)"},
+			Deps:      []*debug.Module{crypto},
+			Settings: []debug.BuildSetting{
+				{Key: "vcs.revision", Value: "0123456789abcdef0123456789abcdef01234567"},
+				{Key: "vcs.modified", Value: "true"},
+			},
+		}, VersionInfo{
+			Version:       Version,
+			Module:        "(devel)",
+			Commit:        "0123456789abcdef0123456789abcdef01234567",
+			Modified:      true,
+			GoVersion:     "go1.22.1",
+			CryptoVersion: "v0.21.0",
+		}, "gitkit " + Version + " (0123456789ab-modified) go1.22.1 golang.org/x/crypto v0.21.0"},
+		{"Imported at a release", &debug.BuildInfo{
+			GoVersion: "go1.22.1",
+			Main:      debug.Module{Path: "example.com/server"},
+			Deps:      []*debug.Module{{Path: modulePath, Version: "v0.4.0"}, crypto},
+			Settings:  []debug.BuildSetting{{Key: "vcs.revision", Value: "fedcba"}},
+		}, VersionInfo{
+			Version:       Version,
+			Module:        "v0.4.0",
+			GoVersion:     "go1.22.1",
+			CryptoVersion: "v0.21.0",
+		}, "gitkit " + Version + " (v0.4.0) go1.22.1 golang.org/x/crypto v0.21.0"},
+		{"Imported at a commit", &debug.BuildInfo{
+			GoVersion: "go1.22.1",
+			Main:      debug.Module{Path: "example.com/server"},
+			Deps:      []*debug.Module{{Path: modulePath, Version: "v0.4.1-0.20240101120000-abcdef123456"}},
+		}, VersionInfo{
+			Version:   Version,
+			Module:    "v0.4.1-0.20240101120000-abcdef123456",
+			Commit:    "abcdef123456",
+			GoVersion: "go1.22.1",
+		}, "gitkit " + Version + " (v0.4.1-0.20240101120000-abcdef123456, abcdef123456) go1.22.1"},
+		{"Replaced dependencies", &debug.BuildInfo{
+			GoVersion: "go1.22.1",
+			Main:      debug.Module{Path: "example.com/server"},
+			Deps:      []*debug.Module{{Path: cryptoPath, Version: "v0.20.0", Replace: &debug.Module{Path: cryptoPath, Version: "v0.21.0"}}},
+		}, VersionInfo{
+			Version:       Version,
+			GoVersion:     "go1.22.1",
+			CryptoVersion: "v0.21.0",
+		}, "gitkit " + Version + " go1.22.1 golang.org/x/crypto v0.21.0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			v := buildInfo(test.info)
+
+			assert.Equal(t, test.expect, v)
+			assert.Equal(t, test.str, v.String())
+		})
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	v := BuildInfo()
+
+	assert.Equal(t, Version, v.Version)
+	assert.Equal(t, runtime.Version(), v.GoVersion)
+	assert.NotEmpty(t, v.CryptoVersion)
+}
+
+func TestSSH_ServerVersionBuild(t *testing.T) {
+	v := VersionInfo{Version: Version, Commit: "0123456789abcdef", GoVersion: "go1.22.1"}
+
+	assert.Equal(t, "SSH-2.0-gitkit "+Version, v.serverVersion(false))
+	assert.Equal(t, "SSH-2.0-gitkit "+Version+" 0123456789ab go1.22.1", v.serverVersion(true))
+
+	s := startTestSSH(t, Config{ServerVersionBuild: true}, nil)
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	version := string(client.ServerVersion())
+	assert.True(t, strings.HasPrefix(version, "SSH-2.0-gitkit "+Version+" "), version)
+	assert.True(t, strings.HasSuffix(version, " "+runtime.Version()), version)
+}
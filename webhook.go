@@ -0,0 +1,330 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Webhook defaults, used when the equivalent WebhookDispatcher fields are
+// zero
+const (
+	DefaultWebhookAttempts = 5
+	DefaultWebhookBackoff  = time.Second
+	DefaultWebhookTimeout  = 10 * time.Second
+)
+
+// Webhook is an endpoint notified after successful pushes. When Secret is
+// set, each payload is signed with HMAC-SHA256 and the signature sent in
+// the X-Gitkit-Signature-256 header as sha256=<hex>.
+type Webhook struct {
+	URL    string
+	Secret string
+}
+
+// WebhookPusher identifies who made a push
+type WebhookPusher struct {
+	KeyID       string `json:"key_id"`
+	KeyName     string `json:"key_name"`
+	Fingerprint string `json:"fingerprint"`
+	User        string `json:"user"`
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks. Event is
+// EventPushCompleted, or EventQuotaWarning when a push takes a repository
+// past its quota warning threshold, in which case Quota is set.
+type WebhookPayload struct {
+	ID        string        `json:"id"`
+	Event     string        `json:"event"`
+	Time      time.Time     `json:"time"`
+	Repo      string        `json:"repo"`
+	Updates   []RefUpdate   `json:"updates"`
+	Pusher    WebhookPusher `json:"pusher"`
+	CloneURLs CloneURLs     `json:"clone_urls"`
+	Quota     *QuotaUsage   `json:"quota,omitempty"`
+}
+
+// WebhookDelivery records the outcome of delivering a payload to a webhook
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	Time       time.Time `json:"time"`
+}
+
+// WebhookDispatcher delivers payloads to webhooks in the background,
+// retrying failures with exponential backoff, and logs every delivery to
+// Store under webhooks/deliveries/
+type WebhookDispatcher struct {
+	Hooks       []Webhook
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+	Store       Store
+}
+
+func (d *WebhookDispatcher) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+
+	return &http.Client{Timeout: DefaultWebhookTimeout}
+}
+
+// Dispatch sends payload to every webhook, returning immediately
+func (d *WebhookDispatcher) Dispatch(payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range d.Hooks {
+		go d.deliver(hook, payload.Event, payload.ID, body)
+	}
+
+	return nil
+}
+
+func (d *WebhookDispatcher) deliver(hook Webhook, event, id string, body []byte) {
+	attempts := d.MaxAttempts
+	if attempts == 0 {
+		attempts = DefaultWebhookAttempts
+	}
+
+	backoff := d.Backoff
+	if backoff == 0 {
+		backoff = DefaultWebhookBackoff
+	}
+
+	delivery := WebhookDelivery{ID: id, URL: hook.URL}
+
+	for delivery.Attempts < attempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(backoff << (delivery.Attempts - 1))
+		}
+
+		delivery.Attempts++
+		delivery.Time = time.Now()
+
+		status, err := d.post(hook, event, id, body)
+		delivery.StatusCode = status
+		delivery.Error = ""
+
+		if err != nil {
+			delivery.Error = err.Error()
+			continue
+		}
+
+		// Client errors, other than rate limiting, will not be fixed by
+		// trying again
+		if status < 500 && status != http.StatusTooManyRequests {
+			delivery.Delivered = status < 300
+			break
+		}
+	}
+
+	if !delivery.Delivered {
+		logError("webhook", fmt.Errorf("delivery %s to %s failed after %d attempts: status %d %s", id, hook.URL, delivery.Attempts, delivery.StatusCode, delivery.Error))
+	}
+
+	d.record(delivery)
+}
+
+func (d *WebhookDispatcher) post(hook Webhook, event, id string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gitkit/"+Version)
+	req.Header.Set("X-Gitkit-Event", event)
+	req.Header.Set("X-Gitkit-Delivery", id)
+
+	if hook.Secret != "" {
+		req.Header.Set("X-Gitkit-Signature-256", SignWebhookPayload(hook.Secret, body))
+	}
+
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func (d *WebhookDispatcher) record(delivery WebhookDelivery) {
+	if d.Store == nil {
+		return
+	}
+
+	data, err := json.Marshal(delivery)
+	if err == nil {
+		err = d.Store.Put(fmt.Sprintf("webhooks/deliveries/%s/%x", delivery.ID, sha256.Sum256([]byte(delivery.URL))), data)
+	}
+
+	if err != nil {
+		logError("webhook", err)
+	}
+}
+
+// Deliveries returns the delivery log
+func (d *WebhookDispatcher) Deliveries() ([]WebhookDelivery, error) {
+	if d.Store == nil {
+		return nil, nil
+	}
+
+	keys, err := d.Store.List("webhooks/deliveries/")
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(keys))
+	for _, key := range keys {
+		data, err := d.Store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// SignWebhookPayload returns the signature header value for body, so that
+// receivers may verify payloads with hmac.Equal
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookPayload builds the payload describing a completed push
+func newWebhookPayload(ctx context.Context, repo string, updates []RefUpdate) (WebhookPayload, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return WebhookPayload{}, err
+	}
+
+	return WebhookPayload{
+		ID:      id.String(),
+		Event:   EventPushCompleted,
+		Time:    time.Now(),
+		Repo:    repo,
+		Updates: updates,
+		Pusher:  pusherFromContext(ctx),
+	}, nil
+}
+
+// pusherFromContext identifies the client of a session
+func pusherFromContext(ctx context.Context) WebhookPusher {
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+	user, _ := ctx.Value(UserContextKey{}).(string)
+
+	return WebhookPusher{
+		KeyID:       pk.Id,
+		KeyName:     pk.Name,
+		Fingerprint: pk.Fingerprint,
+		User:        user,
+	}
+}
+
+// WebhookDeliveries returns the delivery log of the server's webhooks
+func (s *SSH) WebhookDeliveries() ([]WebhookDelivery, error) {
+	webhooks := s.current().webhooks
+	if webhooks == nil {
+		return nil, nil
+	}
+
+	return webhooks.Deliveries()
+}
+
+// pushCompleted emits EventPushCompleted and notifies webhooks of the ref
+// updates in push which receive-pack applied; updates it refused, such as
+// rejected non-fast-forwards, are left out
+func (s SSH) pushCompleted(ctx context.Context, gitcmd *GitCommand, loc repoLocation, push *PushRequest) {
+	applied, err := appliedUpdates(s.config.GitPath, loc.Path, gitcmd.Namespace, push.Updates)
+	if err != nil {
+		logError("push", err)
+		return
+	}
+
+	if len(applied) == 0 {
+		return
+	}
+
+	refs := make([]string, len(applied))
+	for i, u := range applied {
+		refs[i] = u.Ref
+	}
+
+	s.emit(ctx, Event{Type: EventPushCompleted, Repo: gitcmd.Repo, Data: map[string]string{
+		"refs": strings.Join(refs, " "),
+	}})
+
+	if s.webhooks == nil {
+		return
+	}
+
+	payload, err := newWebhookPayload(ctx, gitcmd.Repo, applied)
+	if err == nil {
+		payload.CloneURLs = s.config.CloneURLs(gitcmd.Repo)
+		err = s.webhooks.Dispatch(payload)
+	}
+
+	if err != nil {
+		logError("webhook", err)
+	}
+}
+
+// appliedUpdates returns the updates which match the refs now in the
+// repository at path, within namespace when set. for-each-ref does not
+// follow GIT_NAMESPACE, so the namespace's refs are listed by their prefix.
+func appliedUpdates(gitPath, path, namespace string, updates []RefUpdate) ([]RefUpdate, error) {
+	prefix := namespaceRefPrefix(namespace)
+
+	out, err := exec.Command(gitPath, "-C", path, "for-each-ref", "--format=%(objectname) %(refname)", prefix+"refs/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list refs: %w", err)
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if rev, ref, ok := strings.Cut(line, " "); ok {
+			refs[strings.TrimPrefix(ref, prefix)] = rev
+		}
+	}
+
+	applied := []RefUpdate{}
+	for _, u := range updates {
+		rev, exists := refs[u.Ref]
+
+		if (u.NewRev == ZeroSHA && !exists) || (exists && rev == u.NewRev) {
+			applied = append(applied, u)
+		}
+	}
+
+	return applied, nil
+}
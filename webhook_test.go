@@ -0,0 +1,133 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcher_Dispatch(t *testing.T) {
+	var calls int32
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	d := &WebhookDispatcher{
+		Hooks:   []Webhook{{URL: srv.URL, Secret: "s3cret"}},
+		Backoff: time.Millisecond,
+		Store:   NewMemoryStore(),
+	}
+
+	payload := WebhookPayload{
+		ID:      "abc",
+		Repo:    "test",
+		Updates: []RefUpdate{{OldRev: ZeroSHA, NewRev: "1234", Ref: "refs/heads/main"}},
+	}
+
+	if err := d.Dispatch(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var r *http.Request
+	var body []byte
+
+	select {
+	case r = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	if sig := r.Header.Get("X-Gitkit-Signature-256"); sig != SignWebhookPayload("s3cret", body) {
+		t.Errorf("unexpected signature %q", sig)
+	}
+
+	var got WebhookPayload
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Repo != "test" || len(got.Updates) != 1 || got.Updates[0].Ref != "refs/heads/main" {
+		t.Errorf("unexpected payload %#v", got)
+	}
+
+	var deliveries []WebhookDelivery
+	for i := 0; i < 100 && len(deliveries) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		deliveries, _ = d.Deliveries()
+	}
+
+	if len(deliveries) != 1 || !deliveries[0].Delivered || deliveries[0].Attempts != 3 {
+		t.Errorf("unexpected delivery log %#v", deliveries)
+	}
+}
+
+func TestWebhookDispatcher_ClientError(t *testing.T) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	d := &WebhookDispatcher{Backoff: time.Millisecond, Store: NewMemoryStore()}
+	d.deliver(Webhook{URL: srv.URL}, EventPushCompleted, "abc", []byte("{}"))
+
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected a single attempt, received %d", calls)
+	}
+
+	deliveries, err := d.Deliveries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].Delivered || deliveries[0].StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected delivery log %#v", deliveries)
+	}
+}
+
+func TestSSH_Webhooks(t *testing.T) {
+	payloads := make(chan WebhookPayload, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	defer srv.Close()
+
+	s := startTestSSH(t, Config{AutoCreate: true, Webhooks: []Webhook{{URL: srv.URL}}}, nil)
+
+	work := testWorkTree(t, s)
+
+	out, err := testGit(t, s, work, "push", testRemote(s, "test.git"), "main")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	select {
+	case p := <-payloads:
+		if p.Repo != "test" || len(p.Updates) != 1 || p.Updates[0].Ref != "refs/heads/main" {
+			t.Errorf("unexpected payload %#v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
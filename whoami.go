@@ -0,0 +1,97 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WhoamiCommand is the exec command which, like an interactive shell,
+// reports who the client authenticated as when WhoamiFunc is set, unless
+// Commands has one of its own
+const WhoamiCommand = "whoami"
+
+// Whoami is the diagnostics report shown to clients opening a shell, or
+// running WhoamiCommand, as returned by WhoamiFunc and passed to the
+// MsgWhoami template
+type Whoami struct {
+	Name      string       // How the client is greeted; the key's Name when empty
+	PublicKey PublicKey    // The key the client authenticated with, filled in by gitkit
+	Access    []RepoAccess // Repositories the client may use; taken from route Readers and Writers when nil
+}
+
+// RepoAccess is a repository listed in a Whoami report
+type RepoAccess struct {
+	Repo  string
+	Write bool
+}
+
+// whoami builds the report WhoamiFunc returns for the client, rendered
+// for locale
+func (s SSH) whoami(ctx context.Context, locale string) (string, error) {
+	pk, _ := ctx.Value(PublicKeyContextKey{}).(PublicKey)
+
+	report, err := s.WhoamiFunc(ctx, pk)
+	if err != nil {
+		return "", fmt.Errorf("ssh: whoami: %w", err)
+	}
+
+	if report == nil {
+		report = new(Whoami)
+	}
+
+	report.PublicKey = pk
+	if report.Name == "" {
+		report.Name = pk.Name
+	}
+
+	if report.Access == nil {
+		if report.Access, err = s.repoAccess(ctx, pk); err != nil {
+			return "", fmt.Errorf("ssh: whoami: %w", err)
+		}
+	}
+
+	return s.config.Message(locale, MsgWhoami, report), nil
+}
+
+// repoAccess lists the repositories route Readers and Writers let pk use.
+// Hidden repositories are left out, as are private ones the key is not
+// named for.
+func (s SSH) repoAccess(ctx context.Context, pk PublicKey) ([]RepoAccess, error) {
+	repos, err := s.listAllRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	access := []RepoAccess{}
+	for _, repo := range repos {
+		loc, err := s.resolveRepo(ctx, repo)
+		if err != nil || loc.Visibility == VisibilityHidden || !loc.permits(pk.Name, false) {
+			continue
+		}
+
+		if loc.Visibility == VisibilityPrivate && len(loc.Readers) == 0 && len(loc.Writers) == 0 {
+			continue
+		}
+
+		access = append(access, RepoAccess{
+			Repo:  repo,
+			Write: !loc.ReadOnly && !s.config.ReadOnly && loc.permits(pk.Name, true),
+		})
+	}
+
+	return access, nil
+}
+
+// whoamiCommand serves WhoamiCommand
+func (s SSH) whoamiCommand(ctx context.Context, ch ssh.Channel, args []string) error {
+	report, err := s.whoami(ctx, s.sessionLocale(ctx, nil))
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.Write([]byte(report))
+
+	return err
+}
@@ -0,0 +1,113 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_WhoamiFunc(t *testing.T) {
+	alice := testClientSigner(t)
+	fingerprint := ssh.FingerprintSHA256(alice.PublicKey())
+
+	s := startTestKeySSH(t, map[string]PublicKey{
+		fingerprint: {Id: "1", Name: "alice"},
+	}, func(s *SSH) {
+		// Commands take precedence, so would otherwise answer whoami
+		s.Commands = nil
+
+		s.WhoamiFunc = func(_ context.Context, pk PublicKey) (*Whoami, error) {
+			return nil, nil
+		}
+	})
+
+	assert.NoError(t, s.Routes().Set([]Route{
+		{Pattern: "team/*", Writers: []string{"alice"}},
+		{Pattern: "docs/*", Readers: []string{"alice"}, Visibility: VisibilityPrivate},
+		{Pattern: "secret/*", Writers: []string{"bob"}},
+		{Pattern: "private/*", Visibility: VisibilityPrivate},
+		{Pattern: "hidden/*", Visibility: VisibilityHidden},
+	}))
+
+	for _, repo := range []string{"public", "team/app", "docs/guide", "secret/plans", "private/notes", "hidden/stash"} {
+		if err := initRepo(filepath.Join(s.config.Dir, repo), s.config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := testKeyDial(s, alice)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	expect := "Hi alice! You've authenticated with " + fingerprint + ", but shell access is not provided.\r\n" +
+		"R  docs/guide\r\n" +
+		"RW public\r\n" +
+		"RW team/app\r\n"
+
+	assert.Equal(t, expect, testShell(t, client))
+
+	sess, err := client.NewSession()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+
+	out, err := sess.Output(WhoamiCommand)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, string(out))
+}
+
+func TestSSH_WhoamiFunc_Report(t *testing.T) {
+	failed := errors.New("directory unavailable")
+	var fail atomic.Bool
+
+	s := startTestSSH(t, Config{}, func(s *SSH) {
+		s.Commands = map[string]CommandFunc{
+			"fail": func(ctx context.Context, ch ssh.Channel, args []string) error {
+				fail.Store(true)
+
+				return nil
+			},
+		}
+
+		s.WhoamiFunc = func(_ context.Context, pk PublicKey) (*Whoami, error) {
+			if fail.Load() {
+				return nil, failed
+			}
+
+			return &Whoami{Name: "Alice Smith", Access: []RepoAccess{{Repo: "mono", Write: true}}}, nil
+		}
+	})
+
+	client := testSSHClient(t, s)
+
+	assert.Contains(t, testShell(t, client), "Hi Alice Smith!")
+
+	sess, err := client.NewSession()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	out, err := sess.Output(WhoamiCommand)
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "RW mono\r\n")
+	sess.Close()
+
+	sess, _ = client.NewSession()
+	assert.NoError(t, sess.Run("fail"))
+	sess.Close()
+
+	assert.Equal(t, "Access denied.\r\n", testShell(t, client))
+	assert.True(t, errors.Is(s.Report().LastError, failed))
+
+	sess, _ = client.NewSession()
+	assert.Error(t, sess.Run(WhoamiCommand))
+	sess.Close()
+}